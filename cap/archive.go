@@ -0,0 +1,107 @@
+package cap
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"tractor.dev/wanix/fs"
+	"tractor.dev/wanix/fs/fskit"
+)
+
+// archivingKey marks the context of a walk archiving a resource. The
+// resource leaves its mount and archive out of that walk, so archiving a
+// tree the resource is part of doesn't recurse into itself.
+type archivingKey struct{ r *Resource }
+
+func archiving(ctx context.Context, r *Resource) bool {
+	return ctx != nil && ctx.Value(archivingKey{r}) != nil
+}
+
+// archiveFile is a read-only file that streams a tarball of the mount of
+// r. The archive is only generated once the file is first read.
+func archiveFile(r *Resource, fsys fs.FS) fs.FS {
+	return fskit.OpenFunc(func(ctx context.Context, name string) (fs.File, error) {
+		return &streamFile{
+			Node: fskit.Entry(name, 0444),
+			gen: func(w io.Writer) error {
+				ctx := context.WithValue(fs.ContextFor(fsys), archivingKey{r}, true)
+				return fs.ArchiveContext(ctx, w, fsys, ".", fs.ArchiveTar)
+			},
+		}, nil
+	})
+}
+
+type streamFile struct {
+	*fskit.Node
+	gen func(w io.Writer) error
+
+	mu     sync.Mutex
+	r      *io.PipeReader
+	offset int64
+}
+
+func (f *streamFile) Stat() (fs.FileInfo, error) {
+	return f.Node, nil
+}
+
+func (f *streamFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.read(p)
+}
+
+// read reads the stream, starting it if needed. It's called holding mu.
+func (f *streamFile) read(p []byte) (int, error) {
+	if f.r == nil {
+		r, w := io.Pipe()
+		go func() {
+			w.CloseWithError(f.gen(w))
+		}()
+		f.r = r
+	}
+	n, err := f.r.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+// ReadAt reads the stream at off. Streams are usually read sequentially,
+// as they are through 9P and FUSE, so reading ahead skips the stream
+// forward and reading behind generates it again from the start.
+func (f *streamFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if off < f.offset {
+		f.r.Close()
+		f.r = nil
+		f.offset = 0
+	}
+	if off > f.offset {
+		if _, err := io.CopyN(io.Discard, readFunc(f.read), off-f.offset); err != nil {
+			return 0, err
+		}
+	}
+	n, err := io.ReadFull(readFunc(f.read), p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *streamFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.r != nil {
+		return f.r.Close()
+	}
+	return nil
+}
+
+// readFunc adapts a read method to an io.Reader.
+type readFunc func(p []byte) (int, error)
+
+func (fn readFunc) Read(p []byte) (int, error) {
+	return fn(p)
+}
@@ -0,0 +1,67 @@
+package cap
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+
+	"tractor.dev/wanix/fs"
+	"tractor.dev/wanix/fs/fskit"
+)
+
+func TestArchiveFile(t *testing.T) {
+	r := &Resource{typ: "test", Extra: map[string]fs.FS{}}
+	// the resource is in the tree it mounts, so archiving it must not
+	// recurse into its own mount and archive
+	r.fs = fskit.MapFS{
+		"hello": fskit.RawNode([]byte("hello")),
+		"res":   r,
+	}
+
+	f, err := r.Open("archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(b))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	want := map[string]bool{"hello": true, "res/": true, "res/ctl": true, "res/type": true}
+	for _, name := range names {
+		if !want[name] {
+			t.Fatalf("unexpected entry %q in %v", name, names)
+		}
+		delete(want, name)
+	}
+	if len(want) > 0 {
+		t.Fatalf("missing entries %v in %v", want, names)
+	}
+
+	// reads at any offset see the same stream
+	ra := f.(io.ReaderAt)
+	p := make([]byte, 100)
+	for _, off := range []int64{512, 0, 1024, 100} {
+		n, err := ra.ReadAt(p, off)
+		if err != nil {
+			t.Fatalf("ReadAt %d: %v", off, err)
+		}
+		if !bytes.Equal(p[:n], b[off:off+100]) {
+			t.Fatalf("ReadAt %d: unexpected data", off)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package cap
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"testing"
@@ -12,7 +13,7 @@ import (
 func TestDevice(t *testing.T) {
 	dev := New(nil)
 	dev.Register("hellofs", func(_ *Resource) (Mounter, error) {
-		return func(_ []string) (fs.FS, error) {
+		return func(_ context.Context, _ []string) (fs.FS, error) {
 			return fskit.MapFS{"hellofile": fskit.RawNode([]byte("hello, world\n"))}, nil
 		}, nil
 	})
@@ -0,0 +1,256 @@
+package cap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"tractor.dev/wanix/fs"
+	"tractor.dev/wanix/fs/p9kit"
+	"tractor.dev/wanix/internal"
+)
+
+// redialInterval is the least time between attempts to reconnect an
+// import whose connection dropped.
+const redialInterval = time.Second
+
+// dialTimeout bounds connecting to a server, including the 9P handshake.
+var dialTimeout = 10 * time.Second
+
+// importUser is the uname imports authenticate as.
+const importUser = "wanix"
+
+// importAllocator mounts a tree served over 9P by another machine, like
+// Plan 9's import. The mount ctl takes an address and an optional aname.
+// Addresses are host:port for tcp, unix:<path> for unix sockets, or a
+// ws:// or wss:// URL. The last connection error is readable from err.
+// For servers requiring auth, the key or token is written to key before
+// mounting. It can't be read back.
+func importAllocator() Allocator {
+	return func(r *Resource) (Mounter, error) {
+		var (
+			mu      sync.Mutex
+			lastErr error
+			key     []byte
+		)
+		setErr := func(err error) {
+			mu.Lock()
+			lastErr = err
+			mu.Unlock()
+		}
+		r.Extra["err"] = internal.FieldFile(func() (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if lastErr == nil {
+				return "", nil
+			}
+			return lastErr.Error(), nil
+		})
+		r.Extra["key"] = internal.FieldFile(fs.FileMode(0200), func() (string, error) {
+			return "", nil
+		}, func(in []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			key = bytes.TrimSpace(in)
+			return nil
+		})
+		return func(_ context.Context, args []string) (fs.FS, error) {
+			if len(args) < 1 || len(args) > 2 {
+				err := fmt.Errorf("import: expected 1 or 2 arguments, got %d", len(args))
+				setErr(err)
+				return nil, err
+			}
+			var aname string
+			if len(args) == 2 {
+				aname = args[1]
+			}
+			addr := args[0]
+			var opts []p9kit.ClientOpt
+			mu.Lock()
+			if key != nil {
+				opts = append(opts, p9kit.WithKey(importUser, key))
+			}
+			mu.Unlock()
+			fsys := &importFS{
+				dial: func() (net.Conn, error) {
+					ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+					defer cancel()
+					return dialImport(ctx, addr)
+				},
+				aname:  aname,
+				opts:   opts,
+				setErr: setErr,
+			}
+			if _, err := fsys.current(); err != nil {
+				return nil, fmt.Errorf("import: %w", err)
+			}
+			return fsys, nil
+		}, nil
+	}
+}
+
+// dialImport connects to a 9P server at addr.
+func dialImport(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	switch {
+	case strings.HasPrefix(addr, "ws://"), strings.HasPrefix(addr, "wss://"):
+		return dialWebsocket(ctx, addr)
+	case strings.HasPrefix(addr, "unix:"):
+		return d.DialContext(ctx, "unix", strings.TrimPrefix(addr, "unix:"))
+	default:
+		return d.DialContext(ctx, "tcp", strings.TrimPrefix(addr, "tcp:"))
+	}
+}
+
+// importFS is a tree imported over 9P. When its connection drops it dials
+// again on next use, waiting at least redialInterval between attempts.
+// Files open on a dropped connection stay broken.
+type importFS struct {
+	dial   func() (net.Conn, error)
+	aname  string
+	opts   []p9kit.ClientOpt
+	setErr func(error)
+
+	mu      sync.Mutex
+	fsys    fs.FS
+	conn    *watchConn
+	err     error
+	dialed  time.Time
+	dialing chan struct{} // closed when the dial in progress is done
+}
+
+// current returns the client for the live connection, dialing a new one
+// if it dropped. Dialing happens without holding mu, and callers arriving
+// meanwhile wait for its result.
+func (f *importFS) current() (fs.FS, error) {
+	f.mu.Lock()
+	if f.fsys != nil {
+		err := f.conn.failed()
+		if err == nil {
+			defer f.mu.Unlock()
+			return f.fsys, nil
+		}
+		f.conn.Close()
+		f.fsys, f.conn = nil, nil
+		f.err = lostErr(err)
+	}
+	if dialing := f.dialing; dialing != nil {
+		f.mu.Unlock()
+		<-dialing
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.fsys, f.err
+	}
+	if !f.dialed.IsZero() && time.Since(f.dialed) < redialInterval {
+		defer f.mu.Unlock()
+		return nil, f.err
+	}
+	f.dialed = time.Now()
+	dialing := make(chan struct{})
+	f.dialing = dialing
+	f.mu.Unlock()
+
+	fsys, wc, err := f.connect()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fsys, f.conn, f.err = fsys, wc, err
+	f.dialing = nil
+	close(dialing)
+	f.setErr(err)
+	return fsys, err
+}
+
+// connect dials the server and attaches to the tree.
+func (f *importFS) connect() (fs.FS, *watchConn, error) {
+	conn, err := f.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	wc := &watchConn{Conn: conn, onFail: func(err error) {
+		f.setErr(lostErr(err))
+	}}
+	// a server that accepts but never answers fails the handshake
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	fsys, err := p9kit.ClientFS(wc, f.aname, f.opts...)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return fsys, wc, nil
+}
+
+func lostErr(err error) error {
+	return fmt.Errorf("connection lost: %w", err)
+}
+
+func (f *importFS) ResolveFS(ctx context.Context, name string) (fs.FS, string, error) {
+	fsys, err := f.current()
+	if err != nil {
+		return nil, "", &fs.PathError{Op: "resolve", Path: name, Err: err}
+	}
+	return fsys, name, nil
+}
+
+func (f *importFS) Open(name string) (fs.File, error) {
+	return f.OpenContext(context.Background(), name)
+}
+
+func (f *importFS) OpenContext(ctx context.Context, name string) (fs.File, error) {
+	fsys, err := f.current()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return fs.OpenContext(ctx, fsys, name)
+}
+
+// watchConn remembers the first error reading or writing its conn,
+// passing it to onFail.
+type watchConn struct {
+	net.Conn
+	onFail func(error)
+
+	mu  sync.Mutex
+	err error
+}
+
+func (c *watchConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.note(err)
+	return n, err
+}
+
+func (c *watchConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.note(err)
+	return n, err
+}
+
+func (c *watchConn) note(err error) {
+	if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		return
+	}
+	c.mu.Lock()
+	first := c.err == nil
+	if first {
+		c.err = err
+	}
+	c.mu.Unlock()
+	if first {
+		c.onFail(err)
+	}
+}
+
+// failed returns the error the conn failed with, if it has.
+func (c *watchConn) failed() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
@@ -0,0 +1,169 @@
+package cap
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"tractor.dev/wanix/fs"
+	"tractor.dev/wanix/fs/fskit"
+	"tractor.dev/wanix/fs/p9kit"
+)
+
+func TestImport(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var (
+		mu    sync.Mutex
+		conns []net.Conn
+	)
+	srv := p9kit.NewServer(fskit.MapFS{"hello": fskit.RawNode([]byte("hello"))})
+	srv.Publish("sub", fskit.MapFS{"file": fskit.RawNode([]byte("sub"))})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go srv.Handle(conn, conn)
+		}
+	}()
+
+	r := &Resource{Extra: map[string]fs.FS{}}
+	mount, err := importAllocator()(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := mount(context.Background(), []string{l.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := fs.ReadFile(fsys, "hello"); err != nil || string(b) != "hello" {
+		t.Fatalf("unexpected read: %q %v", b, err)
+	}
+
+	// drop the connection, then read again once the import has redialed
+	mu.Lock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	mu.Unlock()
+	if _, err := fs.ReadFile(fsys, "hello"); err == nil {
+		t.Fatal("expected read on a dropped connection to fail")
+	}
+	b, err := fs.ReadFile(r.Extra["err"], ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "connection lost") {
+		t.Fatalf("expected err to report the lost connection, got %q", b)
+	}
+	// skip the wait between redials
+	imp := fsys.(*importFS)
+	imp.mu.Lock()
+	imp.dialed = time.Time{}
+	imp.mu.Unlock()
+	if b, err := fs.ReadFile(fsys, "hello"); err != nil || string(b) != "hello" {
+		t.Fatalf("unexpected read after reconnect: %q %v", b, err)
+	}
+
+	sub, err := mount(context.Background(), []string{"tcp:" + l.Addr().String(), "sub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := fs.ReadFile(sub, "file"); err != nil || string(b) != "sub" {
+		t.Fatalf("unexpected read from aname: %q %v", b, err)
+	}
+
+	if _, err := mount(context.Background(), []string{"unix:" + t.TempDir() + "/missing.sock"}); err == nil {
+		t.Fatal("expected dialing a missing socket to fail")
+	}
+}
+
+func TestImportKey(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	srv := p9kit.NewServer(fskit.MapFS{"hello": fskit.RawNode([]byte("hello"))})
+	srv.RequireAuth(p9kit.PSK([]byte("hunter2")))
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go srv.Handle(conn, conn)
+		}
+	}()
+
+	r := &Resource{Extra: map[string]fs.FS{}}
+	mount, err := importAllocator()(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mount(context.Background(), []string{l.Addr().String()}); err == nil {
+		t.Fatal("expected mount without a key to fail")
+	}
+	if err := fs.WriteFile(r.Extra["key"], ".", []byte("hunter2\n"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := fs.ReadFile(r.Extra["key"], "."); strings.Contains(string(b), "hunter2") {
+		t.Fatal("expected key to not be readable")
+	}
+	fsys, err := mount(context.Background(), []string{l.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := fs.ReadFile(fsys, "hello"); err != nil || string(b) != "hello" {
+		t.Fatalf("unexpected read: %q %v", b, err)
+	}
+}
+
+func TestImportTimeout(t *testing.T) {
+	// the server accepts but never answers the handshake
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	defer func(d time.Duration) { dialTimeout = d }(dialTimeout)
+	dialTimeout = 50 * time.Millisecond
+
+	r := &Resource{Extra: map[string]fs.FS{}}
+	mount, err := importAllocator()(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mount(context.Background(), []string{l.Addr().String()}); err == nil {
+		t.Fatal("expected mount to time out")
+	}
+	b, err := fs.ReadFile(r.Extra["err"], ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(strings.TrimSpace(string(b))) == 0 {
+		t.Fatal("expected err to report the timeout")
+	}
+}
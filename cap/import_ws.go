@@ -0,0 +1,36 @@
+//go:build !js || !wasm
+
+package cap
+
+import (
+	"context"
+	"net"
+
+	"github.com/gorilla/websocket"
+	"tractor.dev/wanix/fs/p9kit"
+)
+
+// dialWebsocket connects to a 9P server over a websocket, carrying
+// messages in binary frames.
+func dialWebsocket(ctx context.Context, url string) (net.Conn, error) {
+	ws, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn := p9kit.NewMsgConn(func(msg []byte) error {
+		return ws.WriteMessage(websocket.BinaryMessage, msg)
+	}, ws.Close)
+	go func() {
+		defer conn.Hangup()
+		for {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.Deliver(data); err != nil {
+				return
+			}
+		}
+	}()
+	return conn, nil
+}
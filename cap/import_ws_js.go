@@ -0,0 +1,85 @@
+//go:build js && wasm
+
+package cap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall/js"
+
+	"tractor.dev/wanix/fs/p9kit"
+)
+
+// dialWebsocket connects to a 9P server over a browser websocket,
+// carrying messages in binary frames.
+func dialWebsocket(ctx context.Context, url string) (net.Conn, error) {
+	ws := js.Global().Get("WebSocket").New(url)
+	ws.Set("binaryType", "arraybuffer")
+
+	conn := p9kit.NewMsgConn(func(msg []byte) error {
+		buf := js.Global().Get("Uint8Array").New(len(msg))
+		js.CopyBytesToJS(buf, msg)
+		ws.Call("send", buf)
+		return nil
+	}, func() error {
+		ws.Call("close")
+		return nil
+	})
+
+	// messages are handed off in order so callbacks never block the
+	// event loop
+	in := make(chan []byte, 128)
+	go func() {
+		defer conn.Hangup()
+		for data := range in {
+			if err := conn.Deliver(data); err != nil {
+				return
+			}
+		}
+	}()
+
+	opened := make(chan error, 1)
+	var onopen, onerror, onmessage, onclose js.Func
+	onopen = js.FuncOf(func(this js.Value, args []js.Value) any {
+		opened <- nil
+		return nil
+	})
+	onerror = js.FuncOf(func(this js.Value, args []js.Value) any {
+		select {
+		case opened <- errors.New("websocket: failed to connect to " + url):
+		default:
+		}
+		return nil
+	})
+	onmessage = js.FuncOf(func(this js.Value, args []js.Value) any {
+		jsBuf := js.Global().Get("Uint8Array").New(args[0].Get("data"))
+		buf := make([]byte, jsBuf.Length())
+		js.CopyBytesToGo(buf, jsBuf)
+		in <- buf
+		return nil
+	})
+	onclose = js.FuncOf(func(this js.Value, args []js.Value) any {
+		close(in)
+		onopen.Release()
+		onerror.Release()
+		onmessage.Release()
+		onclose.Release()
+		return nil
+	})
+	ws.Set("onopen", onopen)
+	ws.Set("onerror", onerror)
+	ws.Set("onmessage", onmessage)
+	ws.Set("onclose", onclose)
+
+	select {
+	case err := <-opened:
+		if err != nil {
+			return nil, err
+		}
+	case <-ctx.Done():
+		ws.Call("close")
+		return nil, ctx.Err()
+	}
+	return conn, nil
+}
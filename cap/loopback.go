@@ -17,15 +17,14 @@ func loopbackAllocator() Allocator {
 		r.Extra["loopback"] = fskit.OpenFunc(func(ctx context.Context, name string) (fs.File, error) {
 			return &fskit.FuncFile{
 				Node: fskit.Entry(name, 0644, loopbackA),
-				ReadFunc: func(n *fskit.Node) (err error) {
+				ReadFunc: func(n *fskit.Node) error {
 					delete(r.Extra, "loopback")
-					r.fs, err = r.mounter(nil)
-					return
+					return r.mount(ctx, nil)
 				},
 			}, nil
 		})
-		return func(_ []string) (fs.FS, error) {
-			return p9kit.ClientFS(loopbackB, "", p9.WithClientLogger(ulog.Log))
+		return func(_ context.Context, _ []string) (fs.FS, error) {
+			return p9kit.ClientFS(loopbackB, "", p9kit.WithP9Options(p9.WithClientLogger(ulog.Log)))
 		}, nil
 	}
 }
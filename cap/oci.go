@@ -0,0 +1,60 @@
+package cap
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+
+	"tractor.dev/wanix/fs"
+	"tractor.dev/wanix/fs/ocifs"
+	"tractor.dev/wanix/internal"
+)
+
+// ociAllocator mounts an image from an OCI image layout. The image is
+// selected for the platform in platform, linux/386 unless written
+// before mounting.
+func ociAllocator() Allocator {
+	return func(r *Resource) (Mounter, error) {
+		var (
+			mu       sync.Mutex
+			platform = ocifs.DefaultPlatform
+		)
+		r.Extra["platform"] = internal.FieldFile(func() (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return platform.String(), nil
+		}, func(in []byte) error {
+			p, err := ocifs.ParsePlatform(string(bytes.TrimSpace(in)))
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			platform = p
+			mu.Unlock()
+			return nil
+		})
+		return func(ctx context.Context, args []string) (fs.FS, error) {
+			if len(args) < 1 || len(args) > 2 {
+				return nil, fmt.Errorf("oci: expected 1 or 2 arguments, got %d", len(args))
+			}
+			layout, err := openDirSource(ctx, args[0])
+			if err != nil {
+				return nil, fmt.Errorf("oci: %w", err)
+			}
+			var ref string
+			if len(args) == 2 {
+				ref = args[1]
+			}
+			mu.Lock()
+			p := platform
+			mu.Unlock()
+			img, err := ocifs.Load(layout, ref, &p)
+			if err != nil {
+				return nil, fmt.Errorf("oci: %w", err)
+			}
+			r.Extra["config"] = img.ConfigFS()
+			return img.Mount(), nil
+		}, nil
+	}
+}
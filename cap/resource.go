@@ -3,6 +3,7 @@ package cap
 import (
 	"context"
 	"log"
+	"sync"
 
 	"tractor.dev/toolkit-go/engine/cli"
 	"tractor.dev/wanix/fs"
@@ -12,22 +13,33 @@ import (
 
 type Resource struct {
 	mounter Mounter
-	fs      fs.FS
 	id      int
 	typ     string
 	Extra   map[string]fs.FS
+
+	mu sync.Mutex
+	fs fs.FS
+}
+
+// mount mounts args with the mounter, resolving namespace paths in
+// them against ctx.
+func (r *Resource) mount(ctx context.Context, args []string) error {
+	fsys, err := r.mounter(ctx, args)
+	r.mu.Lock()
+	r.fs = fsys
+	r.mu.Unlock()
+	return err
 }
 
 func (r *Resource) ResolveFS(ctx context.Context, name string) (fs.FS, string, error) {
+	mountCtx := ctx
 	fsys := fskit.MapFS{
 		"ctl": internal.ControlFile(&cli.Command{
 			Usage: "ctl",
 			Short: "control the resource",
 			Run: func(ctx *cli.Context, args []string) {
 				if args[0] == "mount" {
-					var err error
-					r.fs, err = r.mounter(args[1:])
-					if err != nil {
+					if err := r.mount(mountCtx, args[1:]); err != nil {
 						log.Println(err)
 					}
 				}
@@ -35,8 +47,12 @@ func (r *Resource) ResolveFS(ctx context.Context, name string) (fs.FS, string, e
 		}),
 		"type": internal.FieldFile(r.typ, nil),
 	}
-	if r.fs != nil {
-		fsys["mount"] = r.fs
+	r.mu.Lock()
+	mounted := r.fs
+	r.mu.Unlock()
+	if mounted != nil && !archiving(ctx, r) {
+		fsys["mount"] = mounted
+		fsys["archive"] = archiveFile(r, mounted)
 	}
 	for k, v := range r.Extra {
 		fsys[k] = v
@@ -10,7 +10,10 @@ import (
 )
 
 type Allocator func(*Resource) (Mounter, error)
-type Mounter func([]string) (fs.FS, error)
+
+// Mounter mounts a resource with the arguments of a mount command. The
+// context is that of the ctl write, for resolving namespace paths.
+type Mounter func(ctx context.Context, args []string) (fs.FS, error)
 
 type Service struct {
 	allocators map[string]Allocator
@@ -21,10 +24,13 @@ type Service struct {
 func New(nsch <-chan *vfs.NS) *Service {
 	return &Service{
 		allocators: map[string]Allocator{
+			"import":   importAllocator(),
 			"loopback": loopbackAllocator(),
+			"oci":      ociAllocator(),
 			"tarfs":    tarfsAllocator(),
+			"zipfs":    zipfsAllocator(),
 			"tmpfs": func(r *Resource) (Mounter, error) {
-				return func(_ []string) (fs.FS, error) {
+				return func(_ context.Context, _ []string) (fs.FS, error) {
 					return fskit.MemFS{}, nil
 				}, nil
 			},
@@ -0,0 +1,72 @@
+package cap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"tractor.dev/wanix/fs"
+	"tractor.dev/wanix/fs/tarfs"
+	"tractor.dev/wanix/internal"
+)
+
+// openSource opens src for reading. Sources with an http(s) scheme are
+// downloaded, file:// URLs are opened from the host filesystem, and
+// anything else is a path in the namespace that ctx originated from.
+func openSource(ctx context.Context, src string) (io.ReadCloser, error) {
+	if !strings.Contains(src, "://") {
+		fsys, _, ok := fs.Origin(ctx)
+		if !ok {
+			return nil, fmt.Errorf("no namespace to resolve %s", src)
+		}
+		// the origin context must not be reused for a different file
+		return fs.OpenContext(fs.ContextFor(fsys), fsys, fs.NSPath(src))
+	}
+	u, err := internal.ParseURL(src)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		resp, err := http.Get(u.String())
+		if err != nil {
+			return nil, fmt.Errorf("failed to download %s: %w", u.String(), err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to download %s: %s", u.String(), resp.Status)
+		}
+		return resp.Body, nil
+	case "file":
+		return os.Open(u.Path)
+	default:
+		return nil, fmt.Errorf("unsupported scheme: %s", u.Scheme)
+	}
+}
+
+// openDirSource returns a filesystem for the directory or archive at src,
+// using the same rules as openSource. Archives are loaded with tarfs.
+func openDirSource(ctx context.Context, src string) (fs.FS, error) {
+	if u, err := url.Parse(src); err == nil && u.Scheme == "file" {
+		if fi, err := os.Stat(u.Path); err == nil && fi.IsDir() {
+			return os.DirFS(u.Path), nil
+		}
+	}
+	if !strings.Contains(src, "://") {
+		if fsys, _, ok := fs.Origin(ctx); ok {
+			if ok, _ := fs.DirExists(fsys, fs.NSPath(src)); ok {
+				return fs.Sub(fsys, fs.NSPath(src))
+			}
+		}
+	}
+	r, err := openSource(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return tarfs.Read(r)
+}
@@ -0,0 +1,50 @@
+package cap
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"tractor.dev/wanix/fs"
+	"tractor.dev/wanix/fs/zipfs"
+)
+
+func zipfsAllocator() Allocator {
+	return func(r *Resource) (Mounter, error) {
+		return func(ctx context.Context, args []string) (fs.FS, error) {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("zipfs: expected 1 argument, got %d", len(args))
+			}
+			src, err := openSource(ctx, args[0])
+			if err != nil {
+				return nil, fmt.Errorf("zipfs: %w", err)
+			}
+			defer src.Close()
+			// zip needs random access, so the archive is held in memory
+			b, err := io.ReadAll(src)
+			if err != nil {
+				return nil, fmt.Errorf("zipfs: failed to read %s: %w", args[0], err)
+			}
+			if !isZip(b) {
+				return nil, fmt.Errorf("zipfs: %s is not a zip archive", args[0])
+			}
+			fsys, err := zipfs.New(bytes.NewReader(b), int64(len(b)))
+			if err != nil {
+				return nil, fmt.Errorf("zipfs: failed to read archive: %w", err)
+			}
+			return fsys, nil
+		}, nil
+	}
+}
+
+// isZip reports whether b ends with an end of central directory
+// record, which can be followed by a comment of up to 64K. Unlike
+// the first local file header, it's there when the archive has data
+// before it, as self-extracting archives do.
+func isZip(b []byte) bool {
+	const eocdLen = 22
+	tail := b[max(0, len(b)-eocdLen-0xFFFF):]
+	i := bytes.LastIndex(tail, []byte("PK\x05\x06"))
+	return i >= 0 && len(tail)-i >= eocdLen
+}
@@ -0,0 +1,40 @@
+package cap
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+)
+
+func TestIsZip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hello"))
+	zw.SetComment("a comment")
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var empty bytes.Buffer
+	zip.NewWriter(&empty).Close()
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"archive", buf.Bytes(), true},
+		{"empty archive", empty.Bytes(), true},
+		{"self-extracting", append([]byte("#!/bin/sh\nexit 0\n"), buf.Bytes()...), true},
+		{"tar", make([]byte, 1024), false},
+		{"truncated", buf.Bytes()[:buf.Len()-20], false},
+	} {
+		if got := isZip(tt.data); got != tt.want {
+			t.Errorf("%s: isZip = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
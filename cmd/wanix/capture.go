@@ -0,0 +1,242 @@
+//go:build !js && !wasm
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// capturePath is where a capture can be downloaded, under the network.
+const capturePath = "/capture"
+
+// captureFlushInterval is how often captured frames are written out to
+// the capture file, which they're buffered for between.
+const captureFlushInterval = time.Second
+
+// Frame directions as pcapng records them, relative to the virtual
+// network: inbound frames come from a VM, outbound frames go to one.
+const (
+	inbound  uint32 = 1
+	outbound uint32 = 2
+)
+
+// capture records the Ethernet frames crossing the network websockets as
+// pcapng, to a file, to a buffer of the most recent frames, or both. Each
+// network is an interface named after it.
+type capture struct {
+	mu     sync.Mutex
+	file   *os.File
+	w      *bufio.Writer // buffers file
+	max    int
+	ifaces []string // networks, by interface
+	frames []capturedFrame
+	next   int // where the next frame goes once frames is full
+}
+
+type capturedFrame struct {
+	time  time.Time
+	iface uint32
+	dir   uint32
+	data  []byte
+}
+
+// newCapture captures to the file at name if set, and keeps the last
+// keep frames if more than zero.
+func newCapture(name string, keep int) (*capture, error) {
+	c := &capture{max: keep}
+	if name != "" {
+		f, err := os.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		c.file = f
+		c.w = bufio.NewWriterSize(f, 64<<10)
+		// write errors stick, so they're reported when flushed
+		c.w.Write(pcapngHeader())
+		go c.flushEvery(captureFlushInterval)
+	}
+	return c, nil
+}
+
+// flushEvery flushes the capture file every d until it's closed.
+func (c *capture) flushEvery(d time.Duration) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for range t.C {
+		c.mu.Lock()
+		if c.file == nil {
+			c.mu.Unlock()
+			return
+		}
+		c.flush()
+		c.mu.Unlock()
+	}
+}
+
+// flush writes out buffered frames. c.mu must be held.
+func (c *capture) flush() {
+	if c.file == nil {
+		return
+	}
+	if err := c.w.Flush(); err != nil {
+		c.fail(err)
+	}
+}
+
+// fail stops capturing to the file after err. c.mu must be held.
+func (c *capture) fail(err error) {
+	log.Println("capture:", err)
+	c.file.Close()
+	c.file = nil
+}
+
+// frame records a frame going in dir on network. It's safe to call with
+// a nil capture, which records nothing.
+func (c *capture) frame(network string, dir uint32, data []byte) {
+	if c == nil {
+		return
+	}
+	f := capturedFrame{time: time.Now(), dir: dir, data: bytes.Clone(data)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var block []byte
+	if i := slices.Index(c.ifaces, network); i >= 0 {
+		f.iface = uint32(i)
+	} else {
+		// interfaces are described as networks are first seen
+		f.iface = uint32(len(c.ifaces))
+		c.ifaces = append(c.ifaces, network)
+		block = interfaceBlock(network)
+	}
+	if c.file != nil {
+		// errors stick, so the second write reports the first's
+		c.w.Write(block)
+		if _, err := c.w.Write(f.block()); err != nil {
+			c.fail(err)
+		}
+	}
+	if c.max > 0 {
+		if len(c.frames) < c.max {
+			c.frames = append(c.frames, f)
+		} else {
+			c.frames[c.next] = f
+			c.next = (c.next + 1) % c.max
+		}
+	}
+}
+
+// writeTo writes what's been captured as a pcapng file: the buffered
+// frames, or the file captured so far if not buffering.
+func (c *capture) writeTo(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flush()
+	if c.max == 0 && c.file != nil {
+		f, err := os.Open(c.file.Name())
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	}
+	if _, err := w.Write(pcapngHeader()); err != nil {
+		return err
+	}
+	for _, network := range c.ifaces {
+		if _, err := w.Write(interfaceBlock(network)); err != nil {
+			return err
+		}
+	}
+	for i := range c.frames {
+		// the oldest frame is at next once the buffer wraps
+		f := c.frames[(c.next+i)%len(c.frames)]
+		if _, err := w.Write(f.block()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handler serves the capture for download, to open in Wireshark.
+func (c *capture) handler(ctl control) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ctl.allow(w, r) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pcapng")
+		w.Header().Set("Content-Disposition", `attachment; filename="wanix.pcapng"`)
+		if err := c.writeTo(w); err != nil {
+			log.Println("capture:", err)
+		}
+	})
+}
+
+// pcapngHeader returns a section header block.
+func pcapngHeader() []byte {
+	// byte order magic, version 1.0, unknown length
+	shb := binary.LittleEndian.AppendUint32(nil, 0x1A2B3C4D)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	shb = binary.LittleEndian.AppendUint64(shb, 0xFFFFFFFFFFFFFFFF)
+	return pcapngBlock(0x0A0D0D0A, shb)
+}
+
+// interfaceBlock returns an interface description block for Ethernet,
+// with no snap length and microsecond timestamps, named in the if_name
+// option.
+func interfaceBlock(name string) []byte {
+	idb := binary.LittleEndian.AppendUint16(nil, 1)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, 0)
+	idb = binary.LittleEndian.AppendUint16(idb, 2)
+	idb = binary.LittleEndian.AppendUint16(idb, uint16(len(name)))
+	idb = append(idb, pad4([]byte(name))...)
+	idb = binary.LittleEndian.AppendUint32(idb, 0)
+	return pcapngBlock(0x00000001, idb)
+}
+
+// block returns the frame as an enhanced packet block with its direction
+// in the flags option.
+func (f capturedFrame) block() []byte {
+	ts := uint64(f.time.UnixMicro())
+	epb := binary.LittleEndian.AppendUint32(nil, f.iface)
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(f.data)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(f.data)))
+	epb = append(epb, pad4(f.data)...)
+	// epb_flags, then the end of options
+	epb = binary.LittleEndian.AppendUint16(epb, 2)
+	epb = binary.LittleEndian.AppendUint16(epb, 4)
+	epb = binary.LittleEndian.AppendUint32(epb, f.dir)
+	epb = binary.LittleEndian.AppendUint32(epb, 0)
+	return pcapngBlock(0x00000006, epb)
+}
+
+// pcapngBlock frames body as a block of type, with its total length
+// before and after.
+func pcapngBlock(typ uint32, body []byte) []byte {
+	n := uint32(12 + len(body))
+	b := binary.LittleEndian.AppendUint32(nil, typ)
+	b = binary.LittleEndian.AppendUint32(b, n)
+	b = append(b, body...)
+	return binary.LittleEndian.AppendUint32(b, n)
+}
+
+func pad4(data []byte) []byte {
+	if n := len(data) % 4; n != 0 {
+		return append(bytes.Clone(data), make([]byte, 4-n)...)
+	}
+	return data
+}
@@ -0,0 +1,199 @@
+//go:build !js && !wasm
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type pcapngTestBlock struct {
+	typ  uint32
+	body []byte
+}
+
+// readBlocks splits a pcapng stream into blocks, checking the lengths
+// before and after each.
+func readBlocks(t *testing.T, data []byte) []pcapngTestBlock {
+	t.Helper()
+	var blocks []pcapngTestBlock
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("short block of %d bytes", len(data))
+		}
+		n := binary.LittleEndian.Uint32(data[4:])
+		if n%4 != 0 || n < 12 || int(n) > len(data) {
+			t.Fatalf("bad block length %d of %d bytes", n, len(data))
+		}
+		if trailer := binary.LittleEndian.Uint32(data[n-4:]); trailer != n {
+			t.Fatalf("block length %d doesn't match trailing length %d", n, trailer)
+		}
+		blocks = append(blocks, pcapngTestBlock{binary.LittleEndian.Uint32(data), data[8 : n-4]})
+		data = data[n:]
+	}
+	return blocks
+}
+
+// readOptions returns the options of a block body by code.
+func readOptions(t *testing.T, opts []byte) map[uint16][]byte {
+	t.Helper()
+	m := make(map[uint16][]byte)
+	for {
+		if len(opts) < 4 {
+			t.Fatalf("options not ended: %x", opts)
+		}
+		code, n := binary.LittleEndian.Uint16(opts), int(binary.LittleEndian.Uint16(opts[2:]))
+		if code == 0 {
+			if len(opts) != 4 {
+				t.Fatalf("%d bytes after the end of options", len(opts)-4)
+			}
+			return m
+		}
+		padded := (n + 3) &^ 3
+		if len(opts) < 4+padded {
+			t.Fatalf("option %d overruns its block", code)
+		}
+		m[code] = opts[4 : 4+n]
+		opts = opts[4+padded:]
+	}
+}
+
+func checkHeader(t *testing.T, b pcapngTestBlock) {
+	t.Helper()
+	if b.typ != 0x0A0D0D0A || len(b.body) != 16 {
+		t.Fatalf("expected a section header, got type %#x of %d bytes", b.typ, len(b.body))
+	}
+	if magic := binary.LittleEndian.Uint32(b.body); magic != 0x1A2B3C4D {
+		t.Fatalf("bad byte order magic %#x", magic)
+	}
+	if major, minor := binary.LittleEndian.Uint16(b.body[4:]), binary.LittleEndian.Uint16(b.body[6:]); major != 1 || minor != 0 {
+		t.Fatalf("bad version %d.%d", major, minor)
+	}
+}
+
+func checkInterface(t *testing.T, b pcapngTestBlock, name string) {
+	t.Helper()
+	if b.typ != 1 {
+		t.Fatalf("expected an interface description, got type %#x", b.typ)
+	}
+	if link := binary.LittleEndian.Uint16(b.body); link != 1 {
+		t.Fatalf("expected Ethernet, got link type %d", link)
+	}
+	if got := string(readOptions(t, b.body[8:])[2]); got != name {
+		t.Fatalf("expected interface %q, got %q", name, got)
+	}
+}
+
+func checkFrame(t *testing.T, b pcapngTestBlock, want capturedFrame) {
+	t.Helper()
+	if b.typ != 6 {
+		t.Fatalf("expected an enhanced packet, got type %#x", b.typ)
+	}
+	body := b.body
+	ts := uint64(binary.LittleEndian.Uint32(body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(body[8:]))
+	caplen, origlen := binary.LittleEndian.Uint32(body[12:]), binary.LittleEndian.Uint32(body[16:])
+	if iface := binary.LittleEndian.Uint32(body); iface != want.iface {
+		t.Fatalf("expected interface %d, got %d", want.iface, iface)
+	}
+	if ts != uint64(want.time.UnixMicro()) {
+		t.Fatalf("expected timestamp %d, got %d", want.time.UnixMicro(), ts)
+	}
+	if int(caplen) != len(want.data) || origlen != caplen {
+		t.Fatalf("expected %d bytes captured, got %d of %d", len(want.data), caplen, origlen)
+	}
+	padded := (int(caplen) + 3) &^ 3
+	if !bytes.Equal(body[20:20+caplen], want.data) {
+		t.Fatalf("unexpected data %x", body[20:20+caplen])
+	}
+	flags := readOptions(t, body[20+padded:])[2]
+	if len(flags) != 4 || binary.LittleEndian.Uint32(flags) != want.dir {
+		t.Fatalf("expected direction %d, got flags %x", want.dir, flags)
+	}
+}
+
+func TestPcapngBlocks(t *testing.T) {
+	var stream []byte
+	stream = append(stream, pcapngHeader()...)
+	stream = append(stream, interfaceBlock("default")...)
+	stream = append(stream, interfaceBlock("lab")...)
+	frames := []capturedFrame{
+		{time.UnixMicro(1700000000123456), 0, inbound, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14}},
+		{time.UnixMicro(1700000000223456), 1, outbound, bytes.Repeat([]byte{0xff}, 60)},
+		{time.UnixMicro(1700000000323456), 0, outbound, nil},
+	}
+	for _, f := range frames {
+		stream = append(stream, f.block()...)
+	}
+
+	blocks := readBlocks(t, stream)
+	if len(blocks) != 6 {
+		t.Fatalf("expected 6 blocks, got %d", len(blocks))
+	}
+	checkHeader(t, blocks[0])
+	checkInterface(t, blocks[1], "default")
+	checkInterface(t, blocks[2], "lab")
+	for i, f := range frames {
+		checkFrame(t, blocks[3+i], f)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "net.pcapng")
+	c, err := newCapture(name, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.frame("default", inbound, []byte("one"))
+	c.frame("lab", outbound, []byte("two"))
+	c.frame("default", outbound, []byte("three"))
+
+	// the buffer has the last frames and every interface
+	var buf bytes.Buffer
+	if err := c.writeTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	blocks := readBlocks(t, buf.Bytes())
+	if len(blocks) != 5 {
+		t.Fatalf("expected 5 blocks, got %d", len(blocks))
+	}
+	checkHeader(t, blocks[0])
+	checkInterface(t, blocks[1], "default")
+	checkInterface(t, blocks[2], "lab")
+	if got := blocks[3].body[20:23]; string(got) != "two" {
+		t.Fatalf("expected the oldest kept frame first, got %q", got)
+	}
+
+	// the file has every frame once flushed, which writeTo did
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks = readBlocks(t, data)
+	if len(blocks) != 6 {
+		t.Fatalf("expected 6 blocks in the file, got %d", len(blocks))
+	}
+	checkHeader(t, blocks[0])
+	checkInterface(t, blocks[1], "default")
+	checkInterface(t, blocks[3], "lab")
+
+	// frames are flushed on their own too
+	c.frame("default", inbound, []byte("four"))
+	deadline := time.Now().Add(5 * captureFlushInterval)
+	for {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(readBlocks(t, data)) == 7 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the frame to be flushed to the file")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
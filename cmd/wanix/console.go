@@ -23,6 +23,7 @@ import (
 )
 
 func (m *Main) addConsoleCmd(root *cli.Command) {
+	var allowedOrigins string
 	cmd := &cli.Command{
 		Usage: "console",
 		Short: "enter wanix console",
@@ -54,7 +55,13 @@ func (m *Main) addConsoleCmd(root *cli.Command) {
 					w.Header().Add("Cross-Origin-Embedder-Policy", "require-corp")
 					http.FileServerFS(fsys).ServeHTTP(w, r)
 				}))
-				http.Handle("/.tty", websocket.Handler(func(conn *websocket.Conn) {
+				origins := parseOrigins(allowedOrigins)
+				http.Handle("/.tty", websocket.Server{Handshake: func(_ *websocket.Config, r *http.Request) error {
+					if !origins.allow(r) {
+						return fmt.Errorf("origin not allowed")
+					}
+					return nil
+				}, Handler: func(conn *websocket.Conn) {
 					conn.PayloadType = websocket.BinaryFrame
 
 					oldstate, err := term.MakeRaw(int(os.Stdin.Fd()))
@@ -93,7 +100,7 @@ func (m *Main) addConsoleCmd(root *cli.Command) {
 						}
 					}
 
-				}))
+				}})
 
 				hostname := fmt.Sprintf("localhost:%d", l.Addr().(*net.TCPAddr).Port)
 				url := fmt.Sprintf("http://%s/?tty=ws://%s/.tty", hostname, hostname)
@@ -115,5 +122,6 @@ func (m *Main) addConsoleCmd(root *cli.Command) {
 			})
 		},
 	}
+	cmd.Flags().StringVar(&allowedOrigins, "allowed-origins", "", "comma separated origins allowed to open the tty websocket, which may use * like https://*.example.com, by default any")
 	root.AddCommand(cmd)
 }
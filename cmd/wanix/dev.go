@@ -0,0 +1,372 @@
+//go:build !js && !wasm
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"tractor.dev/wanix/fs"
+	"tractor.dev/wanix/fs/fskit"
+	"tractor.dev/wanix/wasm/assets"
+)
+
+// reloadPath is where pages served in dev mode listen for changes,
+// under the path prefix.
+const reloadPath = "/.wanix/reload"
+
+// reloadScript is added to pages served in dev mode to reload them when
+// something changes at url.
+func reloadScript(url string) string {
+	return `<script>new EventSource("` + url + `").onmessage = () => location.reload();</script>`
+}
+
+// pollInterval is how often overlays are checked for changes.
+const pollInterval = 500 * time.Millisecond
+
+// overlay is a local directory served over the embedded files at prefix.
+type overlay struct {
+	prefix string
+	dir    string
+}
+
+// parseOverlays parses comma separated "[<prefix>=]<dir>" entries.
+func parseOverlays(spec string) ([]overlay, error) {
+	var overlays []overlay
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		o := overlay{dir: entry}
+		if prefix, dir, ok := strings.Cut(entry, "="); ok {
+			o = overlay{prefix: strings.Trim(path.Clean(prefix), "/"), dir: dir}
+		}
+		if o.prefix == "." {
+			o.prefix = ""
+		}
+		if fi, err := os.Stat(o.dir); err != nil || !fi.IsDir() {
+			return nil, fmt.Errorf("overlay %s: not a directory", o.dir)
+		}
+		overlays = append(overlays, o)
+	}
+	return overlays, nil
+}
+
+// defaultOverlays are the source directories of the embedded files when
+// serving from a checkout of the repository.
+func defaultOverlays() []overlay {
+	var overlays []overlay
+	for _, o := range []overlay{
+		{"", "wasm/assets"},
+		{"v86", "external/v86"},
+		{"linux", "external/linux"},
+		{"shell", "shell"},
+	} {
+		if fi, err := os.Stat(o.dir); err == nil && fi.IsDir() {
+			overlays = append(overlays, o)
+		}
+	}
+	return overlays
+}
+
+// devServer serves overlays over the embedded files, tells pages to
+// reload when they change, and rebuilds what's built from them.
+type devServer struct {
+	fsys     fs.FS
+	overlays []overlay
+	shellDir string // rebuild shell.tgz from here if set
+
+	// reloadURL is where pages listen for changes, which is reloadPath
+	// unless served under a prefix.
+	reloadURL string
+	// headScript is added to the head of pages if set.
+	headScript string
+
+	mu       sync.Mutex
+	bundle   []byte
+	shellTgz []byte
+	clients  map[chan struct{}]struct{}
+}
+
+// newDevServer layers overlays over embedded. If rebuildShell is set, an
+// overlay at shell is used to rebuild shell.tgz.
+func newDevServer(embedded fs.FS, overlays []overlay, rebuildShell bool) (*devServer, error) {
+	var union fskit.UnionFS
+	for _, o := range overlays {
+		if o.prefix == "" {
+			union = append(union, os.DirFS(o.dir))
+		} else {
+			union = append(union, fskit.MapFS{o.prefix: os.DirFS(o.dir)})
+		}
+	}
+	union = append(union, embedded)
+
+	d := &devServer{
+		fsys:      union,
+		overlays:  overlays,
+		reloadURL: reloadPath,
+		clients:   make(map[chan struct{}]struct{}),
+	}
+	if rebuildShell {
+		for _, o := range overlays {
+			if o.prefix == "shell" {
+				d.shellDir = o.dir
+			}
+		}
+		if d.shellDir == "" {
+			return nil, fmt.Errorf("rebuilding shell needs an overlay at shell")
+		}
+	}
+	d.rebuild(true)
+	return d, nil
+}
+
+// rebuild rebuilds the bundle, and shell.tgz if shell changed. Errors
+// are logged and the last build kept, since they're usually fixed by
+// the next change.
+func (d *devServer) rebuild(shell bool) {
+	v86fs, err := fs.Sub(d.fsys, "v86")
+	if err == nil {
+		var bundle []byte
+		if bundle, err = assets.BundleFrom(d.fsys, v86fs); err == nil {
+			d.mu.Lock()
+			d.bundle = bundle
+			d.mu.Unlock()
+		}
+	}
+	if err != nil {
+		log.Println("dev: bundle:", err)
+	}
+
+	if !shell || d.shellDir == "" {
+		return
+	}
+	base, err := fs.ReadFile(d.fsys, "shell/shell.tgz")
+	if err == nil {
+		var tgz []byte
+		if tgz, err = rebuildShellTgz(base, d.shellDir); err == nil {
+			d.mu.Lock()
+			d.shellTgz = tgz
+			d.mu.Unlock()
+		}
+	}
+	if err != nil {
+		log.Println("dev: shell.tgz:", err)
+	}
+}
+
+// watch polls the overlays for changes, rebuilding and telling pages to
+// reload after each.
+func (d *devServer) watch() {
+	last := make([]map[string]string, len(d.overlays))
+	for i, o := range d.overlays {
+		last[i] = snapshot(o.dir)
+	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		changed, shell := false, false
+		for i, o := range d.overlays {
+			snap := snapshot(o.dir)
+			if !sameSnapshot(snap, last[i]) {
+				changed = true
+				shell = shell || o.dir == d.shellDir
+			}
+			last[i] = snap
+		}
+		if !changed {
+			continue
+		}
+		log.Println("dev: changes detected, reloading")
+		d.rebuild(shell)
+		d.notify()
+	}
+}
+
+// snapshot returns the size and modification time of every file below
+// dir by path.
+func snapshot(dir string) map[string]string {
+	snap := make(map[string]string)
+	filepath.WalkDir(dir, func(p string, e os.DirEntry, err error) error {
+		if err != nil || e.IsDir() {
+			return nil
+		}
+		if fi, err := e.Info(); err == nil {
+			snap[p] = fmt.Sprintf("%d %d", fi.Size(), fi.ModTime().UnixNano())
+		}
+		return nil
+	})
+	return snap
+}
+
+func sameSnapshot(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// notify tells connected pages to reload.
+func (d *devServer) notify() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for ch := range d.clients {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// ServeHTTP streams reload events to a page as server-sent events.
+func (d *devServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	ch := make(chan struct{}, 1)
+	d.mu.Lock()
+	d.clients[ch] = struct{}{}
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.clients, ch)
+		d.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ch:
+			fmt.Fprint(w, "data: reload\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// serveFile serves what dev mode builds or changes: the bundle, a rebuilt
+// shell.tgz and pages with the reload script. It reports whether it
+// served the request.
+func (d *devServer) serveFile(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Cache-Control", "no-cache")
+
+	d.mu.Lock()
+	bundle, shellTgz := d.bundle, d.shellTgz
+	d.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/wanix.bundle.js" && bundle != nil:
+		w.Header().Set("Content-Type", "text/javascript")
+		w.Write(bundle)
+		return true
+	case r.URL.Path == "/shell/shell.tgz" && shellTgz != nil:
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Write(shellTgz)
+		return true
+	}
+
+	return servePage(w, r, d.fsys, d.headScript, reloadScript(d.reloadURL))
+}
+
+// rebuildShellTgz returns the shell.tgz base with the files in the bin
+// and etc directories of dir added, replacing any already there, as the
+// shell image build copies them in.
+func rebuildShellTgz(base []byte, dir string) ([]byte, error) {
+	files := make(map[string]string) // archive name to host path
+	var names []string
+	for _, sub := range []string{"bin", "etc"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+			name := path.Join(sub, e.Name())
+			files[name] = filepath.Join(dir, sub, e.Name())
+			names = append(names, name)
+		}
+	}
+
+	gr, err := gzip.NewReader(bytes.NewReader(base))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gr)
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := files[path.Clean(hdr.Name)]; ok {
+			continue
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range names {
+		data, err := os.ReadFile(files[name])
+		if err != nil {
+			return nil, err
+		}
+		mode := int64(0644)
+		if strings.HasPrefix(name, "bin/") {
+			mode = 0755
+		}
+		// entries are relative to the rootfs like the rest, as ./bin/init
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     "./" + name,
+			Mode:     mode,
+			Size:     int64(len(data)),
+			ModTime:  time.Now(),
+		}); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
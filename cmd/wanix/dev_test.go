@@ -0,0 +1,162 @@
+//go:build !js && !wasm
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseOverlays(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	overlays, err := parseOverlays(dir + ", /v86/=" + sub + ",./=" + sub + ",,a/b=" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []overlay{{"", dir}, {"v86", sub}, {"", sub}, {"a/b", dir}}
+	if len(overlays) != len(want) {
+		t.Fatalf("unexpected overlays: %v", overlays)
+	}
+	for i, o := range want {
+		if overlays[i] != o {
+			t.Errorf("overlay %d: got %v, want %v", i, overlays[i], o)
+		}
+	}
+
+	if overlays, err := parseOverlays(""); err != nil || len(overlays) != 0 {
+		t.Fatalf("expected no overlays, got %v %v", overlays, err)
+	}
+	for _, spec := range []string{file, "v86=" + filepath.Join(dir, "missing")} {
+		if _, err := parseOverlays(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+type tarEntry struct {
+	mode int64
+	data string
+}
+
+func makeTgz(t *testing.T, entries map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, data := range entries {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0600, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readTgz(t *testing.T, data []byte) map[string]tarEntry {
+	t.Helper()
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]tarEntry)
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := entries[hdr.Name]; ok {
+			t.Fatalf("duplicate entry %s", hdr.Name)
+		}
+		entries[hdr.Name] = tarEntry{hdr.Mode, string(b)}
+	}
+}
+
+func TestRebuildShellTgz(t *testing.T) {
+	base := makeTgz(t, map[string]string{
+		"./bin/init":     "old init",
+		"bin/keep":       "keep",
+		"./etc/profile":  "old profile",
+		"./usr/bin/tool": "tool",
+	})
+
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"bin/init":        "new init",
+		"bin/extra":       "extra",
+		"etc/profile":     "new profile",
+		"etc/nested/skip": "skip",
+		"other/ignored":   "ignored",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := rebuildShellTgz(base, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := readTgz(t, data)
+	want := map[string]tarEntry{
+		"bin/keep":       {0600, "keep"},
+		"./usr/bin/tool": {0600, "tool"},
+		"./bin/init":     {0755, "new init"},
+		"./bin/extra":    {0755, "extra"},
+		"./etc/profile":  {0644, "new profile"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("unexpected entries: %v", got)
+	}
+	for name, e := range want {
+		if got[name] != e {
+			t.Errorf("%s: got %v, want %v", name, got[name], e)
+		}
+	}
+
+	// without bin or etc, the base is unchanged
+	data, err = rebuildShellTgz(base, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readTgz(t, data); len(got) != 4 || got["./bin/init"].data != "old init" {
+		t.Fatalf("unexpected entries: %v", got)
+	}
+
+	if _, err := rebuildShellTgz([]byte("not gzip"), dir); err == nil {
+		t.Fatal("expected an error for a bad base")
+	}
+}
@@ -4,10 +4,22 @@ package main
 
 import (
 	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
 
 	"tractor.dev/toolkit-go/engine/cli"
 	"tractor.dev/wanix/external/linux"
@@ -18,74 +30,443 @@ import (
 	"tractor.dev/wanix/wasm/assets"
 )
 
+// An export manifest lists what goes in a bundle, one line at a time:
+//
+//	# comment
+//	file <pattern> [<dst>]
+//	local <pattern> [<dst>]
+//	index [<key>=<value>...]
+//
+// file includes files built into this binary and local includes files
+// from the host, with relative paths relative to the manifest. A pattern
+// is a file, a directory, which includes everything below it, or a glob.
+// dst is where a file or directory goes in the bundle, or the directory
+// glob matches go in. Without it, built in files keep their path and
+// local files go at the top by their base name. Later lines replace
+// earlier ones that put a file at the same path.
+//
+// index generates index.html, with each key and value setting an option
+// passed to the Wanix constructor. Values are JSON, or otherwise strings.
+// The shell option sets whether the page boots the shell, which it does
+// by default.
+
+// defaultManifest is the bundle exported without a manifest.
+const defaultManifest = `
+file wanix.bundle.js
+file wanix-sw.js
+file wanix.wasm
+file wanix.css
+file favicon.ico
+file wasi/wasi.bundle.js
+file wasi/worker.js
+file wasi/worker_sync.js
+file shell/shell.tgz
+file linux/bzImage
+file v86/v86.wasm
+file v86/seabios.bin
+file v86/vgabios.bin
+file index.html
+`
+
 func exportCmd() *cli.Command {
+	var (
+		manifest string
+		output   string
+		gzipped  bool
+		hashes   string
+	)
 	cmd := &cli.Command{
 		Usage: "export",
-		Short: "",
+		Short: "export a bundle of wanix as a tar or zip",
+		Long: "Writes the files needed to host wanix as a tar, by default to stdout, or as a zip. " +
+			"What goes in the bundle can be changed with a manifest, which has lines of:\n\n" +
+			"  file <pattern> [<dst>]     files built in, where pattern is a file, directory or glob\n" +
+			"  local <pattern> [<dst>]    files from the host, relative to the manifest\n" +
+			"  index [<key>=<value>...]   generate index.html passing options to Wanix\n",
 		Run: func(ctx *cli.Context, args []string) {
 			log.SetFlags(log.Ltime | log.Lmicroseconds | log.Lshortfile)
 
-			fsys := fskit.UnionFS{assets.Dir, fskit.MapFS{
+			builtin := fskit.UnionFS{assets.Dir, fskit.MapFS{
 				"v86":             v86.Dir,
 				"linux":           linux.Dir,
 				"shell":           shell.Dir,
 				"wanix.bundle.js": fskit.RawNode(fs.FileMode(0600), assets.WanixBundle()),
 			}}
 
-			// Create a new tar writer
-			var buf bytes.Buffer
-			tarWriter := tar.NewWriter(&buf)
-
-			fatal(addFileToTar(tarWriter, fsys, "wanix.bundle.js"))
-			fatal(addFileToTar(tarWriter, fsys, "wanix-sw.js"))
-			fatal(addFileToTar(tarWriter, fsys, "wanix.wasm"))
-			fatal(addFileToTar(tarWriter, fsys, "wanix.css"))
-			fatal(addFileToTar(tarWriter, fsys, "favicon.ico"))
-			fatal(addFileToTar(tarWriter, fsys, "wasi/wasi.bundle.js"))
-			fatal(addFileToTar(tarWriter, fsys, "wasi/worker.js"))
-			fatal(addFileToTar(tarWriter, fsys, "wasi/worker_sync.js"))
-			fatal(addFileToTar(tarWriter, fsys, "shell/shell.tgz"))
-			fatal(addFileToTar(tarWriter, fsys, "linux/bzImage"))
-			fatal(addFileToTar(tarWriter, fsys, "v86/v86.wasm"))
-			fatal(addFileToTar(tarWriter, fsys, "v86/seabios.bin"))
-			fatal(addFileToTar(tarWriter, fsys, "v86/vgabios.bin"))
-			fatal(addFileToTar(tarWriter, fsys, "index.html"))
-
-			tarWriter.Close()
-			os.Stdout.Write(buf.Bytes())
+			var b *bundle
+			if manifest != "" {
+				f, err := os.Open(manifest)
+				fatal(err)
+				b, err = parseManifest(f, manifest, builtin, filepath.Dir(manifest))
+				f.Close()
+				fatal(err)
+			} else {
+				var err error
+				b, err = parseManifest(strings.NewReader(defaultManifest), "default manifest", builtin, ".")
+				fatal(err)
+			}
+
+			format, err := exportFormat(output, gzipped)
+			fatal(err)
+
+			var w io.Writer = os.Stdout
+			if output != "" && output != "-" {
+				f, err := os.Create(output)
+				fatal(err)
+				defer f.Close()
+				w = f
+			}
+			fatal(b.write(w, format, hashes))
 		},
 	}
+	cmd.Flags().StringVar(&manifest, "manifest", "", "manifest of files to export instead of the default bundle")
+	cmd.Flags().StringVar(&output, "o", "", "file to write to instead of stdout, ending in .tar, .tar.gz, .tgz or .zip")
+	cmd.Flags().BoolVar(&gzipped, "gzip", false, "gzip the tar")
+	cmd.Flags().StringVar(&hashes, "hashes", "", "path in the bundle to write a JSON object of the SHA-256 of each file to")
 	return cmd
 }
 
-func addFileToTar(tarWriter *tar.Writer, fsys fs.FS, name string) error {
-	// Open the file
-	file, err := fsys.Open(name)
-	if err != nil {
-		return err
+// exportFormat returns the archive format to export to output in, which
+// is set by its extension. Stdout gets a tar. gzipped gzips a tar.
+func exportFormat(output string, gzipped bool) (fs.ArchiveFormat, error) {
+	format := fs.ArchiveTar
+	if output != "" && output != "-" {
+		var ok bool
+		if format, ok = fs.ArchiveFormatFor(output); !ok {
+			return "", fmt.Errorf("unknown archive format for %s, expected .tar, .tar.gz, .tgz or .zip", output)
+		}
+	}
+	if gzipped {
+		if format == fs.ArchiveZip {
+			return "", fmt.Errorf("unable to gzip a zip")
+		}
+		format = fs.ArchiveTarGzip
+	}
+	return format, nil
+}
+
+// bundleFile is a file to export, name in fsys.
+type bundleFile struct {
+	fsys fs.FS
+	name string
+}
+
+// bundle is the files to export by their path in the bundle, and the
+// index.html options if it's generated.
+type bundle struct {
+	paths []string
+	files map[string]bundleFile
+	index map[string]any
+}
+
+// parseManifest reads the manifest in r, called name in errors. Built in
+// files come from builtin and relative local ones from dir.
+func parseManifest(r io.Reader, name string, builtin fs.FS, dir string) (*bundle, error) {
+	b := &bundle{files: make(map[string]bundleFile)}
+	lineno := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := b.applyLine(line, builtin, dir); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, lineno, err)
+		}
 	}
-	defer file.Close()
+	return b, scanner.Err()
+}
 
-	// Get file information for header
-	fileInfo, err := file.Stat()
+func (b *bundle) applyLine(line string, builtin fs.FS, dir string) error {
+	args := strings.Fields(line)
+	switch args[0] {
+	case "file", "local":
+		if len(args) < 2 || len(args) > 3 {
+			return fmt.Errorf("%s: expected a pattern and optional destination", args[0])
+		}
+		dst := ""
+		if len(args) == 3 {
+			dst = strings.Trim(path.Clean(args[2]), "/")
+		}
+		if args[0] == "file" {
+			return b.addBuiltin(builtin, args[1], dst)
+		}
+		pattern := args[1]
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		return b.addLocal(pattern, dst)
+	case "index":
+		b.index = map[string]any{"helpers": true}
+		for _, opt := range args[1:] {
+			key, value, ok := strings.Cut(opt, "=")
+			if !ok || key == "" {
+				return fmt.Errorf("index: expected key=value, got %q", opt)
+			}
+			var v any
+			if err := json.Unmarshal([]byte(value), &v); err != nil {
+				v = value
+			}
+			b.index[key] = v
+		}
+		b.add("index.html", bundleFile{})
+		return nil
+	default:
+		return fmt.Errorf("unknown directive %q", args[0])
+	}
+}
+
+func (b *bundle) addBuiltin(fsys fs.FS, pattern, dst string) error {
+	pattern = strings.Trim(path.Clean(pattern), "/")
+	if !hasMeta(pattern) {
+		if dst == "" {
+			dst = pattern
+		}
+		return b.addTree(fsys, pattern, dst)
+	}
+	matches, err := fs.Glob(fsys, pattern)
 	if err != nil {
 		return err
 	}
+	if len(matches) == 0 {
+		return fmt.Errorf("file: no matches for %s", pattern)
+	}
+	for _, m := range matches {
+		to := m
+		if dst != "" {
+			to = path.Join(dst, path.Base(m))
+		}
+		if err := b.addTree(fsys, m, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *bundle) addLocal(pattern, dst string) error {
+	matches := []string{pattern}
+	if hasMeta(pattern) {
+		var err error
+		if matches, err = filepath.Glob(pattern); err != nil {
+			return err
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("local: no matches for %s", pattern)
+		}
+	}
+	for _, m := range matches {
+		to := filepath.Base(m)
+		if dst != "" {
+			to = dst
+			if hasMeta(pattern) {
+				to = path.Join(dst, filepath.Base(m))
+			}
+		}
+		if err := b.addTree(os.DirFS(filepath.Dir(m)), filepath.Base(m), to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addTree adds the file at name in fsys as dst, or if it's a directory,
+// every file below it under dst.
+func (b *bundle) addTree(fsys fs.FS, name, dst string) error {
+	return fs.WalkDir(fsys, name, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(p, name), "/")
+		b.add(path.Join(dst, rel), bundleFile{fsys: fsys, name: p})
+		return nil
+	})
+}
+
+func (b *bundle) add(name string, f bundleFile) {
+	if _, ok := b.files[name]; !ok {
+		b.paths = append(b.paths, name)
+	}
+	b.files[name] = f
+}
 
-	// Create a tar header from the file info
-	header, err := tar.FileInfoHeader(fileInfo, "")
+// write writes the bundle to w as an archive in format. If hashes is set,
+// a JSON object of the hash of every file is written at that path too. A
+// generated index.html is written last so its links can carry hashes.
+func (b *bundle) write(w io.Writer, format fs.ArchiveFormat, hashes string) error {
+	aw, err := newArchiveWriter(w, format)
 	if err != nil {
 		return err
 	}
+	index, ok := b.files["index.html"]
+	generated := ok && index.fsys == nil
+	sums := make(map[string]string)
+	for _, name := range b.paths {
+		f := b.files[name]
+		if f.fsys == nil {
+			continue
+		}
+		if err := aw.add(f.fsys, f.name, name); err != nil {
+			return err
+		}
+		// files are hashed in a second pass over them rather than
+		// buffered, since some are tens of megabytes
+		if generated || hashes != "" {
+			if sums[name], err = hashFile(f.fsys, f.name); err != nil {
+				return err
+			}
+		}
+	}
+	if generated {
+		data, err := b.indexHTML(sums)
+		if err != nil {
+			return err
+		}
+		if err := aw.addData("index.html", data); err != nil {
+			return err
+		}
+		sums["index.html"] = hashOf(data)
+	}
+	if hashes != "" {
+		data, err := json.MarshalIndent(sums, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := aw.addData(strings.Trim(path.Clean(hashes), "/"), append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	return aw.Close()
+}
+
+// archiveWriter writes files to a tar or zip with the fs archive helpers.
+type archiveWriter struct {
+	tw *tar.Writer
+	zw *zip.Writer
+	gw *gzip.Writer
+}
+
+func newArchiveWriter(w io.Writer, format fs.ArchiveFormat) (*archiveWriter, error) {
+	aw := &archiveWriter{}
+	switch format {
+	case fs.ArchiveTar:
+		aw.tw = tar.NewWriter(w)
+	case fs.ArchiveTarGzip:
+		aw.gw = gzip.NewWriter(w)
+		aw.tw = tar.NewWriter(aw.gw)
+	case fs.ArchiveZip:
+		aw.zw = zip.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unknown archive format %q", format)
+	}
+	return aw, nil
+}
+
+// add writes the file at name in fsys to the archive as arcname.
+func (aw *archiveWriter) add(fsys fs.FS, name, arcname string) error {
+	if aw.zw != nil {
+		return fs.AddToZip(aw.zw, fsys, name, arcname)
+	}
+	return fs.AddToTar(aw.tw, fsys, name, arcname)
+}
 
-	header.Name = name
+// addData writes a generated file with data to the archive as arcname.
+func (aw *archiveWriter) addData(arcname string, data []byte) error {
+	fsys := fskit.MapFS{"file": fskit.RawNode(data, fs.FileMode(0644), time.Now())}
+	return aw.add(fsys, "file", arcname)
+}
 
-	// Write the header to the tar archive
-	if err := tarWriter.WriteHeader(header); err != nil {
+func (aw *archiveWriter) Close() error {
+	if aw.zw != nil {
+		return aw.zw.Close()
+	}
+	if err := aw.tw.Close(); err != nil {
 		return err
 	}
+	if aw.gw != nil {
+		return aw.gw.Close()
+	}
+	return nil
+}
+
+var indexTemplate = template.Must(template.New("index.html").Parse(`<html>
+	<head>
+		<meta charset="utf-8"/>
+        <link rel="stylesheet" href="./wanix.css{{.CSSVersion}}" />
+        <script src="./wanix.bundle.js{{.JSVersion}}"></script>
+	</head>
+	<body>
+        <script>
+            new Wanix({{.Options}});
+{{- if .Shell}}
+
+            if (!window.location.search.includes('shell=false')) {
+                window.bootShell(window.location.search.includes('console=true'));
+            }
+{{- end}}
+        </script>
+	</body>
+</html>
+`))
+
+// indexHTML generates index.html from the index options, with links to
+// files in sums versioned by their hash so a new bundle isn't served
+// from a stale cache.
+func (b *bundle) indexHTML(sums map[string]string) ([]byte, error) {
+	opts := make(map[string]any)
+	shell := true
+	for k, v := range b.index {
+		if k == "shell" {
+			if on, ok := v.(bool); ok {
+				shell = on
+				continue
+			}
+		}
+		opts[k] = v
+	}
+	options, err := json.Marshal(opts)
+	if err != nil {
+		return nil, err
+	}
+	version := func(name string) string {
+		if sum, ok := sums[name]; ok {
+			return "?v=" + sum[:12]
+		}
+		return ""
+	}
+	var buf bytes.Buffer
+	err = indexTemplate.Execute(&buf, map[string]any{
+		"CSSVersion": version("wanix.css"),
+		"JSVersion":  version("wanix.bundle.js"),
+		"Options":    string(options),
+		"Shell":      shell,
+	})
+	return buf.Bytes(), err
+}
+
+func hashOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashFile returns the hash of the file at name in fsys, reading it as
+// a stream.
+func hashFile(fsys fs.FS, name string) (string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
 
-	// Copy the file contents to the tar writer
-	_, err = io.Copy(tarWriter, file)
-	return err
+func hasMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
 }
@@ -0,0 +1,268 @@
+//go:build !js && !wasm
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"tractor.dev/wanix/fs"
+	"tractor.dev/wanix/fs/fskit"
+)
+
+func testBuiltin() fs.FS {
+	return fskit.MapFS{
+		"wanix.js":       fskit.RawNode([]byte("js")),
+		"wanix.css":      fskit.RawNode([]byte("css")),
+		"v86/v86.wasm":   fskit.RawNode([]byte("v86")),
+		"v86/bios.bin":   fskit.RawNode([]byte("bios")),
+		"shell/shell.gz": fskit.RawNode([]byte("shell")),
+	}
+}
+
+func parseTestManifest(t *testing.T, manifest, dir string) *bundle {
+	t.Helper()
+	b, err := parseManifest(strings.NewReader(manifest), "manifest", testBuiltin(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// bundleSources returns the file each path in b comes from, or "" for
+// generated ones.
+func bundleSources(b *bundle) map[string]string {
+	srcs := make(map[string]string)
+	for _, p := range b.paths {
+		srcs[p] = b.files[p].name
+	}
+	return srcs
+}
+
+func TestParseManifest(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"app.js":         "app",
+		"site/a.html":    "a",
+		"site/sub/b.txt": "b",
+		"img/x.png":      "x",
+		"img/y.png":      "y",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := parseTestManifest(t, `
+# builtin files keep their path
+file wanix.js
+file /v86 emu/
+file shell/*.gz boot
+
+# local files go at the top by default
+local app.js
+local site
+local img/*.png static
+local `+filepath.Join(dir, "app.js")+` js/main.js
+
+index
+`, dir)
+
+	want := map[string]string{
+		"wanix.js":       "wanix.js",
+		"emu/v86.wasm":   "v86/v86.wasm",
+		"emu/bios.bin":   "v86/bios.bin",
+		"boot/shell.gz":  "shell/shell.gz",
+		"app.js":         "app.js",
+		"site/a.html":    "site/a.html",
+		"site/sub/b.txt": "site/sub/b.txt",
+		"static/x.png":   "x.png",
+		"static/y.png":   "y.png",
+		"js/main.js":     "app.js",
+		"index.html":     "",
+	}
+	got := bundleSources(b)
+	if len(got) != len(want) {
+		t.Fatalf("unexpected paths: %v", b.paths)
+	}
+	for p, src := range want {
+		if got[p] != src {
+			t.Errorf("%s: got source %q, want %q", p, got[p], src)
+		}
+	}
+}
+
+func TestParseManifestReplace(t *testing.T) {
+	b := parseTestManifest(t, `
+file wanix.js app.js
+file wanix.css
+file wanix.css app.js
+`, ".")
+	if !slices.Equal(b.paths, []string{"app.js", "wanix.css"}) {
+		t.Fatalf("unexpected paths: %v", b.paths)
+	}
+	if src := b.files["app.js"].name; src != "wanix.css" {
+		t.Fatalf("expected later line to replace app.js, got %s", src)
+	}
+}
+
+func TestApplyLineIndex(t *testing.T) {
+	b := &bundle{files: make(map[string]bundleFile)}
+	if err := b.applyLine(`index shell=false network="wss://relay" n=3 name=demo`, testBuiltin(), "."); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{"helpers": true, "shell": false, "network": "wss://relay", "n": float64(3), "name": "demo"}
+	if len(b.index) != len(want) {
+		t.Fatalf("unexpected options: %v", b.index)
+	}
+	for k, v := range want {
+		if b.index[k] != v {
+			t.Errorf("%s: got %#v, want %#v", k, b.index[k], v)
+		}
+	}
+	if f, ok := b.files["index.html"]; !ok || f.fsys != nil {
+		t.Fatal("expected a generated index.html")
+	}
+}
+
+func TestApplyLineErrors(t *testing.T) {
+	for _, line := range []string{
+		"file",
+		"file a b c",
+		"file missing.js",
+		"file *.txt",
+		"local missing/*.js",
+		"index shell",
+		"index =1",
+		"copy a b",
+	} {
+		b := &bundle{files: make(map[string]bundleFile)}
+		if err := b.applyLine(line, testBuiltin(), t.TempDir()); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+
+	_, err := parseManifest(strings.NewReader("file wanix.js\n\nbogus\n"), "manifest", testBuiltin(), ".")
+	if err == nil || !strings.HasPrefix(err.Error(), "manifest:3: ") {
+		t.Fatalf("expected an error at line 3, got %v", err)
+	}
+}
+
+func TestExportFormat(t *testing.T) {
+	for _, tt := range []struct {
+		output  string
+		gzipped bool
+		want    fs.ArchiveFormat
+	}{
+		{"", false, fs.ArchiveTar},
+		{"-", true, fs.ArchiveTarGzip},
+		{"bundle.tar", false, fs.ArchiveTar},
+		{"bundle.tar", true, fs.ArchiveTarGzip},
+		{"bundle.tgz", false, fs.ArchiveTarGzip},
+		{"bundle.zip", false, fs.ArchiveZip},
+	} {
+		got, err := exportFormat(tt.output, tt.gzipped)
+		if err != nil || got != tt.want {
+			t.Errorf("%q gzip=%v: got %q %v, want %q", tt.output, tt.gzipped, got, err, tt.want)
+		}
+	}
+	for _, output := range []string{"bundle", "bundle.tar.xz"} {
+		if _, err := exportFormat(output, false); err == nil {
+			t.Errorf("%q: expected an error", output)
+		}
+	}
+	if _, err := exportFormat("bundle.zip", true); err == nil {
+		t.Error("expected an error gzipping a zip")
+	}
+}
+
+// readBundle returns the files of an exported bundle.
+func readBundle(t *testing.T, data []byte, format fs.ArchiveFormat) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	if format == fs.ArchiveZip {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			r, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[f.Name] = string(b)
+		}
+		return files
+	}
+	var r io.Reader = bytes.NewReader(data)
+	if format == fs.ArchiveTarGzip {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gr
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = string(b)
+	}
+}
+
+func TestBundleWrite(t *testing.T) {
+	b := parseTestManifest(t, `
+file wanix.js
+file wanix.css
+index
+`, ".")
+	for _, format := range []fs.ArchiveFormat{fs.ArchiveTar, fs.ArchiveTarGzip, fs.ArchiveZip} {
+		var buf bytes.Buffer
+		if err := b.write(&buf, format, "/hashes.json"); err != nil {
+			t.Fatal(err)
+		}
+		files := readBundle(t, buf.Bytes(), format)
+		if len(files) != 4 || files["wanix.js"] != "js" || files["wanix.css"] != "css" {
+			t.Fatalf("%s: unexpected files: %v", format, files)
+		}
+		var sums map[string]string
+		if err := json.Unmarshal([]byte(files["hashes.json"]), &sums); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"wanix.js", "wanix.css", "index.html"} {
+			if sums[name] != hashOf([]byte(files[name])) {
+				t.Fatalf("%s: unexpected hash of %s", format, name)
+			}
+		}
+		if !strings.Contains(files["index.html"], "wanix.css?v="+sums["wanix.css"][:12]) {
+			t.Fatalf("%s: expected index.html to version wanix.css", format)
+		}
+	}
+}
@@ -0,0 +1,399 @@
+//go:build !js && !wasm
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/progrium/go-netstack/vnet"
+)
+
+// forwardPath is where forwards are controlled, under the network.
+const forwardPath = "/forward"
+
+// dialTimeout is how long a forwarded connection waits for the guest.
+const dialTimeout = 10 * time.Second
+
+// forwarder exposes guest TCP ports on host listeners through the
+// virtual networks. It's controlled with line commands:
+//
+//	add <host:port> <guestip:port> [<network>]
+//	remove <host:port>
+//	list
+//
+// A host address of just a port listens on localhost, and guests are on
+// the default network unless another is given. Only loopback host
+// addresses are allowed unless public is set.
+type forwarder struct {
+	nets   *networks
+	public bool
+
+	mu       sync.Mutex
+	forwards map[string]*forward // by host address
+}
+
+type forward struct {
+	host    string
+	guest   string
+	network string
+	n       *network // held while forwarding
+	l       net.Listener
+}
+
+func newForwarder(nets *networks) *forwarder {
+	return &forwarder{nets: nets, forwards: make(map[string]*forward)}
+}
+
+// parseForwards parses comma separated
+// "<host:port>=<guestip:port>[@<network>]" entries.
+func parseForwards(spec string) ([]forward, error) {
+	var forwards []forward
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, guest, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("forward %q: expected host:port=guestip:port", entry)
+		}
+		guest, network, _ := strings.Cut(guest, "@")
+		forwards = append(forwards, forward{host: host, guest: guest, network: network})
+	}
+	return forwards, nil
+}
+
+// hostAddr normalizes a host address, listening on localhost if only a
+// port is given.
+func hostAddr(addr string) string {
+	if !strings.Contains(addr, ":") {
+		return net.JoinHostPort("localhost", addr)
+	}
+	return addr
+}
+
+// isLoopback reports whether the host of addr, which may have a port, is
+// a loopback address.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// add listens on host and forwards connections to guest on network.
+func (f *forwarder) add(host, guest, network string) error {
+	host = hostAddr(host)
+	if !f.public && !isLoopback(host) {
+		return fmt.Errorf("%s: not a loopback address, which needs --forward-public", host)
+	}
+	if network == "" {
+		network = defaultNetwork
+	}
+	ip, port, err := net.SplitHostPort(guest)
+	if err != nil {
+		return fmt.Errorf("guest %s: %w", guest, err)
+	}
+	if net.ParseIP(ip).To4() == nil || port == "" {
+		return fmt.Errorf("guest %s: expected an IPv4 address and port", guest)
+	}
+	n, err := f.nets.acquire(network, false)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.forwards[host]; ok {
+		f.nets.release(n)
+		return fmt.Errorf("%s: already forwarded", host)
+	}
+	l, err := net.Listen("tcp", host)
+	if err != nil {
+		f.nets.release(n)
+		return err
+	}
+	fw := &forward{host: host, guest: guest, network: network, n: n, l: l}
+	f.forwards[host] = fw
+	go serveForward(fw, n.vn)
+	log.Printf("forwarding %s to guest %s on %s", host, guest, network)
+	return nil
+}
+
+// remove stops forwarding host. Connections already made stay open.
+func (f *forwarder) remove(host string) error {
+	host = hostAddr(host)
+	f.mu.Lock()
+	fw, ok := f.forwards[host]
+	delete(f.forwards, host)
+	f.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%s: not forwarded", host)
+	}
+	log.Printf("stopped forwarding %s", host)
+	err := fw.l.Close()
+	f.nets.release(fw.n)
+	return err
+}
+
+// list returns "<host> <guest> <network>" for each forward, sorted by
+// host.
+func (f *forwarder) list() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var lines []string
+	for _, fw := range f.forwards {
+		lines = append(lines, fw.host+" "+fw.guest+" "+fw.network)
+	}
+	slices.Sort(lines)
+	return lines
+}
+
+func serveForward(fw *forward, vn *vnet.VirtualNetwork) {
+	for {
+		conn, err := fw.l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Println("forward:", err)
+			}
+			return
+		}
+		go func() {
+			defer conn.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+			guest, err := vn.DialContextTCP(ctx, fw.guest)
+			cancel()
+			if err != nil {
+				log.Printf("forward %s: %v", fw.guest, err)
+				return
+			}
+			defer guest.Close()
+			go func() {
+				io.Copy(guest, conn)
+				if cw, ok := guest.(interface{ CloseWrite() error }); ok {
+					cw.CloseWrite()
+				}
+			}()
+			io.Copy(conn, guest)
+		}()
+	}
+}
+
+// exec runs a control command, returning what it outputs.
+func (f *forwarder) exec(line string) (string, error) {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return "", nil
+	}
+	switch args[0] {
+	case "add":
+		if len(args) != 3 && len(args) != 4 {
+			return "", fmt.Errorf("add: expected host and guest addresses and an optional network")
+		}
+		network := ""
+		if len(args) == 4 {
+			network = args[3]
+		}
+		return "", f.add(args[1], args[2], network)
+	case "remove":
+		if len(args) != 2 {
+			return "", fmt.Errorf("remove: expected a host address")
+		}
+		return "", f.remove(args[1])
+	case "list":
+		var out strings.Builder
+		for _, l := range f.list() {
+			out.WriteString(l + "\n")
+		}
+		return out.String(), nil
+	default:
+		return "", fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// handler serves the control endpoint. GET lists forwards and POST runs
+// the commands in the body, one per line. A websocket runs each message
+// as commands, replying with their output or an error, so a kernel can
+// drive it through a ws cap.
+func (f *forwarder) handler(ctl control) http.Handler {
+	upgrader := websocket.Upgrader{CheckOrigin: ctl.allowOrigin}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ctl.allow(w, r) {
+			return
+		}
+		switch {
+		case websocket.IsWebSocketUpgrade(r):
+			ws, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				// the upgrader has already replied with the error
+				log.Println(err)
+				return
+			}
+			defer ws.Close()
+			for {
+				_, msg, err := ws.ReadMessage()
+				if err != nil {
+					return
+				}
+				out, err := f.execAll(string(msg))
+				if err != nil {
+					out += "error: " + err.Error() + "\n"
+				}
+				if err := ws.WriteMessage(websocket.TextMessage, []byte(out)); err != nil {
+					return
+				}
+			}
+		case r.Method == http.MethodGet:
+			out, _ := f.exec("list")
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(w, out)
+		case r.Method == http.MethodPost:
+			body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			out, err := f.execAll(string(body))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(w, out)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// execAll runs each line of cmds, stopping at the first error.
+func (f *forwarder) execAll(cmds string) (string, error) {
+	var out strings.Builder
+	scanner := bufio.NewScanner(strings.NewReader(cmds))
+	for scanner.Scan() {
+		s, err := f.exec(scanner.Text())
+		out.WriteString(s)
+		if err != nil {
+			return out.String(), err
+		}
+	}
+	return out.String(), nil
+}
+
+// control guards the control endpoints under the network, which open
+// ports on the host and show its traffic. Without a token only clients
+// on this host can use them. With one, requests carry it as a bearer
+// token or, as browsers can't set headers on websockets, a token query
+// parameter. Either way, requests must be for this host by name, so a
+// page can't reach them by rebinding its own name to this host.
+type control struct {
+	origins origins
+	token   string
+	host    string // host the endpoints are served on, if not a wildcard
+}
+
+// allow reports whether r may use a control endpoint, replying with an
+// error if not.
+func (c control) allow(w http.ResponseWriter, r *http.Request) bool {
+	if c.token == "" && !isLoopback(r.RemoteAddr) {
+		log.Printf("rejected control request from %s", r.RemoteAddr)
+		http.Error(w, "control endpoints are only served to this host without a token", http.StatusForbidden)
+		return false
+	}
+	if c.token != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			token = r.URL.Query().Get("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(c.token)) != 1 {
+			log.Printf("rejected control request from %s without the token", r.RemoteAddr)
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return false
+		}
+	}
+	if !c.allowHost(r.Host) {
+		log.Printf("rejected control request for host %q", r.Host)
+		http.Error(w, "host not allowed", http.StatusForbidden)
+		return false
+	}
+	if !c.allowOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// allowHost reports whether host, with or without a port, names this
+// host: a loopback name, the host the endpoints are served on, or the
+// host of an allowed origin, as when behind a reverse proxy.
+func (c control) allowHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	switch host {
+	case "localhost", "127.0.0.1", "::1":
+		return true
+	case "":
+		return false
+	case c.host:
+		return true
+	}
+	for _, pattern := range c.origins {
+		u, err := url.Parse(pattern)
+		if err != nil {
+			continue
+		}
+		if ok, _ := path.Match(u.Hostname(), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allowOrigin reports whether the origin of r may use a control
+// endpoint, which isn't open to any page by default. Requests not from
+// a page, without an origin, are allowed, and otherwise the origin must
+// be allowed or, if none are set, on a loopback name or the host the
+// endpoints are served on.
+func (c control) allowOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(c.origins) > 0 {
+		return c.origins.allow(r)
+	}
+	u, err := url.Parse(origin)
+	if err == nil {
+		switch u.Hostname() {
+		case "localhost", "127.0.0.1", "::1":
+			return true
+		case "":
+		case c.host:
+			return true
+		}
+	}
+	log.Printf("rejected control request from origin %q", origin)
+	return false
+}
@@ -0,0 +1,126 @@
+//go:build !js && !wasm
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseForwards(t *testing.T) {
+	forwards, err := parseForwards(" 8080=192.168.127.2:80, localhost:2222=192.168.127.3:22@lab,,0.0.0.0:9000=10.0.0.2:9000@")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []forward{
+		{host: "8080", guest: "192.168.127.2:80"},
+		{host: "localhost:2222", guest: "192.168.127.3:22", network: "lab"},
+		{host: "0.0.0.0:9000", guest: "10.0.0.2:9000"},
+	}
+	if len(forwards) != len(want) {
+		t.Fatalf("unexpected forwards: %v", forwards)
+	}
+	for i, fw := range want {
+		got := forwards[i]
+		if got.host != fw.host || got.guest != fw.guest || got.network != fw.network {
+			t.Errorf("forward %d: got %+v, want %+v", i, got, fw)
+		}
+	}
+
+	if forwards, err := parseForwards(""); err != nil || len(forwards) != 0 {
+		t.Fatalf("expected no forwards, got %v %v", forwards, err)
+	}
+	if _, err := parseForwards("8080=192.168.127.2:80,8081"); err == nil {
+		t.Fatal("expected an error for an entry without a guest")
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"localhost:8080": true,
+		"127.0.0.1:8080": true,
+		"127.1.2.3":      true,
+		"[::1]:8080":     true,
+		"::1":            true,
+		"0.0.0.0:8080":   false,
+		":8080":          false,
+		"[::]:8080":      false,
+		"10.0.0.2:8080":  false,
+		"example.com:80": false,
+	} {
+		if got := isLoopback(addr); got != want {
+			t.Errorf("isLoopback(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestForwardPublic(t *testing.T) {
+	f := newForwarder(nil)
+	for _, host := range []string{"0.0.0.0:8080", ":8080", "10.0.0.2:8080"} {
+		err := f.add(host, "192.168.127.2:80", "")
+		if err == nil || !strings.Contains(err.Error(), "--forward-public") {
+			t.Errorf("%s: expected to be rejected, got %v", host, err)
+		}
+	}
+}
+
+func TestControlAllow(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		ctl    control
+		remote string
+		host   string
+		header http.Header
+		query  string
+		want   int
+	}{
+		{"loopback", control{}, "127.0.0.1:4000", "", nil, "", http.StatusOK},
+		{"loopback v6", control{}, "[::1]:4000", "[::1]:8777", nil, "", http.StatusOK},
+		{"remote", control{}, "10.0.0.2:4000", "", nil, "", http.StatusForbidden},
+		{"remote with token", control{token: "s3cret", host: "wanix.lan"}, "10.0.0.2:4000", "wanix.lan:8777", http.Header{"Authorization": {"Bearer s3cret"}}, "", http.StatusOK},
+		{"query token", control{token: "s3cret"}, "10.0.0.2:4000", "", nil, "?token=s3cret", http.StatusOK},
+		{"wrong token", control{token: "s3cret"}, "10.0.0.2:4000", "", http.Header{"Authorization": {"Bearer nope"}}, "", http.StatusUnauthorized},
+		{"no token", control{token: "s3cret"}, "127.0.0.1:4000", "", nil, "", http.StatusUnauthorized},
+		{"foreign page", control{}, "127.0.0.1:4000", "", http.Header{"Origin": {"https://evil.example"}}, "", http.StatusForbidden},
+		{"local page", control{}, "127.0.0.1:4000", "", http.Header{"Origin": {"http://localhost:7654"}}, "", http.StatusOK},
+		{"listen host page", control{host: "wanix.lan"}, "127.0.0.1:4000", "wanix.lan:8777", http.Header{"Origin": {"http://wanix.lan:7654"}}, "", http.StatusOK},
+		{"allowed page", control{origins: origins{"https://*.example.com"}}, "127.0.0.1:4000", "app.example.com", http.Header{"Origin": {"https://app.example.com"}}, "", http.StatusOK},
+		{"rebound page", control{}, "127.0.0.1:4000", "evil.com:8777", http.Header{"Origin": {"http://evil.com:8777"}}, "", http.StatusForbidden},
+		{"rebound name", control{}, "127.0.0.1:4000", "evil.com:8777", nil, "", http.StatusForbidden},
+		{"rebound name with token", control{token: "s3cret"}, "127.0.0.1:4000", "evil.com:8777", nil, "?token=s3cret", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest("GET", "/forward"+tt.query, nil)
+		r.RemoteAddr = tt.remote
+		r.Host = "localhost:8777"
+		if tt.host != "" {
+			r.Host = tt.host
+		}
+		for k, v := range tt.header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		if tt.ctl.allow(w, r) {
+			w.WriteHeader(http.StatusOK)
+		}
+		if w.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestListenHost(t *testing.T) {
+	for addr, want := range map[string]string{
+		":8777":          "",
+		"0.0.0.0:8777":   "",
+		"[::]:8777":      "",
+		"localhost:8777": "localhost",
+		"wanix.lan:8777": "wanix.lan",
+		"10.0.0.2":       "10.0.0.2",
+	} {
+		if got := listenHost(addr); got != want {
+			t.Errorf("listenHost(%q) = %q, want %q", addr, got, want)
+		}
+	}
+}
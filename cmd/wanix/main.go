@@ -22,6 +22,8 @@ func (m *Main) InitializeCLI(root *cli.Command) {
 	root.Version = Version
 	root.AddCommand(serveCmd())
 	root.AddCommand(exportCmd())
+	root.AddCommand(ninepCmd())
+	root.AddCommand(shCmd())
 
 	var v any = m
 	if mm, ok := v.(interface{ addConsoleCmd(root *cli.Command) }); ok {
@@ -6,6 +6,8 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
 	"tractor.dev/toolkit-go/engine/cli"
 	"tractor.dev/wanix"
@@ -13,6 +15,16 @@ import (
 )
 
 func (m *Main) addMountCmd(root *cli.Command) {
+	var (
+		mountpoint   string
+		nsFile       string
+		caps         capFlags
+		readOnly     bool
+		allowOther   bool
+		debug        bool
+		attrTimeout  time.Duration
+		entryTimeout time.Duration
+	)
 	cmd := &cli.Command{
 		Usage: "mount",
 		Short: "mount wanix",
@@ -20,29 +32,45 @@ func (m *Main) addMountCmd(root *cli.Command) {
 			log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 
 			k := wanix.New()
+			k.Cap.Register("hostdir", hostdirAllocator())
 
 			root, err := k.NewRoot()
 			fatal(err)
 
-			root.Bind("#cap", "cap")
-			root.Bind("#task", "task")
+			if nsFile != "" {
+				fatal(loadNamespace(root, nsFile))
+			} else {
+				root.Bind("#cap", "cap")
+				root.Bind("#task", "task")
+			}
+			fatal(applyCaps(root, caps))
 
-			mount, err := fusekit.Mount(root.Namespace(), "/tmp/wanix", root.Context())
+			mount, err := fusekit.Mount(root.Namespace(), mountpoint, root.Context(), &fusekit.Options{
+				ReadOnly:     readOnly,
+				AttrTimeout:  attrTimeout,
+				EntryTimeout: entryTimeout,
+				AllowOther:   allowOther,
+				Debug:        debug,
+			})
 			fatal(err)
-			defer func() {
-				fatal(mount.Close())
-			}()
 
-			log.Println("Mounted at /tmp/wanix ...")
+			log.Printf("Mounted at %s ...", mountpoint)
 
 			sigChan := make(chan os.Signal, 1)
-			signal.Notify(sigChan)
-			for sig := range sigChan {
-				if sig == os.Interrupt {
-					return
-				}
-			}
+			signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+			<-sigChan
+			signal.Stop(sigChan)
+
+			fatal(mount.Close())
 		},
 	}
+	cmd.Flags().StringVar(&mountpoint, "mountpoint", "/tmp/wanix", "directory to mount on")
+	cmd.Flags().StringVar(&nsFile, "ns", "", "namespace description file to set up instead of binding cap and task")
+	cmd.Flags().Var(&caps, "cap", "\"<type> <path> [args...]\" cap to allocate and bind, may be repeated")
+	cmd.Flags().BoolVar(&readOnly, "read-only", false, "mount read-only")
+	cmd.Flags().BoolVar(&allowOther, "allow-other", false, "allow other users to access the mount")
+	cmd.Flags().BoolVar(&debug, "debug", false, "log every filesystem operation")
+	cmd.Flags().DurationVar(&attrTimeout, "attr-timeout", 0, "how long the kernel may cache attributes of static files, like archives")
+	cmd.Flags().DurationVar(&entryTimeout, "entry-timeout", 0, "how long the kernel may cache name lookups of static files, like archives")
 	root.AddCommand(cmd)
 }
@@ -0,0 +1,134 @@
+//go:build !js && !wasm
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"tractor.dev/wanix/cap"
+	"tractor.dev/wanix/fs"
+	"tractor.dev/wanix/task"
+)
+
+// A namespace description sets up a namespace one line at a time:
+//
+//	# comment
+//	bind <src> <dst>
+//	cap <type> <dst> [args...]
+//
+// bind binds the namespace path src at dst. cap allocates a capability
+// of type, mounts it with args as a write to its ctl would, and binds the
+// mount at dst.
+
+// loadNamespace sets up the namespace of t from the description in the
+// file at name.
+func loadNamespace(t *task.Resource, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	lineno := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := applyNamespaceLine(t, line); err != nil {
+			return fmt.Errorf("%s:%d: %w", name, lineno, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// capFlags collects the "<type> <dst> [args...]" values of a repeatable
+// --cap flag.
+type capFlags []string
+
+func (c *capFlags) String() string { return strings.Join(*c, ", ") }
+
+func (c *capFlags) Set(v string) error {
+	*c = append(*c, v)
+	return nil
+}
+
+func (c *capFlags) Type() string { return "cap" }
+
+// applyCaps allocates each "<type> <dst> [args...]" entry in caps as a
+// cap line of a namespace description.
+func applyCaps(t *task.Resource, caps []string) error {
+	for _, entry := range caps {
+		if err := applyNamespaceLine(t, "cap "+strings.TrimSpace(entry)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyNamespaceLine(t *task.Resource, line string) error {
+	args := strings.Fields(line)
+	switch args[0] {
+	case "bind":
+		if len(args) != 3 {
+			return fmt.Errorf("bind: expected 2 arguments, got %d", len(args)-1)
+		}
+		return t.Bind(fs.NSPath(args[1]), fs.NSPath(args[2]))
+	case "cap":
+		if len(args) < 3 {
+			return fmt.Errorf("cap: expected type and path")
+		}
+		return allocCap(t, args[1], fs.NSPath(args[2]), args[3:])
+	default:
+		return fmt.Errorf("unknown directive %q", args[0])
+	}
+}
+
+// allocCap allocates a cap of kind through the #cap device, mounts it
+// with args and binds the mount at dst, as a task would with files.
+func allocCap(t *task.Resource, kind, dst string, args []string) error {
+	ns := t.Namespace()
+	b, err := fs.ReadFile(ns, path.Join("#cap/new", kind))
+	if err != nil {
+		return fmt.Errorf("cap %s: %w", kind, err)
+	}
+	id := strings.TrimSpace(string(b))
+
+	ctl := strings.Join(append([]string{"mount"}, args...), " ")
+	if err := fs.WriteFile(ns, path.Join("#cap", id, "ctl"), []byte(ctl), 0644); err != nil {
+		return fmt.Errorf("cap %s: %w", kind, err)
+	}
+	// the ctl only logs mount errors, so a failed mount shows up as a
+	// missing mount
+	mount := path.Join("#cap", id, "mount")
+	if ok, _ := fs.Exists(ns, mount); !ok {
+		return fmt.Errorf("cap %s: unable to mount %s", kind, strings.Join(args, " "))
+	}
+	return t.Bind(mount, dst)
+}
+
+// hostdirAllocator mounts a directory of the host, read-only.
+func hostdirAllocator() cap.Allocator {
+	return func(r *cap.Resource) (cap.Mounter, error) {
+		return func(_ context.Context, args []string) (fs.FS, error) {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("hostdir: expected 1 argument, got %d", len(args))
+			}
+			fi, err := os.Stat(args[0])
+			if err != nil {
+				return nil, fmt.Errorf("hostdir: %w", err)
+			}
+			if !fi.IsDir() {
+				return nil, fmt.Errorf("hostdir: %s is not a directory", args[0])
+			}
+			return os.DirFS(args[0]), nil
+		}, nil
+	}
+}
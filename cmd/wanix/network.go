@@ -0,0 +1,545 @@
+//go:build !js && !wasm
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/progrium/go-netstack/types"
+	"github.com/progrium/go-netstack/vnet"
+)
+
+// statsPath is where network stats are served, under the network.
+const statsPath = "/stats"
+
+// defaultNetwork is the network at the root of the network path.
+const defaultNetwork = "default"
+
+// defaultZone is the DNS zone of names given without a domain, which
+// guests search.
+const defaultZone = "wanix.internal"
+
+// validNetworkName is what a network can be called in a websocket path.
+var validNetworkName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// A network config describes the topology of virtual networks, one
+// setting per line:
+//
+//	# comment
+//	mtu <bytes>
+//	subnet <cidr>
+//	gateway <ip> [<mac>]
+//	vip <ip>...
+//	dns <name> <ip>
+//	host <name> [<ip>]
+//	search <domain>
+//	lease <mac> <ip>
+//	network <name>
+//
+// dns adds a static record served by the gateway. A name without a
+// domain is in wanix.internal, which guests search. host adds a name for
+// the machine running the server, reached at a virtual ip that defaults
+// to the last in the subnet. vip adds addresses the gateway answers for,
+// and lease gives a MAC address a fixed address.
+//
+// Settings before any network line apply to the default network and to
+// networks made on demand. A network line starts a network of that name
+// with those settings, changed by the lines after it. A network called
+// default sets up the default network and those made on demand instead.
+
+// netConfig is the topology of a virtual network.
+type netConfig struct {
+	mtu        int
+	subnet     string
+	gatewayIP  string
+	gatewayMAC string
+	vips       []string
+	records    []dnsRecord
+	hosts      []dnsRecord // where an empty ip is the default
+	search     []string
+	leases     map[string]string // ip by mac
+}
+
+// dnsRecord is a name the network's DNS answers with ip.
+type dnsRecord struct {
+	name string
+	ip   string
+}
+
+func defaultNetConfig() *netConfig {
+	return &netConfig{
+		mtu:        1500,
+		subnet:     "192.168.127.0/24",
+		gatewayIP:  "192.168.127.1",
+		gatewayMAC: "5a:94:ef:e4:0c:dd",
+		vips:       []string{"192.168.127.253"},
+		leases:     make(map[string]string),
+	}
+}
+
+func (c *netConfig) clone() *netConfig {
+	cc := *c
+	cc.vips = slices.Clone(c.vips)
+	cc.records = slices.Clone(c.records)
+	cc.hosts = slices.Clone(c.hosts)
+	cc.search = slices.Clone(c.search)
+	cc.leases = maps.Clone(c.leases)
+	return &cc
+}
+
+// loadNetConfig reads the network config file at name, returning the
+// settings for the default and on demand networks and those of each
+// named network.
+func loadNetConfig(name string) (*netConfig, map[string]*netConfig, error) {
+	base := defaultNetConfig()
+	named := make(map[string]*netConfig)
+	if name == "" {
+		return base, named, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	cur := base
+	lineno := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args := strings.Fields(line)
+		if args[0] == "network" {
+			if len(args) != 2 || !validNetworkName.MatchString(args[1]) || reservedNetworkName(args[1]) {
+				return nil, nil, fmt.Errorf("%s:%d: network: expected a name of letters, digits, - and _", name, lineno)
+			}
+			if _, ok := named[args[1]]; ok {
+				return nil, nil, fmt.Errorf("%s:%d: network %s: already defined", name, lineno, args[1])
+			}
+			cur = base.clone()
+			named[args[1]] = cur
+			continue
+		}
+		if err := cur.apply(args); err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %w", name, lineno, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if c, ok := named[defaultNetwork]; ok {
+		// the default network can be set up like the others
+		base = c
+		delete(named, defaultNetwork)
+	}
+	return base, named, nil
+}
+
+func (c *netConfig) apply(args []string) error {
+	expect := func(min, max int) error {
+		n := len(args) - 1
+		switch {
+		case min == max && n != min:
+			return fmt.Errorf("%s: expected %d arguments, got %d", args[0], min, n)
+		case n < min || n > max:
+			return fmt.Errorf("%s: expected %d to %d arguments, got %d", args[0], min, max, n)
+		}
+		return nil
+	}
+	ip := func(s string) error {
+		if net.ParseIP(s).To4() == nil {
+			return fmt.Errorf("%s: %q is not an IPv4 address", args[0], s)
+		}
+		return nil
+	}
+	switch args[0] {
+	case "mtu":
+		if err := expect(1, 1); err != nil {
+			return err
+		}
+		mtu, err := strconv.Atoi(args[1])
+		if err != nil || mtu < 576 || mtu > 65535 {
+			return fmt.Errorf("mtu: %q is not between 576 and 65535", args[1])
+		}
+		c.mtu = mtu
+	case "subnet":
+		if err := expect(1, 1); err != nil {
+			return err
+		}
+		if _, _, err := net.ParseCIDR(args[1]); err != nil {
+			return fmt.Errorf("subnet: %w", err)
+		}
+		c.subnet = args[1]
+	case "gateway":
+		if err := expect(1, 2); err != nil {
+			return err
+		}
+		if err := ip(args[1]); err != nil {
+			return err
+		}
+		c.gatewayIP = args[1]
+		if len(args) == 3 {
+			if _, err := net.ParseMAC(args[2]); err != nil {
+				return fmt.Errorf("gateway: %w", err)
+			}
+			c.gatewayMAC = args[2]
+		}
+	case "vip":
+		if err := expect(1, 64); err != nil {
+			return err
+		}
+		for _, v := range args[1:] {
+			if err := ip(v); err != nil {
+				return err
+			}
+		}
+		c.vips = append(c.vips, args[1:]...)
+	case "dns":
+		if err := expect(2, 2); err != nil {
+			return err
+		}
+		if err := ip(args[2]); err != nil {
+			return err
+		}
+		c.records = append(c.records, dnsRecord{name: args[1], ip: args[2]})
+	case "host":
+		if err := expect(1, 2); err != nil {
+			return err
+		}
+		h := dnsRecord{name: args[1]}
+		if len(args) == 3 {
+			if err := ip(args[2]); err != nil {
+				return err
+			}
+			h.ip = args[2]
+		}
+		c.hosts = append(c.hosts, h)
+	case "search":
+		if err := expect(1, 1); err != nil {
+			return err
+		}
+		c.search = append(c.search, strings.Trim(args[1], "."))
+	case "lease":
+		if err := expect(2, 2); err != nil {
+			return err
+		}
+		if _, err := net.ParseMAC(args[1]); err != nil {
+			return fmt.Errorf("lease: %w", err)
+		}
+		if err := ip(args[2]); err != nil {
+			return err
+		}
+		c.leases[args[1]] = args[2]
+	default:
+		return fmt.Errorf("unknown setting %q", args[0])
+	}
+	return nil
+}
+
+// vnetConfig returns the vnet configuration for c.
+func (c *netConfig) vnetConfig() (*vnet.Configuration, error) {
+	_, subnet, err := net.ParseCIDR(c.subnet)
+	if err != nil {
+		return nil, err
+	}
+	if !subnet.Contains(net.ParseIP(c.gatewayIP)) {
+		return nil, fmt.Errorf("gateway %s is not in subnet %s", c.gatewayIP, c.subnet)
+	}
+	cfg := &vnet.Configuration{
+		MTU:               c.mtu,
+		Subnet:            c.subnet,
+		GatewayIP:         c.gatewayIP,
+		GatewayMacAddress: c.gatewayMAC,
+		DNSSearchDomains:  slices.Clone(c.search),
+		DHCPStaticLeases:  make(map[string]string),
+		NAT:               make(map[string]string),
+	}
+	// virtual ips inherited from another subnet are left out
+	for _, ip := range c.vips {
+		if subnet.Contains(net.ParseIP(ip)) {
+			cfg.GatewayVirtualIPs = append(cfg.GatewayVirtualIPs, ip)
+		}
+	}
+	// vnet reserves leases by ip
+	for mac, ip := range c.leases {
+		cfg.DHCPStaticLeases[ip] = mac
+	}
+
+	records := slices.Clone(c.records)
+	for _, h := range c.hosts {
+		ip := h.ip
+		if ip == "" {
+			ip = lastIP(subnet).String()
+		}
+		cfg.NAT[ip] = "127.0.0.1"
+		if !slices.Contains(cfg.GatewayVirtualIPs, ip) {
+			cfg.GatewayVirtualIPs = append(cfg.GatewayVirtualIPs, ip)
+		}
+		records = append(records, dnsRecord{name: h.name, ip: ip})
+	}
+
+	// records are grouped into zones by domain, as vnet serves them
+	zones := make(map[string]*types.Zone)
+	var zoneNames []string
+	for _, r := range records {
+		name := strings.ToLower(strings.Trim(r.name, "."))
+		label, domain, ok := strings.Cut(name, ".")
+		if !ok {
+			domain = defaultZone
+			if !slices.Contains(cfg.DNSSearchDomains, defaultZone) {
+				cfg.DNSSearchDomains = append(cfg.DNSSearchDomains, defaultZone)
+			}
+		}
+		z, ok := zones[domain]
+		if !ok {
+			z = &types.Zone{Name: domain + "."}
+			zones[domain] = z
+			zoneNames = append(zoneNames, domain)
+		}
+		z.Records = append(z.Records, types.Record{Name: label, IP: net.ParseIP(r.ip).To4()})
+	}
+	for _, name := range zoneNames {
+		cfg.DNS = append(cfg.DNS, *zones[name])
+	}
+	return cfg, nil
+}
+
+// lastIP returns the last address in subnet before the broadcast address.
+func lastIP(subnet *net.IPNet) net.IP {
+	ip := slices.Clone(subnet.IP.To4())
+	for i := range ip {
+		ip[i] |= ^subnet.Mask[i]
+	}
+	ip[3]--
+	return ip
+}
+
+// reservedNetworkName reports whether name is taken by an endpoint under
+// the network path.
+func reservedNetworkName(name string) bool {
+	switch "/" + name {
+	case forwardPath, capturePath, statsPath:
+		return true
+	}
+	return false
+}
+
+// networks are the isolated virtual networks of a server, selected by
+// the websocket path VMs connect on. The default network and those in
+// the config always exist, and up to max more are made on demand with
+// the default settings, lasting while VMs are connected or ports are
+// forwarded to them. vnet has no way to stop a network, so a closed one
+// keeps its stack running, and as reusing it would hand its leases and
+// connections to the next, max bounds those made over the server's life.
+type networks struct {
+	base  *netConfig
+	named map[string]*netConfig
+	max   int
+
+	mu   sync.Mutex
+	nets map[string]*network
+	made int // on demand, including closed ones
+}
+
+// network is a virtual network and the clients connected to it.
+type network struct {
+	name     string
+	subnet   string
+	vn       *vnet.VirtualNetwork
+	onDemand bool
+	refs     int // clients and forwards, guarded by networks.mu
+
+	mu      sync.Mutex
+	clients map[*netClient]struct{}
+}
+
+// netClient is a VM connected to a network over a websocket.
+type netClient struct {
+	remote    string
+	origin    string
+	since     time.Time
+	framesIn  atomic.Uint64
+	framesOut atomic.Uint64
+	bytesIn   atomic.Uint64
+	bytesOut  atomic.Uint64
+}
+
+// newNetworks makes the default and configured networks, allowing max
+// more on demand.
+func newNetworks(base *netConfig, named map[string]*netConfig, max int) (*networks, error) {
+	ns := &networks{base: base, named: named, max: max, nets: make(map[string]*network)}
+	if _, err := ns.acquire(defaultNetwork, true); err != nil {
+		return nil, err
+	}
+	for name := range named {
+		if _, err := ns.acquire(name, true); err != nil {
+			return nil, err
+		}
+	}
+	return ns, nil
+}
+
+// acquire returns the named network, making it if it doesn't exist yet
+// and create is set. It's held until released.
+func (ns *networks) acquire(name string, create bool) (*network, error) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if n, ok := ns.nets[name]; ok {
+		n.refs++
+		return n, nil
+	}
+	if !create {
+		return nil, fmt.Errorf("network %s: does not exist", name)
+	}
+	cfg, configured := ns.named[name]
+	if name == defaultNetwork {
+		cfg, configured = ns.base, true
+	}
+	if !configured {
+		if !validNetworkName.MatchString(name) || reservedNetworkName(name) {
+			return nil, fmt.Errorf("network %q: invalid name", name)
+		}
+		if ns.made >= ns.max {
+			return nil, fmt.Errorf("network %s: no more than %d networks can be made on demand", name, ns.max)
+		}
+		cfg = ns.base
+	}
+	vcfg, err := cfg.vnetConfig()
+	if err != nil {
+		return nil, fmt.Errorf("network %s: %w", name, err)
+	}
+	vn, err := vnet.New(vcfg)
+	if err != nil {
+		return nil, fmt.Errorf("network %s: %w", name, err)
+	}
+	n := &network{name: name, subnet: cfg.subnet, vn: vn, onDemand: !configured, refs: 1, clients: make(map[*netClient]struct{})}
+	ns.nets[name] = n
+	if !configured {
+		ns.made++
+		log.Printf("made network %s", name)
+	}
+	return n, nil
+}
+
+// release lets go of a network from acquire. A network made on demand
+// is closed once nothing holds it.
+func (ns *networks) release(n *network) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	n.refs--
+	if !n.onDemand || n.refs > 0 || ns.nets[n.name] != n {
+		return
+	}
+	delete(ns.nets, n.name)
+	log.Printf("closed network %s", n.name)
+}
+
+// connect records a client connecting until the returned func is called.
+func (n *network) connect(r *http.Request) (*netClient, func()) {
+	c := &netClient{remote: r.RemoteAddr, origin: r.Header.Get("Origin"), since: time.Now()}
+	n.mu.Lock()
+	n.clients[c] = struct{}{}
+	n.mu.Unlock()
+	return c, func() {
+		n.mu.Lock()
+		delete(n.clients, c)
+		n.mu.Unlock()
+	}
+}
+
+func (c *netClient) frameIn(size int) {
+	if c != nil {
+		c.framesIn.Add(1)
+		c.bytesIn.Add(uint64(size))
+	}
+}
+
+func (c *netClient) frameOut(size int) {
+	if c != nil {
+		c.framesOut.Add(1)
+		c.bytesOut.Add(uint64(size))
+	}
+}
+
+type networkStats struct {
+	Name          string        `json:"name"`
+	Subnet        string        `json:"subnet"`
+	BytesSent     uint64        `json:"bytesSent"`
+	BytesReceived uint64        `json:"bytesReceived"`
+	Clients       []clientStats `json:"clients"`
+}
+
+type clientStats struct {
+	Remote    string    `json:"remote"`
+	Origin    string    `json:"origin,omitempty"`
+	Since     time.Time `json:"since"`
+	FramesIn  uint64    `json:"framesIn"`
+	FramesOut uint64    `json:"framesOut"`
+	BytesIn   uint64    `json:"bytesIn"`
+	BytesOut  uint64    `json:"bytesOut"`
+}
+
+// stats returns the stats of every network, by name.
+func (ns *networks) stats() []networkStats {
+	ns.mu.Lock()
+	nets := slices.Collect(maps.Values(ns.nets))
+	ns.mu.Unlock()
+	slices.SortFunc(nets, func(a, b *network) int { return strings.Compare(a.name, b.name) })
+
+	stats := []networkStats{}
+	for _, n := range nets {
+		s := networkStats{
+			Name:          n.name,
+			Subnet:        n.subnet,
+			BytesSent:     n.vn.BytesSent(),
+			BytesReceived: n.vn.BytesReceived(),
+			Clients:       []clientStats{},
+		}
+		n.mu.Lock()
+		for c := range n.clients {
+			s.Clients = append(s.Clients, clientStats{
+				Remote:    c.remote,
+				Origin:    c.origin,
+				Since:     c.since,
+				FramesIn:  c.framesIn.Load(),
+				FramesOut: c.framesOut.Load(),
+				BytesIn:   c.bytesIn.Load(),
+				BytesOut:  c.bytesOut.Load(),
+			})
+		}
+		n.mu.Unlock()
+		slices.SortFunc(s.Clients, func(a, b clientStats) int { return a.Since.Compare(b.Since) })
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+// statsHandler serves the stats of the networks as JSON.
+func (ns *networks) statsHandler(ctl control) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ctl.allow(w, r) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(ns.stats())
+	})
+}
@@ -0,0 +1,298 @@
+//go:build !js && !wasm
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func writeNetConfig(t *testing.T, config string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "net.conf")
+	if err := os.WriteFile(name, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestLoadNetConfig(t *testing.T) {
+	base, named, err := loadNetConfig("")
+	if err != nil || len(named) != 0 || base.subnet != defaultNetConfig().subnet {
+		t.Fatalf("expected the default config, got %+v %v %v", base, named, err)
+	}
+
+	base, named, err = loadNetConfig(writeNetConfig(t, `
+# settings for every network
+mtu 9000
+dns db 192.168.127.10
+host laptop
+
+network lab
+subnet 10.0.0.0/24
+gateway 10.0.0.1 02:00:00:00:00:01
+lease 52:54:00:12:34:56 10.0.0.5
+
+network empty
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base.mtu != 9000 || len(base.records) != 1 || len(base.hosts) != 1 {
+		t.Fatalf("unexpected base config: %+v", base)
+	}
+	if len(named) != 2 {
+		t.Fatalf("unexpected networks: %v", named)
+	}
+	lab := named["lab"]
+	if lab.mtu != 9000 || lab.subnet != "10.0.0.0/24" || lab.gatewayIP != "10.0.0.1" || lab.gatewayMAC != "02:00:00:00:00:01" {
+		t.Fatalf("unexpected lab config: %+v", lab)
+	}
+	if lab.leases["52:54:00:12:34:56"] != "10.0.0.5" || len(base.leases) != 0 {
+		t.Fatal("expected the lease on lab only")
+	}
+	if empty := named["empty"]; empty.subnet != base.subnet || len(empty.records) != 1 {
+		t.Fatalf("expected empty to inherit the base config, got %+v", empty)
+	}
+
+	// a network called default sets up the default network
+	base, named, err = loadNetConfig(writeNetConfig(t, "mtu 1400\nnetwork default\nsubnet 10.1.0.0/16\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(named) != 0 || base.subnet != "10.1.0.0/16" || base.mtu != 1400 {
+		t.Fatalf("unexpected default config: %+v %v", base, named)
+	}
+}
+
+func TestLoadNetConfigErrors(t *testing.T) {
+	for _, config := range []string{
+		"mtu 100",
+		"mtu",
+		"subnet 10.0.0.0",
+		"gateway ::1",
+		"gateway 10.0.0.1 nope",
+		"vip 10.0.0.2 bad",
+		"dns db",
+		"host a b c",
+		"lease 52:54:00:12:34:56 nope",
+		"network",
+		"network bad/name",
+		"network forward",
+		"route 10.0.0.0/8",
+	} {
+		_, _, err := loadNetConfig(writeNetConfig(t, "# first\n"+config))
+		if err == nil || !strings.Contains(err.Error(), ".conf:2: ") {
+			t.Errorf("%q: expected an error at line 2, got %v", config, err)
+		}
+	}
+	if _, _, err := loadNetConfig(writeNetConfig(t, "network a\nmtu 1400\nnetwork a\n")); err == nil || !strings.Contains(err.Error(), ".conf:3: network a: already defined") {
+		t.Errorf("expected a second network a to be rejected, got %v", err)
+	}
+	if _, _, err := loadNetConfig(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestVnetConfig(t *testing.T) {
+	c := defaultNetConfig()
+	for _, line := range []string{
+		"vip 192.168.127.50 10.9.9.9",
+		"dns db 192.168.127.10",
+		"dns api.example.com 192.168.127.11",
+		"dns web.example.com. 192.168.127.12",
+		"host laptop",
+		"host printer 192.168.127.60",
+		"search corp.example",
+		"lease 52:54:00:12:34:56 192.168.127.5",
+	} {
+		if err := c.apply(strings.Fields(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg, err := c.vnetConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MTU != 1500 || cfg.Subnet != c.subnet || cfg.GatewayIP != c.gatewayIP {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+	// vips outside the subnet are dropped and hosts get vips
+	if want := []string{"192.168.127.253", "192.168.127.50", "192.168.127.254", "192.168.127.60"}; !slices.Equal(cfg.GatewayVirtualIPs, want) {
+		t.Fatalf("unexpected vips: %v", cfg.GatewayVirtualIPs)
+	}
+	if cfg.NAT["192.168.127.254"] != "127.0.0.1" || cfg.NAT["192.168.127.60"] != "127.0.0.1" || len(cfg.NAT) != 2 {
+		t.Fatalf("unexpected NAT: %v", cfg.NAT)
+	}
+	if cfg.DHCPStaticLeases["192.168.127.5"] != "52:54:00:12:34:56" {
+		t.Fatalf("unexpected leases: %v", cfg.DHCPStaticLeases)
+	}
+	if want := []string{"corp.example", defaultZone}; !slices.Equal(cfg.DNSSearchDomains, want) {
+		t.Fatalf("unexpected search domains: %v", cfg.DNSSearchDomains)
+	}
+
+	zones := make(map[string][]string)
+	for _, z := range cfg.DNS {
+		for _, r := range z.Records {
+			zones[z.Name] = append(zones[z.Name], r.Name+"="+r.IP.String())
+		}
+	}
+	want := map[string][]string{
+		defaultZone + ".": {"db=192.168.127.10", "laptop=192.168.127.254", "printer=192.168.127.60"},
+		"example.com.":    {"api=192.168.127.11", "web=192.168.127.12"},
+	}
+	if len(zones) != len(want) {
+		t.Fatalf("unexpected zones: %v", zones)
+	}
+	for name, records := range want {
+		if !slices.Equal(zones[name], records) {
+			t.Errorf("zone %s: got %v, want %v", name, zones[name], records)
+		}
+	}
+
+	c = defaultNetConfig()
+	c.subnet = "10.0.0.0/24"
+	if _, err := c.vnetConfig(); err == nil {
+		t.Fatal("expected an error for a gateway outside the subnet")
+	}
+}
+
+func TestLastIP(t *testing.T) {
+	for cidr, want := range map[string]string{
+		"192.168.127.0/24": "192.168.127.254",
+		"10.0.0.0/8":       "10.255.255.254",
+		"10.1.2.0/23":      "10.1.3.254",
+		"172.16.5.64/26":   "172.16.5.126",
+	} {
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := lastIP(subnet).String(); got != want {
+			t.Errorf("lastIP(%s) = %s, want %s", cidr, got, want)
+		}
+	}
+}
+
+func TestNetworksOnDemand(t *testing.T) {
+	ns, err := newNetworks(defaultNetConfig(), map[string]*netConfig{"lab": defaultNetConfig()}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := ns.acquire("a", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := ns.acquire("a", true); err != nil || again != a {
+		t.Fatalf("expected the same network, got %v", err)
+	}
+
+	// a tenant leaves a port open on the network
+	l, err := a.vn.Listen("tcp", "192.168.127.1:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// held twice, so it's only closed once both let go
+	ns.release(a)
+	if _, err := ns.acquire("a", false); err != nil {
+		t.Fatal("expected a to still exist")
+	}
+	ns.release(a)
+	ns.release(a)
+	if _, err := ns.acquire("a", false); err == nil {
+		t.Fatal("expected a to be closed")
+	}
+
+	// the next network gets a stack of its own, with nothing left over
+	b, err := ns.acquire("a", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b == a || b.vn == a.vn {
+		t.Fatal("expected a new stack")
+	}
+	l2, err := b.vn.Listen("tcp", "192.168.127.1:8080")
+	if err != nil {
+		t.Fatalf("expected no leftover listener: %v", err)
+	}
+	l2.Close()
+	def, err := ns.acquire(defaultNetwork, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := leases(t, b), leases(t, def); got != want {
+		t.Fatalf("expected no leftover leases, got %s, want %s", got, want)
+	}
+	ns.release(def)
+
+	// closed networks still count, as their stacks keep running
+	if _, err := ns.acquire("c", true); err == nil {
+		t.Fatal("expected no more than 2 networks on demand")
+	}
+	ns.release(b)
+
+	// configured networks are never closed
+	for _, name := range []string{defaultNetwork, "lab"} {
+		n, err := ns.acquire(name, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ns.release(n)
+		ns.release(n)
+		if _, err := ns.acquire(name, false); err != nil {
+			t.Fatalf("expected %s to stay", name)
+		}
+	}
+}
+
+// leases returns the DHCP leases of n as vnet reports them.
+func leases(t *testing.T, n *network) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	n.vn.Mux().ServeHTTP(w, httptest.NewRequest("GET", "/leases", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("leases: status %d", w.Code)
+	}
+	return w.Body.String()
+}
+
+func TestForwardHoldsNetwork(t *testing.T) {
+	ns, err := newNetworks(defaultNetConfig(), nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newForwarder(ns)
+	if err := f.add("127.0.0.1:0", "192.168.127.2:80", "demo"); err == nil {
+		t.Fatal("expected forwarding to a missing network to fail")
+	}
+
+	n, err := ns.acquire("demo", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.add("127.0.0.1:0", "192.168.127.2:80", "demo"); err != nil {
+		t.Fatal(err)
+	}
+	// the client leaving doesn't close a network ports are forwarded to
+	ns.release(n)
+	if _, err := ns.acquire("demo", false); err != nil {
+		t.Fatal("expected the forward to hold the network")
+	}
+	ns.release(n)
+
+	if err := f.remove("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ns.acquire("demo", false); err == nil {
+		t.Fatal("expected the network to close with its last forward")
+	}
+}
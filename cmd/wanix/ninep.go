@@ -0,0 +1,184 @@
+//go:build !js && !wasm
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"tractor.dev/toolkit-go/engine/cli"
+	"tractor.dev/wanix"
+	"tractor.dev/wanix/fs"
+	"tractor.dev/wanix/fs/p9kit"
+	"tractor.dev/wanix/task"
+)
+
+func ninepCmd() *cli.Command {
+	cmd := &cli.Command{
+		Usage: "9p",
+		Short: "9P file service",
+	}
+	cmd.AddCommand(ninepServeCmd())
+	return cmd
+}
+
+func ninepServeCmd() *cli.Command {
+	var (
+		listenAddr string
+		taskID     string
+		nsFile     string
+		caps       capFlags
+		clone      bool
+		publish    string
+		keyFile    string
+	)
+	cmd := &cli.Command{
+		Usage: "serve",
+		Short: "serve the kernel namespace over 9P",
+		Run: func(ctx *cli.Context, args []string) {
+			log.SetFlags(log.Ltime | log.Lmicroseconds | log.Lshortfile)
+
+			k := wanix.New()
+			k.Cap.Register("hostdir", hostdirAllocator())
+
+			t, err := k.NewRoot()
+			fatal(err)
+
+			if nsFile != "" {
+				fatal(loadNamespace(t, nsFile))
+			} else {
+				t.Bind("#cap", "cap")
+				t.Bind("#task", "task")
+			}
+			fatal(applyCaps(t, caps))
+
+			if taskID != "" {
+				var ok bool
+				t, ok = k.Task.Get(taskID)
+				if !ok {
+					fatal(fmt.Errorf("no task with id %s", taskID))
+				}
+			}
+
+			var keys p9kit.KeyFunc
+			if keyFile != "" {
+				key, err := os.ReadFile(keyFile)
+				fatal(err)
+				keys = p9kit.PSK(bytes.TrimSpace(key))
+			}
+
+			network, addr := "tcp", listenAddr
+			if path, ok := strings.CutPrefix(listenAddr, "unix:"); ok {
+				network, addr = "unix", path
+				// remove a socket left behind by an earlier run
+				os.Remove(addr)
+			}
+			l, err := net.Listen(network, addr)
+			fatal(err)
+
+			sigChan := make(chan os.Signal, 1)
+			signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+			go func() {
+				<-sigChan
+				l.Close()
+			}()
+
+			fmt.Printf("serving 9P on %s:%s ...\n", network, l.Addr())
+
+			srv := &ninepServer{k: k, task: t, clone: clone, keys: keys, publish: publish}
+			fatal(srv.serve(l))
+		},
+	}
+	cmd.Flags().StringVar(&listenAddr, "listen", "localhost:5640", "tcp addr or unix:<path> to serve on")
+	cmd.Flags().StringVar(&taskID, "task", "", "id of the task whose namespace to serve, by default the root task")
+	cmd.Flags().StringVar(&nsFile, "ns", "", "namespace description file to set up instead of binding cap and task")
+	cmd.Flags().Var(&caps, "cap", "\"<type> <path> [args...]\" cap to allocate and bind, may be repeated")
+	cmd.Flags().BoolVar(&clone, "clone", false, "serve each client a fresh clone of the namespace")
+	cmd.Flags().StringVar(&keyFile, "key-file", "", "file holding a pre-shared key clients must authenticate with")
+	cmd.Flags().StringVar(&publish, "publish", "", "comma separated aname=path subtrees to serve by attach name")
+	return cmd
+}
+
+// ninepServer serves the namespace of a task to each client that
+// connects, or a clone of it per client if clone is set. Clients share
+// the namespace otherwise, so bindings one makes are seen by the others.
+type ninepServer struct {
+	k       *wanix.K
+	task    *task.Resource
+	clone   bool
+	keys    p9kit.KeyFunc
+	publish string
+}
+
+// serve accepts clients on l until it's closed.
+func (s *ninepServer) serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Println(err)
+			continue
+		}
+		ns := s.task.Namespace()
+		free := func() {}
+		if s.clone {
+			// each client gets its own task so bindings don't leak between them
+			ct, err := s.k.Task.Alloc("ns", s.task)
+			if err != nil {
+				log.Println(err)
+				conn.Close()
+				continue
+			}
+			ns = ct.Namespace()
+			free = func() { s.k.Task.Free(ct.ID()) }
+		}
+		srv := p9kit.NewServer(ns)
+		if s.keys != nil {
+			srv.RequireAuth(s.keys)
+		}
+		if err := publishTrees(srv, ns, s.publish); err != nil {
+			log.Println(err)
+			conn.Close()
+			free()
+			continue
+		}
+		go func() {
+			defer free()
+			defer conn.Close()
+			if err := srv.Handle(conn, conn); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+}
+
+// publishTrees publishes each aname=path pair in spec as a subtree of ns.
+func publishTrees(srv *p9kit.Server, ns fs.FS, spec string) error {
+	if spec == "" {
+		return nil
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		aname, name, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("bad publish entry %q, expected aname=path", pair)
+		}
+		if name = strings.Trim(name, "/"); name == "" {
+			name = "."
+		}
+		sub, err := fs.Sub(ns, name)
+		if err != nil {
+			return err
+		}
+		srv.Publish(aname, sub)
+	}
+	return nil
+}
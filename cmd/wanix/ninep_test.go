@@ -0,0 +1,111 @@
+//go:build !js && !wasm
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"tractor.dev/wanix"
+	"tractor.dev/wanix/fs"
+	"tractor.dev/wanix/fs/p9kit"
+)
+
+// startNinep serves a root namespace binding cap and task on a loopback
+// port, returning the root task's ctl file and a func to dial a client.
+func startNinep(t *testing.T) (string, func() fs.FS) {
+	t.Helper()
+	k := wanix.New()
+	root, err := k.NewRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root.Bind("#cap", "cap")
+	root.Bind("#task", "task")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	srv := &ninepServer{k: k, task: root}
+	go srv.serve(l)
+
+	return path.Join("task", root.ID(), "ctl"), func() fs.FS {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		fsys, err := p9kit.ClientFS(conn, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fsys
+	}
+}
+
+func writeCtl(fsys fs.FS, name, cmd string) error {
+	f, err := fs.OpenFile(fsys, name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := fs.Write(f, []byte(cmd)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func TestNinepSharedNamespace(t *testing.T) {
+	ctl, dial := startNinep(t)
+
+	// clients bind and unbind in the namespace they share while the
+	// other walks it, which the race detector checks
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := range 2 {
+		fsys := dial()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := fmt.Sprintf("c%d", i)
+			for range 20 {
+				if err := writeCtl(fsys, ctl, "bind #cap "+name); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := fs.ReadDir(fsys, "task"); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := fs.Stat(fsys, name); err != nil {
+					errs <- err
+					return
+				}
+				if err := writeCtl(fsys, ctl, "unbind #cap "+name); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// bindings are seen by every client
+	a, b := dial(), dial()
+	if err := writeCtl(a, ctl, "bind #cap shared"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(b, "shared"); err != nil {
+		t.Fatalf("expected the binding to be shared: %v", err)
+	}
+}
@@ -3,22 +3,28 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"path"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/progrium/go-netstack/vnet"
 
 	"tractor.dev/toolkit-go/engine/cli"
 	"tractor.dev/wanix/external/linux"
 	v86 "tractor.dev/wanix/external/v86"
+	"tractor.dev/wanix/fs"
 	"tractor.dev/wanix/fs/fskit"
 	"tractor.dev/wanix/shell"
 	"tractor.dev/wanix/wasm/assets"
@@ -26,7 +32,25 @@ import (
 
 func serveCmd() *cli.Command {
 	var (
-		listenAddr string
+		listenAddr     string
+		netListen      string
+		netPath        string
+		netConfigFile  string
+		netMax         int
+		forwardSpec    string
+		forwardPublic  bool
+		controlToken   string
+		captureFile    string
+		captureKeep    int
+		prefix         string
+		tlsCert        string
+		tlsKey         string
+		selfSigned     bool
+		headersFile    string
+		allowedOrigins string
+		devMode        bool
+		overlaySpec    string
+		rebuildShell   bool
 	)
 	cmd := &cli.Command{
 		Usage: "serve",
@@ -34,23 +58,127 @@ func serveCmd() *cli.Command {
 		Run: func(ctx *cli.Context, args []string) {
 			log.SetFlags(log.Ltime | log.Lmicroseconds | log.Lshortfile)
 
-			h, p, _ := net.SplitHostPort(listenAddr)
-			if h == "" {
-				h = "localhost"
+			prefix = "/" + strings.Trim(prefix, "/")
+			if prefix != "/" {
+				prefix += "/"
+			}
+
+			var tlsConfig *tls.Config
+			switch {
+			case tlsCert != "" || tlsKey != "":
+				cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+				fatal(err)
+				tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+			case selfSigned:
+				cert, err := selfSignedCert()
+				fatal(err)
+				fmt.Printf("using self-signed certificate with SHA-256 fingerprint %s\n", certFingerprint(cert))
+				tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+			}
+
+			headers := http.Header{
+				"Cross-Origin-Opener-Policy":   {"same-origin"},
+				"Cross-Origin-Embedder-Policy": {"require-corp"},
+			}
+			if headersFile != "" {
+				fatal(loadHeaders(headers, headersFile))
+			}
+
+			origins := parseOrigins(allowedOrigins)
+
+			// the control endpoints are served with the network, and
+			// only trust this host without a token, which a listener
+			// other hosts reach or a reverse proxy in front would break
+			ctlAddr := netListen
+			if netPath != "" {
+				ctlAddr = listenAddr
+			}
+			if controlToken == "" && (netPath != "" || !isLoopback(ctlAddr)) {
+				fatal(fmt.Errorf("serving the network on %s needs --control-token, or use --net-listen on a loopback address", ctlAddr))
 			}
-			fmt.Printf("serving on http://%s:%s ...\n", h, p)
 
-			fsys := fskit.UnionFS{assets.Dir, fskit.MapFS{
+			var fsys fs.FS = fskit.UnionFS{assets.Dir, fskit.MapFS{
 				"v86":   v86.Dir,
 				"linux": linux.Dir,
 				"shell": shell.Dir,
 			}}
 
-			go serveNetwork()
+			mux := http.NewServeMux()
 
-			http.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				w.Header().Add("Cross-Origin-Opener-Policy", "same-origin")
-				w.Header().Add("Cross-Origin-Embedder-Policy", "require-corp")
+			// pages default to the network at its own listener, so
+			// they're told where it is when it's under the prefix
+			var netScript string
+			if netPath != "" {
+				netScript = networkScript(path.Join(prefix, netPath))
+			}
+
+			var dev *devServer
+			if devMode {
+				overlays := defaultOverlays()
+				if overlaySpec != "" {
+					var err error
+					overlays, err = parseOverlays(overlaySpec)
+					fatal(err)
+				}
+				var err error
+				dev, err = newDevServer(fsys, overlays, rebuildShell)
+				fatal(err)
+				dev.reloadURL = path.Join(prefix, reloadPath)
+				dev.headScript = netScript
+				fsys = dev.fsys
+				for _, o := range overlays {
+					fmt.Printf("overlaying %s at /%s\n", o.dir, o.prefix)
+				}
+				go dev.watch()
+				mux.Handle(dev.reloadURL, dev)
+			}
+
+			base, named, err := loadNetConfig(netConfigFile)
+			fatal(err)
+			nets, err := newNetworks(base, named, netMax)
+			fatal(err)
+			fwd := newForwarder(nets)
+			fwd.public = forwardPublic
+			forwards, err := parseForwards(forwardSpec)
+			fatal(err)
+			for _, f := range forwards {
+				fatal(fwd.add(f.host, f.guest, f.network))
+			}
+			var pcap *capture
+			if captureFile != "" || captureKeep > 0 {
+				pcap, err = newCapture(captureFile, captureKeep)
+				fatal(err)
+			}
+
+			netmux := mux
+			netPrefix := path.Join(prefix, netPath)
+			if netPath == "" {
+				netmux = http.NewServeMux()
+				netPrefix = "/"
+			}
+			vms := handler(nets, netPrefix, origins, pcap)
+			netmux.Handle(netPrefix, vms)
+			if netPrefix != "/" {
+				netmux.Handle(netPrefix+"/", vms)
+			}
+			ctl := control{origins: origins, token: controlToken, host: listenHost(ctlAddr)}
+			netmux.Handle(path.Join(netPrefix, statsPath), nets.statsHandler(ctl))
+			netmux.Handle(path.Join(netPrefix, forwardPath), fwd.handler(ctl))
+			if pcap != nil {
+				netmux.Handle(path.Join(netPrefix, capturePath), pcap.handler(ctl))
+			}
+			if netPath == "" {
+				go serveNetwork(netListen, netmux, tlsConfig)
+			}
+
+			files := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if dev != nil && dev.serveFile(w, r) {
+					return
+				}
+
+				if netScript != "" && servePage(w, r, fsys, netScript, "") {
+					return
+				}
 
 				if r.URL.Path == "/wanix.bundle.js" {
 					w.Header().Add("Content-Type", "text/javascript")
@@ -59,61 +187,236 @@ func serveCmd() *cli.Command {
 				}
 
 				http.FileServerFS(fsys).ServeHTTP(w, r)
-			}))
-			http.ListenAndServe(listenAddr, nil)
+			})
+			mux.Handle(prefix, http.StripPrefix(strings.TrimSuffix(prefix, "/"), files))
+
+			server := &http.Server{
+				Addr:      listenAddr,
+				Handler:   withHeaders(mux, headers),
+				TLSConfig: tlsConfig,
+			}
+
+			scheme := "http"
+			if tlsConfig != nil {
+				scheme = "https"
+			}
+			h, p, _ := net.SplitHostPort(listenAddr)
+			if h == "" {
+				h = "localhost"
+			}
+			fmt.Printf("serving on %s://%s%s ...\n", scheme, net.JoinHostPort(h, p), prefix)
+			if netPath != "" {
+				fmt.Printf("network on %s\n", path.Join(prefix, netPath))
+			}
+
+			if tlsConfig != nil {
+				fatal(server.ListenAndServeTLS("", ""))
+			} else {
+				fatal(server.ListenAndServe())
+			}
 		},
 	}
+	netDefault := "localhost:8777"
+	if os.Getenv("NET_LISTEN") != "" {
+		netDefault = os.Getenv("NET_LISTEN")
+	}
 	cmd.Flags().StringVar(&listenAddr, "listen", ":7654", "addr to serve on")
+	cmd.Flags().StringVar(&netListen, "net-listen", netDefault, "addr to serve the network websocket on, defaulting to $NET_LISTEN if set, which needs --control-token if not a loopback address")
+	cmd.Flags().StringVar(&netPath, "net-path", "", "path under the prefix to serve the network websocket on instead of a separate listener, which needs --control-token")
+	cmd.Flags().StringVar(&netConfigFile, "net-config", "", "file setting the MTU, subnet, gateway, DNS records, host aliases and named networks of the virtual network")
+	cmd.Flags().IntVar(&netMax, "net-max", 16, "number of isolated networks that can be made on demand, one per websocket path under the network, closed when unused, though their stacks can't be stopped so closing one doesn't free it")
+	cmd.Flags().StringVar(&forwardSpec, "forward", "", "comma separated \"<host:port>=<guestip:port>[@<network>]\" guest ports to expose on the host, also controlled at "+forwardPath+" under the network")
+	cmd.Flags().BoolVar(&forwardPublic, "forward-public", false, "allow forwards to listen on addresses other than loopback ones")
+	cmd.Flags().StringVar(&controlToken, "control-token", "", "token required to use "+forwardPath+", "+capturePath+" and "+statsPath+" under the network, which are otherwise only served to this host, and are only served for loopback names, the listen host or hosts of --allowed-origins")
+	cmd.Flags().StringVar(&captureFile, "capture", "", "pcapng file to capture the Ethernet frames of the network to")
+	cmd.Flags().IntVar(&captureKeep, "capture-buffer", 0, "number of recent frames to keep for download at "+capturePath+" under the network")
+	cmd.Flags().StringVar(&prefix, "prefix", "/", "path prefix to serve under, such as behind a reverse proxy")
+	cmd.Flags().StringVar(&tlsCert, "tls-cert", "", "TLS certificate file to serve HTTPS with")
+	cmd.Flags().StringVar(&tlsKey, "tls-key", "", "TLS key file for the certificate")
+	cmd.Flags().BoolVar(&selfSigned, "tls-self-signed", false, "serve HTTPS with a generated self-signed certificate, for testing on a LAN")
+	cmd.Flags().StringVar(&headersFile, "headers", "", "file of \"Name: value\" lines to add to responses, where an empty value removes a default header")
+	cmd.Flags().StringVar(&allowedOrigins, "allowed-origins", "", "comma separated origins allowed to open websockets, which may use * like https://*.example.com, by default any")
+	cmd.Flags().BoolVar(&devMode, "dev", false, "serve overlays from disk and reload pages when they change")
+	cmd.Flags().StringVar(&overlaySpec, "overlay", "", "comma separated \"[<prefix>=]<dir>\" directories to overlay in dev mode, by default the sources in a checkout")
+	cmd.Flags().BoolVar(&rebuildShell, "rebuild-shell", false, "in dev mode, rebuild shell.tgz with the bin and etc files of the shell overlay")
 	return cmd
 }
 
-func serveNetwork() {
-	vn, err := vnet.New(&vnet.Configuration{
-		Debug:             false,
-		MTU:               1500,
-		Subnet:            "192.168.127.0/24",
-		GatewayIP:         "192.168.127.1",
-		GatewayMacAddress: "5a:94:ef:e4:0c:dd",
-		GatewayVirtualIPs: []string{"192.168.127.253"},
-	})
+// loadHeaders sets the headers in the file at name, one "Name: value"
+// per line, in headers. A header with an empty value is removed.
+func loadHeaders(headers http.Header, name string) error {
+	f, err := os.Open(name)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer f.Close()
 
-	addr := ":8777"
-	if os.Getenv("NET_LISTEN") != "" {
-		addr = os.Getenv("NET_LISTEN")
+	lineno := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" {
+			return fmt.Errorf("%s:%d: expected \"Name: value\"", name, lineno)
+		}
+		if value == "" {
+			headers.Del(key)
+		} else {
+			headers.Set(key, value)
+		}
+	}
+	return scanner.Err()
+}
+
+// networkScript is added to the head of pages to default the network
+// option of Wanix to url.
+func networkScript(url string) string {
+	u, _ := json.Marshal(url)
+	return `<script>{const W = window.Wanix; window.Wanix = class extends W { constructor(config = {}) { super({network: ` + string(u) + `, ...config}); } };}</script>`
+}
+
+// servePage serves the HTML page of r from fsys with head added to the
+// end of its head and body to the end of its body. It reports whether
+// it served the request.
+func servePage(w http.ResponseWriter, r *http.Request, fsys fs.FS, head, body string) bool {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if name == "" || strings.HasSuffix(name, "/") {
+		name += "index.html"
+	}
+	if path.Ext(name) != ".html" {
+		return false
+	}
+	page, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return false
+	}
+	// the head script has to run after the bundle script in the head,
+	// so a page without a head doesn't get it
+	if i := bytes.Index(page, []byte("</head>")); i >= 0 && head != "" {
+		page = slices.Insert(page, i, []byte(head)...)
 	}
+	if i := bytes.LastIndex(page, []byte("</body>")); i >= 0 {
+		page = slices.Insert(page, i, []byte(body)...)
+	} else {
+		page = append(page, body...)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page)
+	return true
+}
+
+// withHeaders adds headers to every response of h.
+func withHeaders(h http.Handler, headers http.Header) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range headers {
+			w.Header()[k] = v
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// origins are patterns of origins allowed to open websockets. None
+// allows any.
+type origins []string
+
+// parseOrigins parses a comma separated list of origin patterns.
+func parseOrigins(spec string) origins {
+	var o origins
+	for _, pattern := range strings.Split(spec, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			o = append(o, strings.TrimSuffix(pattern, "/"))
+		}
+	}
+	return o
+}
+
+// allow reports whether the origin of r is allowed.
+func (o origins) allow(r *http.Request) bool {
+	if len(o) == 0 {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	for _, pattern := range o {
+		if ok, _ := path.Match(pattern, origin); ok {
+			return true
+		}
+	}
+	log.Printf("rejected websocket from origin %q", origin)
+	return false
+}
+
+// listenHost is the host of the listen address addr, or empty if it
+// listens on every address.
+func listenHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return ""
+	}
+	return host
+}
+
+func serveNetwork(addr string, h http.Handler, tlsConfig *tls.Config) {
 	if strings.HasPrefix(addr, ":") {
 		addr = "0.0.0.0" + addr
 	}
-	if err := http.ListenAndServe(addr, handler(vn)); err != nil {
+	server := &http.Server{Addr: addr, Handler: h, TLSConfig: tlsConfig}
+	var err error
+	if tlsConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func handler(vn *vnet.VirtualNetwork) http.Handler {
+// handler connects VMs to the network named by the websocket path under
+// prefix, or the default network at prefix itself.
+func handler(nets *networks, prefix string, origins origins, pcap *capture) http.Handler {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     origins.allow,
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if vn == nil {
-			http.Error(w, "network not available", http.StatusNotFound)
-			return
+		name := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		if name == "" {
+			name = defaultNetwork
 		}
 		if !websocket.IsWebSocketUpgrade(r) {
 			http.Error(w, "expecting websocket upgrade", http.StatusBadRequest)
 			return
 		}
 
+		n, err := nets.acquire(name, true)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		defer nets.release(n)
+
 		ws, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			// the upgrader has already replied with the error
 			log.Println(err)
 			return
 		}
 		defer ws.Close()
 
-		fmt.Println("network session started")
+		client, disconnect := n.connect(r)
+		defer disconnect()
+		fmt.Printf("network session started on %s\n", n.name)
 
-		if err := vn.AcceptQemu(r.Context(), &qemuAdapter{Conn: ws}); err != nil {
+		if err := n.vn.AcceptQemu(r.Context(), &qemuAdapter{Conn: ws, network: n.name, client: client, capture: pcap}); err != nil {
 			if strings.Contains(err.Error(), "websocket: close") {
 				return
 			}
@@ -123,16 +426,11 @@ func handler(vn *vnet.VirtualNetwork) http.Handler {
 	})
 }
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
-
 type qemuAdapter struct {
 	*websocket.Conn
+	network     string
+	client      *netClient
+	capture     *capture
 	mu          sync.Mutex
 	readBuffer  []byte
 	writeBuffer []byte
@@ -145,6 +443,8 @@ func (q *qemuAdapter) Read(p []byte) (n int, err error) {
 		if err != nil {
 			return 0, err
 		}
+		q.client.frameIn(len(message))
+		q.capture.frame(q.network, inbound, message)
 		length := uint32(len(message))
 		lengthPrefix := make([]byte, 4)
 		binary.BigEndian.PutUint32(lengthPrefix, length)
@@ -179,6 +479,8 @@ func (q *qemuAdapter) Write(p []byte) (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	q.client.frameOut(int(length))
+	q.capture.frame(q.network, outbound, q.writeBuffer[4:4+length])
 
 	q.writeBuffer = q.writeBuffer[4+length:]
 	return len(p), nil
@@ -0,0 +1,96 @@
+//go:build !js && !wasm
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tractor.dev/wanix/fs/fskit"
+)
+
+func TestLoadHeaders(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "headers")
+	if err := os.WriteFile(name, []byte(`
+# comment
+Cross-Origin-Embedder-Policy:
+X-Frame-Options: DENY
+  cache-control :  no-store  
+Content-Security-Policy: default-src 'self'; img-src https://example.com
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	headers := http.Header{
+		"Cross-Origin-Opener-Policy":   {"same-origin"},
+		"Cross-Origin-Embedder-Policy": {"require-corp"},
+	}
+	if err := loadHeaders(headers, name); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"Cross-Origin-Opener-Policy": "same-origin",
+		"X-Frame-Options":            "DENY",
+		"Cache-Control":              "no-store",
+		"Content-Security-Policy":    "default-src 'self'; img-src https://example.com",
+	}
+	if len(headers) != len(want) {
+		t.Fatalf("unexpected headers: %v", headers)
+	}
+	for k, v := range want {
+		if got := headers.Get(k); got != v {
+			t.Errorf("%s: got %q, want %q", k, got, v)
+		}
+	}
+
+	for _, bad := range []string{"X-Frame-Options DENY", ": value"} {
+		if err := os.WriteFile(name, []byte("Ok: 1\n"+bad+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := loadHeaders(http.Header{}, name)
+		if err == nil || !strings.HasPrefix(err.Error(), name+":2: ") {
+			t.Errorf("%q: expected an error at line 2, got %v", bad, err)
+		}
+	}
+
+	if err := loadHeaders(http.Header{}, filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+}
+
+func TestServePage(t *testing.T) {
+	fsys := fskit.MapFS{
+		"index.html":     fskit.RawNode([]byte("<html><head><script src=b.js></script></head><body>hi</body></html>")),
+		"bare.html":      fskit.RawNode([]byte("hi")),
+		"app.js":         fskit.RawNode([]byte("js")),
+		"sub/index.html": fskit.RawNode([]byte("<head></head><body>sub</body>")),
+	}
+	head := networkScript("/wanix/.net")
+	for _, tt := range []struct {
+		path string
+		want string // empty if not served
+	}{
+		{"/", "<html><head><script src=b.js></script>" + head + "</head><body>hi<b></b></body></html>"},
+		{"/index.html", "<html><head><script src=b.js></script>" + head + "</head><body>hi<b></b></body></html>"},
+		{"/sub/", "<head>" + head + "</head><body>sub<b></b></body>"},
+		{"/bare.html", "hi<b></b>"},
+		{"/app.js", ""},
+		{"/missing.html", ""},
+	} {
+		rec := httptest.NewRecorder()
+		served := servePage(rec, httptest.NewRequest("GET", tt.path, nil), fsys, head, "<b></b>")
+		if served != (tt.want != "") {
+			t.Fatalf("%s: served = %v", tt.path, served)
+		}
+		if served && rec.Body.String() != tt.want {
+			t.Fatalf("%s: unexpected page: %s", tt.path, rec.Body)
+		}
+	}
+
+	if script := networkScript(`/a"</script>`); strings.Contains(script, `a"<`) {
+		t.Fatalf("expected the url to be escaped, got %s", script)
+	}
+}
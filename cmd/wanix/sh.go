@@ -0,0 +1,654 @@
+//go:build !js && !wasm
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/term"
+	"tractor.dev/toolkit-go/engine/cli"
+	"tractor.dev/wanix"
+	"tractor.dev/wanix/fs"
+	"tractor.dev/wanix/task"
+)
+
+func shCmd() *cli.Command {
+	var (
+		nsFile  string
+		caps    capFlags
+		command string
+	)
+	cmd := &cli.Command{
+		Usage: "sh",
+		Short: "shell over the kernel namespace",
+		Long: "Boots a kernel and runs commands against the namespace of its root task, " +
+			"interactively on a terminal, or from -c, a script file argument or stdin. " +
+			"Type help for the commands.",
+		Run: func(ctx *cli.Context, args []string) {
+			log.SetFlags(log.Ltime | log.Lmicroseconds | log.Lshortfile)
+
+			k := wanix.New()
+			k.Cap.Register("hostdir", hostdirAllocator())
+
+			root, err := k.NewRoot()
+			fatal(err)
+
+			if nsFile != "" {
+				fatal(loadNamespace(root, nsFile))
+			} else {
+				root.Bind("#cap", "cap")
+				root.Bind("#task", "task")
+			}
+			fatal(applyCaps(root, caps))
+
+			sh := &nsShell{t: root, cwd: "."}
+			switch {
+			case command != "":
+				os.Exit(sh.runScript(strings.NewReader(command), os.Stdout, os.Stderr))
+			case len(args) > 0:
+				f, err := os.Open(args[0])
+				fatal(err)
+				defer f.Close()
+				os.Exit(sh.runScript(f, os.Stdout, os.Stderr))
+			case term.IsTerminal(int(os.Stdin.Fd())):
+				fatal(sh.interactive())
+			default:
+				os.Exit(sh.runScript(os.Stdin, os.Stdout, os.Stderr))
+			}
+		},
+	}
+	cmd.Flags().StringVar(&nsFile, "ns", "", "namespace description file to set up instead of binding cap and task")
+	cmd.Flags().Var(&caps, "cap", "\"<type> <path> [args...]\" cap to allocate and bind, may be repeated")
+	cmd.Flags().StringVar(&command, "c", "", "commands to run instead of reading them")
+	return cmd
+}
+
+// nsShell runs commands against the namespace of a task.
+type nsShell struct {
+	t   *task.Resource
+	cwd string // fs path of the working directory
+
+	term *term.Terminal // set when interactive
+}
+
+type shCommand struct {
+	name  string
+	usage string
+	run   func(sh *nsShell, args []string, out io.Writer) error
+}
+
+// maxTreeDepth is how deep tree goes by default, since namespaces can
+// contain themselves, like task/<id>/ns.
+const maxTreeDepth = 3
+
+var shCommands []shCommand
+
+func init() {
+	// set in init since help refers to the table
+	shCommands = []shCommand{
+		{"ls", "ls [-l] [path...]", (*nsShell).ls},
+		{"cat", "cat path...", (*nsShell).cat},
+		{"echo", "echo [arg...]", (*nsShell).echo},
+		{"bind", "bind [-a|-b|-r] src dst", (*nsShell).bind},
+		{"unbind", "unbind src dst", (*nsShell).unbind},
+		{"mkdir", "mkdir [-p] path...", (*nsShell).mkdir},
+		{"rm", "rm [-r] path...", (*nsShell).rm},
+		{"cp", "cp src dst", (*nsShell).cp},
+		{"tree", "tree [-L depth] [path]", (*nsShell).tree},
+		{"cd", "cd [path]", (*nsShell).cd},
+		{"pwd", "pwd", (*nsShell).pwd},
+		{"help", "help", (*nsShell).help},
+	}
+}
+
+// runScript runs each line of r, returning the exit status: 0 if every
+// command succeeded, otherwise 1.
+func (sh *nsShell) runScript(r io.Reader, stdout, stderr io.Writer) int {
+	status := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if err := sh.exec(scanner.Text(), stdout); err != nil {
+			if errors.Is(err, errExit) {
+				break
+			}
+			fmt.Fprintln(stderr, err)
+			status = 1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return status
+}
+
+// interactive reads commands from the terminal on stdin until exit or
+// end of input.
+func (sh *nsShell) interactive() error {
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+
+	sh.term = term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "")
+	sh.term.AutoCompleteCallback = sh.complete
+	for {
+		sh.term.SetPrompt(sh.display(sh.cwd) + "% ")
+		line, err := sh.term.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := sh.exec(line, sh.term); err != nil {
+			if errors.Is(err, errExit) {
+				return nil
+			}
+			fmt.Fprintln(sh.term, err)
+		}
+	}
+}
+
+var errExit = errors.New("exit")
+
+// exec runs a command line, writing its output to out unless the line
+// redirects it into a file with > or >>.
+func (sh *nsShell) exec(line string, out io.Writer) error {
+	args, redirect, appending, err := splitLine(line)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		if redirect != "" {
+			return errors.New("missing command")
+		}
+		return nil
+	}
+	if args[0] == "exit" {
+		return errExit
+	}
+	i := slices.IndexFunc(shCommands, func(c shCommand) bool { return c.name == args[0] })
+	if i < 0 {
+		return fmt.Errorf("%s: unknown command", args[0])
+	}
+	if redirect == "" {
+		return sh.run(shCommands[i], args[1:], out)
+	}
+
+	// output is collected and written at once, so a ctl file gets the
+	// whole command in one write
+	var buf strings.Builder
+	if err := sh.run(shCommands[i], args[1:], &buf); err != nil {
+		return err
+	}
+	if err := sh.writeFile(redirect, []byte(buf.String()), appending); err != nil {
+		return fmt.Errorf("%s: %w", redirect, err)
+	}
+	return nil
+}
+
+func (sh *nsShell) run(c shCommand, args []string, out io.Writer) error {
+	if err := c.run(sh, args, out); err != nil {
+		return fmt.Errorf("%s: %w", c.name, err)
+	}
+	return nil
+}
+
+// writeFile writes data to the named file, appending if asked.
+func (sh *nsShell) writeFile(name string, data []byte, appending bool) error {
+	ns := sh.t.Namespace()
+	name = sh.abs(name)
+	if !appending {
+		return fs.WriteFile(ns, name, data, 0644)
+	}
+	f, err := fs.OpenFile(ns, name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	// files opened without OpenFile support start at the beginning
+	fs.Seek(f, 0, io.SeekEnd)
+	_, err = fs.Write(f, data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// abs returns the fs path of a shell path, which is absolute when it
+// starts with / and otherwise relative to the working directory.
+func (sh *nsShell) abs(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		p = path.Join("/", sh.cwd, p)
+	}
+	return fs.NSPath(p)
+}
+
+// display returns the shell path of an fs path.
+func (sh *nsShell) display(name string) string {
+	if name == "." {
+		return "/"
+	}
+	return "/" + name
+}
+
+func (sh *nsShell) ls(args []string, out io.Writer) error {
+	long := len(args) > 0 && args[0] == "-l"
+	if long {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+	ns := sh.t.Namespace()
+	var errs []error
+	for i, arg := range args {
+		name := sh.abs(arg)
+		fi, err := fs.StatContext(ns.Context(), ns, name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !fi.IsDir() {
+			printEntry(out, arg, fi, long)
+			continue
+		}
+		entries, err := fs.ReadDirContext(ns.Context(), ns, name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(args) > 1 {
+			if i > 0 {
+				fmt.Fprintln(out)
+			}
+			fmt.Fprintf(out, "%s:\n", arg)
+		}
+		for _, e := range entries {
+			var info fs.FileInfo
+			if long {
+				if info, err = e.Info(); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+			}
+			printEntry(out, entryName(e), info, long)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func printEntry(out io.Writer, name string, fi fs.FileInfo, long bool) {
+	if !long {
+		fmt.Fprintln(out, name)
+		return
+	}
+	fmt.Fprintf(out, "%s %8d %s %s\n", fi.Mode(), fi.Size(), fi.ModTime().Format("Jan _2 15:04"), name)
+}
+
+// entryName is the name of a directory entry as listed, with a slash
+// after directories.
+func entryName(e fs.DirEntry) string {
+	if e.IsDir() {
+		return e.Name() + "/"
+	}
+	return e.Name()
+}
+
+func (sh *nsShell) cat(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("expected a path")
+	}
+	ns := sh.t.Namespace()
+	for _, arg := range args {
+		f, err := ns.Open(sh.abs(arg))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sh *nsShell) echo(args []string, out io.Writer) error {
+	_, err := fmt.Fprintln(out, strings.Join(args, " "))
+	return err
+}
+
+func (sh *nsShell) bind(args []string, out io.Writer) error {
+	mode := ""
+	if len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+		case "-a":
+			mode = "after"
+		case "-b":
+			mode = "before"
+		case "-r":
+			mode = "replace"
+		default:
+			return fmt.Errorf("unknown flag %s", args[0])
+		}
+		args = args[1:]
+	}
+	if len(args) != 2 {
+		return errors.New("expected src and dst")
+	}
+	ns := sh.t.Namespace()
+	return ns.Bind(ns, sh.abs(args[0]), sh.abs(args[1]), mode)
+}
+
+func (sh *nsShell) unbind(args []string, out io.Writer) error {
+	if len(args) != 2 {
+		return errors.New("expected src and dst")
+	}
+	ns := sh.t.Namespace()
+	return ns.Unbind(ns, sh.abs(args[0]), sh.abs(args[1]))
+}
+
+func (sh *nsShell) mkdir(args []string, out io.Writer) error {
+	parents := len(args) > 0 && args[0] == "-p"
+	if parents {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return errors.New("expected a path")
+	}
+	ns := sh.t.Namespace()
+	for _, arg := range args {
+		var err error
+		if parents {
+			err = fs.MkdirAll(ns, sh.abs(arg), 0755)
+		} else {
+			err = fs.Mkdir(ns, sh.abs(arg), 0755)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sh *nsShell) rm(args []string, out io.Writer) error {
+	recursive := len(args) > 0 && args[0] == "-r"
+	if recursive {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return errors.New("expected a path")
+	}
+	ns := sh.t.Namespace()
+	for _, arg := range args {
+		var err error
+		if recursive {
+			err = fs.RemoveAll(ns, sh.abs(arg))
+		} else {
+			err = fs.Remove(ns, sh.abs(arg))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sh *nsShell) cp(args []string, out io.Writer) error {
+	if len(args) != 2 {
+		return errors.New("expected src and dst")
+	}
+	ns := sh.t.Namespace()
+	src, dst := sh.abs(args[0]), sh.abs(args[1])
+	// copying onto a directory copies into it
+	if ok, _ := fs.DirExists(ns, dst); ok {
+		dst = path.Join(dst, path.Base(src))
+	}
+	return fs.CopyAll(ns, src, dst)
+}
+
+func (sh *nsShell) tree(args []string, out io.Writer) error {
+	depth := maxTreeDepth
+	if len(args) > 1 && args[0] == "-L" {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return fmt.Errorf("bad depth %q", args[1])
+		}
+		depth = n
+		args = args[2:]
+	}
+	if len(args) > 1 {
+		return errors.New("expected one path")
+	}
+	arg := "."
+	if len(args) == 1 {
+		arg = args[0]
+	}
+	name := sh.abs(arg)
+	if ok, err := fs.DirExists(sh.t.Namespace(), name); !ok {
+		if err == nil {
+			err = fmt.Errorf("%s: not a directory", arg)
+		}
+		return err
+	}
+	fmt.Fprintln(out, arg)
+	return sh.treeDir(out, name, "", depth)
+}
+
+func (sh *nsShell) treeDir(out io.Writer, name, indent string, depth int) error {
+	ns := sh.t.Namespace()
+	entries, err := fs.ReadDirContext(ns.Context(), ns, name)
+	if err != nil {
+		return err
+	}
+	for i, e := range entries {
+		branch, next := "├── ", "│   "
+		if i == len(entries)-1 {
+			branch, next = "└── ", "    "
+		}
+		fmt.Fprintf(out, "%s%s%s\n", indent, branch, entryName(e))
+		if e.IsDir() && depth > 1 {
+			if err := sh.treeDir(out, path.Join(name, e.Name()), indent+next, depth-1); err != nil {
+				fmt.Fprintf(out, "%s%s[%s]\n", indent, next, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (sh *nsShell) cd(args []string, out io.Writer) error {
+	if len(args) > 1 {
+		return errors.New("expected one path")
+	}
+	name := "."
+	if len(args) == 1 {
+		name = sh.abs(args[0])
+	}
+	if ok, err := fs.DirExists(sh.t.Namespace(), name); !ok {
+		if err == nil {
+			err = fmt.Errorf("%s: not a directory", args[0])
+		}
+		return err
+	}
+	sh.cwd = name
+	return nil
+}
+
+func (sh *nsShell) pwd(args []string, out io.Writer) error {
+	_, err := fmt.Fprintln(out, sh.display(sh.cwd))
+	return err
+}
+
+func (sh *nsShell) help(args []string, out io.Writer) error {
+	for _, c := range shCommands {
+		fmt.Fprintf(out, "  %s\n", c.usage)
+	}
+	fmt.Fprintln(out, "  exit")
+	fmt.Fprintln(out, "Output can be written to a file with > path, or appended with >> path.")
+	return nil
+}
+
+// complete completes command names and namespace paths on tab.
+func (sh *nsShell) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+	head := line[:pos]
+	start := strings.LastIndexAny(head, " \t>") + 1
+	word := head[start:]
+
+	var candidates []string
+	if strings.TrimSpace(head[:start]) == "" {
+		for _, c := range shCommands {
+			if strings.HasPrefix(c.name, word) {
+				candidates = append(candidates, c.name+" ")
+			}
+		}
+	} else {
+		candidates = sh.completePath(word)
+	}
+	if len(candidates) == 0 {
+		return line, pos, true
+	}
+
+	prefix := candidates[0]
+	for _, c := range candidates[1:] {
+		for !strings.HasPrefix(c, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	if len(prefix) > len(word) {
+		return head[:start] + prefix + line[pos:], start + len(prefix), true
+	}
+	if len(candidates) > 1 && sh.term != nil {
+		var names []string
+		for _, c := range candidates {
+			// list names without the directory typed so far
+			c = strings.TrimSuffix(c, " ")
+			names = append(names, c[strings.LastIndex(strings.TrimSuffix(c, "/"), "/")+1:])
+		}
+		fmt.Fprintln(sh.term, strings.Join(names, "  "))
+	}
+	return line, pos, true
+}
+
+// completePath returns the paths in the namespace starting with word,
+// with a slash after directories and a space after anything else.
+func (sh *nsShell) completePath(word string) []string {
+	dir, base := "", word
+	if i := strings.LastIndex(word, "/"); i >= 0 {
+		dir, base = word[:i+1], word[i+1:]
+	}
+	ns := sh.t.Namespace()
+	entries, err := fs.ReadDirContext(ns.Context(), ns, sh.abs(dir))
+	if err != nil {
+		return nil
+	}
+	var candidates []string
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), base) {
+			continue
+		}
+		suffix := " "
+		if e.IsDir() {
+			suffix = "/"
+		}
+		candidates = append(candidates, dir+e.Name()+suffix)
+	}
+	return candidates
+}
+
+// splitLine splits a command line into arguments and where its output
+// is redirected. Arguments can be quoted with ' or ", and a backslash
+// escapes the next character outside single quotes. A # outside quotes
+// starts a comment.
+func splitLine(line string) (args []string, redirect string, appending bool, err error) {
+	var (
+		words   []string
+		ops     []bool // whether each word is a > or >> operator
+		cur     strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+	flush := func() {
+		if inWord {
+			words = append(words, cur.String())
+			ops = append(ops, false)
+			cur.Reset()
+			inWord = false
+		}
+	}
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else if r == '\\' && quote == '"' {
+				escaped = true
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\\':
+			escaped, inWord = true, true
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			flush()
+		case r == '#' && !inWord:
+			i = len(runes)
+		case r == '>':
+			flush()
+			op := ">"
+			if i+1 < len(runes) && runes[i+1] == '>' {
+				op = ">>"
+				i++
+			}
+			words = append(words, op)
+			ops = append(ops, true)
+		default:
+			cur.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, "", false, errors.New("unterminated quote")
+	}
+	flush()
+
+	for i := 0; i < len(words); i++ {
+		if !ops[i] {
+			args = append(args, words[i])
+			continue
+		}
+		if redirect != "" {
+			return nil, "", false, errors.New("more than one redirect")
+		}
+		if i+1 >= len(words) || ops[i+1] {
+			return nil, "", false, fmt.Errorf("expected a path after %s", words[i])
+		}
+		redirect, appending = words[i+1], words[i] == ">>"
+		i++
+	}
+	return args, redirect, appending, nil
+}
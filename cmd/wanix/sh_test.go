@@ -0,0 +1,54 @@
+//go:build !js && !wasm
+
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitLine(t *testing.T) {
+	for _, tt := range []struct {
+		line      string
+		args      []string
+		redirect  string
+		appending bool
+	}{
+		{"", nil, "", false},
+		{"ls -l  /cap", []string{"ls", "-l", "/cap"}, "", false},
+		{"\tcat\tfile\t", []string{"cat", "file"}, "", false},
+		{`echo "a b" 'c d'`, []string{"echo", "a b", "c d"}, "", false},
+		{`echo 'a\b' "a\"b"`, []string{"echo", `a\b`, `a"b`}, "", false},
+		{`echo a\ b \#`, []string{"echo", "a b", "#"}, "", false},
+		{`echo ""`, []string{"echo", ""}, "", false},
+		{"echo a # comment", []string{"echo", "a"}, "", false},
+		{"echo a#b", []string{"echo", "a#b"}, "", false},
+		{"# comment", nil, "", false},
+		{"echo hi > out", []string{"echo", "hi"}, "out", false},
+		{"echo hi>out", []string{"echo", "hi"}, "out", false},
+		{"echo hi >> out", []string{"echo", "hi"}, "out", true},
+		{">out echo hi", []string{"echo", "hi"}, "out", false},
+		{`echo ">" '>>'`, []string{"echo", ">", ">>"}, "", false},
+		{`echo hi > "my file"`, []string{"echo", "hi"}, "my file", false},
+	} {
+		args, redirect, appending, err := splitLine(tt.line)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.line, err)
+		}
+		if !slices.Equal(args, tt.args) || redirect != tt.redirect || appending != tt.appending {
+			t.Errorf("%q: got %q %q %v, want %q %q %v", tt.line, args, redirect, appending, tt.args, tt.redirect, tt.appending)
+		}
+	}
+
+	for _, line := range []string{
+		`echo "unterminated`,
+		`echo 'unterminated`,
+		"echo hi >",
+		"echo hi > > out",
+		"echo hi > a > b",
+	} {
+		if _, _, _, err := splitLine(line); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+}
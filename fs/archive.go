@@ -0,0 +1,226 @@
+package fs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+type ArchiveFormat string
+
+const (
+	ArchiveTar     ArchiveFormat = "tar"
+	ArchiveTarGzip ArchiveFormat = "tar.gz"
+	ArchiveZip     ArchiveFormat = "zip"
+)
+
+// ArchiveFormatFor returns the archive format implied by the extension of name.
+func ArchiveFormatFor(name string) (ArchiveFormat, bool) {
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return ArchiveTarGzip, true
+	case strings.HasSuffix(name, ".tar"):
+		return ArchiveTar, true
+	case strings.HasSuffix(name, ".zip"):
+		return ArchiveZip, true
+	}
+	return "", false
+}
+
+// Archive walks the subtree at root and writes it to w in the given format.
+// Entry names are relative to root. Symlinks are stored as links and not followed.
+func Archive(w io.Writer, fsys FS, root string, format ArchiveFormat) error {
+	return ArchiveContext(ContextFor(fsys), w, fsys, root, format)
+}
+
+// ArchiveContext is Archive with ctx used for every operation on fsys.
+func ArchiveContext(ctx context.Context, w io.Writer, fsys FS, root string, format ArchiveFormat) error {
+	switch format {
+	case ArchiveTar:
+		tw := tar.NewWriter(w)
+		if err := archiveWalk(ctx, fsys, root, func(name, arcname string) error {
+			return addToTar(ctx, tw, fsys, name, arcname)
+		}); err != nil {
+			return err
+		}
+		return tw.Close()
+	case ArchiveTarGzip:
+		gw := gzip.NewWriter(w)
+		if err := ArchiveContext(ctx, gw, fsys, root, ArchiveTar); err != nil {
+			return err
+		}
+		return gw.Close()
+	case ArchiveZip:
+		zw := zip.NewWriter(w)
+		if err := archiveWalk(ctx, fsys, root, func(name, arcname string) error {
+			return addToZip(ctx, zw, fsys, name, arcname)
+		}); err != nil {
+			return err
+		}
+		return zw.Close()
+	default:
+		return fmt.Errorf("archive: unknown format %q", format)
+	}
+}
+
+func archiveWalk(ctx context.Context, fsys FS, root string, fn func(name, arcname string) error) error {
+	entries, err := ReadDirContext(ctx, fsys, root)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := archiveWalkEntry(ctx, fsys, path.Join(root, entry.Name()), entry.Name(), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func archiveWalkEntry(ctx context.Context, fsys FS, name, arcname string, fn func(name, arcname string) error) error {
+	if err := fn(name, arcname); err != nil {
+		return err
+	}
+	fi, err := lstat(ctx, fsys, name)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return nil
+	}
+	entries, err := ReadDirContext(ctx, fsys, name)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := archiveWalkEntry(ctx, fsys, path.Join(name, entry.Name()), path.Join(arcname, entry.Name()), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddToTar writes the file, directory or symlink at name to tw as arcname.
+// Directories are written without their contents.
+func AddToTar(tw *tar.Writer, fsys FS, name, arcname string) error {
+	return addToTar(ContextFor(fsys), tw, fsys, name, arcname)
+}
+
+func addToTar(ctx context.Context, tw *tar.Writer, fsys FS, name, arcname string) error {
+	fi, err := lstat(ctx, fsys, name)
+	if err != nil {
+		return err
+	}
+
+	var link string
+	if IsSymlink(fi.Mode()) {
+		link, err = Readlink(fsys, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = arcname
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	if !fi.Mode().IsRegular() {
+		return tw.WriteHeader(hdr)
+	}
+
+	r, size, err := openSized(ctx, fsys, name, fi)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	hdr.Size = size
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, r, size)
+	return err
+}
+
+// AddToZip writes the file, directory or symlink at name to zw as arcname.
+// Directories are written without their contents.
+func AddToZip(zw *zip.Writer, fsys FS, name, arcname string) error {
+	return addToZip(ContextFor(fsys), zw, fsys, name, arcname)
+}
+
+func addToZip(ctx context.Context, zw *zip.Writer, fsys FS, name, arcname string) error {
+	fi, err := lstat(ctx, fsys, name)
+	if err != nil {
+		return err
+	}
+
+	hdr, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	hdr.Name = arcname
+	switch {
+	case fi.IsDir():
+		hdr.Name += "/"
+		hdr.Method = zip.Store
+		_, err = zw.CreateHeader(hdr)
+		return err
+	case IsSymlink(fi.Mode()):
+		link, err := Readlink(fsys, name)
+		if err != nil {
+			return err
+		}
+		hdr.Method = zip.Store
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, link)
+		return err
+	case !fi.Mode().IsRegular():
+		return fmt.Errorf("archive: cannot add %q with mode %v", name, fi.Mode())
+	}
+
+	hdr.Method = zip.Deflate
+	r, _, err := openSized(ctx, fsys, name, fi)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func lstat(ctx context.Context, fsys FS, name string) (FileInfo, error) {
+	return StatContext(WithNoFollow(ctx), fsys, name)
+}
+
+// openSized opens name for reading and returns its size. Synthetic files
+// often report a zero size, so those are read into memory to learn it.
+func openSized(ctx context.Context, fsys FS, name string, fi FileInfo) (io.ReadCloser, int64, error) {
+	f, err := OpenContext(ctx, fsys, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	if fi.Size() > 0 {
+		return f, fi.Size(), nil
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	return io.NopCloser(bytes.NewReader(b)), int64(len(b)), nil
+}
@@ -0,0 +1,97 @@
+package fs_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+	"time"
+
+	"tractor.dev/wanix/fs"
+	"tractor.dev/wanix/fs/fskit"
+)
+
+func archiveTestFS() fskit.MemFS {
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	return fskit.MemFS{
+		"sub/file": fskit.RawNode([]byte("hello"), fs.FileMode(0640), mtime),
+		"sub/dir":  fskit.RawNode(fs.ModeDir|0755, mtime),
+		"link":     fskit.RawNode([]byte("sub/file"), fs.ModeSymlink|0777),
+		"top":      fskit.RawNode([]byte("top"), fs.FileMode(0644)),
+	}
+}
+
+func TestArchiveTar(t *testing.T) {
+	var buf bytes.Buffer
+	if err := fs.Archive(&buf, archiveTestFS(), ".", fs.ArchiveTarGzip); err != nil {
+		t.Fatal(err)
+	}
+
+	gr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := map[string]*tar.Header{}
+	contents := map[string]string{}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(tr)
+		headers[hdr.Name] = hdr
+		contents[hdr.Name] = string(b)
+	}
+
+	for _, name := range []string{"link", "sub/", "sub/dir/", "sub/file", "top"} {
+		if _, ok := headers[name]; !ok {
+			t.Fatalf("missing entry %q in %v", name, headers)
+		}
+	}
+	if hdr := headers["link"]; hdr.Typeflag != tar.TypeSymlink || hdr.Linkname != "sub/file" {
+		t.Fatalf("unexpected symlink header: %+v", hdr)
+	}
+	if hdr := headers["sub/file"]; hdr.Mode&0777 != 0640 || !hdr.ModTime.Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Fatalf("unexpected file header: mode=%o mtime=%v", hdr.Mode, hdr.ModTime)
+	}
+	if contents["sub/file"] != "hello" {
+		t.Fatalf("unexpected file contents: %q", contents["sub/file"])
+	}
+}
+
+func TestArchiveZipSubtree(t *testing.T) {
+	var buf bytes.Buffer
+	if err := fs.Archive(&buf, archiveTestFS(), "sub", fs.ArchiveZip); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	if len(names) != 2 || names[0] != "dir/" || names[1] != "file" {
+		t.Fatalf("unexpected entries: %v", names)
+	}
+	rc, err := zr.File[1].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	b, _ := io.ReadAll(rc)
+	if string(b) != "hello" {
+		t.Fatalf("unexpected file contents: %q", b)
+	}
+	if zr.File[1].Mode().Perm() != 0640 {
+		t.Fatalf("unexpected file mode: %v", zr.File[1].Mode())
+	}
+}
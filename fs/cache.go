@@ -0,0 +1,23 @@
+package fs
+
+import "context"
+
+// CacheableFS is implemented by filesystems whose files only change
+// through the helpers in this package, if at all, like archives. Clients
+// like a kernel mount can cache those files, relying on Watch to learn
+// of changes. Files of other filesystems, like synthetic ctl files, may
+// change at any time and are not cached.
+type CacheableFS interface {
+	FS
+	Cacheable(name string) bool
+}
+
+// Cacheable reports whether clients can cache the attributes and contents
+// of the named file.
+func Cacheable(ctx context.Context, fsys FS, name string) bool {
+	cfsys, rname, err := ResolveTo[CacheableFS](fsys, ctx, name)
+	if err != nil {
+		return false
+	}
+	return cfsys.Cacheable(rname)
+}
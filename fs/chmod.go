@@ -8,12 +8,12 @@ type ChmodFS interface {
 // Chmod changes the mode of the named file if supported.
 func Chmod(fsys FS, name string, mode FileMode) error {
 	if c, ok := fsys.(ChmodFS); ok {
-		return c.Chmod(name, mode)
+		return changed(c.Chmod(name, mode), fsys, name)
 	}
 
 	rfsys, rname, err := ResolveTo[ChmodFS](fsys, ContextFor(fsys), name)
 	if err == nil {
-		return rfsys.Chmod(rname, mode)
+		return resolvedChanged(rfsys.Chmod(rname, mode), fsys, name, rfsys, rname)
 	}
 	return opErr(fsys, name, "chmod", err)
 }
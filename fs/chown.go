@@ -8,12 +8,12 @@ type ChownFS interface {
 // Chown changes the numeric uid and gid of the named file if supported.
 func Chown(fsys FS, name string, uid, gid int) error {
 	if c, ok := fsys.(ChownFS); ok {
-		return c.Chown(name, uid, gid)
+		return changed(c.Chown(name, uid, gid), fsys, name)
 	}
 
 	rfsys, rname, err := ResolveTo[ChownFS](fsys, ContextFor(fsys), name)
 	if err == nil {
-		return rfsys.Chown(rname, uid, gid)
+		return resolvedChanged(rfsys.Chown(rname, uid, gid), fsys, name, rfsys, rname)
 	}
 	return opErr(fsys, name, "chown", err)
 }
@@ -12,12 +12,12 @@ type ChtimesFS interface {
 // Chtimes changes the access and modification times of the named file if supported.
 func Chtimes(fsys FS, name string, atime time.Time, mtime time.Time) error {
 	if c, ok := fsys.(ChtimesFS); ok {
-		return c.Chtimes(name, atime, mtime)
+		return changed(c.Chtimes(name, atime, mtime), fsys, name)
 	}
 
 	rfsys, rname, err := ResolveTo[ChtimesFS](fsys, ContextFor(fsys), name)
 	if err == nil {
-		return rfsys.Chtimes(rname, atime, mtime)
+		return resolvedChanged(rfsys.Chtimes(rname, atime, mtime), fsys, name, rfsys, rname)
 	}
 
 	return opErr(fsys, name, "chtimes", err)
@@ -8,13 +8,15 @@ type CreateFS interface {
 // Create creates or truncates the named file if supported.
 func Create(fsys FS, name string) (File, error) {
 	if c, ok := fsys.(CreateFS); ok {
-		return c.Create(name)
+		f, err := c.Create(name)
+		return f, changed(err, fsys, name)
 	}
 
 	ctx := WithOrigin(ContextFor(fsys), fsys, name, "create")
 	rfsys, rname, err := ResolveTo[CreateFS](fsys, ctx, name) //path.Dir(name))
 	if err == nil {
-		return rfsys.Create(rname) //path.Join(rdir, path.Base(name)))
+		f, err := rfsys.Create(rname) //path.Join(rdir, path.Base(name)))
+		return f, resolvedChanged(err, fsys, name, rfsys, rname)
 	}
 
 	// TODO: implement derived Create using OpenFile?
@@ -0,0 +1,359 @@
+package fskit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"tractor.dev/wanix/fs"
+)
+
+// CacheCtlName is the hidden control file served by CacheFS. Writing
+// "invalidate [path]" to it drops cached entries for path and everything
+// under it, or the whole cache if no path is given.
+const CacheCtlName = "#cache"
+
+// DefaultMaxCacheContent is the largest file CacheFS will keep in memory.
+const DefaultMaxCacheContent = 1 << 20
+
+// CacheFS is a read-through cache in front of a slow filesystem. Stat
+// results, directory listings and the contents of small regular files
+// are kept for their TTL, where a zero TTL disables that cache. Writes
+// made through CacheFS invalidate affected entries, but changes made
+// to the underlying filesystem directly are only seen after expiry or
+// an explicit invalidate.
+type CacheFS struct {
+	FS fs.FS
+
+	StatTTL    time.Duration
+	ReadDirTTL time.Duration
+	ContentTTL time.Duration
+
+	// MaxContentSize limits the size of files kept in the content
+	// cache. Files reporting a zero size are never cached.
+	MaxContentSize int64
+
+	mu      sync.Mutex
+	stats   map[statKey]cached[fs.FileInfo]
+	dirs    map[string]cached[[]fs.DirEntry]
+	content map[string]cached[[]byte]
+}
+
+type statKey struct {
+	name     string
+	nofollow bool
+}
+
+type cached[T any] struct {
+	v       T
+	expires time.Time
+}
+
+func (c cached[T]) fresh() bool {
+	return time.Now().Before(c.expires)
+}
+
+// NewCacheFS wraps fsys with the given stat, readdir and content TTLs.
+func NewCacheFS(fsys fs.FS, statTTL, readdirTTL, contentTTL time.Duration) *CacheFS {
+	return &CacheFS{
+		FS:             fsys,
+		StatTTL:        statTTL,
+		ReadDirTTL:     readdirTTL,
+		ContentTTL:     contentTTL,
+		MaxContentSize: DefaultMaxCacheContent,
+	}
+}
+
+// Invalidate drops cached entries for name and anything under it, along
+// with the listing of its parent directory.
+func (c *CacheFS) Invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if name == "." || name == "" {
+		c.stats = nil
+		c.dirs = nil
+		c.content = nil
+		return
+	}
+	under := func(n string) bool {
+		return n == name || strings.HasPrefix(n, name+"/")
+	}
+	for k := range c.stats {
+		if under(k.name) {
+			delete(c.stats, k)
+		}
+	}
+	for k := range c.dirs {
+		if under(k) {
+			delete(c.dirs, k)
+		}
+	}
+	for k := range c.content {
+		if under(k) {
+			delete(c.content, k)
+		}
+	}
+	delete(c.dirs, path.Dir(name))
+}
+
+func (c *CacheFS) ctlFile(name string) fs.File {
+	return &FuncFile{
+		Node: Entry(name, 0644),
+		ReadFunc: func(n *Node) error {
+			SetData(n, []byte(fmt.Sprintf("stat %s\nreaddir %s\ncontent %s\n", c.StatTTL, c.ReadDirTTL, c.ContentTTL)))
+			return nil
+		},
+		CloseFunc: func(n *Node) error {
+			for _, line := range strings.Split(strings.TrimSpace(string(n.Data())), "\n") {
+				args := strings.Fields(line)
+				switch {
+				case len(args) == 0:
+				case args[0] == "invalidate" && len(args) == 1:
+					c.Invalidate(".")
+				case args[0] == "invalidate" && len(args) == 2:
+					c.Invalidate(strings.Trim(path.Clean(args[1]), "/"))
+				default:
+					return &fs.PathError{Op: "write", Path: name, Err: fs.ErrInvalid}
+				}
+			}
+			return nil
+		},
+	}
+}
+
+func (c *CacheFS) Open(name string) (fs.File, error) {
+	ctx := fs.WithOrigin(context.Background(), c, name, "open")
+	return c.OpenContext(ctx, name)
+}
+
+func (c *CacheFS) OpenContext(ctx context.Context, name string) (fs.File, error) {
+	if name == CacheCtlName {
+		return c.ctlFile(name), nil
+	}
+	if !fs.IsReadOnly(ctx) {
+		c.Invalidate(name)
+		f, err := fs.OpenContext(ctx, c.FS, name)
+		if err != nil {
+			return nil, err
+		}
+		return &cacheFile{File: f, onClose: func() { c.Invalidate(name) }}, nil
+	}
+
+	if c.ReadDirTTL > 0 {
+		fi, err := c.StatContext(ctx, name)
+		if err == nil && fi.IsDir() {
+			entries, err := c.ReadDirContext(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			return DirFile(RawNode(fi, name), entries...), nil
+		}
+	}
+
+	if c.ContentTTL > 0 {
+		c.mu.Lock()
+		e, ok := c.content[name]
+		c.mu.Unlock()
+		if ok && e.fresh() {
+			fi, err := c.StatContext(ctx, name)
+			if err == nil {
+				return RawNode(fi, e.v).Open(".")
+			}
+		}
+	}
+
+	f, err := fs.OpenContext(ctx, c.FS, name)
+	if err != nil {
+		return nil, err
+	}
+	if c.ContentTTL <= 0 {
+		return f, nil
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() == 0 || fi.Size() > c.MaxContentSize {
+		return f, nil
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.content == nil {
+		c.content = make(map[string]cached[[]byte])
+	}
+	c.content[name] = cached[[]byte]{v: data, expires: time.Now().Add(c.ContentTTL)}
+	c.mu.Unlock()
+	return RawNode(fi, data).Open(".")
+}
+
+func (c *CacheFS) Stat(name string) (fs.FileInfo, error) {
+	ctx := fs.WithOrigin(context.Background(), c, name, "stat")
+	return c.StatContext(ctx, name)
+}
+
+func (c *CacheFS) StatContext(ctx context.Context, name string) (fs.FileInfo, error) {
+	if name == CacheCtlName {
+		return Entry(name, 0644), nil
+	}
+	key := statKey{name: name, nofollow: !fs.FollowSymlinks(ctx)}
+	if c.StatTTL > 0 {
+		c.mu.Lock()
+		e, ok := c.stats[key]
+		c.mu.Unlock()
+		if ok && e.fresh() {
+			return e.v, nil
+		}
+	}
+	fi, err := fs.StatContext(ctx, c.FS, name)
+	if err != nil || c.StatTTL <= 0 {
+		return fi, err
+	}
+	c.mu.Lock()
+	if c.stats == nil {
+		c.stats = make(map[statKey]cached[fs.FileInfo])
+	}
+	c.stats[key] = cached[fs.FileInfo]{v: fi, expires: time.Now().Add(c.StatTTL)}
+	c.mu.Unlock()
+	return fi, nil
+}
+
+func (c *CacheFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	ctx := fs.WithOrigin(context.Background(), c, name, "readdir")
+	return c.ReadDirContext(ctx, name)
+}
+
+func (c *CacheFS) ReadDirContext(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	if c.ReadDirTTL > 0 {
+		c.mu.Lock()
+		e, ok := c.dirs[name]
+		c.mu.Unlock()
+		if ok && e.fresh() {
+			return slices.Clone(e.v), nil
+		}
+	}
+	entries, err := fs.ReadDirContext(ctx, c.FS, name)
+	if err != nil || c.ReadDirTTL <= 0 {
+		return entries, err
+	}
+	c.mu.Lock()
+	if c.dirs == nil {
+		c.dirs = make(map[string]cached[[]fs.DirEntry])
+	}
+	c.dirs[name] = cached[[]fs.DirEntry]{v: slices.Clone(entries), expires: time.Now().Add(c.ReadDirTTL)}
+	c.mu.Unlock()
+	return entries, nil
+}
+
+func (c *CacheFS) Readlink(name string) (string, error) {
+	return fs.Readlink(c.FS, name)
+}
+
+func (c *CacheFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) == 0 {
+		return c.Open(name)
+	}
+	if name == CacheCtlName {
+		return c.ctlFile(name), nil
+	}
+	c.Invalidate(name)
+	f, err := fs.OpenFile(c.FS, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &cacheFile{File: f, onClose: func() { c.Invalidate(name) }}, nil
+}
+
+func (c *CacheFS) Create(name string) (fs.File, error) {
+	if name == CacheCtlName {
+		return c.ctlFile(name), nil
+	}
+	c.Invalidate(name)
+	f, err := fs.Create(c.FS, name)
+	if err != nil {
+		return nil, err
+	}
+	return &cacheFile{File: f, onClose: func() { c.Invalidate(name) }}, nil
+}
+
+func (c *CacheFS) Mkdir(name string, perm fs.FileMode) error {
+	defer c.Invalidate(name)
+	return fs.Mkdir(c.FS, name, perm)
+}
+
+func (c *CacheFS) Remove(name string) error {
+	defer c.Invalidate(name)
+	return fs.Remove(c.FS, name)
+}
+
+func (c *CacheFS) Rename(oldname, newname string) error {
+	defer c.Invalidate(newname)
+	defer c.Invalidate(oldname)
+	return fs.Rename(c.FS, oldname, newname)
+}
+
+func (c *CacheFS) Symlink(oldname, newname string) error {
+	defer c.Invalidate(newname)
+	return fs.Symlink(c.FS, oldname, newname)
+}
+
+func (c *CacheFS) Chmod(name string, mode fs.FileMode) error {
+	defer c.Invalidate(name)
+	return fs.Chmod(c.FS, name, mode)
+}
+
+func (c *CacheFS) Chtimes(name string, atime, mtime time.Time) error {
+	defer c.Invalidate(name)
+	return fs.Chtimes(c.FS, name, atime, mtime)
+}
+
+func (c *CacheFS) Truncate(name string, size int64) error {
+	defer c.Invalidate(name)
+	return fs.Truncate(c.FS, name, size)
+}
+
+// cacheFile is a file opened for writing that invalidates
+// its cache entries again once it is closed.
+type cacheFile struct {
+	fs.File
+	onClose func()
+}
+
+func (f *cacheFile) Write(p []byte) (int, error) {
+	return fs.Write(f.File, p)
+}
+
+func (f *cacheFile) WriteAt(p []byte, off int64) (int, error) {
+	return fs.WriteAt(f.File, p, off)
+}
+
+func (f *cacheFile) ReadAt(p []byte, off int64) (int, error) {
+	return fs.ReadAt(f.File, p, off)
+}
+
+func (f *cacheFile) Seek(offset int64, whence int) (int64, error) {
+	return fs.Seek(f.File, offset, whence)
+}
+
+func (f *cacheFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d, ok := f.File.(fs.ReadDirFile); ok {
+		return d.ReadDir(n)
+	}
+	return nil, &fs.PathError{Op: "readdir", Err: fs.ErrInvalid}
+}
+
+func (f *cacheFile) Sync() error {
+	return fs.Sync(f.File)
+}
+
+func (f *cacheFile) Close() error {
+	defer f.onClose()
+	return f.File.Close()
+}
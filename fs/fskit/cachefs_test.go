@@ -0,0 +1,100 @@
+package fskit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"tractor.dev/wanix/fs"
+)
+
+// countingFS counts stat, readdir and open calls reaching the wrapped MemFS.
+type countingFS struct {
+	MemFS
+	stats, readdirs, opens int
+}
+
+func (c *countingFS) StatContext(ctx context.Context, name string) (fs.FileInfo, error) {
+	c.stats++
+	return c.MemFS.StatContext(ctx, name)
+}
+
+func (c *countingFS) ReadDirContext(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	c.readdirs++
+	return fs.ReadDirContext(ctx, c.MemFS, name)
+}
+
+func (c *countingFS) OpenContext(ctx context.Context, name string) (fs.File, error) {
+	c.opens++
+	return c.MemFS.OpenContext(ctx, name)
+}
+
+func TestCacheFS(t *testing.T) {
+	backend := &countingFS{MemFS: MemFS{
+		"dir/file": RawNode([]byte("hello"), fs.FileMode(0644)),
+	}}
+	cache := NewCacheFS(backend, time.Minute, time.Minute, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if _, err := fs.Stat(cache, "dir/file"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.ReadDir(cache, "dir"); err != nil {
+			t.Fatal(err)
+		}
+		b, err := fs.ReadFile(cache, "dir/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "hello" {
+			t.Fatalf("unexpected contents: %q", b)
+		}
+	}
+	if backend.stats != 1 || backend.readdirs != 1 || backend.opens != 1 {
+		t.Fatalf("expected one call each, got stats=%d readdirs=%d opens=%d", backend.stats, backend.readdirs, backend.opens)
+	}
+
+	// writes through the cache invalidate it
+	if err := fs.WriteFile(cache, "dir/file", []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := fs.ReadFile(cache, "dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "changed" {
+		t.Fatalf("expected write to invalidate content, got %q", b)
+	}
+	if err := fs.WriteFile(cache, "dir/other", []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := fs.ReadDir(cache, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected create to invalidate listing, got %d entries", len(entries))
+	}
+}
+
+func TestCacheFSInvalidateCtl(t *testing.T) {
+	backend := MemFS{"file": RawNode([]byte("one"), fs.FileMode(0644))}
+	cache := NewCacheFS(backend, time.Minute, time.Minute, time.Minute)
+
+	if _, err := fs.ReadFile(cache, "file"); err != nil {
+		t.Fatal(err)
+	}
+	// changes behind the cache are not seen until invalidated
+	SetData(backend["file"], []byte("two"))
+	b, _ := fs.ReadFile(cache, "file")
+	if string(b) != "one" {
+		t.Fatalf("expected cached contents, got %q", b)
+	}
+	if err := fs.WriteFile(cache, CacheCtlName, []byte("invalidate /file\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, _ = fs.ReadFile(cache, "file")
+	if string(b) != "two" {
+		t.Fatalf("expected fresh contents after invalidate, got %q", b)
+	}
+}
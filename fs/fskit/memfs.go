@@ -220,6 +220,28 @@ func (fsys MemFS) Chtimes(name string, atime, mtime time.Time) error {
 	return nil
 }
 
+func (fsys MemFS) Truncate(name string, size int64) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "truncate", Path: name, Err: fs.ErrNotExist}
+	}
+
+	n, ok := fsys[name]
+	if !ok {
+		return &fs.PathError{Op: "truncate", Path: name, Err: fs.ErrNotExist}
+	}
+	if n.IsDir() {
+		return &fs.PathError{Op: "truncate", Path: name, Err: fs.ErrInvalid}
+	}
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: name, Err: fs.ErrInvalid}
+	}
+
+	// the node is changed in place so files open on it keep pointing at it
+	n.data = resize(n.data, size)
+	n.modTime = time.Now()
+	return nil
+}
+
 func (fsys MemFS) Remove(name string) error {
 	if !fs.ValidPath(name) {
 		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
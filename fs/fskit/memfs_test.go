@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"os"
 	"strings"
 	"testing"
 	"testing/fstest"
@@ -73,6 +74,43 @@ func TestMemFSChtimes(t *testing.T) {
 	}
 }
 
+func TestMemFSTruncate(t *testing.T) {
+	m := MemFS{
+		"hello": RawNode([]byte("hello, world\n")),
+	}
+
+	// check for failure if file does not exist
+	if err := fs.Truncate(m, "foo", 0); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// an open file sees the truncate, and its writes are seen
+	// by others once synced
+	f, err := fs.OpenFile(m, "hello", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := fs.Truncate(m, "hello", 5); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := fs.ReadFile(m, "hello"); string(b) != "hello" {
+		t.Fatalf("unexpected contents after truncate: %q", b)
+	}
+	if err := f.(interface{ Truncate(int64) error }).Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.WriteAt(f, []byte("bye"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Sync(f); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := fs.ReadFile(m, "hello"); string(b) != "bye" {
+		t.Fatalf("unexpected contents after sync: %q", b)
+	}
+}
+
 func TestMemFSChmod(t *testing.T) {
 	m := MemFS{
 		"hello": RawNode([]byte("hello, world\n"), fs.FileMode(0666)),
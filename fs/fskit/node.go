@@ -159,6 +159,49 @@ func (f *nodeFile) Close() error {
 	return nil
 }
 
+// Sync commits written data to the node without closing the file.
+func (f *nodeFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return fs.ErrClosed
+	}
+
+	if f.dirty && f.inode != nil {
+		// later writes may reuse the slice, so the node gets a copy
+		f.inode.data = bytes.Clone(f.data)
+		f.inode.modTime = f.modTime
+	}
+	return nil
+}
+
+// Truncate changes the size of the file, which is committed to the node
+// on Sync or Close.
+func (f *nodeFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return fs.ErrClosed
+	}
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: fs.ErrInvalid}
+	}
+
+	f.data = resize(f.data, size)
+	f.modTime = time.Now()
+	f.dirty = true
+	return nil
+}
+
+// resize returns a copy of data cut or zero-extended to size.
+func resize(data []byte, size int64) []byte {
+	b := make([]byte, size)
+	copy(b, data)
+	return b
+}
+
 func (f *nodeFile) Stat() (fs.FileInfo, error) {
 	return f, nil
 }
@@ -59,7 +59,8 @@ func (f UnionFS) ResolveFS(ctx context.Context, name string) (fs.FS, string, err
 		return f, name, nil
 	}
 
-	var toStat []fs.FS
+	// members are checked in order, so an earlier one without a resolver
+	// still shadows a later one that resolves name
 	for _, fsys := range f {
 		if resolver, ok := fsys.(fs.ResolveFS); ok {
 			rfsys, rname, err := resolver.ResolveFS(ctx, name)
@@ -80,10 +81,7 @@ func (f UnionFS) ResolveFS(ctx context.Context, name string) (fs.FS, string, err
 				return rfsys, rname, nil
 			}
 		}
-		toStat = append(toStat, fsys)
-	}
 
-	for _, fsys := range toStat {
 		_, err := fs.StatContext(ctx, fsys, name)
 		if err != nil {
 			continue
@@ -66,3 +66,22 @@ func TestUnionFS_ImplicitDirs(t *testing.T) {
 		}
 	}
 }
+
+func TestUnionFS_Shadowing(t *testing.T) {
+	overlay := fstest.MapFS{
+		"file": &fstest.MapFile{Data: []byte("overlay")},
+	}
+	base := UnionFS{fstest.MapFS{
+		"file": &fstest.MapFile{Data: []byte("base")},
+	}, MapFS{}}
+
+	// an earlier member shadows a later one that resolves the name
+	union := UnionFS{overlay, base}
+	data, err := fs.ReadFile(union, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "overlay" {
+		t.Errorf("got %q, want %q", data, "overlay")
+	}
+}
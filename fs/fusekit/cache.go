@@ -0,0 +1,195 @@
+package fusekit
+
+import (
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	iofs "tractor.dev/wanix/fs"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// cacheable looks up whether the kernel may cache the named file, and
+// what it resolves to so changes to it can be matched.
+func (n *node) cacheable(name string) (rfsys iofs.FS, rname string, ok bool) {
+	cfsys, rname, err := iofs.ResolveTo[iofs.CacheableFS](n.fs, n.ctx, name)
+	if err != nil || !cfsys.Cacheable(rname) {
+		return nil, "", false
+	}
+	return cfsys, rname, true
+}
+
+// setCache records whether the kernel may cache the child node ch named
+// name, setting the timeouts of out to match.
+func (n *node) setCache(ch *node, name string, out *fuse.EntryOut) {
+	rfsys, rname, ok := n.cacheable(name)
+	n.w.track(ch, rfsys, rname, ok)
+	if ok {
+		out.SetEntryTimeout(n.opts.EntryTimeout)
+		out.SetAttrTimeout(n.opts.AttrTimeout)
+	}
+}
+
+// openFlags returns the FUSE open flags for the node, keeping the page
+// cache for files the kernel may cache and bypassing it for the rest.
+func (n *node) openFlags() uint32 {
+	if n.w.cached(n) {
+		return fuse.FOPEN_KEEP_CACHE
+	}
+	return fuse.FOPEN_DIRECT_IO
+}
+
+var _ = (fs.NodeOnForgetter)((*node)(nil))
+
+func (n *node) OnForget() {
+	n.w.track(n, nil, "", false)
+}
+
+// change is a change to name in fsys reported by iofs.Watch.
+type change struct {
+	fsys iofs.FS
+	name string
+}
+
+// watcher keeps what the kernel caches of a mount in step with changes
+// made through the Wanix API by passing them on as FUSE notifications.
+// Only nodes the kernel may cache are tracked, since it asks about the
+// rest every time.
+type watcher struct {
+	root *node
+	fsys iofs.FS
+	stop func()
+
+	mu      sync.Mutex
+	nodes   map[*node]change   // where cached nodes resolve to
+	byName  map[string][]*node // cached nodes by the name they resolve to
+	pending []change
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+func newWatcher(root *node) *watcher {
+	return &watcher{
+		root:   root,
+		fsys:   root.fs,
+		nodes:  make(map[*node]change),
+		byName: make(map[string][]*node),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+// start begins passing on changes, once the mount is serving.
+func (w *watcher) start() {
+	w.stop = iofs.Watch(w.changed)
+	go w.run()
+}
+
+// close stops passing on changes.
+func (w *watcher) close() {
+	if w.stop != nil {
+		w.stop()
+		close(w.done)
+	}
+}
+
+// track records whether nd may be cached and, if so, what it resolves to.
+func (w *watcher) track(nd *node, rfsys iofs.FS, rname string, cached bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if old, ok := w.nodes[nd]; ok {
+		w.byName[old.name] = slices.DeleteFunc(w.byName[old.name], func(o *node) bool {
+			return o == nd
+		})
+		if len(w.byName[old.name]) == 0 {
+			delete(w.byName, old.name)
+		}
+		delete(w.nodes, nd)
+	}
+	if cached {
+		w.nodes[nd] = change{fsys: rfsys, name: rname}
+		w.byName[rname] = append(w.byName[rname], nd)
+	}
+}
+
+func (w *watcher) cached(nd *node) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, ok := w.nodes[nd]
+	return ok
+}
+
+// changed queues a change. It's called by whatever made the change, which
+// may be this mount in the middle of an operation, so notifying the kernel
+// is left to run.
+func (w *watcher) changed(fsys iofs.FS, name string) {
+	w.mu.Lock()
+	w.pending = append(w.pending, change{fsys: fsys, name: name})
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *watcher) run() {
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-w.wake:
+		}
+		w.mu.Lock()
+		pending := w.pending
+		w.pending = nil
+		w.mu.Unlock()
+		for _, c := range pending {
+			w.notify(c)
+		}
+	}
+}
+
+// notify invalidates what the kernel caches of nodes affected by c.
+func (w *watcher) notify(c change) {
+	var affected []*fs.Inode
+	if iofs.Equal(c.fsys, w.fsys) {
+		if in := w.lookup(c.name); in != nil {
+			affected = append(affected, in)
+		}
+	}
+	w.mu.Lock()
+	for _, nd := range w.byName[c.name] {
+		if iofs.Equal(w.nodes[nd].fsys, c.fsys) {
+			affected = append(affected, &nd.Inode)
+		}
+	}
+	w.mu.Unlock()
+
+	for _, in := range affected {
+		// dropping the entry drops everything cached below it too
+		if name, parent := in.Parent(); parent != nil {
+			parent.NotifyEntry(name)
+		}
+		if w.cached(in.Operations().(*node)) {
+			in.NotifyContent(0, 0)
+		}
+	}
+}
+
+// lookup returns the inode the kernel knows for name, if any.
+func (w *watcher) lookup(name string) *fs.Inode {
+	in := &w.root.Inode
+	if name == "." {
+		return in
+	}
+	for _, elem := range strings.Split(path.Clean(name), "/") {
+		if in = in.GetChild(elem); in == nil {
+			return nil
+		}
+	}
+	return in
+}
@@ -1,47 +1,48 @@
 package fusekit
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"runtime"
 	"syscall"
 
+	"github.com/hugelgupf/p9/linux"
 	"tractor.dev/wanix/fs"
 )
 
 func sysErrno(err error) syscall.Errno {
-	log.Printf("ERR: %T %v", err, err)
-	// printLastFrames()
-	switch err {
-	case nil:
+	if err == nil {
 		return syscall.Errno(0)
-	case fs.ErrNotSupported:
+	}
+	// printLastFrames()
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno
+	}
+	// errnos relayed over 9P are numbered the same as syscall's
+	var lerrno linux.Errno
+	if errors.As(err, &lerrno) && lerrno != 0 {
+		return syscall.Errno(lerrno)
+	}
+	switch {
+	case errors.Is(err, fs.ErrNotSupported):
 		return syscall.EOPNOTSUPP
-	case os.ErrPermission:
+	case errors.Is(err, fs.ErrNotEmpty):
+		return syscall.ENOTEMPTY
+	case errors.Is(err, os.ErrPermission):
 		return syscall.EPERM
-	case os.ErrExist:
+	case errors.Is(err, os.ErrExist):
 		return syscall.EEXIST
-	case os.ErrNotExist:
+	case errors.Is(err, os.ErrNotExist):
 		return syscall.ENOENT
-	case os.ErrInvalid:
+	case errors.Is(err, os.ErrInvalid):
 		return syscall.EINVAL
+	case errors.Is(err, os.ErrClosed):
+		return syscall.EBADF
 	}
-
-	switch t := err.(type) {
-	case syscall.Errno:
-		return t
-	case *os.SyscallError:
-		return t.Err.(syscall.Errno)
-	case *os.PathError:
-		return sysErrno(t.Err)
-	case *os.LinkError:
-		return sysErrno(t.Err)
-	default:
-		log.Panicf("unsupported error type: %T", err)
-		return syscall.EOPNOTSUPP
-	}
-
+	return syscall.EIO
 }
 
 func printLastFrames() {
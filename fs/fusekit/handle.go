@@ -2,8 +2,8 @@ package fusekit
 
 import (
 	"context"
+	"errors"
 	"io"
-	"log"
 	"syscall"
 
 	iofs "tractor.dev/wanix/fs"
@@ -15,12 +15,26 @@ import (
 type handle struct {
 	file iofs.File
 	path string
+	opts *Options
+}
+
+// truncateFile is a file that can change its own size, like *os.File.
+type truncateFile interface {
+	Truncate(size int64) error
+}
+
+// handleFile returns the file behind fh, if it is a handle.
+func handleFile(fh fs.FileHandle) iofs.File {
+	if h, ok := fh.(*handle); ok {
+		return h.file
+	}
+	return nil
 }
 
 var _ = (fs.FileReader)((*handle)(nil))
 
 func (h *handle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
-	log.Println("read", h.path, off)
+	h.opts.trace("read", h.path, off)
 
 	n, err := iofs.ReadAt(h.file, dest, off)
 	if err != nil && err != io.EOF {
@@ -33,7 +47,7 @@ func (h *handle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadRes
 var _ = (fs.FileWriter)((*handle)(nil))
 
 func (h *handle) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
-	log.Println("write", h.path, off)
+	h.opts.trace("write", h.path, off)
 
 	n, err := iofs.WriteAt(h.file, data, off)
 	if err != nil {
@@ -43,21 +57,47 @@ func (h *handle) Write(ctx context.Context, data []byte, off int64) (uint32, sys
 	return uint32(n), 0
 }
 
+var _ = (fs.FileGetattrer)((*handle)(nil))
+
+func (h *handle) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	h.opts.trace("fgetattr", h.path)
+
+	fi, err := h.file.Stat()
+	if err != nil {
+		return sysErrno(err)
+	}
+	applyStat(&out.Attr, fi)
+
+	return 0
+}
+
 var _ = (fs.FileFlusher)((*handle)(nil))
 
+// Flush is called on every close of a descriptor for the file, including
+// duplicates, so the file is only closed on Release.
 func (h *handle) Flush(ctx context.Context) syscall.Errno {
-	log.Println("flush", h.path)
+	h.opts.trace("flush", h.path)
+	return h.Fsync(ctx, 0)
+}
+
+var _ = (fs.FileReleaser)((*handle)(nil))
+
+func (h *handle) Release(ctx context.Context) syscall.Errno {
+	h.opts.trace("release", h.path)
 
 	if err := h.file.Close(); err != nil {
 		return sysErrno(err)
 	}
-
 	return 0
 }
 
 var _ = (fs.FileFsyncer)((*handle)(nil))
 
 func (h *handle) Fsync(ctx context.Context, flags uint32) syscall.Errno {
-	log.Println("fsync", h.path)
+	h.opts.trace("fsync", h.path)
+
+	if err := iofs.Sync(h.file); err != nil && !errors.Is(err, iofs.ErrNotSupported) {
+		return sysErrno(err)
+	}
 	return 0
 }
@@ -3,17 +3,48 @@ package fusekit
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	iofs "io/fs"
+	"log"
 	"os"
 	"os/exec"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
+// Options configure a mount. The zero value mounts read-write for the
+// current user with no kernel caching.
+type Options struct {
+	// ReadOnly mounts the filesystem read-only.
+	ReadOnly bool
+
+	// AttrTimeout and EntryTimeout are how long the kernel may cache
+	// file attributes and name lookups, for files whose filesystem says
+	// they can be cached. Other files are never cached.
+	AttrTimeout  time.Duration
+	EntryTimeout time.Duration
+
+	// AllowOther lets users other than the one mounting access the
+	// mount. It needs user_allow_other in /etc/fuse.conf when not root.
+	AllowOther bool
+
+	// Debug logs every operation on the mount.
+	Debug bool
+}
+
+// trace logs an operation when debugging is on.
+func (o *Options) trace(v ...any) {
+	if o.Debug {
+		log.Output(2, fmt.Sprintln(v...))
+	}
+}
+
 type mount struct {
 	path string
+	w    *watcher
 	*fuse.Server
 }
 
@@ -22,26 +53,46 @@ func (m *mount) Close() error {
 		exec.Command("umount", m.path).Run()
 		return nil
 	}
-	return m.Server.Unmount()
+	m.w.close()
+	if err := m.Server.Unmount(); err != nil {
+		return err
+	}
+	m.Server.Wait()
+	return nil
 }
 
-func Mount(fsys iofs.FS, path string, fsctx context.Context) (closer io.Closer, err error) {
+// Mount mounts fsys at path, using fsctx for opening files. Closing the
+// returned closer unmounts it. A nil opts uses the zero Options.
+func Mount(fsys iofs.FS, path string, fsctx context.Context, opts *Options) (closer io.Closer, err error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
 	exec.Command("umount", path).Run()
 
 	if err := os.MkdirAll(path, 0755); err != nil {
 		return nil, errors.New("unable to mkdir")
 	}
 
-	opts := &fs.Options{
+	// timeouts are set per file, so there are none for the mount
+	fopts := &fs.Options{
 		UID: uint32(os.Getuid()),
 		GID: uint32(os.Getgid()),
 	}
-	opts.Debug = false
+	fopts.FsName = "wanix"
+	fopts.Name = "wanix"
+	fopts.AllowOther = opts.AllowOther
+	if opts.ReadOnly {
+		fopts.Options = append(fopts.Options, "ro")
+	}
 
-	server, err := fs.Mount(path, &node{fs: fsys, ctx: fsctx}, opts)
+	root := &node{fs: fsys, ctx: fsctx, opts: opts}
+	root.w = newWatcher(root)
+	server, err := fs.Mount(path, root, fopts)
 	if err != nil {
 		return nil, err
 	}
+	root.w.start()
 
-	return &mount{Server: server, path: path}, nil
+	return &mount{Server: server, path: path, w: root.w}, nil
 }
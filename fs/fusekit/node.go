@@ -2,8 +2,9 @@ package fusekit
 
 import (
 	"context"
-	"log"
-	"path/filepath"
+	"errors"
+	"os"
+	"path"
 	"strings"
 	"syscall"
 
@@ -13,25 +14,67 @@ import (
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
-// TODO: mkdir
-
+// node is a file in the mounted filesystem. Every node shares the mounted
+// fs and works out its name from where the inode sits in the tree, so
+// renames don't leave nodes pointing at old names.
 type node struct {
 	fs.Inode
 	fs   iofs.FS
-	path string
 	ctx  context.Context
+	opts *Options
+	w    *watcher
+}
+
+// name returns the name of the node in the mounted fs.
+func (n *node) name() string {
+	p := n.Path(nil)
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+// child returns the name of a child of the node in the mounted fs.
+func (n *node) child(name string) string {
+	return path.Join(n.name(), name)
+}
+
+// lstat stats name without following a final symlink, so symlinks show
+// up as symlinks.
+func (n *node) lstat(name string) (iofs.FileInfo, error) {
+	return iofs.StatContext(iofs.WithNoFollow(n.ctx), n.fs, name)
+}
+
+// newChild returns an inode for the child name with info fi, filling out.
+func (n *node) newChild(ctx context.Context, name string, fi iofs.FileInfo, out *fuse.EntryOut) *fs.Inode {
+	applyStat(&out.Attr, fi)
+	ch := &node{
+		ctx:  n.ctx,
+		fs:   n.fs,
+		opts: n.opts,
+		w:    n.w,
+	}
+	n.setCache(ch, n.child(name), out)
+	// inode numbers are assigned by go-fuse, since ones derived from
+	// names would collide when a file is renamed and its name reused
+	return n.NewInode(ctx, ch, fs.StableAttr{
+		Mode: fuseMode(fi.Mode()) & syscall.S_IFMT,
+	})
 }
 
 var _ = (fs.NodeGetattrer)((*node)(nil))
 
 func (n *node) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
-	log.Println("getattr", n.path)
+	n.opts.trace("getattr", n.name())
 
-	fi, err := iofs.StatContext(n.ctx, n.fs, ".")
+	fi, err := n.lstat(n.name())
 	if err != nil {
 		return sysErrno(err)
 	}
 	applyStat(&out.Attr, fi)
+	if n.w.cached(n) {
+		out.SetTimeout(n.opts.AttrTimeout)
+	}
 
 	return 0
 }
@@ -39,27 +82,91 @@ func (n *node) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut)
 var _ = (fs.NodeSetattrer)((*node)(nil))
 
 func (n *node) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
-	log.Println("setattr", n.path)
-	out.Size = in.Size
-	return 0
+	name := n.name()
+	n.opts.trace("setattr", name)
+
+	if mode, ok := in.GetMode(); ok {
+		if err := iofs.Chmod(n.fs, name, iofs.FileMode(mode&0777)); err != nil {
+			return sysErrno(err)
+		}
+	}
+
+	uid, uok := in.GetUID()
+	gid, gok := in.GetGID()
+	if uok || gok {
+		owner, group := -1, -1
+		if uok {
+			owner = int(uid)
+		}
+		if gok {
+			group = int(gid)
+		}
+		// ownership is synthesized by the mount for filesystems
+		// without it, so there's nothing to change
+		if err := iofs.Chown(n.fs, name, owner, group); err != nil && !errors.Is(err, iofs.ErrNotSupported) {
+			return sysErrno(err)
+		}
+	}
+
+	if size, ok := in.GetSize(); ok {
+		// truncating through the open file keeps it in step with its
+		// own writes, as happens for an open with O_TRUNC
+		var err error
+		if f, ok := handleFile(fh).(truncateFile); ok {
+			err = f.Truncate(int64(size))
+		} else {
+			err = iofs.Truncate(n.fs, name, int64(size))
+		}
+		if err != nil {
+			return sysErrno(err)
+		}
+	}
+
+	atime, aok := in.GetATime()
+	mtime, mok := in.GetMTime()
+	if aok || mok {
+		if !aok || !mok {
+			fi, err := n.lstat(name)
+			if err != nil {
+				return sysErrno(err)
+			}
+			if !aok {
+				atime = fi.ModTime()
+			}
+			if !mok {
+				mtime = fi.ModTime()
+			}
+		}
+		if err := iofs.Chtimes(n.fs, name, atime, mtime); err != nil {
+			return sysErrno(err)
+		}
+	}
+
+	return n.Getattr(ctx, fh, out)
 }
 
 var _ = (fs.NodeReaddirer)((*node)(nil))
 
 func (n *node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
-	log.Println("readdir", n.path)
+	n.opts.trace("readdir", n.name())
 
-	entries, err := iofs.ReadDirContext(n.ctx, n.fs, ".")
+	entries, err := iofs.ReadDirContext(n.ctx, n.fs, n.name())
 	if err != nil {
 		return nil, sysErrno(err)
 	}
 
 	var fentries []fuse.DirEntry
 	for _, entry := range entries {
+		// entries the kernel knows keep their inode numbers, and the
+		// rest are left for it to fill in on lookup
+		var ino uint64
+		if ch := n.GetChild(entry.Name()); ch != nil {
+			ino = ch.StableAttr().Ino
+		}
 		fentries = append(fentries, fuse.DirEntry{
 			Name: entry.Name(),
-			Mode: uint32(entry.Type()),
-			Ino:  fakeIno(filepath.Join(n.path, entry.Name())),
+			Mode: fuseMode(entry.Type()),
+			Ino:  ino,
 		})
 	}
 
@@ -68,102 +175,174 @@ func (n *node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 
 var _ = (fs.NodeOpendirer)((*node)(nil))
 
-func (r *node) Opendir(ctx context.Context) syscall.Errno {
-	log.Println("opendir", r.path)
+func (n *node) Opendir(ctx context.Context) syscall.Errno {
+	n.opts.trace("opendir", n.name())
 	return 0
 }
 
 var _ = (fs.NodeLookuper)((*node)(nil))
 
 func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
-	log.Println("lookup", n.path, name)
-
-	fi, err := iofs.StatContext(n.ctx, n.fs, name)
-	if err != nil {
-		return nil, sysErrno(err)
-	}
+	n.opts.trace("lookup", n.name(), name)
 
-	applyStat(&out.Attr, fi)
-
-	subfs, err := iofs.Sub(n.fs, name)
+	fi, err := n.lstat(n.child(name))
 	if err != nil {
 		return nil, sysErrno(err)
 	}
 
-	mode := fuse.S_IFREG
-	if fi.IsDir() {
-		mode = fuse.S_IFDIR
+	// the kernel drops its entry for a name if a lookup gives another
+	// inode, which would pull the working directory out from under
+	// anything sitting in it
+	if ch := n.GetChild(name); ch != nil && ch.StableAttr().Mode == fuseMode(fi.Mode())&syscall.S_IFMT {
+		applyStat(&out.Attr, fi)
+		n.setCache(ch.Operations().(*node), n.child(name), out)
+		return ch, 0
 	}
 
-	return n.Inode.NewPersistentInode(ctx, &node{
-		ctx:  n.ctx,
-		fs:   subfs,
-		path: filepath.Join(n.path, name),
-	}, fs.StableAttr{
-		Mode: uint32(mode),
-		Ino:  fakeIno(filepath.Join(n.path, name)),
-	}), 0
+	return n.newChild(ctx, name, fi, out), 0
 }
 
 var _ = (fs.NodeCreater)((*node)(nil))
 
 func (n *node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
-	log.Println("create", n.path, name, flags, mode)
-	// TODO: check if we can create a file on our n.fs
-	// TODO: do we need to check if creating a dir?
+	n.opts.trace("create", n.name(), name, flags, mode)
 
-	f, err := iofs.Create(n.fs, name)
+	f, err := iofs.OpenFile(n.fs, n.child(name), openFileFlags(flags)|os.O_CREATE, iofs.FileMode(mode&0777))
 	if err != nil {
 		return nil, 0, 0, sysErrno(err)
 	}
 	fi, err := f.Stat()
 	if err != nil {
+		f.Close()
 		return nil, 0, 0, sysErrno(err)
 	}
-	// if err := f.Close(); err != nil {
-	// 	return nil, 0, 0, sysErrno(err)
-	// }
 
-	applyStat(&out.Attr, fi)
+	ch := n.newChild(ctx, name, fi, out)
+	return ch, &handle{file: f, path: n.child(name), opts: n.opts}, ch.Operations().(*node).openFlags(), 0
+}
+
+var _ = (fs.NodeOpener)((*node)(nil))
 
-	subfs, err := iofs.Sub(n.fs, name)
+func (n *node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	name := n.name()
+	n.opts.trace("open", name, strings.Join(openFlags(flags), "|"))
+
+	var f iofs.File
+	var err error
+	if flags&syscall.O_ACCMODE == syscall.O_RDONLY && flags&syscall.O_TRUNC == 0 {
+		f, err = iofs.OpenContext(n.ctx, n.fs, name)
+	} else {
+		f, err = iofs.OpenFile(n.fs, name, openFileFlags(flags), 0)
+	}
 	if err != nil {
-		return nil, 0, 0, sysErrno(err)
+		return nil, 0, sysErrno(err)
+	}
+
+	return &handle{file: f, path: name, opts: n.opts}, n.openFlags(), 0
+}
+
+var _ = (fs.NodeMkdirer)((*node)(nil))
+
+func (n *node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	n.opts.trace("mkdir", n.name(), name, mode)
+
+	if err := iofs.Mkdir(n.fs, n.child(name), iofs.FileMode(mode&0777)); err != nil {
+		return nil, sysErrno(err)
+	}
+	fi, err := n.lstat(n.child(name))
+	if err != nil {
+		return nil, sysErrno(err)
 	}
 
-	outMode := fuse.S_IFREG
+	return n.newChild(ctx, name, fi, out), 0
+}
+
+var _ = (fs.NodeUnlinker)((*node)(nil))
+
+func (n *node) Unlink(ctx context.Context, name string) syscall.Errno {
+	n.opts.trace("unlink", n.name(), name)
+
+	fi, err := n.lstat(n.child(name))
+	if err != nil {
+		return sysErrno(err)
+	}
 	if fi.IsDir() {
-		outMode = fuse.S_IFDIR
+		return syscall.EISDIR
 	}
+	return sysErrno(iofs.Remove(n.fs, n.child(name)))
+}
 
-	return n.Inode.NewPersistentInode(ctx, &node{
-		ctx:  n.ctx,
-		fs:   subfs,
-		path: filepath.Join(n.path, name),
-	}, fs.StableAttr{
-		Mode: uint32(outMode),
-		Ino:  fakeIno(filepath.Join(n.path, name)),
-	}), &handle{file: f, path: n.path}, fuse.FOPEN_DIRECT_IO, 0
+var _ = (fs.NodeRmdirer)((*node)(nil))
+
+func (n *node) Rmdir(ctx context.Context, name string) syscall.Errno {
+	n.opts.trace("rmdir", n.name(), name)
+
+	fi, err := n.lstat(n.child(name))
+	if err != nil {
+		return sysErrno(err)
+	}
+	if !fi.IsDir() {
+		return syscall.ENOTDIR
+	}
+	empty, err := iofs.IsEmpty(n.fs, n.child(name))
+	if err != nil {
+		return sysErrno(err)
+	}
+	if !empty {
+		return syscall.ENOTEMPTY
+	}
+	return sysErrno(iofs.Remove(n.fs, n.child(name)))
 }
 
-var _ = (fs.NodeOpener)((*node)(nil))
+var _ = (fs.NodeRenamer)((*node)(nil))
 
-func (n *node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
-	log.Println("open", n.path, strings.Join(openFlags(flags), "|"))
+func (n *node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	parent, ok := newParent.(*node)
+	if !ok {
+		return syscall.EXDEV
+	}
+	oldpath, newpath := n.child(name), parent.child(newName)
+	n.opts.trace("rename", oldpath, newpath, flags)
 
-	var f iofs.File
-	var err error
-	if flags&syscall.O_CREAT != 0 {
-		f, err = iofs.Create(n.fs, ".")
-		if err != nil {
-			return nil, 0, sysErrno(err)
-		}
-	} else {
-		f, err = iofs.OpenContext(n.ctx, n.fs, ".")
-		if err != nil {
-			return nil, 0, sysErrno(err)
+	if flags&fs.RENAME_EXCHANGE != 0 {
+		return syscall.ENOTSUP
+	}
+	if flags&renameNoReplace != 0 {
+		if _, err := n.lstat(newpath); err == nil {
+			return syscall.EEXIST
 		}
 	}
 
-	return &handle{file: f, path: n.path}, fuse.FOPEN_DIRECT_IO, 0
+	return sysErrno(iofs.Rename(n.fs, oldpath, newpath))
+}
+
+// renameNoReplace is the RENAME_NOREPLACE flag for renameat2.
+const renameNoReplace = 0x1
+
+var _ = (fs.NodeSymlinker)((*node)(nil))
+
+func (n *node) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	n.opts.trace("symlink", n.name(), name, target)
+
+	if err := iofs.Symlink(n.fs, target, n.child(name)); err != nil {
+		return nil, sysErrno(err)
+	}
+	fi, err := n.lstat(n.child(name))
+	if err != nil {
+		return nil, sysErrno(err)
+	}
+
+	return n.newChild(ctx, name, fi, out), 0
+}
+
+var _ = (fs.NodeReadlinker)((*node)(nil))
+
+func (n *node) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	n.opts.trace("readlink", n.name())
+
+	target, err := iofs.Readlink(n.fs, n.name())
+	if err != nil {
+		return nil, sysErrno(err)
+	}
+	return []byte(target), 0
 }
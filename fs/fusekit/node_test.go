@@ -0,0 +1,170 @@
+package fusekit
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hugelgupf/p9/linux"
+	iofs "tractor.dev/wanix/fs"
+	"tractor.dev/wanix/fs/fskit"
+)
+
+// testRoot returns the root node of fsys as it would be mounted, without
+// a kernel mount.
+func testRoot(fsys iofs.FS) *node {
+	root := &node{fs: fsys, ctx: context.Background(), opts: &Options{}}
+	root.w = newWatcher(root)
+	fs.NewNodeFS(root, &fs.Options{})
+	return root
+}
+
+func lookup(t *testing.T, n *node, name string) *node {
+	t.Helper()
+	var out fuse.EntryOut
+	in, errno := n.Lookup(context.Background(), name, &out)
+	if errno != 0 {
+		t.Fatalf("lookup %s: %v", name, errno)
+	}
+	// the bridge links looked up inodes into the tree, which gives
+	// them their names
+	n.AddChild(name, in, true)
+	return in.Operations().(*node)
+}
+
+// statusErr is an error with an unsigned value that isn't an errno.
+type statusErr uint
+
+func (e statusErr) Error() string { return fmt.Sprintf("status %d", uint(e)) }
+
+func TestSysErrno(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want syscall.Errno
+	}{
+		{nil, 0},
+		{syscall.EROFS, syscall.EROFS},
+		{&iofs.PathError{Op: "open", Path: "x", Err: syscall.ENOSPC}, syscall.ENOSPC},
+		{fmt.Errorf("relayed: %w", linux.ENAMETOOLONG), syscall.ENAMETOOLONG},
+		{iofs.ErrNotExist, syscall.ENOENT},
+		{iofs.ErrNotEmpty, syscall.ENOTEMPTY},
+		{iofs.ErrNotSupported, syscall.EOPNOTSUPP},
+		// unsigned values that aren't errnos aren't taken for one
+		{fmt.Errorf("wrapped: %w", statusErr(2)), syscall.EIO},
+	} {
+		if got := sysErrno(tt.err); got != tt.want {
+			t.Errorf("sysErrno(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestSetattr(t *testing.T) {
+	fsys := fskit.MemFS{"file": fskit.RawNode([]byte("hello"), iofs.FileMode(0644))}
+	n := lookup(t, testRoot(fsys), "file")
+
+	mtime := time.Unix(1700000000, 0)
+	in := &fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_MODE | fuse.FATTR_SIZE | fuse.FATTR_MTIME
+	in.Mode = 0600
+	in.Size = 2
+	in.Mtime = uint64(mtime.Unix())
+	var out fuse.AttrOut
+	if errno := n.Setattr(context.Background(), nil, in, &out); errno != 0 {
+		t.Fatal(errno)
+	}
+	if out.Mode&0777 != 0600 || out.Size != 2 || out.Mtime != uint64(mtime.Unix()) {
+		t.Fatalf("unexpected attrs: mode %o size %d mtime %d", out.Mode, out.Size, out.Mtime)
+	}
+	b, err := iofs.ReadFile(fsys, "file")
+	if err != nil || string(b) != "he" {
+		t.Fatalf("unexpected contents after truncate: %q %v", b, err)
+	}
+}
+
+func TestRename(t *testing.T) {
+	fsys := fskit.MemFS{
+		"a":     fskit.RawNode([]byte("a")),
+		"b":     fskit.RawNode([]byte("b")),
+		"dir/c": fskit.RawNode([]byte("c")),
+		"empty": fskit.RawNode(iofs.FileMode(0755 | iofs.ModeDir)),
+	}
+	root := testRoot(fsys)
+	ctx := context.Background()
+
+	if errno := root.Rename(ctx, "a", root, "b", renameNoReplace); errno != syscall.EEXIST {
+		t.Fatalf("expected EEXIST renaming onto b with NOREPLACE, got %v", errno)
+	}
+	if errno := root.Rename(ctx, "a", root, "b", fs.RENAME_EXCHANGE); errno != syscall.ENOTSUP {
+		t.Fatalf("expected ENOTSUP exchanging, got %v", errno)
+	}
+	if errno := root.Rename(ctx, "a", root, "new", renameNoReplace); errno != 0 {
+		t.Fatal(errno)
+	}
+	if b, _ := iofs.ReadFile(fsys, "new"); string(b) != "a" {
+		t.Fatalf("unexpected contents after rename: %q", b)
+	}
+
+	dir := lookup(t, root, "dir")
+	if errno := root.Rename(ctx, "b", dir, "b", 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if b, _ := iofs.ReadFile(fsys, "dir/b"); string(b) != "b" {
+		t.Fatalf("unexpected contents after rename into dir: %q", b)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	fsys := fskit.MemFS{
+		"file":  fskit.RawNode([]byte("file")),
+		"dir/c": fskit.RawNode([]byte("c")),
+		"empty": fskit.RawNode(iofs.FileMode(0755 | iofs.ModeDir)),
+	}
+	root := testRoot(fsys)
+	ctx := context.Background()
+
+	if errno := root.Rmdir(ctx, "dir"); errno != syscall.ENOTEMPTY {
+		t.Fatalf("expected ENOTEMPTY removing dir, got %v", errno)
+	}
+	if errno := root.Rmdir(ctx, "file"); errno != syscall.ENOTDIR {
+		t.Fatalf("expected ENOTDIR removing file with rmdir, got %v", errno)
+	}
+	if errno := root.Unlink(ctx, "empty"); errno != syscall.EISDIR {
+		t.Fatalf("expected EISDIR unlinking dir, got %v", errno)
+	}
+	if errno := root.Unlink(ctx, "missing"); errno != syscall.ENOENT {
+		t.Fatalf("expected ENOENT unlinking missing file, got %v", errno)
+	}
+	if errno := root.Rmdir(ctx, "empty"); errno != 0 {
+		t.Fatal(errno)
+	}
+	if errno := root.Unlink(ctx, "file"); errno != 0 {
+		t.Fatal(errno)
+	}
+	if ok, _ := iofs.Exists(fsys, "file"); ok {
+		t.Fatal("expected file to be removed")
+	}
+}
+
+func TestSymlink(t *testing.T) {
+	fsys := fskit.MemFS{"target": fskit.RawNode([]byte("data"))}
+	root := testRoot(fsys)
+	ctx := context.Background()
+
+	var out fuse.EntryOut
+	in, errno := root.Symlink(ctx, "target", "link", &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if out.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		t.Fatalf("expected a symlink, got mode %o", out.Mode)
+	}
+	root.AddChild("link", in, true)
+	target, errno := in.Operations().(*node).Readlink(ctx)
+	if errno != 0 || string(target) != "target" {
+		t.Fatalf("unexpected readlink: %q %v", target, errno)
+	}
+}
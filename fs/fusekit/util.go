@@ -1,29 +1,65 @@
 package fusekit
 
 import (
-	"hash/fnv"
 	iofs "io/fs"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
-func fakeIno(s string) uint64 {
-	h := fnv.New64a() // FNV-1a 64-bit hash
-	h.Write([]byte(s))
-	return h.Sum64()
-}
-
 func applyStat(out *fuse.Attr, fi iofs.FileInfo) {
 	stat := fi.Sys()
 	if s, ok := stat.(*syscall.Stat_t); ok {
 		out.FromStat(s)
 		return
 	}
-	out.Mtime = uint64(fi.ModTime().Unix())
-	out.Mtimensec = uint32(fi.ModTime().UnixNano())
-	out.Mode = uint32(fi.Mode())
+	mtime := fi.ModTime()
+	out.Mtime = uint64(mtime.Unix())
+	out.Mtimensec = uint32(mtime.Nanosecond())
+	out.Atime, out.Atimensec = out.Mtime, out.Mtimensec
+	out.Ctime, out.Ctimensec = out.Mtime, out.Mtimensec
+	out.Mode = fuseMode(fi.Mode())
 	out.Size = uint64(fi.Size())
+	out.Blocks = (out.Size + 511) / 512
+	out.Nlink = 1
+}
+
+// fuseMode converts a FileMode to the S_IF type bits and permissions
+// used by FUSE.
+func fuseMode(mode iofs.FileMode) uint32 {
+	perm := uint32(mode.Perm())
+	if mode&iofs.ModeSetuid != 0 {
+		perm |= syscall.S_ISUID
+	}
+	if mode&iofs.ModeSetgid != 0 {
+		perm |= syscall.S_ISGID
+	}
+	if mode&iofs.ModeSticky != 0 {
+		perm |= syscall.S_ISVTX
+	}
+	switch {
+	case mode.IsDir():
+		return perm | syscall.S_IFDIR
+	case mode&iofs.ModeSymlink != 0:
+		return perm | syscall.S_IFLNK
+	case mode&iofs.ModeNamedPipe != 0:
+		return perm | syscall.S_IFIFO
+	case mode&iofs.ModeSocket != 0:
+		return perm | syscall.S_IFSOCK
+	case mode&iofs.ModeCharDevice != 0:
+		return perm | syscall.S_IFCHR
+	case mode&iofs.ModeDevice != 0:
+		return perm | syscall.S_IFBLK
+	default:
+		return perm | syscall.S_IFREG
+	}
+}
+
+// openFileFlags keeps the open flags fs.OpenFile understands, dropping
+// ones only meaningful to the kernel.
+func openFileFlags(flags uint32) int {
+	return int(flags) & (syscall.O_ACCMODE | syscall.O_APPEND | syscall.O_CREAT |
+		syscall.O_EXCL | syscall.O_SYNC | syscall.O_TRUNC)
 }
 
 func openFlags(flags uint32) []string {
@@ -13,13 +13,13 @@ type MkdirFS interface {
 // Mkdir creates a directory with the given permissions if supported.
 func Mkdir(fsys FS, name string, perm FileMode) error {
 	if m, ok := fsys.(MkdirFS); ok {
-		return m.Mkdir(name, perm)
+		return changed(m.Mkdir(name, perm), fsys, name)
 	}
 
 	ctx := WithOrigin(ContextFor(fsys), fsys, name, "mkdir")
 	rfsys, rname, err := ResolveTo[MkdirFS](fsys, ctx, name) // path.Dir(name))
 	if err == nil {
-		return rfsys.Mkdir(rname, perm) //path.Join(rdir, path.Base(name)), perm)
+		return resolvedChanged(rfsys.Mkdir(rname, perm), fsys, name, rfsys, rname) //path.Join(rdir, path.Base(name)), perm)
 	}
 	return opErr(fsys, name, "mkdir", err)
 }
@@ -32,12 +32,12 @@ type MkdirAllFS interface {
 // MkdirAll creates a directory and any necessary parents with the given permissions if supported.
 func MkdirAll(fsys FS, name string, perm FileMode) error {
 	if m, ok := fsys.(MkdirAllFS); ok {
-		return m.MkdirAll(name, perm)
+		return changed(m.MkdirAll(name, perm), fsys, name)
 	}
 
 	rfsys, rname, err := ResolveTo[MkdirAllFS](fsys, ContextFor(fsys), name) // path.Dir(name))
 	if err == nil {
-		return rfsys.MkdirAll(rname, perm) //path.Join(rdir, path.Base(name)), perm)
+		return resolvedChanged(rfsys.MkdirAll(rname, perm), fsys, name, rfsys, rname) //path.Join(rdir, path.Base(name)), perm)
 	}
 	if !errors.Is(err, ErrNotSupported) {
 		return opErr(fsys, name, "mkdirall", err)
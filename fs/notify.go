@@ -0,0 +1,62 @@
+package fs
+
+import (
+	"sync"
+)
+
+var (
+	watchMu   sync.Mutex
+	watchers  = map[int]func(fsys FS, name string){}
+	nextWatch int
+)
+
+// Watch calls fn with the filesystem and name of every change made through
+// the helpers in this package, like Create, Remove, Rename and Chmod, and
+// any reported with Changed. A change a helper resolved to another
+// filesystem is reported for both names. fn is called after the change,
+// on the goroutine that made it, so it must not block. The returned func
+// stops watching.
+func Watch(fn func(fsys FS, name string)) (stop func()) {
+	watchMu.Lock()
+	defer watchMu.Unlock()
+	id := nextWatch
+	nextWatch++
+	watchers[id] = fn
+	return func() {
+		watchMu.Lock()
+		defer watchMu.Unlock()
+		delete(watchers, id)
+	}
+}
+
+// Changed tells watchers that name in fsys changed, for filesystems that
+// change other than through the helpers in this package.
+func Changed(fsys FS, name string) {
+	watchMu.Lock()
+	fns := make([]func(FS, string), 0, len(watchers))
+	for _, fn := range watchers {
+		fns = append(fns, fn)
+	}
+	watchMu.Unlock()
+	for _, fn := range fns {
+		fn(fsys, name)
+	}
+}
+
+// changed reports a change to name in fsys if err is nil, returning err.
+func changed(err error, fsys FS, name string) error {
+	if err == nil {
+		Changed(fsys, name)
+	}
+	return err
+}
+
+// resolvedChanged reports a change to name in fsys, and to rname in rfsys
+// it resolved to, if err is nil, returning err.
+func resolvedChanged(err error, fsys FS, name string, rfsys FS, rname string) error {
+	if err == nil {
+		Changed(rfsys, rname)
+		Changed(fsys, name)
+	}
+	return err
+}
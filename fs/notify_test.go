@@ -0,0 +1,42 @@
+package fs_test
+
+import (
+	"slices"
+	"testing"
+
+	"tractor.dev/wanix/fs"
+	"tractor.dev/wanix/fs/fskit"
+)
+
+func TestWatch(t *testing.T) {
+	fsys := fskit.MemFS{}
+	var got []string
+	stop := fs.Watch(func(changed fs.FS, name string) {
+		if fs.Equal(changed, fsys) {
+			got = append(got, name)
+		}
+	})
+
+	if err := fs.Mkdir(fsys, "dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile(fsys, "dir/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Rename(fsys, "dir/file", "dir/moved"); err != nil {
+		t.Fatal(err)
+	}
+	// failed changes aren't reported
+	if err := fs.Remove(fsys, "missing"); err == nil {
+		t.Fatal("expected error")
+	}
+	stop()
+	if err := fs.Remove(fsys, "dir/moved"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"dir", "dir/file", "dir/file", "dir/file", "dir/moved"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("expected changes %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,302 @@
+// ocifs mounts OCI image layouts as layered root filesystems
+package ocifs
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"strings"
+
+	"tractor.dev/wanix/fs"
+	"tractor.dev/wanix/fs/fskit"
+	"tractor.dev/wanix/fs/tarfs"
+)
+
+const (
+	MediaTypeIndex          = "application/vnd.oci.image.index.v1+json"
+	MediaTypeManifest       = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+
+	// AnnotationRefName is the index annotation used to look up images by reference.
+	AnnotationRefName = "org.opencontainers.image.ref.name"
+)
+
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *Platform         `json:"platform,omitempty"`
+}
+
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// DefaultPlatform is the platform Load selects without one given, the
+// one the v86 emulator runs.
+var DefaultPlatform = Platform{OS: "linux", Architecture: "386"}
+
+// ParsePlatform parses a platform written as os/arch or os/arch/variant.
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("ocifs: invalid platform %q, expected os/arch[/variant]", s)
+	}
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// matches reports whether an image for p runs on want. A variant only
+// has to match if want has one.
+func (p Platform) matches(want Platform) bool {
+	return p.OS == want.OS && p.Architecture == want.Architecture &&
+		(want.Variant == "" || p.Variant == want.Variant)
+}
+
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+type ImageConfig struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Config       struct {
+		User       string   `json:"User,omitempty"`
+		Env        []string `json:"Env,omitempty"`
+		Entrypoint []string `json:"Entrypoint,omitempty"`
+		Cmd        []string `json:"Cmd,omitempty"`
+		WorkingDir string   `json:"WorkingDir,omitempty"`
+	} `json:"config"`
+}
+
+// Image is an image read from an OCI image layout.
+type Image struct {
+	Manifest Manifest
+	Config   ImageConfig
+	Layers   []fs.FS // bottom layer first
+}
+
+// Load reads the image named ref from the OCI image layout in layout. If ref
+// is empty, the first image in index.json is used. Manifests for platforms
+// other than platform, or DefaultPlatform if nil, are skipped, in nested
+// indexes as well.
+func Load(layout fs.FS, ref string, platform *Platform) (*Image, error) {
+	if platform == nil {
+		platform = &DefaultPlatform
+	}
+	var index Index
+	if err := readJSON(layout, "index.json", &index); err != nil {
+		return nil, err
+	}
+	desc, err := selectManifest(index, ref, *platform)
+	if err != nil {
+		return nil, err
+	}
+	for desc.MediaType == MediaTypeIndex || desc.MediaType == MediaTypeDockerList {
+		var nested Index
+		if err := readBlobJSON(layout, desc, &nested); err != nil {
+			return nil, err
+		}
+		desc, err = selectManifest(nested, "", *platform)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	img := &Image{}
+	if err := readBlobJSON(layout, desc, &img.Manifest); err != nil {
+		return nil, err
+	}
+	if err := readBlobJSON(layout, img.Manifest.Config, &img.Config); err != nil {
+		return nil, err
+	}
+	// a manifest without a platform in the index may still be for another
+	if cfg := img.Config; cfg.Architecture != "" {
+		got := Platform{OS: cfg.OS, Architecture: cfg.Architecture}
+		if !got.matches(Platform{OS: platform.OS, Architecture: platform.Architecture}) {
+			return nil, fmt.Errorf("ocifs: image is for %s, not %s", got, platform)
+		}
+	}
+	for _, layer := range img.Manifest.Layers {
+		lfs, err := loadLayer(layout, layer)
+		if err != nil {
+			return nil, err
+		}
+		img.Layers = append(img.Layers, lfs)
+	}
+	return img, nil
+}
+
+// Mount returns the image layers stacked under a new writable layer.
+func (img *Image) Mount() *LayerFS {
+	return NewLayerFS(fskit.MemFS{}, img.Layers...)
+}
+
+// ConfigFS exposes the image config as a set of files.
+func (img *Image) ConfigFS() fs.FS {
+	lines := func(s []string) []byte {
+		if len(s) == 0 {
+			return nil
+		}
+		return []byte(strings.Join(s, "\n") + "\n")
+	}
+	line := func(s string) []byte {
+		if s == "" {
+			return nil
+		}
+		return []byte(s + "\n")
+	}
+	cfg := img.Config.Config
+	return fskit.MapFS{
+		"env":        fskit.Entry("env", 0444, lines(cfg.Env)),
+		"cmd":        fskit.Entry("cmd", 0444, lines(cfg.Cmd)),
+		"entrypoint": fskit.Entry("entrypoint", 0444, lines(cfg.Entrypoint)),
+		"workdir":    fskit.Entry("workdir", 0444, line(cfg.WorkingDir)),
+		"user":       fskit.Entry("user", 0444, line(cfg.User)),
+	}
+}
+
+func selectManifest(index Index, ref string, platform Platform) (Descriptor, error) {
+	for _, desc := range index.Manifests {
+		if ref != "" && desc.Annotations[AnnotationRefName] != ref {
+			continue
+		}
+		if desc.Platform != nil && !desc.Platform.matches(platform) {
+			continue
+		}
+		return desc, nil
+	}
+	if ref != "" {
+		return Descriptor{}, fmt.Errorf("ocifs: no image for ref %q on %s", ref, platform)
+	}
+	return Descriptor{}, fmt.Errorf("ocifs: no manifest for %s in index", platform)
+}
+
+func blobPath(digest string) (string, error) {
+	alg, hex, ok := strings.Cut(digest, ":")
+	if !ok || alg == "" || hex == "" || strings.Contains(hex, "/") {
+		return "", fmt.Errorf("ocifs: invalid digest %q", digest)
+	}
+	return path.Join("blobs", alg, hex), nil
+}
+
+// openBlob opens the blob for desc, verifying its digest as it is read.
+func openBlob(layout fs.FS, desc Descriptor) (io.ReadCloser, error) {
+	name, err := blobPath(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	alg, _, _ := strings.Cut(desc.Digest, ":")
+	newHash, ok := digestAlgorithms[alg]
+	if !ok {
+		return nil, fmt.Errorf("ocifs: unsupported digest algorithm in %q", desc.Digest)
+	}
+	f, err := layout.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &verifiedReader{f: f, h: newHash(), alg: alg, digest: desc.Digest}, nil
+}
+
+// digestAlgorithms are the digest algorithms of the OCI image spec,
+// which blobs are verified with.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+type verifiedReader struct {
+	f      fs.File
+	h      hash.Hash
+	alg    string
+	digest string
+}
+
+func (r *verifiedReader) Read(p []byte) (int, error) {
+	n, err := r.f.Read(p)
+	r.h.Write(p[:n])
+	if err == io.EOF {
+		if got := r.alg + ":" + hex.EncodeToString(r.h.Sum(nil)); got != r.digest {
+			return n, fmt.Errorf("ocifs: digest mismatch for %s: got %s", r.digest, got)
+		}
+	}
+	return n, err
+}
+
+func (r *verifiedReader) Close() error {
+	return r.f.Close()
+}
+
+func readJSON(fsys fs.FS, name string, v any) error {
+	b, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("ocifs: %s: %w", name, err)
+	}
+	return nil
+}
+
+func readBlobJSON(layout fs.FS, desc Descriptor, v any) error {
+	r, err := openBlob(layout, desc)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("ocifs: blob %s: %w", desc.Digest, err)
+	}
+	return nil
+}
+
+func loadLayer(layout fs.FS, desc Descriptor) (fs.FS, error) {
+	r, err := openBlob(layout, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	// compression is detected from the blob rather than the media type
+	lfs, err := tarfs.Read(r)
+	if err == nil {
+		// read any trailing padding so the digest gets verified
+		_, err = io.Copy(io.Discard, r)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ocifs: layer %s: %w", desc.Digest, err)
+	}
+	return lfs, nil
+}
@@ -0,0 +1,701 @@
+package ocifs
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"tractor.dev/wanix/fs"
+	"tractor.dev/wanix/fs/fskit"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+// LayerFS stacks read-only layers under a writable MemFS using the OCI
+// whiteout conventions. A file named .wh.<name> in a layer hides <name>
+// in the layers below it, and a .wh..wh..opq file hides everything below
+// its directory. Changes are copied up into the top layer, and removals
+// of lower files are recorded there as whiteouts.
+type LayerFS struct {
+	mu     sync.RWMutex // guards upper
+	upper  fskit.MemFS
+	layers []fs.FS // top first, starting with upper
+}
+
+// NewLayerFS returns a LayerFS with upper on top of lower, where lower
+// is ordered from the bottom layer up as in an image manifest.
+func NewLayerFS(upper fskit.MemFS, lower ...fs.FS) *LayerFS {
+	layers := []fs.FS{upper}
+	for i := len(lower) - 1; i >= 0; i-- {
+		layers = append(layers, lower[i])
+	}
+	return &LayerFS{upper: upper, layers: layers}
+}
+
+func isWhiteout(name string) bool {
+	return strings.HasPrefix(path.Base(name), whiteoutPrefix)
+}
+
+func whiteoutFor(name string) string {
+	return path.Join(path.Dir(name), whiteoutPrefix+path.Base(name))
+}
+
+func lstat(fsys fs.FS, name string) (fs.FileInfo, error) {
+	return fs.StatContext(fs.WithNoFollow(context.Background()), fsys, name)
+}
+
+func exists(fsys fs.FS, name string) bool {
+	_, err := lstat(fsys, name)
+	return err == nil
+}
+
+// masks reports whether layer hides name in the layers below it.
+func masks(layer fs.FS, name string) bool {
+	if name == "." {
+		return false
+	}
+	for p := name; p != "."; p = path.Dir(p) {
+		if exists(layer, whiteoutFor(p)) {
+			return true
+		}
+	}
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		if exists(layer, path.Join(dir, opaqueWhiteout)) {
+			return true
+		}
+		if dir == "." {
+			break
+		}
+		if fi, err := lstat(layer, dir); err == nil && !fi.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup finds the topmost layer at or below index from that has name.
+func (fsys *LayerFS) lookup(op, name string, from int) (int, fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return -1, nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if !isWhiteout(name) {
+		for i := from; i < len(fsys.layers); i++ {
+			fi, err := lstat(fsys.layers[i], name)
+			if err == nil {
+				return i, fi, nil
+			}
+			if masks(fsys.layers[i], name) {
+				break
+			}
+		}
+	}
+	return -1, nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+// resolve follows symlinks in the parent directories of name, returning
+// where it is in the layers. Images merging /lib into /usr/lib depend on
+// this for paths like lib/x86_64-linux-gnu/libc.so.6. The last element
+// isn't followed, since not every operation follows it.
+func (fsys *LayerFS) resolve(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return name, nil
+	}
+	dir, rest := ".", strings.Split(name, "/")
+	for hops := 0; len(rest) > 1; {
+		next := path.Join(dir, rest[0])
+		rest = rest[1:]
+		i, fi, err := fsys.lookup(op, next, 0)
+		if err != nil {
+			return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		switch {
+		case fs.IsSymlink(fi.Mode()):
+			if hops++; hops > maxSymlinkHops {
+				return "", &fs.PathError{Op: op, Path: name, Err: syscall.ELOOP}
+			}
+			target, err := fs.Readlink(fsys.layers[i], next)
+			if err != nil {
+				return "", err
+			}
+			// the target may have symlinks of its own, so start over
+			dir, rest = ".", strings.Split(path.Join(linkTarget(next, target), strings.Join(rest, "/")), "/")
+		case fi.IsDir():
+			dir = next
+		default:
+			return "", &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+	}
+	return path.Join(dir, rest[0]), nil
+}
+
+// resolveFollow is resolve, also following the last element if it's a
+// symlink, for operations on what a link points to. A dangling link
+// resolves to its target, so creating through it makes the target.
+func (fsys *LayerFS) resolveFollow(op, name string) (string, error) {
+	name, err := fsys.resolve(op, name)
+	if err != nil {
+		return "", err
+	}
+	if _, fi, err := fsys.lookup(op, name, 0); err == nil && fs.IsSymlink(fi.Mode()) {
+		return fsys.followLink(name)
+	}
+	return name, nil
+}
+
+// maxSymlinkHops is how many symlinks are followed resolving a path.
+const maxSymlinkHops = 40
+
+// linkTarget returns where the symlink at name pointing to target leads,
+// relative to the root. Absolute targets are taken to be relative to
+// the root, and .. stops at the root, as in a chroot of the image.
+func linkTarget(name, target string) string {
+	if !strings.HasPrefix(target, "/") {
+		target = path.Join("/", path.Dir(name), target)
+	}
+	target = path.Clean(target)
+	if target == "/" {
+		return "."
+	}
+	return target[1:]
+}
+
+func (fsys *LayerFS) readDir(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	var entries []fs.DirEntry
+	seen := map[string]bool{}
+	for _, layer := range fsys.layers {
+		fi, err := lstat(layer, name)
+		if err != nil {
+			if masks(layer, name) {
+				break
+			}
+			continue
+		}
+		if !fi.IsDir() {
+			break
+		}
+		list, err := fs.ReadDirContext(ctx, layer, name)
+		if err != nil {
+			return nil, err
+		}
+		var hidden []string
+		for _, e := range list {
+			switch {
+			case e.Name() == opaqueWhiteout:
+			case isWhiteout(e.Name()):
+				hidden = append(hidden, strings.TrimPrefix(e.Name(), whiteoutPrefix))
+			case !seen[e.Name()]:
+				seen[e.Name()] = true
+				entries = append(entries, e)
+			}
+		}
+		for _, n := range hidden {
+			seen[n] = true
+		}
+		if exists(layer, path.Join(name, opaqueWhiteout)) {
+			break
+		}
+	}
+	return entries, nil
+}
+
+func (fsys *LayerFS) Open(name string) (fs.File, error) {
+	ctx := fs.WithOrigin(context.Background(), fsys, name, "open")
+	return fsys.OpenContext(ctx, name)
+}
+
+func (fsys *LayerFS) OpenContext(ctx context.Context, name string) (fs.File, error) {
+	fsys.mu.RLock()
+	f, target, err := fsys.open(ctx, name)
+	fsys.mu.RUnlock()
+	if err != nil || target == "" {
+		return f, err
+	}
+	// the symlink is opened without holding the lock, since it may lead
+	// back into fsys through the origin
+	if origin, fullname, ok := fs.Origin(ctx); ok && !fs.Equal(origin, fsys) {
+		return fs.OpenContext(ctx, origin, path.Join(strings.TrimSuffix(fullname, name), target))
+	}
+	return fsys.OpenContext(ctx, target)
+}
+
+// open opens name, or returns the target to open instead if it's a
+// symlink to follow.
+func (fsys *LayerFS) open(ctx context.Context, name string) (fs.File, string, error) {
+	name, err := fsys.resolve("open", name)
+	if err != nil {
+		return nil, "", err
+	}
+	i, fi, err := fsys.lookup("open", name, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	if fs.FollowSymlinks(ctx) && fs.IsSymlink(fi.Mode()) {
+		target, err := fsys.followLink(name)
+		return nil, target, err
+	}
+	if !fi.IsDir() {
+		f, err := fs.OpenContext(ctx, fsys.layers[i], name)
+		return f, "", err
+	}
+	entries, err := fsys.readDir(ctx, name)
+	if err != nil {
+		return nil, "", err
+	}
+	return fskit.DirFile(fskit.RawNode(fi, name), entries...), "", nil
+}
+
+// followLink resolves the symlink at name to a path relative to the root
+// of fsys.
+func (fsys *LayerFS) followLink(name string) (string, error) {
+	for hops := 0; hops < maxSymlinkHops; hops++ {
+		target, err := fsys.readlink(name)
+		if err != nil {
+			return "", err
+		}
+		name, err = fsys.resolve("open", linkTarget(name, target))
+		if err != nil {
+			return "", err
+		}
+		_, fi, err := fsys.lookup("open", name, 0)
+		if err != nil || !fs.IsSymlink(fi.Mode()) {
+			return name, nil
+		}
+	}
+	return "", &fs.PathError{Op: "open", Path: name, Err: syscall.ELOOP}
+}
+
+func (fsys *LayerFS) Stat(name string) (fs.FileInfo, error) {
+	ctx := fs.WithOrigin(context.Background(), fsys, name, "stat")
+	return fsys.StatContext(ctx, name)
+}
+
+func (fsys *LayerFS) StatContext(ctx context.Context, name string) (fs.FileInfo, error) {
+	fsys.mu.RLock()
+	fi, err := fsys.stat(name)
+	fsys.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if fs.FollowSymlinks(ctx) && fs.IsSymlink(fi.Mode()) {
+		f, err := fsys.OpenContext(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return f.Stat()
+	}
+	return fi, nil
+}
+
+// stat returns the info of name without following it if it's a symlink.
+func (fsys *LayerFS) stat(name string) (fs.FileInfo, error) {
+	name, err := fsys.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	_, fi, err := fsys.lookup("stat", name, 0)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		// directory names from lower layers are not always the base name
+		return fskit.RawNode(fi, name), nil
+	}
+	return fi, nil
+}
+
+func (fsys *LayerFS) ReadDirContext(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	fsys.mu.RLock()
+	defer fsys.mu.RUnlock()
+	name, err := fsys.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	_, fi, err := fsys.lookup("readdir", name, 0)
+	if err != nil {
+		return nil, err
+	}
+	if fs.IsSymlink(fi.Mode()) {
+		if name, err = fsys.followLink(name); err != nil {
+			return nil, err
+		}
+		if _, fi, err = fsys.lookup("readdir", name, 0); err != nil {
+			return nil, err
+		}
+	}
+	if !fi.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	return fsys.readDir(ctx, name)
+}
+
+func (fsys *LayerFS) Readlink(name string) (string, error) {
+	fsys.mu.RLock()
+	defer fsys.mu.RUnlock()
+	name, err := fsys.resolve("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	return fsys.readlink(name)
+}
+
+func (fsys *LayerFS) readlink(name string) (string, error) {
+	i, fi, err := fsys.lookup("readlink", name, 0)
+	if err != nil {
+		return "", err
+	}
+	if !fs.IsSymlink(fi.Mode()) {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return fs.Readlink(fsys.layers[i], name)
+}
+
+// copyUp makes sure name and its parent directories are in the upper layer.
+func (fsys *LayerFS) copyUp(op, name string) error {
+	i, fi, err := fsys.lookup(op, name, 0)
+	if err != nil {
+		return err
+	}
+	if i == 0 {
+		return nil
+	}
+	if err := fsys.copyUpParents(op, name); err != nil {
+		return err
+	}
+	layer := fsys.layers[i]
+	switch {
+	case fi.IsDir():
+		fsys.upper[name] = fskit.Entry(name, fi.Mode(), fi.ModTime())
+	case fs.IsSymlink(fi.Mode()):
+		target, err := fs.Readlink(layer, name)
+		if err != nil {
+			return err
+		}
+		fsys.upper[name] = fskit.Entry(name, fi.Mode(), []byte(target), fi.ModTime())
+	default:
+		f, err := fs.OpenContext(fs.WithNoFollow(context.Background()), layer, name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		fsys.upper[name] = fskit.Entry(name, fi.Mode(), data, fi.ModTime())
+	}
+	return nil
+}
+
+func (fsys *LayerFS) copyUpParents(op, name string) error {
+	dir := path.Dir(name)
+	if dir == "." {
+		return nil
+	}
+	_, fi, err := fsys.lookup(op, dir, 0)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	return fsys.copyUp(op, dir)
+}
+
+// prepareNew readies the upper layer for a new file at name.
+func (fsys *LayerFS) prepareNew(op, name string) (whitedOut bool, err error) {
+	if _, _, err := fsys.lookup(op, name, 0); err == nil {
+		return false, &fs.PathError{Op: op, Path: name, Err: fs.ErrExist}
+	}
+	if err := fsys.copyUpParents(op, name); err != nil {
+		return false, err
+	}
+	wh := whiteoutFor(name)
+	if _, ok := fsys.upper[wh]; ok {
+		delete(fsys.upper, wh)
+		whitedOut = true
+	}
+	return whitedOut, nil
+}
+
+func (fsys *LayerFS) Create(name string) (fs.File, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	name, err := fsys.resolveFollow("create", name)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := fsys.lookup("create", name, 0); err == nil {
+		// truncate existing
+		if err := fsys.copyUp("create", name); err != nil {
+			return nil, err
+		}
+		if n := fsys.upper[name]; !n.IsDir() {
+			fskit.SetData(n, nil)
+		}
+		return fsys.upper.Create(name)
+	}
+	if _, err := fsys.prepareNew("create", name); err != nil {
+		return nil, err
+	}
+	return fsys.upper.Create(name)
+}
+
+func (fsys *LayerFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) == 0 {
+		return fsys.Open(name)
+	}
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	resolve := fsys.resolveFollow
+	if flag&os.O_EXCL != 0 && flag&os.O_CREATE != 0 {
+		// exclusive creates fail on any symlink, even a dangling one
+		resolve = fsys.resolve
+	}
+	name, err := resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	_, _, err = fsys.lookup("open", name, 0)
+	if err != nil {
+		if flag&os.O_CREATE == 0 {
+			return nil, err
+		}
+		if _, err := fsys.prepareNew("open", name); err != nil {
+			return nil, err
+		}
+		f, err := fsys.upper.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		if err := fsys.upper.Chmod(name, perm); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+	if flag&os.O_EXCL != 0 && flag&os.O_CREATE != 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	}
+	if err := fsys.copyUp("open", name); err != nil {
+		return nil, err
+	}
+	if flag&os.O_TRUNC != 0 {
+		fskit.SetData(fsys.upper[name], nil)
+	}
+	f, err := fsys.upper.OpenContext(context.Background(), name)
+	if err != nil {
+		return nil, err
+	}
+	if flag&os.O_APPEND != 0 {
+		if _, err := fs.Seek(f, 0, io.SeekEnd); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (fsys *LayerFS) Mkdir(name string, perm fs.FileMode) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	name, err := fsys.resolve("mkdir", name)
+	if err != nil {
+		return err
+	}
+	whitedOut, err := fsys.prepareNew("mkdir", name)
+	if err != nil {
+		return err
+	}
+	fsys.upper[name] = fskit.Entry(name, fs.ModeDir|perm.Perm(), time.Now())
+	if whitedOut {
+		// keep the contents of the removed lower directory hidden
+		fsys.upper[path.Join(name, opaqueWhiteout)] = fskit.Entry(opaqueWhiteout, 0)
+	}
+	return nil
+}
+
+func (fsys *LayerFS) Symlink(oldname, newname string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	newname, err := fsys.resolve("symlink", newname)
+	if err != nil {
+		return err
+	}
+	if _, err := fsys.prepareNew("symlink", newname); err != nil {
+		return err
+	}
+	return fsys.upper.Symlink(oldname, newname)
+}
+
+func (fsys *LayerFS) Remove(name string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	name, err := fsys.resolve("remove", name)
+	if err != nil {
+		return err
+	}
+	return fsys.remove(name)
+}
+
+func (fsys *LayerFS) remove(name string) error {
+	if name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+	_, fi, err := fsys.lookup("remove", name, 0)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		entries, err := fsys.readDir(context.Background(), name)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotEmpty}
+		}
+	}
+	fsys.removeUpper(name)
+	if _, _, err := fsys.lookup("remove", name, 1); err == nil {
+		if err := fsys.copyUpParents("remove", name); err != nil {
+			return err
+		}
+		fsys.upper[whiteoutFor(name)] = fskit.Entry(whiteoutFor(name), 0)
+	}
+	return nil
+}
+
+// removeUpper deletes name and anything under it from the upper layer.
+func (fsys *LayerFS) removeUpper(name string) {
+	delete(fsys.upper, name)
+	prefix := name + "/"
+	for n := range fsys.upper {
+		if strings.HasPrefix(n, prefix) {
+			delete(fsys.upper, n)
+		}
+	}
+}
+
+// Rename moves oldname to newname. Like overlayfs, directories with
+// contents in the lower layers aren't moved, failing with EXDEV so
+// callers copy them instead, since they'd have to be copied up whole.
+func (fsys *LayerFS) Rename(oldname, newname string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	oldname, err := fsys.resolve("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newname, err = fsys.resolve("rename", newname)
+	if err != nil {
+		return err
+	}
+	if oldname == newname {
+		return nil
+	}
+	_, fi, err := fsys.lookup("rename", oldname, 0)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() && fsys.inLower(oldname) && !exists(fsys.upper, path.Join(oldname, opaqueWhiteout)) {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: syscall.EXDEV}
+	}
+	if err := fsys.copyUp("rename", oldname); err != nil {
+		return err
+	}
+	if _, _, err := fsys.lookup("rename", newname, 0); err == nil {
+		if err := fsys.remove(newname); err != nil {
+			return err
+		}
+	}
+	if _, err := fsys.prepareNew("rename", newname); err != nil {
+		return err
+	}
+
+	prefix := oldname + "/"
+	for n, node := range fsys.upper {
+		if n == oldname || strings.HasPrefix(n, prefix) {
+			nn := newname + strings.TrimPrefix(n, oldname)
+			delete(fsys.upper, n)
+			fsys.upper[nn] = node
+		}
+	}
+	if fi.IsDir() {
+		fsys.upper[path.Join(newname, opaqueWhiteout)] = fskit.Entry(opaqueWhiteout, 0)
+	}
+	if _, _, err := fsys.lookup("rename", oldname, 1); err == nil {
+		fsys.upper[whiteoutFor(oldname)] = fskit.Entry(whiteoutFor(oldname), 0)
+	}
+	return nil
+}
+
+// inLower reports whether name is in a lower layer and not hidden by
+// the upper layer.
+func (fsys *LayerFS) inLower(name string) bool {
+	if masks(fsys.upper, name) {
+		return false
+	}
+	_, _, err := fsys.lookup("lookup", name, 1)
+	return err == nil
+}
+
+func (fsys *LayerFS) Chmod(name string, mode fs.FileMode) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	name, err := fsys.resolveFollow("chmod", name)
+	if err != nil {
+		return err
+	}
+	if err := fsys.copyUp("chmod", name); err != nil {
+		return err
+	}
+	return fsys.upper.Chmod(name, mode)
+}
+
+func (fsys *LayerFS) Chtimes(name string, atime, mtime time.Time) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	name, err := fsys.resolveFollow("chtimes", name)
+	if err != nil {
+		return err
+	}
+	if err := fsys.copyUp("chtimes", name); err != nil {
+		return err
+	}
+	return fsys.upper.Chtimes(name, atime, mtime)
+}
+
+func (fsys *LayerFS) Truncate(name string, size int64) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	name, err := fsys.resolveFollow("truncate", name)
+	if err != nil {
+		return err
+	}
+	if err := fsys.copyUp("truncate", name); err != nil {
+		return err
+	}
+	n := fsys.upper[name]
+	if n.IsDir() {
+		return &fs.PathError{Op: "truncate", Path: name, Err: fs.ErrInvalid}
+	}
+	data := n.Data()
+	if int64(len(data)) >= size {
+		data = data[:size]
+	} else {
+		data = append(data, make([]byte, size-int64(len(data)))...)
+	}
+	fskit.SetData(n, data)
+	return nil
+}
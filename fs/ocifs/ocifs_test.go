@@ -0,0 +1,464 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+
+	"tractor.dev/wanix/fs"
+	"tractor.dev/wanix/fs/fskit"
+	"tractor.dev/wanix/fs/tarfs"
+)
+
+type tarEntry struct {
+	name string
+	data string
+	link string
+	dir  bool
+}
+
+func makeLayer(t *testing.T, compress bool, entries ...tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.data))}
+		switch {
+		case e.dir:
+			hdr.Typeflag = tar.TypeDir
+			hdr.Mode = 0755
+		case e.link != "":
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = e.link
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(e.data))
+	}
+	tw.Close()
+	if !compress {
+		return buf.Bytes()
+	}
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(buf.Bytes())
+	gw.Close()
+	return gz.Bytes()
+}
+
+func addBlob(layout fskit.MemFS, mediaType string, b []byte) Descriptor {
+	sum := sha256.Sum256(b)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	layout["blobs/sha256/"+hex.EncodeToString(sum[:])] = fskit.RawNode(b, fs.FileMode(0644))
+	return Descriptor{MediaType: mediaType, Digest: digest, Size: int64(len(b))}
+}
+
+func addJSON(t *testing.T, layout fskit.MemFS, mediaType string, v any) Descriptor {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addBlob(layout, mediaType, b)
+}
+
+// fixtureLayout builds a two layer image layout where the second
+// layer removes and replaces files from the first.
+func fixtureLayout(t *testing.T) fskit.MemFS {
+	layout := fskit.MemFS{}
+	base := addBlob(layout, "application/vnd.oci.image.layer.v1.tar", makeLayer(t, false,
+		tarEntry{name: "bin/", dir: true},
+		tarEntry{name: "bin/busybox", data: "busybox"},
+		tarEntry{name: "bin/sh", link: "busybox"},
+		tarEntry{name: "etc/hostname", data: "base"},
+		tarEntry{name: "etc/passwd", data: "root:x:0:0"},
+		tarEntry{name: "var/lib/data/old", data: "old"},
+	))
+	top := addBlob(layout, "application/vnd.oci.image.layer.v1.tar+gzip", makeLayer(t, true,
+		tarEntry{name: "etc/.wh.hostname"},
+		tarEntry{name: "etc/motd", data: "welcome"},
+		tarEntry{name: "var/lib/data/.wh..wh..opq"},
+		tarEntry{name: "var/lib/data/new", data: "new"},
+	))
+	var config ImageConfig
+	config.Config.Env = []string{"PATH=/bin", "HOME=/root"}
+	config.Config.Cmd = []string{"/bin/sh"}
+	config.Config.WorkingDir = "/root"
+	manifest := addJSON(t, layout, MediaTypeManifest, Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		Config:        addJSON(t, layout, "application/vnd.oci.image.config.v1+json", config),
+		Layers:        []Descriptor{base, top},
+	})
+	manifest.Annotations = map[string]string{AnnotationRefName: "latest"}
+	b, _ := json.Marshal(Index{SchemaVersion: 2, Manifests: []Descriptor{manifest}})
+	layout["index.json"] = fskit.RawNode(b, fs.FileMode(0644))
+	layout["oci-layout"] = fskit.RawNode([]byte(`{"imageLayoutVersion":"1.0.0"}`), fs.FileMode(0644))
+	return layout
+}
+
+func readDirNames(t *testing.T, fsys fs.FS, name string) []string {
+	t.Helper()
+	entries, err := fs.ReadDir(fsys, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestLoadImage(t *testing.T) {
+	img, err := Load(fixtureLayout(t), "latest", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := img.Mount()
+
+	if names := readDirNames(t, fsys, "etc"); !slices.Equal(names, []string{"motd", "passwd"}) {
+		t.Fatalf("unexpected etc entries: %v", names)
+	}
+	if _, err := fs.Stat(fsys, "etc/hostname"); err == nil {
+		t.Fatal("expected whiteout to hide etc/hostname")
+	}
+	if names := readDirNames(t, fsys, "var/lib/data"); !slices.Equal(names, []string{"new"}) {
+		t.Fatalf("expected opaque dir to hide lower entries, got: %v", names)
+	}
+	if _, err := fs.Stat(fsys, "var/lib/data/old"); err == nil {
+		t.Fatal("expected opaque dir to hide var/lib/data/old")
+	}
+	b, err := fs.ReadFile(fsys, "bin/sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "busybox" {
+		t.Fatalf("unexpected symlink contents: %q", b)
+	}
+
+	cfg := img.ConfigFS()
+	for name, want := range map[string]string{
+		"env":     "PATH=/bin\nHOME=/root\n",
+		"cmd":     "/bin/sh\n",
+		"workdir": "/root\n",
+	} {
+		b, err := fs.ReadFile(cfg, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Fatalf("config %s: got %q, want %q", name, b, want)
+		}
+	}
+}
+
+func TestLoadDigestMismatch(t *testing.T) {
+	layout := fixtureLayout(t)
+	// corrupt the gzipped layer
+	for name, n := range layout {
+		if strings.HasPrefix(name, "blobs/") && bytes.HasPrefix(n.Data(), []byte{0x1f, 0x8b}) {
+			data := slices.Clone(n.Data())
+			data[len(data)-1] ^= 0xff
+			fskit.SetData(n, data)
+		}
+	}
+	if _, err := Load(layout, "", nil); err == nil {
+		t.Fatal("expected digest mismatch error")
+	}
+}
+
+// archManifest adds an image for arch with its name in etc/arch.
+func archManifest(t *testing.T, layout fskit.MemFS, arch string) Descriptor {
+	t.Helper()
+	layer := addBlob(layout, "application/vnd.oci.image.layer.v1.tar", makeLayer(t, false,
+		tarEntry{name: "etc/arch", data: arch},
+	))
+	config := ImageConfig{OS: "linux", Architecture: arch}
+	return addJSON(t, layout, MediaTypeManifest, Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		Config:        addJSON(t, layout, "application/vnd.oci.image.config.v1+json", config),
+		Layers:        []Descriptor{layer},
+	})
+}
+
+func TestLoadPlatform(t *testing.T) {
+	layout := fskit.MemFS{}
+	var manifests []Descriptor
+	for _, arch := range []string{"amd64", "386"} {
+		desc := archManifest(t, layout, arch)
+		desc.Platform = &Platform{OS: "linux", Architecture: arch}
+		manifests = append(manifests, desc)
+	}
+	nested := addJSON(t, layout, MediaTypeIndex, Index{SchemaVersion: 2, MediaType: MediaTypeIndex, Manifests: manifests})
+	nested.Annotations = map[string]string{AnnotationRefName: "latest"}
+	b, _ := json.Marshal(Index{SchemaVersion: 2, Manifests: []Descriptor{nested}})
+	layout["index.json"] = fskit.RawNode(b, fs.FileMode(0644))
+
+	for _, tt := range []struct {
+		platform *Platform
+		want     string
+	}{
+		{nil, "386"},
+		{&Platform{OS: "linux", Architecture: "amd64"}, "amd64"},
+	} {
+		img, err := Load(layout, "latest", tt.platform)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := fs.ReadFile(img.Mount(), "etc/arch")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.want {
+			t.Fatalf("platform %v: got the %s image, want %s", tt.platform, b, tt.want)
+		}
+	}
+	if _, err := Load(layout, "latest", &Platform{OS: "linux", Architecture: "arm64"}); err == nil {
+		t.Fatal("expected no image for linux/arm64")
+	}
+
+	// an image with no platform in the index is checked by its config
+	single := fskit.MemFS{}
+	b, _ = json.Marshal(Index{SchemaVersion: 2, Manifests: []Descriptor{archManifest(t, single, "amd64")}})
+	single["index.json"] = fskit.RawNode(b, fs.FileMode(0644))
+	if _, err := Load(single, "", nil); err == nil || !strings.Contains(err.Error(), "linux/amd64") {
+		t.Fatalf("expected a linux/amd64 image to be refused, got %v", err)
+	}
+}
+
+func TestParsePlatform(t *testing.T) {
+	for s, want := range map[string]Platform{
+		"linux/386":      {OS: "linux", Architecture: "386"},
+		"linux/arm64/v8": {OS: "linux", Architecture: "arm64", Variant: "v8"},
+	} {
+		p, err := ParsePlatform(s)
+		if err != nil || p != want || p.String() != s {
+			t.Fatalf("%s: got %v, %v", s, p, err)
+		}
+	}
+	for _, s := range []string{"", "linux", "linux/", "/386", "linux/arm/v7/x"} {
+		if _, err := ParsePlatform(s); err == nil {
+			t.Fatalf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestLoadUnsupportedDigest(t *testing.T) {
+	layout := fixtureLayout(t)
+	var index Index
+	if err := json.Unmarshal(layout["index.json"].Data(), &index); err != nil {
+		t.Fatal(err)
+	}
+	_, sum, _ := strings.Cut(index.Manifests[0].Digest, ":")
+	index.Manifests[0].Digest = "md5:" + sum
+	layout["blobs/md5/"+sum] = layout["blobs/sha256/"+sum]
+	b, _ := json.Marshal(index)
+	layout["index.json"] = fskit.RawNode(b, fs.FileMode(0644))
+	if _, err := Load(layout, "", nil); err == nil || !strings.Contains(err.Error(), "unsupported digest") {
+		t.Fatalf("expected an unsupported digest error, got %v", err)
+	}
+}
+
+func TestLayerFSWrites(t *testing.T) {
+	img, err := Load(fixtureLayout(t), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := img.Mount()
+
+	if err := fs.WriteFile(fsys, "etc/passwd", []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := fs.ReadFile(fsys, "etc/passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "changed" {
+		t.Fatalf("unexpected contents after write: %q", b)
+	}
+	b, _ = fs.ReadFile(img.Layers[0], "etc/passwd")
+	if string(b) != "root:x:0:0" {
+		t.Fatalf("lower layer was modified: %q", b)
+	}
+
+	if err := fs.Remove(fsys, "bin/busybox"); err != nil {
+		t.Fatal(err)
+	}
+	if names := readDirNames(t, fsys, "bin"); !slices.Equal(names, []string{"sh"}) {
+		t.Fatalf("unexpected bin entries after remove: %v", names)
+	}
+
+	if err := fs.Remove(fsys, "var/lib/data/new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove(fsys, "var/lib/data"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir(fsys, "var/lib/data", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if names := readDirNames(t, fsys, "var/lib/data"); len(names) != 0 {
+		t.Fatalf("expected recreated dir to be empty, got: %v", names)
+	}
+
+	if err := fs.Rename(fsys, "etc/motd", "etc/issue"); err != nil {
+		t.Fatal(err)
+	}
+	if names := readDirNames(t, fsys, "etc"); !slices.Equal(names, []string{"issue", "passwd"}) {
+		t.Fatalf("unexpected etc entries after rename: %v", names)
+	}
+}
+
+func TestLayerFSIntermediateSymlinks(t *testing.T) {
+	// a usrmerge layer, where lib is a symlink into usr
+	base, err := tarfs.Read(bytes.NewReader(makeLayer(t, false,
+		tarEntry{name: "usr/lib/x86_64-linux-gnu/", dir: true},
+		tarEntry{name: "usr/lib/x86_64-linux-gnu/libc.so.6", data: "libc"},
+		tarEntry{name: "lib", link: "usr/lib"},
+		tarEntry{name: "lib64", link: "/lib"},
+		tarEntry{name: "loop", link: "loop/x"},
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := NewLayerFS(fskit.MemFS{}, base)
+
+	for _, name := range []string{
+		"lib/x86_64-linux-gnu/libc.so.6",
+		"lib64/x86_64-linux-gnu/libc.so.6",
+	} {
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "libc" {
+			t.Fatalf("unexpected contents of %s: %q", name, b)
+		}
+	}
+	if names := readDirNames(t, fsys, "lib64"); !slices.Equal(names, []string{"x86_64-linux-gnu"}) {
+		t.Fatalf("unexpected lib64 entries: %v", names)
+	}
+	if _, err := fs.Stat(fsys, "loop/x/y"); err == nil {
+		t.Fatal("expected error resolving a symlink loop")
+	}
+
+	if err := fs.WriteFile(fsys, "lib/x86_64-linux-gnu/libm.so.6", []byte("libm"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := fs.ReadFile(fsys, "usr/lib/x86_64-linux-gnu/libm.so.6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "libm" {
+		t.Fatalf("unexpected contents after write through symlink: %q", b)
+	}
+}
+
+func TestLayerFSFinalSymlinks(t *testing.T) {
+	base, err := tarfs.Read(bytes.NewReader(makeLayer(t, false,
+		tarEntry{name: "etc/", dir: true},
+		tarEntry{name: "run/", dir: true},
+		tarEntry{name: "run/resolv.conf", data: "nameserver 1.1.1.1\n"},
+		tarEntry{name: "etc/resolv.conf", link: "../run/resolv.conf"},
+		tarEntry{name: "etc/motd", link: "/run/motd"},
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := NewLayerFS(fskit.MemFS{}, base)
+
+	f, err := fs.OpenFile(fsys, "etc/resolv.conf", os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Write(f, []byte("nameserver 10.0.0.1\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := fs.Readlink(fsys, "etc/resolv.conf"); err != nil || target != "../run/resolv.conf" {
+		t.Fatalf("expected the symlink to stay, got %q, %v", target, err)
+	}
+	for _, name := range []string{"etc/resolv.conf", "run/resolv.conf"} {
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "nameserver 10.0.0.1\n" {
+			t.Fatalf("unexpected contents of %s: %q", name, b)
+		}
+	}
+
+	if err := fs.Truncate(fsys, "etc/resolv.conf", 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Chmod(fsys, "etc/resolv.conf", 0600); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := fs.Stat(fsys, "run/resolv.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 10 || fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected the target truncated and chmoded, got size %d mode %v", fi.Size(), fi.Mode())
+	}
+	if fi, err := lstat(fsys, "etc/resolv.conf"); err != nil || !fs.IsSymlink(fi.Mode()) {
+		t.Fatalf("expected etc/resolv.conf to stay a symlink, got %v", err)
+	}
+
+	// creating through a dangling symlink makes its target
+	if err := fs.WriteFile(fsys, "etc/motd", []byte("hi"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := fs.ReadFile(fsys, "run/motd"); err != nil || string(b) != "hi" {
+		t.Fatalf("expected run/motd to be made, got %q, %v", b, err)
+	}
+	if _, err := fs.OpenFile(fsys, "etc/motd", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("expected exclusive create of a symlink to fail, got %v", err)
+	}
+}
+
+func TestLayerFSRenameDir(t *testing.T) {
+	img, err := Load(fixtureLayout(t), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := img.Mount()
+
+	if err := fs.Rename(fsys, "etc", "etc2"); !errors.Is(err, syscall.EXDEV) {
+		t.Fatalf("expected EXDEV renaming a lower dir, got: %v", err)
+	}
+
+	if err := fs.Mkdir(fsys, "opt", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile(fsys, "opt/app", []byte("app"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Rename(fsys, "opt", "srv"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := fs.ReadFile(fsys, "srv/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "app" {
+		t.Fatalf("unexpected contents after rename: %q", b)
+	}
+	if _, err := fs.Stat(fsys, "opt"); err == nil {
+		t.Fatal("expected old dir to be gone after rename")
+	}
+}
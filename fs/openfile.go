@@ -12,7 +12,11 @@ type OpenFileFS interface {
 // OpenFile is a helper that opens a file with the given flag and permissions if supported.
 func OpenFile(fsys FS, name string, flag int, perm FileMode) (File, error) {
 	if o, ok := fsys.(OpenFileFS); ok {
-		return o.OpenFile(name, flag, perm)
+		f, err := o.OpenFile(name, flag, perm)
+		if flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+			err = changed(err, fsys, name)
+		}
+		return f, err
 	}
 
 	ctx := ContextFor(fsys)
@@ -22,7 +26,11 @@ func OpenFile(fsys FS, name string, flag int, perm FileMode) (File, error) {
 
 	rfsys, rname, err := ResolveTo[OpenFileFS](fsys, ctx, name)
 	if err == nil {
-		return rfsys.OpenFile(rname, flag, perm)
+		f, err := rfsys.OpenFile(rname, flag, perm)
+		if flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+			err = resolvedChanged(err, fsys, name, rfsys, rname)
+		}
+		return f, err
 	}
 
 	// Log all open flags
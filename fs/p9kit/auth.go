@@ -0,0 +1,217 @@
+package p9kit
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/hugelgupf/p9/linux"
+)
+
+// Authentication is a challenge-response over the auth fid. After Tauth
+// the client reads a random challenge from the afid and writes back
+// HMAC-SHA256 of the challenge, uname and aname keyed with a secret it
+// shares with the server. The afid can then be given to Tattach for the
+// same uname and aname.
+
+// challengeSize is the length of the random challenge read from an afid.
+const challengeSize = 32
+
+// KeyFunc returns the key a client must hold to attach to aname as
+// uname. Returning false refuses the attach outright.
+type KeyFunc func(uname, aname string) ([]byte, bool)
+
+// PSK returns a KeyFunc requiring the same pre-shared key for every
+// user and tree.
+func PSK(key []byte) KeyFunc {
+	return func(uname, aname string) ([]byte, bool) {
+		return key, true
+	}
+}
+
+// Tokens returns a KeyFunc requiring a separate token for each attach
+// name, such as one per published task namespace. Names without a token
+// can't be attached.
+func Tokens(tokens map[string][]byte) KeyFunc {
+	t := make(map[string][]byte, len(tokens))
+	for aname, token := range tokens {
+		t[treeName(aname)] = token
+	}
+	return func(uname, aname string) ([]byte, bool) {
+		token, ok := t[aname]
+		return token, ok
+	}
+}
+
+// authMAC is the response to challenge for uname attaching to aname.
+func authMAC(key, challenge []byte, uname, aname string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(challenge)
+	h.Write([]byte{0})
+	h.Write([]byte(uname))
+	h.Write([]byte{0})
+	h.Write([]byte(aname))
+	return h.Sum(nil)
+}
+
+// authFid is the server side of an auth fid.
+type authFid struct {
+	mu        sync.Mutex
+	uname     string
+	aname     string
+	key       []byte
+	challenge []byte
+	verified  bool
+}
+
+func newAuthFid(keys KeyFunc, uname, aname string) (*authFid, error) {
+	aname = treeName(aname)
+	key, ok := keys(uname, aname)
+	if !ok {
+		return nil, linux.EACCES
+	}
+	challenge := make([]byte, challengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	return &authFid{
+		uname:     uname,
+		aname:     aname,
+		key:       key,
+		challenge: challenge,
+	}, nil
+}
+
+// read returns the challenge.
+func (a *authFid) read(offset uint64, count uint32) []byte {
+	if offset >= uint64(len(a.challenge)) {
+		return nil
+	}
+	b := a.challenge[offset:]
+	return b[:min(uint32(len(b)), count)]
+}
+
+// write checks a response to the challenge.
+func (a *authFid) write(data []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !hmac.Equal(data, authMAC(a.key, a.challenge, a.uname, a.aname)) {
+		return linux.EACCES
+	}
+	a.verified = true
+	return nil
+}
+
+// check reports whether the afid allows attaching to aname as uname.
+func (a *authFid) check(uname, aname string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.verified || a.uname != uname || a.aname != treeName(aname) {
+		return linux.EACCES
+	}
+	return nil
+}
+
+// clientAfid is the client's fid for the auth exchange, high enough that the
+// p9 client won't hand it out before it runs out of fids.
+const clientAfid = noFid - 1
+
+// authConn runs the auth exchange on a connection before the p9 client
+// attaches, then rewrites the client's Tattach to use the auth fid.
+type authConn struct {
+	net.Conn
+	w *frameWriter
+
+	mu    sync.Mutex
+	uname string
+	afid  uint32
+}
+
+func newAuthConn(conn net.Conn) *authConn {
+	c := &authConn{Conn: conn, afid: noFid}
+	c.w = &frameWriter{w: conn, filter: c.rewrite}
+	return c
+}
+
+func (c *authConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c *authConn) rewrite(msg []byte) []byte {
+	if msg[4] != msgTattach {
+		return msg
+	}
+	f, err := parseFcall(msg, true)
+	if err != nil {
+		return msg
+	}
+	c.mu.Lock()
+	f.afid, f.uname = c.afid, c.uname
+	c.mu.Unlock()
+	return attachMsg(f)
+}
+
+// auth proves the client holds key. It must run while no other requests
+// are outstanding, since it reads replies straight off the connection.
+func (c *authConn) auth(uname, aname string, key []byte) error {
+	m := newReply(msgTauth, 0)
+	m.put32(clientAfid)
+	m.putStr(uname)
+	m.putStr(aname)
+	m.put32(noFid)
+	if _, err := c.rpc(m, msgRauth); err != nil {
+		return err
+	}
+
+	m = newReply(msgTread, 0)
+	m.put32(clientAfid)
+	m.put64(0)
+	m.put32(challengeSize)
+	r, err := c.rpc(m, msgRread)
+	if err != nil {
+		return err
+	}
+	challenge := r.get(int(r.get32()))
+	if r.short {
+		return errShortMsg
+	}
+
+	mac := authMAC(key, challenge, uname, treeName(aname))
+	m = newReply(msgTwrite, 0)
+	m.put32(clientAfid)
+	m.put64(0)
+	m.put32(uint32(len(mac)))
+	m.b = append(m.b, mac...)
+	if _, err := c.rpc(m, msgRwrite); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.uname, c.afid = uname, clientAfid
+	c.mu.Unlock()
+	return nil
+}
+
+// rpc sends a 9P2000.L request and reads its reply, returning the reply
+// body after the header.
+func (c *authConn) rpc(m *msgBuf, want uint8) (*msgBuf, error) {
+	if err := c.w.writeMsg(m.bytes()); err != nil {
+		return nil, err
+	}
+	msg, err := readMsg(c.Conn, maxFrameSize)
+	if err != nil {
+		return nil, err
+	}
+	r := &msgBuf{b: msg[7:]}
+	switch msg[4] {
+	case want:
+		return r, nil
+	case msgRlerror:
+		return nil, linux.Errno(r.get32())
+	default:
+		return nil, fmt.Errorf("p9kit: unexpected reply type %d", msg[4])
+	}
+}
@@ -0,0 +1,114 @@
+package p9kit
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"9fans.net/go/plan9/client"
+	"tractor.dev/wanix/fs"
+	"tractor.dev/wanix/fs/fskit"
+)
+
+func authServer(keys KeyFunc) *Server {
+	srv := NewServer(fskit.MemFS{
+		"file": fskit.RawNode([]byte("secret")),
+	})
+	srv.Publish("task/1", fskit.MemFS{
+		"file": fskit.RawNode([]byte("task")),
+	})
+	srv.RequireAuth(keys)
+	return srv
+}
+
+func dialAuth(srv *Server, aname string, o ...ClientOpt) (fs.FS, error) {
+	a, b := net.Pipe()
+	go srv.Handle(a, a)
+	fsys, err := ClientFS(b, aname, o...)
+	if err != nil {
+		b.Close()
+	}
+	return fsys, err
+}
+
+func TestAuthPSK(t *testing.T) {
+	srv := authServer(PSK([]byte("hunter2")))
+
+	fsys, err := dialAuth(srv, "", WithKey("glenda", []byte("hunter2")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fsys, "file"); got != "secret" {
+		t.Fatalf("unexpected contents: %q", got)
+	}
+
+	if _, err := dialAuth(srv, "", WithKey("glenda", []byte("wrong"))); !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("expected mismatched key to be rejected, got %v", err)
+	}
+	if _, err := dialAuth(srv, ""); !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("expected missing key to be rejected, got %v", err)
+	}
+}
+
+func TestAuthTokens(t *testing.T) {
+	srv := authServer(Tokens(map[string][]byte{
+		"/task/1": []byte("token1"),
+	}))
+
+	fsys, err := dialAuth(srv, "task/1", WithKey("glenda", []byte("token1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fsys, "file"); got != "task" {
+		t.Fatalf("unexpected contents: %q", got)
+	}
+
+	// a token only opens the tree it was issued for
+	if _, err := dialAuth(srv, "", WithKey("glenda", []byte("token1"))); !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("expected token to be rejected for another tree, got %v", err)
+	}
+}
+
+func TestAuth9P2000(t *testing.T) {
+	key := []byte("hunter2")
+	a, b := net.Pipe()
+	go authServer(PSK(key)).Handle(a, a)
+	conn, err := client.NewConn(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Attach(nil, "glenda", ""); err == nil {
+		t.Fatal("expected attach without auth to be rejected")
+	}
+
+	for _, tt := range []struct {
+		key []byte
+		ok  bool
+	}{
+		{[]byte("wrong"), false},
+		{key, true},
+	} {
+		afid, err := conn.Auth("glenda", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		challenge := make([]byte, challengeSize)
+		if _, err := afid.ReadFull(challenge); err != nil {
+			t.Fatal(err)
+		}
+		_, err = afid.Write(authMAC(tt.key, challenge, "glenda", ""))
+		if tt.ok != (err == nil) {
+			t.Fatalf("key %q: unexpected auth result: %v", tt.key, err)
+		}
+		fsys, err := conn.Attach(afid, "glenda", "")
+		if tt.ok != (err == nil) {
+			t.Fatalf("key %q: unexpected attach result: %v", tt.key, err)
+		}
+		if fsys != nil {
+			fsys.Close()
+		}
+		afid.Close()
+	}
+}
@@ -1,28 +1,84 @@
 package p9kit
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net"
+	"os"
 	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"tractor.dev/wanix/fs"
 	"tractor.dev/wanix/fs/fskit"
 
+	"github.com/hugelgupf/p9/linux"
 	"github.com/hugelgupf/p9/p9"
 )
 
-func ClientFS(conn net.Conn, aname string, o ...p9.ClientOpt) (fs.FS, error) {
-	client, err := p9.NewClient(conn, o...)
+// maxSymlinks is the most symlinks followed resolving a single path.
+const maxSymlinks = 40
+
+// atRemoveDir is the Linux AT_REMOVEDIR flag for unlinkat.
+const atRemoveDir = 0x200
+
+// ClientOpt configures ClientFS.
+type ClientOpt func(*clientOptions)
+
+type clientOptions struct {
+	p9    []p9.ClientOpt
+	uname string
+	key   []byte
+}
+
+// WithP9Options passes options through to the underlying p9 client.
+func WithP9Options(o ...p9.ClientOpt) ClientOpt {
+	return func(opts *clientOptions) {
+		opts.p9 = append(opts.p9, o...)
+	}
+}
+
+// WithKey authenticates as uname using key before attaching, for servers
+// that require it.
+func WithKey(uname string, key []byte) ClientOpt {
+	return func(opts *clientOptions) {
+		opts.uname = uname
+		opts.key = key
+	}
+}
+
+func ClientFS(conn net.Conn, aname string, o ...ClientOpt) (fs.FS, error) {
+	var opts clientOptions
+	for _, opt := range o {
+		opt(&opts)
+	}
+
+	var ac *authConn
+	if opts.key != nil {
+		ac = newAuthConn(conn)
+		conn = ac
+	}
+
+	client, err := p9.NewClient(conn, opts.p9...)
 	if err != nil {
 		return nil, err
 	}
 
+	if ac != nil {
+		if err := ac.auth(opts.uname, aname, opts.key); err != nil {
+			client.Close()
+			return nil, fixErr(err)
+		}
+	}
+
 	var root p9.File
 	root, err = client.Attach(aname)
 	if err != nil {
-		return nil, err
+		client.Close()
+		return nil, fixErr(err)
 	}
 
 	return &FS{client: client, root: root}, nil
@@ -43,257 +99,552 @@ func walkParts(name string) (parts []string) {
 	return
 }
 
+// fixErr maps errnos returned by the server to their fs equivalents.
 func fixErr(err error) error {
 	if err == nil {
 		return nil
 	}
-	if err.Error() == "file exists" {
+	var errno linux.Errno
+	if !errors.As(err, &errno) {
+		return err
+	}
+	switch errno {
+	case linux.ENOENT:
+		return fs.ErrNotExist
+	case linux.EEXIST:
 		return fs.ErrExist
+	case linux.EACCES, linux.EPERM:
+		return fs.ErrPermission
+	case linux.EINVAL:
+		return fs.ErrInvalid
+	case linux.ENOSYS:
+		return fs.ErrNotSupported
 	}
 	return err
 }
 
-func (fsys *FS) walk(name string) (p9.File, error) {
-	_, f, err := fsys.root.Walk(walkParts(name))
-	// log.Println("walk:", name, walkParts(name), err)
-	if err != nil {
-		return nil, err
+func pathErr(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: fixErr(err)}
+}
+
+// walk returns a new fid for name along with its attributes. Servers won't
+// walk through symlinks, so when a walk fails on one the path is resolved
+// an element at a time. The final element is only followed if follow is set.
+func (fsys *FS) walk(name string, follow bool) (p9.File, p9.Attr, error) {
+	_, f, _, attr, err := fsys.root.WalkGetAttr(walkParts(name))
+	if err == nil {
+		if !follow || !attr.Mode.IsSymlink() {
+			return f, attr, nil
+		}
+		f.Close()
+	} else if !errors.Is(err, linux.EINVAL) {
+		return nil, p9.Attr{}, err
+	}
+	return fsys.resolve(walkParts(name), follow)
+}
+
+func (fsys *FS) resolve(parts []string, follow bool) (p9.File, p9.Attr, error) {
+	var (
+		dir  string
+		hops int
+	)
+	for {
+		_, f, _, attr, err := fsys.root.WalkGetAttr(append(walkParts(dir), parts[:min(1, len(parts))]...))
+		if err != nil {
+			return nil, p9.Attr{}, err
+		}
+		if len(parts) == 0 {
+			return f, attr, nil
+		}
+		if attr.Mode.IsSymlink() && (len(parts) > 1 || follow) {
+			target, err := f.Readlink()
+			f.Close()
+			if err != nil {
+				return nil, p9.Attr{}, err
+			}
+			if hops++; hops > maxSymlinks {
+				return nil, p9.Attr{}, linux.ELOOP
+			}
+			if !path.IsAbs(target) {
+				target = path.Join("/", dir, target)
+			}
+			parts = append(walkParts(strings.TrimPrefix(path.Clean(target), "/")), parts[1:]...)
+			dir = ""
+			continue
+		}
+		if len(parts) == 1 {
+			return f, attr, nil
+		}
+		f.Close()
+		dir = path.Join(dir, parts[0])
+		parts = parts[1:]
+	}
+}
+
+// openFlags converts os open flags to the access mode sent with Tlopen.
+// Other flags are handled by the client with separate requests.
+func openFlags(flag int) p9.OpenFlags {
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_WRONLY:
+		return p9.WriteOnly
+	case os.O_RDWR:
+		return p9.ReadWrite
+	default:
+		return p9.ReadOnly
 	}
-	return f, nil
 }
 
 func (fsys *FS) Create(name string) (fs.File, error) {
+	return fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+func (fsys *FS) create(name string, flag int, perm fs.FileMode) (fs.File, error) {
 	if name == "." {
-		return nil, fs.ErrInvalid
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
 	}
 
-	d, err := fsys.walk(path.Dir(name))
+	d, _, err := fsys.walk(path.Dir(name), true)
 	if err != nil {
-		return nil, err
+		return nil, pathErr("create", name, err)
 	}
 
-	f, _, _, err := d.Create(path.Base(name), p9.ReadWrite, p9.FileMode(0644), 0, 0)
+	f, _, _, err := d.Create(path.Base(name), openFlags(flag), p9.FileMode(perm.Perm()), 0, 0)
 	if err != nil {
-		if fixErr(err) == fs.ErrExist {
-			f, err = fsys.walk(name)
-			if err != nil {
-				return nil, err
-			}
-			if err := f.SetAttr(p9.SetAttrMask{Size: true}, p9.SetAttr{Size: 0}); err != nil {
-				return nil, err
-			}
-			_, _, err = f.Open(p9.ReadWrite)
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			return nil, err
+		d.Close()
+		return nil, pathErr("create", name, err)
+	}
+
+	rf := &remoteFile{
+		file:   f,
+		name:   path.Base(name),
+		append: flag&os.O_APPEND != 0,
+	}
+	rf.dirty.Store(flag&os.O_TRUNC != 0)
+	return rf, nil
+}
+
+func (fsys *FS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	if flag&os.O_CREATE != 0 {
+		f, err := fsys.create(name, flag, perm)
+		if err == nil || flag&os.O_EXCL != 0 || !errors.Is(err, fs.ErrExist) {
+			return f, err
 		}
+	}
 
+	f, attr, err := fsys.walk(name, true)
+	if err != nil {
+		return nil, pathErr("open", name, err)
 	}
 
-	return &remoteFile{
-		file: f,
-		root: fsys.root,
-		name: path.Base(name),
-		path: walkParts(name),
-	}, nil
+	if flag&os.O_TRUNC != 0 && attr.Mode.IsRegular() {
+		if err := f.SetAttr(p9.SetAttrMask{Size: true}, p9.SetAttr{Size: 0}); err != nil {
+			f.Close()
+			return nil, pathErr("open", name, err)
+		}
+	}
+
+	if _, _, err := f.Open(openFlags(flag)); err != nil {
+		f.Close()
+		return nil, pathErr("open", name, err)
+	}
+
+	rf := &remoteFile{
+		file:   f,
+		name:   path.Base(name),
+		append: flag&os.O_APPEND != 0,
+	}
+	rf.dirty.Store(flag&os.O_TRUNC != 0)
+	return rf, nil
 }
 
 func (fsys *FS) Open(name string) (fs.File, error) {
-	f, err := fsys.walk(name)
+	ctx := fs.WithOrigin(context.Background(), fsys, name, "open")
+	return fsys.OpenContext(ctx, name)
+}
+
+func (fsys *FS) OpenContext(ctx context.Context, name string) (fs.File, error) {
+	f, attr, err := fsys.walk(name, fs.FollowSymlinks(ctx))
 	if err != nil {
-		return nil, err
+		return nil, pathErr("open", name, err)
 	}
 
-	_, _, err = f.Open(p9.ReadWrite)
-	if err != nil {
-		// log.Printf("open: %s %v %T %d\n", name, err, err, uintptr(err.(linux.Errno)))
-		// might be a dir and needs to be read-only
+	if attr.Mode.IsSymlink() {
+		// symlinks can't be opened on the server
+		f.Close()
+		return fskit.RawNode(fileInfo(attr, path.Base(name))).Open(".")
+	}
+
+	// files are opened read-write when possible so
+	// they can be written to without OpenFile
+	mode := p9.ReadWrite
+	if attr.Mode.IsDir() || fs.IsReadOnly(ctx) {
+		mode = p9.ReadOnly
+	}
+	if _, _, err = f.Open(mode); err != nil && mode == p9.ReadWrite {
 		_, _, err = f.Open(p9.ReadOnly)
-		if err != nil {
-			// log.Println("open2:", name, err)
-			return nil, fixErr(err)
-		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, pathErr("open", name, err)
 	}
 
 	return &remoteFile{
 		file: f,
-		root: fsys.root,
 		name: path.Base(name),
-		path: walkParts(name),
 	}, nil
 }
 
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	ctx := fs.WithOrigin(context.Background(), fsys, name, "stat")
+	return fsys.StatContext(ctx, name)
+}
+
+func (fsys *FS) StatContext(ctx context.Context, name string) (fs.FileInfo, error) {
+	f, attr, err := fsys.walk(name, fs.FollowSymlinks(ctx))
+	if err != nil {
+		return nil, pathErr("stat", name, err)
+	}
+	f.Close()
+	return fileInfo(attr, path.Base(name)), nil
+}
+
 func (fsys *FS) Mkdir(name string, perm fs.FileMode) error {
-	d, err := fsys.walk(path.Dir(name))
+	d, _, err := fsys.walk(path.Dir(name), true)
 	if err != nil {
-		return err
+		return pathErr("mkdir", name, err)
 	}
+	defer d.Close()
 
-	_, err = d.Mkdir(path.Base(name), p9.FileMode(perm), 0, 0)
-	return fixErr(err)
+	if _, err = d.Mkdir(path.Base(name), p9.FileMode(perm.Perm()), 0, 0); err != nil {
+		return pathErr("mkdir", name, err)
+	}
+	return nil
 }
 
 func (fsys *FS) Remove(name string) error {
-	d, err := fsys.walk(path.Dir(name))
+	d, _, err := fsys.walk(path.Dir(name), true)
 	if err != nil {
-		return err
+		return pathErr("remove", name, err)
 	}
+	defer d.Close()
 
-	err = d.UnlinkAt(path.Base(name), 0)
-	return fixErr(err)
+	_, f, _, attr, err := d.WalkGetAttr([]string{path.Base(name)})
+	if err != nil {
+		return pathErr("remove", name, err)
+	}
+	f.Close()
+
+	var flags uint32
+	if attr.Mode.IsDir() {
+		flags = atRemoveDir
+	}
+	if err := d.UnlinkAt(path.Base(name), flags); err != nil {
+		return pathErr("remove", name, err)
+	}
+	return nil
+}
+
+func (fsys *FS) Rename(oldname, newname string) error {
+	od, _, err := fsys.walk(path.Dir(oldname), true)
+	if err != nil {
+		return pathErr("rename", oldname, err)
+	}
+	defer od.Close()
+
+	nd, _, err := fsys.walk(path.Dir(newname), true)
+	if err != nil {
+		return pathErr("rename", newname, err)
+	}
+	defer nd.Close()
+
+	if err := od.RenameAt(path.Base(oldname), nd, path.Base(newname)); err != nil {
+		return pathErr("rename", oldname, err)
+	}
+	return nil
+}
+
+func (fsys *FS) Symlink(oldname, newname string) error {
+	d, _, err := fsys.walk(path.Dir(newname), true)
+	if err != nil {
+		return pathErr("symlink", newname, err)
+	}
+	defer d.Close()
+
+	if _, err := d.Symlink(oldname, path.Base(newname), 0, 0); err != nil {
+		return pathErr("symlink", newname, err)
+	}
+	return nil
+}
+
+func (fsys *FS) Readlink(name string) (string, error) {
+	f, attr, err := fsys.walk(name, false)
+	if err != nil {
+		return "", pathErr("readlink", name, err)
+	}
+	defer f.Close()
+
+	if !attr.Mode.IsSymlink() {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	target, err := f.Readlink()
+	if err != nil {
+		return "", pathErr("readlink", name, err)
+	}
+	return target, nil
+}
+
+func (fsys *FS) setAttr(op, name string, valid p9.SetAttrMask, attr p9.SetAttr) error {
+	f, _, err := fsys.walk(name, true)
+	if err != nil {
+		return pathErr(op, name, err)
+	}
+	defer f.Close()
+
+	if err := f.SetAttr(valid, attr); err != nil {
+		return pathErr(op, name, err)
+	}
+	return nil
+}
+
+func (fsys *FS) Chmod(name string, mode fs.FileMode) error {
+	return fsys.setAttr("chmod", name,
+		p9.SetAttrMask{Permissions: true},
+		p9.SetAttr{Permissions: p9.FileMode(mode.Perm())})
+}
+
+func (fsys *FS) Chown(name string, uid, gid int) error {
+	return fsys.setAttr("chown", name,
+		p9.SetAttrMask{UID: uid != -1, GID: gid != -1},
+		p9.SetAttr{UID: p9.UID(uid), GID: p9.GID(gid)})
+}
+
+func (fsys *FS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return fsys.setAttr("chtimes", name,
+		p9.SetAttrMask{ATime: true, MTime: true, ATimeNotSystemTime: true, MTimeNotSystemTime: true},
+		p9.SetAttr{
+			ATimeSeconds:     uint64(atime.Unix()),
+			ATimeNanoSeconds: uint64(atime.Nanosecond()),
+			MTimeSeconds:     uint64(mtime.Unix()),
+			MTimeNanoSeconds: uint64(mtime.Nanosecond()),
+		})
+}
+
+func (fsys *FS) Truncate(name string, size int64) error {
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: name, Err: fs.ErrInvalid}
+	}
+	return fsys.setAttr("truncate", name,
+		p9.SetAttrMask{Size: true},
+		p9.SetAttr{Size: uint64(size)})
 }
 
 func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
-	f, err := fsys.walk(name)
+	ctx := fs.WithOrigin(context.Background(), fsys, name, "readdir")
+	return fsys.ReadDirContext(ctx, name)
+}
+
+func (fsys *FS) ReadDirContext(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	f, _, err := fsys.walk(name, true)
 	if err != nil {
-		return nil, err
+		return nil, pathErr("readdir", name, err)
 	}
+	defer f.Close()
 
-	_, _, err = f.Open(p9.ReadOnly)
+	if _, _, err = f.Open(p9.ReadOnly); err != nil {
+		return nil, pathErr("readdir", name, err)
+	}
+	entries, err := readDir(f)
 	if err != nil {
-		// log.Println("readdir2:", name, err)
-		return nil, err
+		return nil, pathErr("readdir", name, err)
 	}
+	return entries, nil
+}
+
+// readDirCount is the most entry bytes asked for per Treaddir, well
+// under any message size a server would negotiate.
+const readDirCount = 32 << 10
 
+// readDir reads all entries of the opened directory d.
+func readDir(d p9.File) ([]fs.DirEntry, error) {
 	var dirents []p9.Dirent
 	offset := uint64(0)
-	nleft := -1
 	for {
-		d, err := f.Readdir(offset, uint32(nleft))
-		// log.Println("readdir3:", name, err)
+		ents, err := d.Readdir(offset, readDirCount)
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
 			return nil, err
 		}
-		if len(d) == 0 {
+		if len(ents) == 0 {
 			break
 		}
-		dirents = append(dirents, d...)
-		nleft -= len(d)
-		offset = d[len(d)-1].Offset
+		dirents = append(dirents, ents...)
+		offset = ents[len(ents)-1].Offset
 	}
 
 	var entries []fs.DirEntry
-	for _, entry := range dirents {
-		var walkPath []string
-		if name != "." {
-			walkPath = append(walkParts(name), entry.Name)
-		} else {
-			walkPath = []string{entry.Name}
+	for _, ent := range dirents {
+		if ent.Name == "." || ent.Name == ".." {
+			continue
 		}
-		_, child, err := fsys.root.Walk(walkPath)
+		_, child, _, attr, err := d.WalkGetAttr([]string{ent.Name})
 		if err != nil {
-			return nil, err
-		}
-		if fi, err := fileInfo(child, entry.Name); err == nil {
-			entries = append(entries, fi.(fs.DirEntry))
+			// removed since it was listed
+			continue
 		}
+		child.Close()
+		entries = append(entries, fileInfo(attr, ent.Name).(fs.DirEntry))
 	}
 	return entries, nil
 }
 
+func fileInfo(attr p9.Attr, name string) fs.FileInfo {
+	return fskit.Entry(
+		name,
+		attr.Mode.OSMode(),
+		int64(attr.Size),
+		time.Unix(int64(attr.MTimeSeconds), int64(attr.MTimeNanoSeconds)),
+	)
+}
+
 type remoteFile struct {
 	name   string
 	file   p9.File
-	root   p9.File
-	path   []string
-	offset int64
+	append bool
+
+	// dirty is set once the file is written to, since files are
+	// opened read-write when possible but only writes need syncing
+	dirty atomic.Bool
+
+	mu      sync.Mutex
+	offset  int64
+	entries []fs.DirEntry
+	listed  bool
 }
 
 func (f *remoteFile) Read(p []byte) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
 	n, err = f.file.ReadAt(p, f.offset)
-	if err != nil {
-		return n, err
-	}
 	f.offset += int64(n)
-	return n, nil
+	return n, err
+}
+
+func (f *remoteFile) ReadAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) && err == nil {
+		var nn int
+		nn, err = f.file.ReadAt(p[n:], off+int64(n))
+		if nn == 0 && err == nil {
+			err = io.EOF
+		}
+		n += nn
+	}
+	return n, err
 }
 
 func (f *remoteFile) Write(p []byte) (n int, err error) {
-	n, err = f.file.WriteAt(p, f.offset)
-	if err != nil {
-		return n, err
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.append {
+		if f.offset, err = f.size(); err != nil {
+			return 0, err
+		}
 	}
+	f.dirty.Store(true)
+	n, err = f.file.WriteAt(p, f.offset)
 	f.offset += int64(n)
-	return n, nil
+	return n, err
 }
 
-func (f *remoteFile) Close() error {
-	if err := f.file.FSync(); err != nil {
-		return err
+func (f *remoteFile) WriteAt(p []byte, off int64) (n int, err error) {
+	if f.append {
+		return 0, &fs.PathError{Op: "writeat", Path: f.name, Err: fs.ErrInvalid}
 	}
-	return f.file.Close()
-}
-
-func fileInfo(f p9.File, name string) (fs.FileInfo, error) {
-	_, _, attr, err := f.GetAttr(p9.AttrMask{
-		Mode: true,
-		// NLink:       true,
-		// UID:         true,
-		// GID:         true,
-		// RDev:        true,
-		ATime: true,
-		MTime: true,
-		CTime: true,
-		// INo:         true,
-		Size: true,
-		// Blocks:      true,
-		// BTime:       true,
-		// Gen:         true,
-		// DataVersion: true,
-	})
+	f.dirty.Store(true)
+	return f.file.WriteAt(p, off)
+}
+
+func (f *remoteFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		size, err := f.size()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *remoteFile) size() (int64, error) {
+	_, _, attr, err := f.file.GetAttr(p9.AttrMask{Size: true})
 	if err != nil {
-		return nil, err
+		return 0, fixErr(err)
 	}
-	var mode fs.FileMode = fs.FileMode(attr.Mode)
-	if attr.Mode&p9.ModeDirectory != 0 {
-		mode |= fs.ModeDir
+	return int64(attr.Size), nil
+}
+
+func (f *remoteFile) Sync() error {
+	return fixErr(f.file.FSync())
+}
+
+func (f *remoteFile) Close() error {
+	if !f.dirty.Load() {
+		return fixErr(f.file.Close())
 	}
-	return fskit.Entry(
-		name,
-		mode,
-		int64(attr.Size),
-		time.Unix(int64(attr.MTimeSeconds), 0),
-	), nil
+	if err := f.file.FSync(); err != nil {
+		f.file.Close()
+		return fixErr(err)
+	}
+	return fixErr(f.file.Close())
 }
 
 func (f *remoteFile) Stat() (fs.FileInfo, error) {
-	return fileInfo(f.file, f.name)
+	_, _, attr, err := f.file.GetAttr(p9.AttrMaskAll)
+	if err != nil {
+		return nil, pathErr("stat", f.name, err)
+	}
+	return fileInfo(attr, f.name), nil
 }
 
 func (f *remoteFile) ReadDir(n int) ([]fs.DirEntry, error) {
-	var dirents []p9.Dirent
-	offset := uint64(0)
-	nleft := n
-	for {
-		d, err := f.file.Readdir(offset, uint32(nleft))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.listed {
+		entries, err := readDir(f.file)
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
-		}
-		if len(d) == 0 {
-			break
+			return nil, pathErr("readdir", f.name, err)
 		}
-		dirents = append(dirents, d...)
-		nleft -= len(d)
-		offset = d[len(d)-1].Offset
+		f.entries = entries
+		f.listed = true
 	}
 
-	var entries []fs.DirEntry
-	for _, entry := range dirents {
-		_, child, err := f.root.Walk(append(f.path, entry.Name))
-		if err != nil {
-			return nil, err
-		}
-		if fi, err := fileInfo(child, entry.Name); err == nil {
-			entries = append(entries, fi.(fs.DirEntry))
-		}
+	if n <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
 	}
+	n = min(n, len(f.entries))
+	entries := f.entries[:n]
+	f.entries = f.entries[n:]
 	return entries, nil
 }
@@ -0,0 +1,473 @@
+package p9kit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hugelgupf/p9/p9"
+	"tractor.dev/wanix/fs"
+	"tractor.dev/wanix/fs/fskit"
+	"tractor.dev/wanix/vfs"
+)
+
+func pipeFS(t *testing.T, backend fs.FS) *FS {
+	t.Helper()
+	a, b := net.Pipe()
+	go NewServer(backend).Handle(a, a)
+	t.Cleanup(func() { b.Close() })
+
+	fsys, err := ClientFS(b, "")
+	if err != nil {
+		t.Fatalf("ClientFS: %v", err)
+	}
+	return fsys.(*FS)
+}
+
+func readFile(t *testing.T, fsys fs.FS, name string) string {
+	t.Helper()
+	b, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		t.Fatalf("ReadFile %s: %v", name, err)
+	}
+	return string(b)
+}
+
+func TestClientStat(t *testing.T) {
+	fsys := pipeFS(t, fskit.MemFS{
+		"dir/file": fskit.RawNode([]byte("hello"), fs.FileMode(0640)),
+	})
+
+	fi, err := fs.Stat(fsys, "dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Name() != "file" || fi.Size() != 5 || fi.Mode() != 0640 {
+		t.Fatalf("unexpected stat: %s %d %v", fi.Name(), fi.Size(), fi.Mode())
+	}
+	fi, err = fs.Stat(fsys, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.IsDir() {
+		t.Fatalf("expected dir, got %v", fi.Mode())
+	}
+	if _, err := fs.Stat(fsys, "dir/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+}
+
+func TestClientRename(t *testing.T) {
+	fsys := pipeFS(t, fskit.MemFS{
+		"a/file": fskit.RawNode([]byte("data")),
+		"b":      fskit.RawNode(fs.FileMode(0755 | fs.ModeDir)),
+	})
+
+	if err := fs.Rename(fsys, "a/file", "b/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(fsys, "a/file"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected old name to be gone, got %v", err)
+	}
+	if got := readFile(t, fsys, "b/moved"); got != "data" {
+		t.Fatalf("unexpected contents: %q", got)
+	}
+}
+
+func TestClientSymlink(t *testing.T) {
+	fsys := pipeFS(t, fskit.MemFS{
+		"dir/file": fskit.RawNode([]byte("target")),
+	})
+
+	if err := fs.Symlink(fsys, "dir/file", "link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Symlink(fsys, "dir", "dirlink"); err != nil {
+		t.Fatal(err)
+	}
+	target, err := fs.Readlink(fsys, "link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "dir/file" {
+		t.Fatalf("unexpected target: %q", target)
+	}
+	fi, err := fs.StatContext(fs.WithNoFollow(fs.ContextFor(fsys)), fsys, "link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&fs.ModeSymlink == 0 {
+		t.Fatalf("expected symlink, got %v", fi.Mode())
+	}
+	if got := readFile(t, fsys, "link"); got != "target" {
+		t.Fatalf("unexpected contents through link: %q", got)
+	}
+	if got := readFile(t, fsys, "dirlink/file"); got != "target" {
+		t.Fatalf("unexpected contents through dir link: %q", got)
+	}
+}
+
+func TestClientSetAttr(t *testing.T) {
+	fsys := pipeFS(t, fskit.MemFS{
+		"file": fskit.RawNode([]byte("hello world"), fs.FileMode(0644)),
+	})
+
+	if err := fs.Truncate(fsys, "file", 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Chmod(fsys, "file", 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := fs.Chtimes(fsys, "file", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := fs.Stat(fsys, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != 0600 {
+		t.Fatalf("unexpected mode: %v", fi.Mode())
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Fatalf("unexpected mtime: %v", fi.ModTime())
+	}
+	if got := readFile(t, fsys, "file"); got != "hello" {
+		t.Fatalf("unexpected contents after truncate: %q", got)
+	}
+}
+
+func TestClientFileIO(t *testing.T) {
+	fsys := pipeFS(t, fskit.MemFS{
+		"file": fskit.RawNode([]byte("0123456789")),
+	})
+
+	f, err := fs.OpenFile(fsys, "file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	if _, err := fs.ReadAt(f, buf, 4); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "456" {
+		t.Fatalf("unexpected ReadAt: %q", buf)
+	}
+	if _, err := fs.WriteAt(f, []byte("ab"), 2); err != nil {
+		t.Fatal(err)
+	}
+	if pos, err := fs.Seek(f, -2, io.SeekEnd); err != nil || pos != 8 {
+		t.Fatalf("unexpected seek: %d %v", pos, err)
+	}
+	if _, err := fs.Write(f, []byte("XY")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fsys, "file"); got != "01ab4567XY" {
+		t.Fatalf("unexpected contents: %q", got)
+	}
+}
+
+// syncCounter counts the FSync calls on a served tree.
+type syncCounter struct {
+	p9.File
+	n *atomic.Int32
+}
+
+func (f syncCounter) Walk(names []string) ([]p9.QID, p9.File, error) {
+	qids, nf, err := f.File.Walk(names)
+	if nf != nil {
+		nf = syncCounter{nf, f.n}
+	}
+	return qids, nf, err
+}
+
+func (f syncCounter) WalkGetAttr(names []string) ([]p9.QID, p9.File, p9.AttrMask, p9.Attr, error) {
+	qids, nf, mask, attr, err := f.File.WalkGetAttr(names)
+	if nf != nil {
+		nf = syncCounter{nf, f.n}
+	}
+	return qids, nf, mask, attr, err
+}
+
+func (f syncCounter) FSync() error {
+	f.n.Add(1)
+	return f.File.FSync()
+}
+
+type syncAttacher struct {
+	p9.Attacher
+	n *atomic.Int32
+}
+
+func (a syncAttacher) Attach() (p9.File, error) {
+	f, err := a.Attacher.Attach()
+	if err != nil {
+		return nil, err
+	}
+	return syncCounter{f, a.n}, nil
+}
+
+func TestClientCloseSync(t *testing.T) {
+	var syncs atomic.Int32
+	a, b := net.Pipe()
+	srv := p9.NewServer(syncAttacher{Attacher(fskit.MemFS{
+		"file": fskit.RawNode([]byte("data")),
+	}), &syncs})
+	go srv.Handle(a, a)
+	t.Cleanup(func() { b.Close() })
+	fsys, err := ClientFS(b, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readFile(t, fsys, "file")
+	f, err := fs.OpenFile(fsys, "file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := syncs.Load(); n != 0 {
+		t.Fatalf("expected no syncs closing unwritten files, got %d", n)
+	}
+
+	if err := fs.WriteFile(fsys, "file", []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if n := syncs.Load(); n != 1 {
+		t.Fatalf("expected 1 sync closing a written file, got %d", n)
+	}
+}
+
+func TestClientOpenFlags(t *testing.T) {
+	fsys := pipeFS(t, fskit.MemFS{
+		"file": fskit.RawNode([]byte("hello")),
+	})
+
+	if _, err := fs.OpenFile(fsys, "file", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("expected ErrExist, got %v", err)
+	}
+
+	f, err := fs.OpenFile(fsys, "file", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Write(f, []byte(" world"))
+	f.Close()
+	if got := readFile(t, fsys, "file"); got != "hello world" {
+		t.Fatalf("unexpected contents after append: %q", got)
+	}
+
+	f, err = fs.OpenFile(fsys, "file", os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Write(f, []byte("bye"))
+	f.Close()
+	if got := readFile(t, fsys, "file"); got != "bye" {
+		t.Fatalf("unexpected contents after truncate: %q", got)
+	}
+
+	f, err = fs.OpenFile(fsys, "new", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Write(f, []byte("new"))
+	f.Close()
+	if got := readFile(t, fsys, "new"); got != "new" {
+		t.Fatalf("unexpected contents of created file: %q", got)
+	}
+}
+
+func TestClientReadDir(t *testing.T) {
+	fsys := pipeFS(t, fskit.MemFS{
+		"dir/a": fskit.RawNode([]byte("a")),
+		"dir/b": fskit.RawNode([]byte("b")),
+		"dir/c": fskit.RawNode(fs.FileMode(0755 | fs.ModeDir)),
+	})
+
+	f, err := fsys.Open("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var names []string
+	for {
+		entries, err := f.(fs.ReadDirFile).ReadDir(2)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+	}
+	if !slices.Equal(names, []string{"a", "b", "c"}) {
+		t.Fatalf("unexpected entries: %v", names)
+	}
+
+	if err := fs.Remove(fsys, "dir/c"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := fs.ReadDir(fsys, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries after remove, got %d", len(entries))
+	}
+}
+
+func TestServerReaddirPages(t *testing.T) {
+	backend := fskit.MemFS{"dir/sub": fskit.RawNode(fs.FileMode(0755 | fs.ModeDir))}
+	var want []string
+	for i := range 200 {
+		name := fmt.Sprintf("file%03d", i)
+		backend["dir/"+name] = fskit.RawNode([]byte(name))
+		want = append(want, name)
+	}
+	want = append(want, "sub")
+
+	a, b := net.Pipe()
+	go NewServer(backend).Handle(a, a)
+	t.Cleanup(func() { b.Close() })
+	client, err := p9.NewClient(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := client.Attach("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, dir, err := root.Walk([]string{"dir"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := dir.Open(p9.ReadOnly); err != nil {
+		t.Fatal(err)
+	}
+
+	// pages of a few entries each, with a removal partway through
+	var names []string
+	offset := uint64(0)
+	for {
+		ents, err := dir.Readdir(offset, 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ents) == 0 {
+			break
+		}
+		for _, e := range ents {
+			names = append(names, e.Name)
+			if e.Name == "sub" && e.QID.Type != p9.TypeDir {
+				t.Fatalf("expected sub to be a directory, got qid type %v", e.QID.Type)
+			}
+		}
+		offset = ents[len(ents)-1].Offset
+		delete(backend, "dir/file000")
+	}
+	if !slices.Equal(names, want) {
+		t.Fatalf("unexpected entries: got %d, want %d", len(names), len(want))
+	}
+
+	// rewinding lists the directory afresh
+	ents, err := dir.Readdir(0, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) == 0 || ents[0].Name != "file001" {
+		t.Fatalf("expected rewind to see the removal, got %v", ents)
+	}
+}
+
+// reversedFS lists directories in reverse order.
+type reversedFS struct {
+	fskit.MemFS
+}
+
+func (fsys reversedFS) ReadDirContext(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDirContext(ctx, fsys.MemFS, name)
+	slices.Reverse(entries)
+	return entries, err
+}
+
+func TestServerReaddirRewindSorted(t *testing.T) {
+	a, b := net.Pipe()
+	go NewServer(reversedFS{fskit.MemFS{
+		"a": fskit.RawNode([]byte("a")),
+		"b": fskit.RawNode([]byte("b")),
+		"c": fskit.RawNode([]byte("c")),
+	}}).Handle(a, a)
+	t.Cleanup(func() { b.Close() })
+	client, err := p9.NewClient(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := client.Attach("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := root.Open(p9.ReadOnly); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first listing and a rewind are in the same order
+	for range 2 {
+		ents, err := root.Readdir(0, 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range ents {
+			names = append(names, e.Name)
+		}
+		if !slices.Equal(names, []string{"a", "b", "c"}) {
+			t.Fatalf("unexpected entries: %v", names)
+		}
+	}
+}
+
+func TestServerWalkBindings(t *testing.T) {
+	ns := vfs.New(context.Background())
+	ns.Bind(fskit.MemFS{
+		"a/b/file": fskit.RawNode([]byte("root")),
+		"a/b/c":    fskit.RawNode(fs.FileMode(0755 | fs.ModeDir)),
+		"link":     fskit.RawNode([]byte("a/b"), fs.FileMode(0777|fs.ModeSymlink)),
+	}, ".", ".", "")
+	ns.Bind(fskit.MemFS{
+		"d/file": fskit.RawNode([]byte("bound")),
+	}, ".", "a/b/c", "")
+
+	a, b := net.Pipe()
+	go NewServer(ns).Handle(a, a)
+	t.Cleanup(func() { b.Close() })
+	fsys, err := ClientFS(b, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a walk continuing from a/b still finds what is bound below it
+	for name, want := range map[string]string{
+		"a/b/file":     "root",
+		"a/b/c/d/file": "bound",
+		"link/file":    "root",
+	} {
+		if got := readFile(t, fsys, name); got != want {
+			t.Fatalf("%s: unexpected contents %q", name, got)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package p9kit
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hugelgupf/p9/fsimpl/templatefs"
+	"github.com/hugelgupf/p9/linux"
+	"github.com/hugelgupf/p9/p9"
+	"tractor.dev/wanix/fs"
+)
+
+// Server serves a filesystem over 9P. The protocol is chosen by the
+// version the client sends in Tversion: 9P2000.L is handled by the p9
+// package, while 9P2000 and 9P2000.u are served natively so Plan 9 tools
+// like plan9port's 9p and 9pfuse can use it.
+type Server struct {
+	opts []p9.ServerOpt
+
+	mu    sync.Mutex
+	trees map[string]fs.FS
+	keys  KeyFunc
+}
+
+// NewServer returns a Server for fsys. Options apply to 9P2000.L sessions.
+func NewServer(fsys fs.FS, o ...p9.ServerOpt) *Server {
+	return &Server{
+		opts:  o,
+		trees: map[string]fs.FS{"": fsys},
+	}
+}
+
+// Publish serves fsys to clients attaching with aname, such as another
+// task namespace, a capability's mount or a subtree. The filesystem given
+// to NewServer is published under the empty aname. An aname that isn't
+// published attaches to the path it names in the tree published under its
+// longest parent, and is rejected if that path doesn't exist.
+func (s *Server) Publish(aname string, fsys fs.FS) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trees[treeName(aname)] = fsys
+}
+
+// RequireAuth makes clients authenticate before attaching, proving they
+// hold the key returned by keys for the uname and aname they attach with.
+// Without it, attaches are unauthenticated.
+func (s *Server) RequireAuth(keys KeyFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+// treeName normalizes an aname so "/", "" and "./" all name the default tree.
+func treeName(aname string) string {
+	return strings.Trim(path.Clean("/"+aname), "/")
+}
+
+// findTree returns the name of the published tree an aname attaches to
+// and the path in it, or false if there is none.
+func findTree(trees map[string]fs.FS, aname string) (string, string, bool) {
+	name, rest := treeName(aname), "."
+	for {
+		if _, ok := trees[name]; ok {
+			return name, rest, true
+		}
+		if name == "" {
+			return "", "", false
+		}
+		dir, base := path.Split(name)
+		rest = path.Join(base, rest)
+		name = strings.TrimSuffix(dir, "/")
+	}
+}
+
+// Handle serves a single connection reading requests from t and
+// writing replies to r.
+func (s *Server) Handle(t io.ReadCloser, r io.WriteCloser) error {
+	s.mu.Lock()
+	trees := make(map[string]fs.FS, len(s.trees))
+	for name, fsys := range s.trees {
+		trees[name] = fsys
+	}
+	keys := s.keys
+	s.mu.Unlock()
+
+	br := bufio.NewReader(t)
+	if !isLinuxDialect(br) {
+		defer r.Close()
+		defer t.Close()
+		return newConn9p(trees, keys, br, r).serve()
+	}
+
+	// The p9 server only knows a single root, so attaches are rewritten
+	// to walk into the published tree from a root listing all of them.
+	// It doesn't know about auth fids either, so they are handled here.
+	var (
+		names []string
+		roots []fs.FS
+	)
+	for name, fsys := range trees {
+		names = append(names, name)
+		roots = append(roots, fsys)
+	}
+
+	// Each tree's files run under its own context, cancelled when the
+	// connection closes, with requests tracked for Tflush to cancel.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sessions := make([]*session, len(roots))
+	for i, fsys := range roots {
+		tctx, tcancel := withCancelOf(fs.ContextFor(fsys), ctx)
+		defer tcancel()
+		sessions[i] = newSession(tctx)
+	}
+	reqs := newRequests()
+
+	afids := make(map[uint32]*authFid)
+	w := &frameWriter{w: r, filter: func(msg []byte) []byte {
+		reqs.reply(msg)
+		return msg
+	}}
+	route := func(msg []byte) []byte {
+		switch msg[4] {
+		case msgTattach:
+		case msgTauth, msgTread, msgTwrite, msgTclunk:
+			if keys == nil {
+				return msg
+			}
+		default:
+			return msg
+		}
+		f, err := parseFcall(msg, true)
+		if err != nil {
+			return msg
+		}
+		var reply *msgBuf
+		switch f.typ {
+		case msgTauth:
+			a, err := newAuthFid(keys, f.uname, f.aname)
+			if err != nil {
+				w.writeMsg(rlerror(f.tag, linux.ExtractErrno(err)))
+				return nil
+			}
+			afids[f.afid] = a
+			reply = newReply(msgRauth, f.tag)
+			reply.putQid(qid9p{typ: qtAuth})
+		case msgTread:
+			a := afids[f.fid]
+			if a == nil {
+				return msg
+			}
+			data := a.read(f.offset, f.count)
+			reply = newReply(msgRread, f.tag)
+			reply.put32(uint32(len(data)))
+			reply.b = append(reply.b, data...)
+		case msgTwrite:
+			a := afids[f.fid]
+			if a == nil {
+				return msg
+			}
+			if err := a.write(f.data); err != nil {
+				w.writeMsg(rlerror(f.tag, linux.EACCES))
+				return nil
+			}
+			reply = newReply(msgRwrite, f.tag)
+			reply.put32(uint32(len(f.data)))
+		case msgTclunk:
+			if afids[f.fid] == nil {
+				return msg
+			}
+			delete(afids, f.fid)
+			reply = newReply(msgRclunk, f.tag)
+		case msgTattach:
+			if keys != nil {
+				a := afids[f.afid]
+				if a == nil || a.check(f.uname, f.aname) != nil {
+					w.writeMsg(rlerror(f.tag, linux.EACCES))
+					return nil
+				}
+				f.afid = noFid
+			}
+			tree, rest, ok := findTree(trees, f.aname)
+			if !ok {
+				w.writeMsg(rlerror(f.tag, linux.ENOENT))
+				return nil
+			}
+			f.aname = strconv.Itoa(slices.Index(names, tree))
+			if rest != "." {
+				f.aname += "/" + rest
+			}
+			return attachMsg(f)
+		}
+		w.writeMsg(reply.bytes())
+		return nil
+	}
+	fr := &frameReader{r: br, c: t, hangup: cancel, filter: func(msg []byte) []byte {
+		if msg = route(msg); msg == nil {
+			return nil
+		}
+		if msg[4] == msgTflush && len(msg) >= 9 {
+			fp, ok := reqs.flushed(binary.LittleEndian.Uint16(msg[7:]))
+			if ok && fp.tree < len(sessions) {
+				sessions[fp.tree].flush(fp.path)
+			}
+		}
+		reqs.request(msg)
+		return msg
+	}}
+	srv := p9.NewServer(&treeAttacher{roots: roots, sessions: sessions}, s.opts...)
+	return srv.Handle(fr, w)
+}
+
+// attachMsg encodes f as a 9P2000.L Tattach.
+func attachMsg(f *fcall) []byte {
+	m := newReply(msgTattach, f.tag)
+	m.put32(f.fid)
+	m.put32(f.afid)
+	m.putStr(f.uname)
+	m.putStr(f.aname)
+	m.put32(f.nuname)
+	return m.bytes()
+}
+
+// rlerror encodes a 9P2000.L error reply.
+func rlerror(tag uint16, errno linux.Errno) []byte {
+	m := newReply(msgRlerror, tag)
+	m.put32(uint32(errno))
+	return m.bytes()
+}
+
+// isLinuxDialect peeks at the first message to see if it is a Tversion
+// for 9P2000.L. Anything unreadable is left for the p9 server to reject.
+func isLinuxDialect(br *bufio.Reader) bool {
+	// size[4] type[1] tag[2] msize[4] version[s]
+	hdr, err := br.Peek(13)
+	if err != nil || hdr[4] != msgTversion {
+		return true
+	}
+	size := int(binary.LittleEndian.Uint32(hdr))
+	if size > br.Size() {
+		return true
+	}
+	msg, err := br.Peek(size)
+	if err != nil {
+		return true
+	}
+	f, err := parseFcall(msg, false)
+	if err != nil {
+		return true
+	}
+	return strings.HasPrefix(f.version, "9P2000.L")
+}
+
+// treeAttacher attaches to a directory of published trees, named by
+// their index, which rewritten attaches then walk into.
+type treeAttacher struct {
+	roots    []fs.FS
+	sessions []*session
+}
+
+func (a *treeAttacher) Attach() (p9.File, error) {
+	return &treeRoot{roots: a.roots, sessions: a.sessions}, nil
+}
+
+type treeRoot struct {
+	templatefs.NoopFile
+
+	roots    []fs.FS
+	sessions []*session
+}
+
+func (r *treeRoot) Walk(names []string) ([]p9.QID, p9.File, error) {
+	if len(names) == 0 {
+		return nil, r, nil
+	}
+	i, err := strconv.Atoi(names[0])
+	if err != nil || i < 0 || i >= len(r.roots) {
+		return nil, nil, linux.ENOENT
+	}
+	root := &p9file{path: ".", fsys: r.roots[i], sess: r.sessions[i]}
+	qid, _, err := root.info()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(names) == 1 {
+		return []p9.QID{qid}, root, nil
+	}
+	qids, f, err := root.Walk(names[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return append([]p9.QID{qid}, qids...), f, nil
+}
+
+func (r *treeRoot) GetAttr(req p9.AttrMask) (p9.QID, p9.AttrMask, p9.Attr, error) {
+	qid := p9.QID{Type: p9.TypeDir}
+	return qid, p9.AttrMask{Mode: true}, p9.Attr{Mode: p9.ModeDirectory | 0555, NLink: 1}, nil
+}
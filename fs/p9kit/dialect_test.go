@@ -0,0 +1,96 @@
+package p9kit
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"9fans.net/go/plan9"
+	"9fans.net/go/plan9/client"
+	"tractor.dev/wanix/fs"
+	"tractor.dev/wanix/fs/fskit"
+)
+
+func publishServer() *Server {
+	srv := NewServer(fskit.MemFS{
+		"root": fskit.RawNode([]byte("root")),
+	})
+	srv.Publish("scratch", fskit.MemFS{
+		"note": fskit.RawNode([]byte("scratch")),
+	})
+	srv.Publish("/cap/3/mount", fskit.MemFS{
+		"dir/file": fskit.RawNode([]byte("cap")),
+	})
+	return srv
+}
+
+func TestServerPublishL(t *testing.T) {
+	srv := publishServer()
+	for _, tt := range []struct {
+		aname, name, want string
+	}{
+		{"", "root", "root"},
+		{"/", "root", "root"},
+		{"scratch", "note", "scratch"},
+		{"cap/3/mount", "dir/file", "cap"},
+		{"/cap/3/mount/", "dir/file", "cap"},
+		// paths under a published tree attach there
+		{"cap/3/mount/dir", "file", "cap"},
+		{"scratch/.", "note", "scratch"},
+	} {
+		a, b := net.Pipe()
+		go srv.Handle(a, a)
+		fsys, err := ClientFS(b, tt.aname)
+		if err != nil {
+			t.Fatalf("ClientFS %q: %v", tt.aname, err)
+		}
+		if got := readFile(t, fsys, tt.name); got != tt.want {
+			t.Fatalf("%q: unexpected contents: %q", tt.aname, got)
+		}
+		b.Close()
+	}
+
+	a, b := net.Pipe()
+	defer b.Close()
+	go srv.Handle(a, a)
+	if _, err := ClientFS(b, "missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected unknown aname to be rejected, got %v", err)
+	}
+}
+
+func TestServerPublish9P2000(t *testing.T) {
+	a, b := net.Pipe()
+	go publishServer().Handle(a, a)
+	conn, err := client.NewConn(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Trees are attached separately over the same connection.
+	for aname, want := range map[string]string{
+		"":                "/root",
+		"scratch":         "/note",
+		"cap/3/mount":     "/dir/file",
+		"cap/3/mount/dir": "/file",
+	} {
+		fsys, err := conn.Attach(nil, "glenda", aname)
+		if err != nil {
+			t.Fatalf("Attach %q: %v", aname, err)
+		}
+		f, err := fsys.Open(want, plan9.OREAD)
+		if err != nil {
+			t.Fatalf("%q: %v", aname, err)
+		}
+		if _, err := io.ReadAll(f); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		fsys.Close()
+	}
+
+	if _, err := conn.Attach(nil, "glenda", "missing"); err == nil {
+		t.Fatal("expected unknown aname to be rejected")
+	}
+}
@@ -0,0 +1,120 @@
+package p9kit
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// maxFrameSize bounds messages read by the frame layer, above any
+// msize a client will negotiate.
+const maxFrameSize = 1 << 24
+
+// frameReader reads whole messages from r and passes each through filter
+// before handing its bytes to the reader. A filter returning nil drops
+// the message, having dealt with it itself. If set, hangup is called when
+// reading fails, such as when the connection closes.
+type frameReader struct {
+	r      io.Reader
+	c      io.Closer
+	filter func(msg []byte) []byte
+	hangup func()
+	buf    []byte
+}
+
+func (fr *frameReader) Read(p []byte) (int, error) {
+	for len(fr.buf) == 0 {
+		msg, err := readMsg(fr.r, maxFrameSize)
+		if err != nil {
+			if fr.hangup != nil {
+				fr.hangup()
+			}
+			return 0, err
+		}
+		if fr.filter != nil {
+			msg = fr.filter(msg)
+		}
+		fr.buf = msg
+	}
+	n := copy(p, fr.buf)
+	fr.buf = fr.buf[n:]
+	return n, nil
+}
+
+func (fr *frameReader) Close() error {
+	return fr.c.Close()
+}
+
+// frameWriter writes whole messages to w. Partial writes are collected
+// until a message is complete, so messages written with writeMsg never
+// land in the middle of another. If set, filter may rewrite each message
+// collected from Write.
+type frameWriter struct {
+	mu      sync.Mutex
+	w       io.WriteCloser
+	filter  func(msg []byte) []byte
+	buf     []byte
+	pending [][]byte
+}
+
+func (fw *frameWriter) Write(p []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	fw.buf = append(fw.buf, p...)
+	for len(fw.buf) >= 4 {
+		size := int(binary.LittleEndian.Uint32(fw.buf))
+		if size < headerSize {
+			// a size that doesn't cover the header would never advance
+			fw.buf = nil
+			return 0, fmt.Errorf("p9kit: bad message size %d", size)
+		}
+		if len(fw.buf) < size {
+			break
+		}
+		msg := fw.buf[:size]
+		if fw.filter != nil {
+			msg = fw.filter(msg)
+		}
+		if _, err := fw.w.Write(msg); err != nil {
+			return 0, err
+		}
+		fw.buf = fw.buf[size:]
+	}
+	if len(fw.buf) == 0 {
+		fw.buf = nil
+		if err := fw.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// writeMsg writes a complete message, or queues it until the message
+// currently being written is done.
+func (fw *frameWriter) writeMsg(msg []byte) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	fw.pending = append(fw.pending, msg)
+	if len(fw.buf) > 0 {
+		return nil
+	}
+	return fw.flush()
+}
+
+func (fw *frameWriter) flush() error {
+	for len(fw.pending) > 0 {
+		msg := fw.pending[0]
+		fw.pending = fw.pending[1:]
+		if _, err := fw.w.Write(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fw *frameWriter) Close() error {
+	return fw.w.Close()
+}
@@ -0,0 +1,38 @@
+package p9kit
+
+import (
+	"bytes"
+	"testing"
+)
+
+type nopWriteCloser struct {
+	bytes.Buffer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestFrameWriter(t *testing.T) {
+	var out nopWriteCloser
+	fw := &frameWriter{w: &out}
+
+	// a message split across writes is written whole
+	msg := newReply(msgRclunk, 1).bytes()
+	if _, err := fw.Write(msg[:3]); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Fatal("expected partial message to be held back")
+	}
+	if _, err := fw.Write(msg[3:]); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), msg) {
+		t.Fatalf("unexpected output: %v", out.Bytes())
+	}
+
+	for _, size := range []byte{0, 4, 6} {
+		if _, err := fw.Write([]byte{size, 0, 0, 0, 0, 0, 0}); err == nil {
+			t.Fatalf("expected error writing a message of size %d", size)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package p9kit
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Message types shared by 9P2000 and 9P2000.u.
+const (
+	msgTversion = 100
+	msgRversion = 101
+	msgTauth    = 102
+	msgRauth    = 103
+	msgTattach  = 104
+	msgRattach  = 105
+	msgRerror   = 107
+	msgTflush   = 108
+	msgRflush   = 109
+	msgTwalk    = 110
+	msgRwalk    = 111
+	msgTopen    = 112
+	msgRopen    = 113
+	msgTcreate  = 114
+	msgRcreate  = 115
+	msgTread    = 116
+	msgRread    = 117
+	msgTwrite   = 118
+	msgRwrite   = 119
+	msgTclunk   = 120
+	msgRclunk   = 121
+	msgTremove  = 122
+	msgRremove  = 123
+	msgTstat    = 124
+	msgRstat    = 125
+	msgTwstat   = 126
+	msgRwstat   = 127
+
+	// 9P2000.L messages the frame layer looks at.
+	msgRlerror  = 7
+	msgTlcreate = 14
+)
+
+const (
+	noTag = ^uint16(0)
+	noFid = ^uint32(0)
+
+	// headerSize is the size[4] type[1] tag[2] header of every message.
+	headerSize = 7
+	// ioHeaderSize is the overhead of a Tread/Twrite header.
+	ioHeaderSize = 24
+	// maxWalkElem is the most names allowed in a single Twalk.
+	maxWalkElem = 16
+)
+
+// Open modes.
+const (
+	oRead   = 0
+	oWrite  = 1
+	oRdwr   = 2
+	oExec   = 3
+	oTrunc  = 0x10
+	oRclose = 0x40
+)
+
+// Qid types.
+const (
+	qtDir     = 0x80
+	qtAppend  = 0x40
+	qtExcl    = 0x20
+	qtAuth    = 0x08
+	qtTmp     = 0x04
+	qtSymlink = 0x02
+	qtFile    = 0x00
+)
+
+// Dir mode bits. Device, pipe, socket, symlink and set-id bits are 9P2000.u.
+const (
+	dmDir       = 0x80000000
+	dmAppend    = 0x40000000
+	dmExcl      = 0x20000000
+	dmTmp       = 0x04000000
+	dmSymlink   = 0x02000000
+	dmDevice    = 0x00800000
+	dmNamedPipe = 0x00200000
+	dmSocket    = 0x00100000
+	dmSetuid    = 0x00080000
+	dmSetgid    = 0x00040000
+)
+
+var errShortMsg = errors.New("p9kit: short message")
+
+// qid9p is a 9P2000 qid.
+type qid9p struct {
+	typ     uint8
+	version uint32
+	path    uint64
+}
+
+// fcall is a decoded 9P2000 or 9P2000.u T-message. Only the fields
+// used by its type are set.
+type fcall struct {
+	typ    uint8
+	tag    uint16
+	fid    uint32
+	newfid uint32
+	afid   uint32
+	msize  uint32
+
+	version string
+	uname   string
+	aname   string
+	nuname  uint32
+	oldtag  uint16
+	wname   []string
+	mode    uint8
+	perm    uint32
+	name    string
+	ext     string
+	offset  uint64
+	count   uint32
+	data    []byte
+	stat    []byte
+}
+
+// msgBuf encodes and decodes 9P little endian fields. Decoding past
+// the end of the buffer sets short instead of failing each call.
+type msgBuf struct {
+	b     []byte
+	short bool
+}
+
+func (m *msgBuf) get(n int) []byte {
+	if len(m.b) < n {
+		m.short = true
+		m.b = nil
+		return make([]byte, n)
+	}
+	b := m.b[:n]
+	m.b = m.b[n:]
+	return b
+}
+
+func (m *msgBuf) get8() uint8   { return m.get(1)[0] }
+func (m *msgBuf) get16() uint16 { return binary.LittleEndian.Uint16(m.get(2)) }
+func (m *msgBuf) get32() uint32 { return binary.LittleEndian.Uint32(m.get(4)) }
+func (m *msgBuf) get64() uint64 { return binary.LittleEndian.Uint64(m.get(8)) }
+func (m *msgBuf) getStr() string {
+	return string(m.get(int(m.get16())))
+}
+
+func (m *msgBuf) put8(v uint8)   { m.b = append(m.b, v) }
+func (m *msgBuf) put16(v uint16) { m.b = binary.LittleEndian.AppendUint16(m.b, v) }
+func (m *msgBuf) put32(v uint32) { m.b = binary.LittleEndian.AppendUint32(m.b, v) }
+func (m *msgBuf) put64(v uint64) { m.b = binary.LittleEndian.AppendUint64(m.b, v) }
+func (m *msgBuf) putStr(s string) {
+	m.put16(uint16(len(s)))
+	m.b = append(m.b, s...)
+}
+func (m *msgBuf) putQid(q qid9p) {
+	m.put8(q.typ)
+	m.put32(q.version)
+	m.put64(q.path)
+}
+
+// newReply starts an R-message with room for its size.
+func newReply(typ uint8, tag uint16) *msgBuf {
+	m := &msgBuf{b: make([]byte, 4, 64)}
+	m.put8(typ)
+	m.put16(tag)
+	return m
+}
+
+// bytes returns the message with its size filled in.
+func (m *msgBuf) bytes() []byte {
+	binary.LittleEndian.PutUint32(m.b, uint32(len(m.b)))
+	return m.b
+}
+
+// readMsg reads a single size-prefixed message from r.
+func readMsg(r io.Reader, msize uint32) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(size[:])
+	if n < headerSize || n > msize {
+		return nil, fmt.Errorf("p9kit: bad message size %d", n)
+	}
+	msg := make([]byte, n)
+	copy(msg, size[:])
+	if _, err := io.ReadFull(r, msg[4:]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// parseFcall decodes a T-message, including the 9P2000.u fields if dotu.
+func parseFcall(msg []byte, dotu bool) (*fcall, error) {
+	m := &msgBuf{b: msg[4:]}
+	f := &fcall{typ: m.get8(), tag: m.get16()}
+	switch f.typ {
+	case msgTversion:
+		f.msize = m.get32()
+		f.version = m.getStr()
+	case msgTauth:
+		f.afid = m.get32()
+		f.uname = m.getStr()
+		f.aname = m.getStr()
+		if dotu {
+			f.nuname = m.get32()
+		}
+	case msgTattach:
+		f.fid = m.get32()
+		f.afid = m.get32()
+		f.uname = m.getStr()
+		f.aname = m.getStr()
+		if dotu {
+			f.nuname = m.get32()
+		}
+	case msgTflush:
+		f.oldtag = m.get16()
+	case msgTwalk:
+		f.fid = m.get32()
+		f.newfid = m.get32()
+		n := int(m.get16())
+		if n > maxWalkElem {
+			return f, fmt.Errorf("p9kit: too many names in walk")
+		}
+		for i := 0; i < n; i++ {
+			f.wname = append(f.wname, m.getStr())
+		}
+	case msgTopen:
+		f.fid = m.get32()
+		f.mode = m.get8()
+	case msgTcreate:
+		f.fid = m.get32()
+		f.name = m.getStr()
+		f.perm = m.get32()
+		f.mode = m.get8()
+		if dotu {
+			f.ext = m.getStr()
+		}
+	case msgTread:
+		f.fid = m.get32()
+		f.offset = m.get64()
+		f.count = m.get32()
+	case msgTwrite:
+		f.fid = m.get32()
+		f.offset = m.get64()
+		f.data = m.get(int(m.get32()))
+	case msgTclunk, msgTremove, msgTstat:
+		f.fid = m.get32()
+	case msgTwstat:
+		f.fid = m.get32()
+		f.stat = m.get(int(m.get16()))
+	default:
+		return f, fmt.Errorf("p9kit: unknown message type %d", f.typ)
+	}
+	if m.short {
+		return f, errShortMsg
+	}
+	return f, nil
+}
+
+// dir9p is a decoded stat structure as sent in Twstat.
+type dir9p struct {
+	mode   uint32
+	atime  uint32
+	mtime  uint32
+	length uint64
+	name   string
+	uid    string
+	gid    string
+	ext    string
+	nuid   uint32
+	ngid   uint32
+}
+
+func parseDir(b []byte, dotu bool) (dir9p, error) {
+	var d dir9p
+	m := &msgBuf{b: b}
+	m.get16() // size
+	m.get16() // type
+	m.get32() // dev
+	m.get(13) // qid
+	d.mode = m.get32()
+	d.atime = m.get32()
+	d.mtime = m.get32()
+	d.length = m.get64()
+	d.name = m.getStr()
+	d.uid = m.getStr()
+	d.gid = m.getStr()
+	m.getStr() // muid
+	d.nuid, d.ngid = noFid, noFid
+	if dotu {
+		d.ext = m.getStr()
+		d.nuid = m.get32()
+		d.ngid = m.get32()
+		m.get32() // n_muid
+	}
+	if m.short {
+		return d, errShortMsg
+	}
+	return d, nil
+}
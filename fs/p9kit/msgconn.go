@@ -0,0 +1,254 @@
+package p9kit
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// msgQueue is how many received messages a MsgConn holds before Deliver
+// blocks waiting for them to be read.
+const msgQueue = 64
+
+// MsgConn is a net.Conn carrying 9P over a channel that moves whole
+// messages, like a virtio queue, a websocket or a postMessage port.
+// Each message written to the conn is handed to send complete, however
+// the writer split it up. Data received from the channel is given to
+// Deliver in whatever pieces it arrives, and is read back from the conn
+// as whole messages.
+type MsgConn struct {
+	w     *frameWriter
+	close func() error
+
+	dmu     sync.Mutex
+	partial []byte
+	msgs    chan []byte
+
+	rmu  sync.Mutex
+	rbuf []byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	hangOnce  sync.Once
+	hungup    chan struct{}
+
+	readDeadline  *deadline
+	writeDeadline *deadline
+}
+
+var _ net.Conn = (*MsgConn)(nil)
+
+// NewMsgConn returns a conn sending messages with send, which is never
+// called concurrently and may keep the message it is given. If not nil,
+// close is called once when the conn is closed.
+func NewMsgConn(send func(msg []byte) error, close func() error) *MsgConn {
+	return &MsgConn{
+		w:             &frameWriter{w: sendWriter(send)},
+		close:         close,
+		msgs:          make(chan []byte, msgQueue),
+		closed:        make(chan struct{}),
+		hungup:        make(chan struct{}),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+	}
+}
+
+// Deliver passes data received from the channel to the conn. It may hold
+// part of a message, or several. Deliver blocks while too many messages
+// are waiting to be read, and must not be called concurrently, since the
+// order of calls is the order of the data.
+func (c *MsgConn) Deliver(data []byte) error {
+	c.dmu.Lock()
+	defer c.dmu.Unlock()
+
+	c.partial = append(c.partial, data...)
+	for len(c.partial) >= 4 {
+		size := binary.LittleEndian.Uint32(c.partial)
+		if size < 7 || size > maxFrameSize {
+			c.Close()
+			return fmt.Errorf("p9kit: bad message size %d", size)
+		}
+		if len(c.partial) < int(size) {
+			break
+		}
+		msg := make([]byte, size)
+		copy(msg, c.partial)
+		c.partial = c.partial[size:]
+		select {
+		case c.msgs <- msg:
+		case <-c.closed:
+			return net.ErrClosed
+		case <-c.hungup:
+			return net.ErrClosed
+		}
+	}
+	if len(c.partial) == 0 {
+		c.partial = nil
+	}
+	return nil
+}
+
+// Hangup tells the conn the channel has closed. Messages already
+// delivered can still be read, after which reads return io.EOF.
+func (c *MsgConn) Hangup() {
+	c.hangOnce.Do(func() { close(c.hungup) })
+}
+
+func (c *MsgConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for len(c.rbuf) == 0 {
+		select {
+		case <-c.closed:
+			return 0, net.ErrClosed
+		case msg := <-c.msgs:
+			c.rbuf = msg
+			continue
+		default:
+		}
+		select {
+		case <-c.closed:
+			return 0, net.ErrClosed
+		case msg := <-c.msgs:
+			c.rbuf = msg
+		case <-c.hungup:
+			// take anything delivered just before the hangup
+			select {
+			case msg := <-c.msgs:
+				c.rbuf = msg
+			default:
+				return 0, io.EOF
+			}
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+// Write collects whole messages from p to send. Sends aren't interrupted
+// by the write deadline, which is only checked before writing.
+func (c *MsgConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	case <-c.hungup:
+		return 0, io.ErrClosedPipe
+	case <-c.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+	return c.w.Write(p)
+}
+
+func (c *MsgConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		if c.close != nil {
+			err = c.close()
+		}
+	})
+	return err
+}
+
+func (c *MsgConn) LocalAddr() net.Addr  { return msgAddr{} }
+func (c *MsgConn) RemoteAddr() net.Addr { return msgAddr{} }
+
+func (c *MsgConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *MsgConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *MsgConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+type msgAddr struct{}
+
+func (msgAddr) Network() string { return "msg" }
+func (msgAddr) String() string  { return "msg" }
+
+// sendWriter adapts a send func to the writer under a frameWriter, which
+// only writes whole messages.
+type sendWriter func(msg []byte) error
+
+func (s sendWriter) Write(p []byte) (int, error) {
+	if err := s(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (sendWriter) Close() error { return nil }
+
+// deadline is a channel closed once a time passes, as net.Pipe does.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+// set sets the deadline, with the zero time clearing it.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer to fire
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel closed when the deadline passes.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,157 @@
+package p9kit
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"tractor.dev/wanix/fs/fskit"
+)
+
+func testMsg(typ uint8, tag uint16, body string) []byte {
+	m := newReply(typ, tag)
+	m.putStr(body)
+	return m.bytes()
+}
+
+func TestMsgConnSend(t *testing.T) {
+	var sent [][]byte
+	c := NewMsgConn(func(msg []byte) error {
+		sent = append(sent, msg)
+		return nil
+	}, nil)
+
+	// a message written in pieces is sent whole, and two written at
+	// once are sent apart
+	m1, m2, m3 := testMsg(msgTread, 1, "one"), testMsg(msgTread, 2, "two"), testMsg(msgTread, 3, "three")
+	for _, p := range [][]byte{m1[:2], m1[2:9], m1[9:], append(append([]byte{}, m2...), m3...)} {
+		if _, err := c.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sent) != 3 || !bytes.Equal(sent[0], m1) || !bytes.Equal(sent[1], m2) || !bytes.Equal(sent[2], m3) {
+		t.Fatalf("unexpected messages sent: %v", sent)
+	}
+}
+
+func TestMsgConnDeliver(t *testing.T) {
+	c := NewMsgConn(func([]byte) error { return nil }, nil)
+	m1, m2, m3 := testMsg(msgRread, 1, "one"), testMsg(msgRread, 2, "two"), testMsg(msgRread, 3, "three")
+
+	// split across deliveries, then merged into one
+	merged := append(append([]byte{}, m2...), m3...)
+	for _, p := range [][]byte{m1[:3], m1[3:], merged} {
+		if err := c.Deliver(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Hangup()
+
+	for _, want := range [][]byte{m1, m2, m3} {
+		got, err := readMsg(c, maxFrameSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF after hangup, got %v", err)
+	}
+
+	if err := NewMsgConn(nil, nil).Deliver([]byte{1, 0, 0, 0}); err == nil {
+		t.Fatal("expected bad message size to be rejected")
+	}
+}
+
+func TestMsgConnBackpressure(t *testing.T) {
+	c := NewMsgConn(func([]byte) error { return nil }, nil)
+	msg := testMsg(msgRread, 1, "x")
+	for range msgQueue {
+		if err := c.Deliver(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	delivered := make(chan error, 1)
+	go func() { delivered <- c.Deliver(msg) }()
+	select {
+	case <-delivered:
+		t.Fatal("expected deliver to block while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := readMsg(c, maxFrameSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-delivered; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMsgConnClose(t *testing.T) {
+	closed := 0
+	c := NewMsgConn(func([]byte) error { return nil }, func() error {
+		closed++
+		return nil
+	})
+
+	c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	c.SetReadDeadline(time.Time{})
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		read <- err
+	}()
+	c.Close()
+	c.Close()
+	if err := <-read; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected blocked read to end on close, got %v", err)
+	}
+	if _, err := c.Write(testMsg(msgTread, 1, "")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected write after close to fail, got %v", err)
+	}
+	if closed != 1 {
+		t.Fatalf("expected close to be called once, got %d", closed)
+	}
+}
+
+func TestMsgConnServe(t *testing.T) {
+	// each side delivers what the other sends a few bytes at a time
+	var client, server *MsgConn
+	chunked := func(to **MsgConn) func([]byte) error {
+		return func(msg []byte) error {
+			for len(msg) > 0 {
+				n := min(len(msg), 5)
+				if err := (*to).Deliver(msg[:n]); err != nil {
+					return err
+				}
+				msg = msg[n:]
+			}
+			return nil
+		}
+	}
+	client = NewMsgConn(chunked(&server), nil)
+	server = NewMsgConn(chunked(&client), nil)
+	defer client.Close()
+	go func() {
+		NewServer(fskit.MapFS{"foo": fskit.RawNode([]byte("bar"))}).Handle(server, server)
+		server.Close()
+	}()
+
+	fsys, err := ClientFS(client, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fsys, "foo"); got != "bar" {
+		t.Fatalf("unexpected contents: %q", got)
+	}
+}
@@ -1,13 +1,16 @@
 package p9kit
 
 import (
+	"context"
 	"errors"
 	"hash/fnv"
 	"io"
 	"log"
 	"os"
 	"path"
-	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/hugelgupf/p9/fsimpl/templatefs"
@@ -24,13 +27,19 @@ var (
 	_ p9.Attacher = &attacher{}
 )
 
+// Attacher returns a p9.Attacher serving fsys to a p9.Server. Each attach
+// gets its own session, but the p9 server gives it no way to cancel
+// operations on Tflush or when the connection closes.
+//
+// Deprecated: use NewServer, which cancels operations on both and
+// serves every 9P dialect.
 func Attacher(fsys fs.FS) p9.Attacher {
 	return &attacher{fsys} //fskit.NamedFS(fsys, "root")}
 }
 
 // Attach implements p9.Attacher.Attach.
 func (a *attacher) Attach() (p9.File, error) {
-	return &p9file{path: ".", fsys: a.FS}, nil
+	return &p9file{path: ".", fsys: a.FS, sess: newSession(fs.ContextFor(a.FS))}, nil
 }
 
 func toQid(name string, _ fs.FileInfo) (uint64, error) {
@@ -45,6 +54,21 @@ type p9file struct {
 	path string
 	file fs.File
 	fsys fs.FS
+
+	// sess is shared by the files of an attach, letting operations be
+	// cancelled when served by Server.
+	sess *session
+
+	// rfsys and rname are what path resolved to when walked, so walks
+	// from here continue from them rather than from the root. They are
+	// unset for names with something bound at or below them and for
+	// symlinks, whose resolution has to start from the root.
+	rfsys fs.FS
+	rname string
+
+	// dirents is the snapshot of an open directory served by Readdir.
+	dirMu   sync.Mutex
+	dirents []fs.DirEntry
 }
 
 var (
@@ -52,8 +76,17 @@ var (
 	_ p9.File = &p9file{}
 )
 
+// begin starts an operation on the file, returning a context carrying
+// its origin and a func to call when it is done.
+func (l *p9file) begin(op string) (context.Context, func()) {
+	ctx, done := l.sess.begin(l.path)
+	return fs.WithOrigin(ctx, l.fsys, l.path, op), done
+}
+
 // info constructs a QID for this file.
 func (l *p9file) info() (p9.QID, fs.FileInfo, error) {
+	ctx, done := l.begin("stat")
+	defer done()
 	var (
 		qid p9.QID
 		fi  fs.FileInfo
@@ -67,8 +100,12 @@ func (l *p9file) info() (p9.QID, fs.FileInfo, error) {
 	//	fi, err = fs.Stat(l.fsys, l.path)
 	// }
 
-	// prefer fs.Stat since symlinks are resolved
-	fi, err = fs.Stat(l.fsys, l.path)
+	// symlinks are not resolved so clients see them as symlinks
+	fsys, name := l.fsys, l.path
+	if l.rfsys != nil {
+		fsys, name = l.rfsys, l.rname
+	}
+	fi, err = fs.StatContext(fs.WithNoFollow(ctx), fsys, name)
 
 	if err != nil {
 		return qid, nil, err
@@ -97,7 +134,7 @@ func (l *p9file) info() (p9.QID, fs.FileInfo, error) {
 func (l *p9file) Walk(names []string) ([]p9.QID, p9.File, error) {
 	// log.Println("server walk:", l.path, names)
 	var qids []p9.QID
-	last := &p9file{path: l.path, fsys: l.fsys}
+	last := &p9file{path: l.path, fsys: l.fsys, sess: l.sess, rfsys: l.rfsys, rname: l.rname}
 
 	// A walk with no names is a copy of self.
 	if len(names) == 0 {
@@ -105,17 +142,45 @@ func (l *p9file) Walk(names []string) ([]p9.QID, p9.File, error) {
 	}
 
 	for _, name := range names {
-		c := &p9file{path: path.Join(last.path, name), fsys: l.fsys}
-		qid, _, err := c.info()
+		c := last.child(name)
+		qid, fi, err := c.info()
 		if err != nil {
 			return nil, nil, err
 		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			c.rfsys, c.rname = nil, ""
+		}
 		qids = append(qids, qid)
 		last = c
 	}
 	return qids, last, nil
 }
 
+// child returns the file for name in the directory, resolved relative to
+// the directory when possible.
+func (l *p9file) child(name string) *p9file {
+	c := &p9file{path: path.Join(l.path, name), fsys: l.fsys, sess: l.sess}
+	if fs.Bound(l.fsys, c.path) {
+		return c
+	}
+	ctx, done := c.begin("stat")
+	defer done()
+	if l.rfsys != nil {
+		c.rfsys, c.rname = resolve(ctx, l.rfsys, path.Join(l.rname, name))
+	} else {
+		c.rfsys, c.rname = resolve(ctx, l.fsys, c.path)
+	}
+	return c
+}
+
+// resolved returns the FS and name the file resolves to under ctx.
+func (l *p9file) resolved(ctx context.Context) (fs.FS, string) {
+	if l.rfsys != nil {
+		return l.rfsys, l.rname
+	}
+	return resolve(ctx, l.fsys, l.path)
+}
+
 // FSync implements p9.File.FSync.
 func (l *p9file) FSync() error {
 	err := fs.Sync(l.file)
@@ -185,8 +250,21 @@ func (l *p9file) Open(mode p9.OpenFlags) (p9.QID, uint32, error) {
 	}
 
 	// Do the actual open.
-
-	f, err := fs.OpenFile(l.fsys, l.path, int(mode), 0)
+	var f fs.File
+	if mode.Mode() == p9.ReadOnly && int(mode)&(os.O_TRUNC|os.O_APPEND) == 0 {
+		ctx, done := l.begin("open")
+		fsys, name := l.fsys, l.path
+		if l.rfsys != nil {
+			fsys, name = l.rfsys, l.rname
+		}
+		f, err = fs.OpenContext(ctx, fsys, name)
+		done()
+	} else {
+		ctx, done := l.begin("openfile")
+		rfsys, rname := l.resolved(ctx)
+		f, err = fs.OpenFile(rfsys, rname, int(mode), 0)
+		done()
+	}
 	if err != nil {
 		return qid, 0, err
 	}
@@ -197,7 +275,11 @@ func (l *p9file) Open(mode p9.OpenFlags) (p9.QID, uint32, error) {
 
 // ReadAt implements p9.File.ReadAt.
 func (l *p9file) ReadAt(p []byte, offset int64) (int, error) {
-	return fs.ReadAt(l.file, p, offset)
+	ctx, done := l.begin("read")
+	defer done()
+	return interruptible(ctx, l.file, p, func(b []byte) (int, error) {
+		return fs.ReadAt(l.file, b, offset)
+	})
 }
 
 // StatFS implements p9.File.StatFS.
@@ -213,7 +295,11 @@ func (l *p9file) Lock(pid int, locktype p9.LockType, flags p9.LockFlags, start,
 
 // WriteAt implements p9.File.WriteAt.
 func (l *p9file) WriteAt(p []byte, offset int64) (int, error) {
-	i, err := fs.WriteAt(l.file, p, offset)
+	ctx, done := l.begin("write")
+	defer done()
+	i, err := interruptible(ctx, l.file, p, func(b []byte) (int, error) {
+		return fs.WriteAt(l.file, b, offset)
+	})
 	if errors.Is(err, fs.ErrNotSupported) {
 		log.Println(err)
 	}
@@ -223,12 +309,20 @@ func (l *p9file) WriteAt(p []byte, offset int64) (int, error) {
 // Create implements p9.File.Create.
 func (l *p9file) Create(name string, mode p9.OpenFlags, permissions p9.FileMode, _ p9.UID, _ p9.GID) (p9.File, p9.QID, uint32, error) {
 	newName := path.Join(l.path, name)
-	f, err := fs.OpenFile(l.fsys, newName, int(mode)|os.O_CREATE|os.O_EXCL, fs.FileMode(permissions))
+	l2 := &p9file{path: newName, fsys: l.fsys, sess: l.sess}
+	ctx, done := l2.begin("create")
+	defer done()
+	// not every filesystem honors O_EXCL
+	if _, err := fs.StatContext(fs.WithNoFollow(ctx), l.fsys, newName); err == nil {
+		return nil, p9.QID{}, 0, fs.ErrExist
+	}
+	rfsys, rname := resolve(ctx, l.fsys, newName)
+	f, err := fs.OpenFile(rfsys, rname, int(mode)|os.O_CREATE|os.O_EXCL, fs.FileMode(permissions))
 	if err != nil {
 		return nil, p9.QID{}, 0, err
 	}
+	l2.file = f
 
-	l2 := &p9file{path: newName, file: f, fsys: l.fsys}
 	qid, _, err := l2.info()
 	if err != nil {
 		l2.Close()
@@ -241,7 +335,11 @@ func (l *p9file) Create(name string, mode p9.OpenFlags, permissions p9.FileMode,
 //
 // Not properly implemented.
 func (l *p9file) Mkdir(name string, permissions p9.FileMode, _ p9.UID, _ p9.GID) (p9.QID, error) {
-	if err := fs.Mkdir(l.fsys, path.Join(l.path, name), fs.FileMode(permissions)); err != nil {
+	c := &p9file{path: path.Join(l.path, name), fsys: l.fsys, sess: l.sess}
+	ctx, done := c.begin("mkdir")
+	defer done()
+	rfsys, rname := resolve(ctx, c.fsys, c.path)
+	if err := fs.Mkdir(rfsys, rname, fs.FileMode(permissions)); err != nil {
 		return p9.QID{}, err
 	}
 
@@ -251,7 +349,11 @@ func (l *p9file) Mkdir(name string, permissions p9.FileMode, _ p9.UID, _ p9.GID)
 
 // Symlink implements p9.File.Symlink.
 func (l *p9file) Symlink(oldname string, newname string, _ p9.UID, _ p9.GID) (p9.QID, error) {
-	if err := fs.Symlink(l.fsys, oldname, path.Join(l.path, newname)); err != nil {
+	c := &p9file{path: path.Join(l.path, newname), fsys: l.fsys, sess: l.sess}
+	ctx, done := c.begin("symlink")
+	defer done()
+	rfsys, rname := resolve(ctx, c.fsys, c.path)
+	if err := fs.Symlink(rfsys, oldname, rname); err != nil {
 		log.Println("p9kit:", err, oldname, path.Join(l.path, newname))
 		return p9.QID{}, err
 	}
@@ -281,38 +383,86 @@ func (l *p9file) RenameAt(oldName string, newDir p9.File, newName string) error
 
 // Readlink implements p9.File.Readlink.
 func (l *p9file) Readlink() (string, error) {
-	return fs.Readlink(l.fsys, l.path)
+	ctx, done := l.begin("readlink")
+	defer done()
+	rfsys, rname := resolve(fs.WithNoFollow(ctx), l.fsys, l.path)
+	return fs.Readlink(rfsys, rname)
 }
 
 // Renamed implements p9.File.Renamed.
 func (l *p9file) Renamed(parent p9.File, newName string) {
 	l.path = path.Join(parent.(*p9file).path, newName)
+	l.rfsys, l.rname = nil, ""
 }
 
 // SetAttr implements p9.File.SetAttr.
 func (l *p9file) SetAttr(valid p9.SetAttrMask, attr p9.SetAttr) error {
 	// When truncate(2) is called on Linux, Linux will try to set time & size. Fake it. Sorry.
-	supported := p9.SetAttrMask{Size: true, MTime: true, CTime: true, ATime: true}
+	supported := p9.SetAttrMask{
+		Permissions: true, UID: true, GID: true, Size: true,
+		MTime: true, CTime: true, ATime: true,
+		ATimeNotSystemTime: true, MTimeNotSystemTime: true,
+	}
 	if !valid.IsSubsetOf(supported) {
 		log.Printf("p9kit: unsupported attr: %v", valid)
 		return linux.ENOSYS
 	}
 
+	ctx, done := l.begin("setattr")
+	defer done()
+	fsys, name := l.resolved(ctx)
+
+	if valid.Permissions {
+		if err := fs.Chmod(fsys, name, fs.FileMode(attr.Permissions.Permissions())); err != nil {
+			return err
+		}
+	}
+
+	if valid.UID || valid.GID {
+		uid, gid := -1, -1
+		if valid.UID {
+			uid = int(attr.UID)
+		}
+		if valid.GID {
+			gid = int(attr.GID)
+		}
+		if err := fs.Chown(fsys, name, uid, gid); err != nil {
+			return err
+		}
+	}
+
 	if valid.Size {
-		if err := fs.Truncate(l.fsys, l.path, int64(attr.Size)); err != nil {
+		if err := fs.Truncate(fsys, name, int64(attr.Size)); err != nil {
 			if errors.Is(err, fs.ErrNotSupported) {
-				log.Printf("p9kit: truncate on %T: %s %s\n", l.fsys, l.path, err)
+				log.Printf("p9kit: truncate on %T: %s %s\n", fsys, name, err)
 			}
 			return err
 		}
 	}
 
 	if valid.MTime || valid.ATime {
-		if err := fs.Chtimes(l.fsys, l.path,
-			time.Unix(int64(attr.ATimeSeconds), int64(attr.ATimeNanoSeconds)),
-			time.Unix(int64(attr.MTimeSeconds), int64(attr.MTimeNanoSeconds))); err != nil {
+		fi, err := fs.StatContext(ctx, l.fsys, l.path)
+		if err != nil {
+			return err
+		}
+		// without an atime to keep, an unchanged atime follows mtime
+		atime, mtime := fi.ModTime(), fi.ModTime()
+		now := time.Now()
+		if valid.ATime {
+			atime = now
+			if valid.ATimeNotSystemTime {
+				atime = time.Unix(int64(attr.ATimeSeconds), int64(attr.ATimeNanoSeconds))
+			}
+		}
+		if valid.MTime {
+			mtime = now
+			if valid.MTimeNotSystemTime {
+				mtime = time.Unix(int64(attr.MTimeSeconds), int64(attr.MTimeNanoSeconds))
+			}
+		}
+		if err := fs.Chtimes(fsys, name, atime, mtime); err != nil {
 			if errors.Is(err, fs.ErrNotSupported) {
-				log.Printf("p9kit: chtimes on %T: %s %s\n", l.fsys, l.path, err)
+				log.Printf("p9kit: chtimes on %T: %s %s\n", fsys, name, err)
 			}
 			return err
 		}
@@ -323,57 +473,87 @@ func (l *p9file) SetAttr(valid p9.SetAttrMask, attr p9.SetAttr) error {
 
 // UnlinkAt implements p9.File.UnlinkAt
 func (l *p9file) UnlinkAt(name string, flags uint32) error {
-	// Construct the full path
-	fullPath := filepath.Join(l.path, name)
-
-	// Remove the file or directory
-	return fs.Remove(l.fsys, fullPath)
+	c := &p9file{path: path.Join(l.path, name), fsys: l.fsys, sess: l.sess}
+	ctx, done := c.begin("remove")
+	defer done()
+	rfsys, rname := resolve(fs.WithNoFollow(ctx), c.fsys, c.path)
+	return fs.Remove(rfsys, rname)
 }
 
-// Readdir implements p9.File.Readdir.
+// Readdir implements p9.File.Readdir. Entries come from a snapshot of
+// the directory taken when reading starts at offset zero, and each
+// entry's offset is the index of the one after it, so pages neither skip
+// nor repeat entries while the directory changes underneath.
 func (l *p9file) Readdir(offset uint64, count uint32) (p9.Dirents, error) {
-	// log.Println("server readdir:", l.path)
-	var (
-		p9Ents = make([]p9.Dirent, 0)
-		cursor = uint64(0)
-	)
-
-	dirfile, ok := l.file.(fs.ReadDirFile)
-	if !ok {
-		return nil, linux.ENOTDIR
-	}
+	l.dirMu.Lock()
+	defer l.dirMu.Unlock()
 
-	for len(p9Ents) < int(count) {
-		singleEnt, err := dirfile.ReadDir(1)
-
-		if err == io.EOF {
-			return p9Ents, nil
-		} else if err != nil {
+	if offset == 0 || l.dirents == nil {
+		entries, err := l.snapshot()
+		if err != nil {
 			return nil, err
 		}
+		// non-nil so later pages read the same snapshot
+		l.dirents = append([]fs.DirEntry{}, entries...)
+	}
 
-		// we consumed an entry
-		cursor++
-
-		// cursor \in (offset, offset+count)
-		if cursor < offset || cursor > offset+uint64(count) {
-			continue
-		}
-
-		e := singleEnt[0]
-
-		localEnt := p9file{path: path.Join(l.path, e.Name()), fsys: l.fsys}
-		qid, _, err := localEnt.info()
-		if err != nil {
-			return p9Ents, err
+	var (
+		p9Ents = make([]p9.Dirent, 0)
+		size   = 0
+	)
+	for i := offset; i < uint64(len(l.dirents)); i++ {
+		e := l.dirents[i]
+		// qid[13] offset[8] type[1] name[s]
+		if size += 13 + 8 + 1 + 2 + len(e.Name()); size > int(count) {
+			break
 		}
+		qid := direntQid(path.Join(l.path, e.Name()), e)
 		p9Ents = append(p9Ents, p9.Dirent{
 			QID:    qid,
 			Type:   qid.Type,
 			Name:   e.Name(),
-			Offset: cursor,
+			Offset: i + 1,
 		})
 	}
-
 	return p9Ents, nil
 }
+
+// snapshot lists the directory sorted by name, reading the open file
+// the first time and listing it afresh when a client rewinds.
+func (l *p9file) snapshot() ([]fs.DirEntry, error) {
+	entries, err := l.list()
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
+
+func (l *p9file) list() ([]fs.DirEntry, error) {
+	dirfile, ok := l.file.(fs.ReadDirFile)
+	if !ok {
+		return nil, linux.ENOTDIR
+	}
+	if l.dirents != nil {
+		ctx, done := l.begin("readdir")
+		defer done()
+		return fs.ReadDirContext(ctx, l.fsys, l.path)
+	}
+	entries, err := dirfile.ReadDir(-1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// direntQid constructs a QID for a directory entry from the entry
+// alone, without a stat.
+func direntQid(name string, e fs.DirEntry) p9.QID {
+	qidPath, _ := toQid(name, nil)
+	return p9.QID{
+		Type: p9.ModeFromOS(e.Type()).QIDType(),
+		Path: qidPath,
+	}
+}
@@ -0,0 +1,930 @@
+package p9kit
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hugelgupf/p9/linux"
+	"tractor.dev/wanix/fs"
+)
+
+// defaultMsize is the largest message size negotiated by conn9p.
+const defaultMsize = 1 << 20
+
+// fileOwner is reported as the owner of every file, since the fs
+// interfaces don't expose one.
+const fileOwner = "wanix"
+
+// conn9p serves a filesystem over a single 9P2000 or 9P2000.u connection.
+// It translates the classic protocol onto the same fs interfaces used by
+// the 9P2000.L attacher.
+type conn9p struct {
+	trees map[string]fs.FS
+	keys  KeyFunc
+	dotu  bool
+	msize uint32
+
+	r io.Reader
+	w io.Writer
+
+	wmu  sync.Mutex
+	mu   sync.Mutex
+	fids map[uint32]*fid9p
+	tags map[uint16]*request9p
+	wg   sync.WaitGroup
+
+	// last holds the done channel of the last request received for
+	// each fid, so requests on a fid run in the order they arrived
+	last map[uint32]chan struct{}
+}
+
+// request9p is a request being served, which Tflush can cancel.
+type request9p struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type fid9p struct {
+	mu     sync.Mutex
+	fsys   fs.FS
+	path   string
+	file   fs.File
+	opened bool
+	mode   uint8
+	rclose bool
+
+	// set if this is an auth fid rather than a file
+	auth *authFid
+
+	// directory reads are served from a listing made at offset zero,
+	// where diroff is the offset of the entry at dirpos
+	dirents [][]byte
+	dirpos  int
+	diroff  uint64
+}
+
+func newConn9p(trees map[string]fs.FS, keys KeyFunc, r io.Reader, w io.Writer) *conn9p {
+	return &conn9p{
+		trees: trees,
+		keys:  keys,
+		msize: defaultMsize,
+		r:     r,
+		w:     w,
+		fids:  make(map[uint32]*fid9p),
+		tags:  make(map[uint16]*request9p),
+		last:  make(map[uint32]chan struct{}),
+	}
+}
+
+// serve handles requests until the connection is closed. Each request
+// runs in its own goroutine apart from Tversion, which resets the session,
+// but waits for earlier requests on the same fids to finish. Requests
+// still running when the connection closes are cancelled.
+func (c *conn9p) serve() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer c.clunkAll()
+	defer cancel()
+	for {
+		msg, err := readMsg(c.r, c.msize)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) {
+				return nil
+			}
+			return err
+		}
+		f, err := parseFcall(msg, c.dotu)
+		if err != nil {
+			c.send(c.rerror(f.tag, err))
+			continue
+		}
+		if f.typ == msgTversion {
+			c.wg.Wait()
+			c.send(c.version(f))
+			continue
+		}
+
+		rctx, rcancel := context.WithCancel(ctx)
+		req := &request9p{cancel: rcancel, done: make(chan struct{})}
+		c.mu.Lock()
+		c.tags[f.tag] = req
+		c.mu.Unlock()
+		prev, done := c.order(f)
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			defer rcancel()
+			defer c.endOrder(f, prev, done)
+			var r []byte
+			if waitAll(rctx, prev) {
+				r = c.handle(rctx, f)
+			} else {
+				r = c.rerror(f.tag, linux.EINTR)
+			}
+			c.mu.Lock()
+			delete(c.tags, f.tag)
+			c.mu.Unlock()
+			c.send(r)
+			close(req.done)
+		}()
+	}
+}
+
+// orderFids returns the fids a request uses, which it's ordered by.
+func orderFids(f *fcall) []uint32 {
+	switch f.typ {
+	case msgTflush:
+		return nil
+	case msgTauth:
+		return []uint32{f.afid}
+	case msgTwalk:
+		if f.newfid != f.fid {
+			return []uint32{f.fid, f.newfid}
+		}
+	}
+	return []uint32{f.fid}
+}
+
+// order queues f behind the last requests on its fids, returning their
+// done channels and the one to close when f is done.
+func (c *conn9p) order(f *fcall) (prev []chan struct{}, done chan struct{}) {
+	done = make(chan struct{})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range orderFids(f) {
+		if ch, ok := c.last[id]; ok {
+			prev = append(prev, ch)
+		}
+		c.last[id] = done
+	}
+	return prev, done
+}
+
+// endOrder lets the next requests on the fids of f run. A request
+// that was flushed while queued still waits for the ones before it.
+func (c *conn9p) endOrder(f *fcall, prev []chan struct{}, done chan struct{}) {
+	for _, ch := range prev {
+		<-ch
+	}
+	c.mu.Lock()
+	for _, id := range orderFids(f) {
+		if c.last[id] == done {
+			delete(c.last, id)
+		}
+	}
+	c.mu.Unlock()
+	close(done)
+}
+
+// waitAll waits for every channel in chs to close, returning false if
+// ctx is done first.
+func waitAll(ctx context.Context, chs []chan struct{}) bool {
+	for _, ch := range chs {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+func (c *conn9p) send(msg []byte) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.w.Write(msg)
+}
+
+func (c *conn9p) clunkAll() {
+	c.wg.Wait()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, f := range c.fids {
+		if f.file != nil {
+			f.file.Close()
+		}
+		delete(c.fids, id)
+	}
+}
+
+func (c *conn9p) rerror(tag uint16, err error) []byte {
+	r := newReply(msgRerror, tag)
+	r.putStr(err.Error())
+	if c.dotu {
+		r.put32(uint32(linux.ExtractErrno(err)))
+	}
+	return r.bytes()
+}
+
+func (c *conn9p) version(f *fcall) []byte {
+	c.clunkAll()
+	c.msize = min(max(f.msize, 256), defaultMsize)
+	version := "unknown"
+	switch {
+	case strings.HasPrefix(f.version, "9P2000.u"):
+		version = "9P2000.u"
+	case strings.HasPrefix(f.version, "9P2000"):
+		version = "9P2000"
+	}
+	c.dotu = version == "9P2000.u"
+	r := newReply(msgRversion, f.tag)
+	r.put32(c.msize)
+	r.putStr(version)
+	return r.bytes()
+}
+
+func (c *conn9p) handle(ctx context.Context, f *fcall) []byte {
+	var (
+		r   *msgBuf
+		err error
+	)
+	switch f.typ {
+	case msgTauth:
+		r, err = c.auth(ctx, f)
+	case msgTattach:
+		r, err = c.attach(ctx, f)
+	case msgTflush:
+		c.mu.Lock()
+		old := c.tags[f.oldtag]
+		c.mu.Unlock()
+		if old != nil {
+			old.cancel()
+			<-old.done
+		}
+		r = newReply(msgRflush, f.tag)
+	case msgTwalk:
+		r, err = c.walk(ctx, f)
+	case msgTopen:
+		r, err = c.open(ctx, f)
+	case msgTcreate:
+		r, err = c.create(ctx, f)
+	case msgTread:
+		r, err = c.read(ctx, f)
+	case msgTwrite:
+		r, err = c.write(ctx, f)
+	case msgTclunk:
+		r, err = c.clunk(ctx, f)
+	case msgTremove:
+		r, err = c.remove(ctx, f)
+	case msgTstat:
+		r, err = c.stat(ctx, f)
+	case msgTwstat:
+		r, err = c.wstat(ctx, f)
+	}
+	if err != nil {
+		return c.rerror(f.tag, err)
+	}
+	return r.bytes()
+}
+
+func (c *conn9p) lookup(id uint32) (*fid9p, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.fids[id]
+	if !ok || f.auth != nil {
+		return nil, linux.EBADF
+	}
+	return f, nil
+}
+
+// lookupAuth returns the auth fid for id, or nil if id is not one.
+func (c *conn9p) lookupAuth(id uint32) *authFid {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f, ok := c.fids[id]; ok {
+		return f.auth
+	}
+	return nil
+}
+
+func (c *conn9p) bind(id uint32, f *fid9p) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.fids[id]; ok {
+		return linux.EBADF
+	}
+	c.fids[id] = f
+	return nil
+}
+
+func (c *conn9p) unbind(id uint32) (*fid9p, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.fids[id]
+	if !ok {
+		return nil, linux.EBADF
+	}
+	delete(c.fids, id)
+	return f, nil
+}
+
+// begin starts an operation on name in fsys for the request with ctx,
+// returning a context carrying the tree's values and the origin of the
+// operation, and a func to call when it is done.
+func (c *conn9p) begin(ctx context.Context, fsys fs.FS, name, op string) (context.Context, func()) {
+	octx, done := withCancelOf(fs.ContextFor(fsys), ctx)
+	return fs.WithOrigin(octx, fsys, name, op), done
+}
+
+// statPath stats name, leaving symlinks unresolved for 9P2000.u
+// clients that know about them.
+func (c *conn9p) statPath(ctx context.Context, fsys fs.FS, name string) (fs.FileInfo, error) {
+	ctx, done := c.begin(ctx, fsys, name, "stat")
+	defer done()
+	if c.dotu {
+		ctx = fs.WithNoFollow(ctx)
+	}
+	return fs.StatContext(ctx, fsys, name)
+}
+
+func (c *conn9p) qid(name string, fi fs.FileInfo) qid9p {
+	q := qid9p{typ: qtFile}
+	switch {
+	case fi.IsDir():
+		q.typ = qtDir
+	case fi.Mode()&fs.ModeSymlink != 0 && c.dotu:
+		q.typ = qtSymlink
+	case fi.Mode()&fs.ModeAppend != 0:
+		q.typ = qtAppend
+	}
+	q.path, _ = toQid(name, fi)
+	return q
+}
+
+// dirStat encodes fi as a stat structure for the file at name.
+func (c *conn9p) dirStat(ctx context.Context, fsys fs.FS, name string, fi fs.FileInfo) []byte {
+	mode := uint32(fi.Mode().Perm())
+	var ext string
+	switch {
+	case fi.IsDir():
+		mode |= dmDir
+	case fi.Mode()&fs.ModeAppend != 0:
+		mode |= dmAppend
+	}
+	if c.dotu {
+		switch {
+		case fi.Mode()&fs.ModeSymlink != 0:
+			mode |= dmSymlink
+			ctx, done := c.begin(ctx, fsys, name, "readlink")
+			rfsys, rname := resolve(fs.WithNoFollow(ctx), fsys, name)
+			ext, _ = fs.Readlink(rfsys, rname)
+			done()
+		case fi.Mode()&fs.ModeNamedPipe != 0:
+			mode |= dmNamedPipe
+		case fi.Mode()&fs.ModeSocket != 0:
+			mode |= dmSocket
+		case fi.Mode()&fs.ModeDevice != 0:
+			mode |= dmDevice
+		}
+		if fi.Mode()&fs.ModeSetuid != 0 {
+			mode |= dmSetuid
+		}
+		if fi.Mode()&fs.ModeSetgid != 0 {
+			mode |= dmSetgid
+		}
+	}
+	base := path.Base(name)
+	if name == "." {
+		base = "/"
+	}
+	mtime := uint32(fi.ModTime().Unix())
+
+	m := &msgBuf{}
+	m.put16(0)
+	m.put16(0) // type
+	m.put32(0) // dev
+	m.putQid(c.qid(name, fi))
+	m.put32(mode)
+	m.put32(mtime)
+	m.put32(mtime)
+	m.put64(uint64(fi.Size()))
+	m.putStr(base)
+	m.putStr(fileOwner)
+	m.putStr(fileOwner)
+	m.putStr(fileOwner)
+	if c.dotu {
+		m.putStr(ext)
+		m.put32(0)
+		m.put32(0)
+		m.put32(0)
+	}
+	binary.LittleEndian.PutUint16(m.b, uint16(len(m.b)-2))
+	return m.b
+}
+
+func (c *conn9p) auth(ctx context.Context, f *fcall) (*msgBuf, error) {
+	if c.keys == nil {
+		return nil, errors.New("authentication not required")
+	}
+	a, err := newAuthFid(c.keys, f.uname, f.aname)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.bind(f.afid, &fid9p{auth: a}); err != nil {
+		return nil, err
+	}
+	r := newReply(msgRauth, f.tag)
+	r.putQid(qid9p{typ: qtAuth})
+	return r, nil
+}
+
+func (c *conn9p) attach(ctx context.Context, f *fcall) (*msgBuf, error) {
+	switch {
+	case c.keys != nil:
+		a := c.lookupAuth(f.afid)
+		if a == nil {
+			return nil, linux.EACCES
+		}
+		if err := a.check(f.uname, f.aname); err != nil {
+			return nil, err
+		}
+	case f.afid != noFid:
+		return nil, errors.New("authentication not required")
+	}
+	tree, name, ok := findTree(c.trees, f.aname)
+	if !ok {
+		return nil, linux.ENOENT
+	}
+	fsys := c.trees[tree]
+	fi, err := c.statPath(ctx, fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.bind(f.fid, &fid9p{fsys: fsys, path: name}); err != nil {
+		return nil, err
+	}
+	r := newReply(msgRattach, f.tag)
+	r.putQid(c.qid(name, fi))
+	return r, nil
+}
+
+func (c *conn9p) walk(ctx context.Context, f *fcall) (*msgBuf, error) {
+	fid, err := c.lookup(f.fid)
+	if err != nil {
+		return nil, err
+	}
+	fid.mu.Lock()
+	name, opened := fid.path, fid.opened
+	fid.mu.Unlock()
+	if opened {
+		return nil, errors.New("cannot walk an open fid")
+	}
+
+	var qids []qid9p
+	for i, elem := range f.wname {
+		if elem == "" || strings.Contains(elem, "/") {
+			if i == 0 {
+				return nil, fs.ErrInvalid
+			}
+			break
+		}
+		dir, err := c.statPath(ctx, fid.fsys, name)
+		if err == nil && !dir.IsDir() {
+			err = linux.ENOTDIR
+		}
+		next := path.Join(name, elem)
+		if elem == ".." {
+			next = path.Dir(name)
+		}
+		var fi fs.FileInfo
+		if err == nil {
+			fi, err = c.statPath(ctx, fid.fsys, next)
+		}
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			break
+		}
+		qids = append(qids, c.qid(next, fi))
+		name = next
+	}
+
+	if len(qids) == len(f.wname) {
+		if f.newfid == f.fid {
+			fid.mu.Lock()
+			fid.path = name
+			fid.mu.Unlock()
+		} else if err := c.bind(f.newfid, &fid9p{fsys: fid.fsys, path: name}); err != nil {
+			return nil, err
+		}
+	}
+
+	r := newReply(msgRwalk, f.tag)
+	r.put16(uint16(len(qids)))
+	for _, q := range qids {
+		r.putQid(q)
+	}
+	return r, nil
+}
+
+// openFlag converts a 9P open mode to os open flags.
+func openFlag(mode uint8) int {
+	var flag int
+	switch mode & 3 {
+	case oWrite:
+		flag = os.O_WRONLY
+	case oRdwr:
+		flag = os.O_RDWR
+	default:
+		flag = os.O_RDONLY
+	}
+	if mode&oTrunc != 0 {
+		flag |= os.O_TRUNC
+	}
+	return flag
+}
+
+func (c *conn9p) open(ctx context.Context, f *fcall) (*msgBuf, error) {
+	fid, err := c.lookup(f.fid)
+	if err != nil {
+		return nil, err
+	}
+	fid.mu.Lock()
+	defer fid.mu.Unlock()
+	if fid.opened {
+		return nil, linux.EBADF
+	}
+
+	op := "open"
+	if mode3(f.mode) != oRead {
+		op = "openfile"
+	}
+	ctx, done := c.begin(ctx, fid.fsys, fid.path, op)
+	defer done()
+	fi, err := fs.StatContext(ctx, fid.fsys, fid.path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() && mode3(f.mode) != oRead {
+		return nil, linux.EISDIR
+	}
+	var file fs.File
+	if op == "open" {
+		file, err = fs.OpenContext(ctx, fid.fsys, fid.path)
+	} else {
+		rfsys, rname := resolve(ctx, fid.fsys, fid.path)
+		// not every filesystem honors O_TRUNC
+		if f.mode&oTrunc != 0 {
+			if err := fs.Truncate(rfsys, rname, 0); err != nil {
+				return nil, err
+			}
+		}
+		file, err = fs.OpenFile(rfsys, rname, openFlag(f.mode), 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fid.file = file
+	fid.opened = true
+	fid.mode = f.mode
+	fid.rclose = f.mode&oRclose != 0
+
+	r := newReply(msgRopen, f.tag)
+	r.putQid(c.qid(fid.path, fi))
+	r.put32(c.msize - ioHeaderSize)
+	return r, nil
+}
+
+func mode3(mode uint8) uint8 {
+	if mode&3 == oExec {
+		return oRead
+	}
+	return mode & 3
+}
+
+func (c *conn9p) create(ctx context.Context, f *fcall) (*msgBuf, error) {
+	fid, err := c.lookup(f.fid)
+	if err != nil {
+		return nil, err
+	}
+	fid.mu.Lock()
+	defer fid.mu.Unlock()
+	if fid.opened {
+		return nil, linux.EBADF
+	}
+	if f.name == "" || f.name == "." || f.name == ".." || strings.Contains(f.name, "/") {
+		return nil, fs.ErrInvalid
+	}
+	name := path.Join(fid.path, f.name)
+	cctx, done := c.begin(ctx, fid.fsys, name, "create")
+	defer done()
+	if _, err := fs.StatContext(fs.WithNoFollow(cctx), fid.fsys, name); err == nil {
+		return nil, fs.ErrExist
+	}
+
+	rfsys, rname := resolve(cctx, fid.fsys, name)
+	var file fs.File
+	switch {
+	case f.perm&dmDir != 0:
+		if err := fs.Mkdir(rfsys, rname, fs.FileMode(f.perm&0777)); err != nil {
+			return nil, err
+		}
+		file, err = fs.OpenContext(cctx, fid.fsys, name)
+	case f.perm&dmSymlink != 0 && c.dotu:
+		err = fs.Symlink(rfsys, f.ext, rname)
+	case f.perm&(dmDevice|dmNamedPipe|dmSocket) != 0:
+		err = fs.ErrNotSupported
+	default:
+		file, err = fs.OpenFile(rfsys, rname, openFlag(f.mode)|os.O_CREATE|os.O_EXCL, fs.FileMode(f.perm&0777))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := c.statPath(ctx, fid.fsys, name)
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return nil, err
+	}
+	fid.path = name
+	fid.file = file
+	fid.opened = true
+	fid.mode = f.mode
+	fid.rclose = f.mode&oRclose != 0
+
+	r := newReply(msgRcreate, f.tag)
+	r.putQid(c.qid(name, fi))
+	r.put32(c.msize - ioHeaderSize)
+	return r, nil
+}
+
+func (c *conn9p) read(ctx context.Context, f *fcall) (*msgBuf, error) {
+	if a := c.lookupAuth(f.fid); a != nil {
+		data := a.read(f.offset, f.count)
+		r := newReply(msgRread, f.tag)
+		r.put32(uint32(len(data)))
+		r.b = append(r.b, data...)
+		return r, nil
+	}
+	fid, err := c.lookup(f.fid)
+	if err != nil {
+		return nil, err
+	}
+	fid.mu.Lock()
+	defer fid.mu.Unlock()
+	if !fid.opened || fid.file == nil || mode3(fid.mode) == oWrite {
+		return nil, linux.EBADF
+	}
+	count := min(f.count, c.msize-ioHeaderSize)
+
+	r := newReply(msgRread, f.tag)
+	if _, ok := fid.file.(fs.ReadDirFile); ok {
+		data, err := c.readDir(ctx, fid, f.offset, count)
+		if err != nil {
+			return nil, err
+		}
+		r.put32(uint32(len(data)))
+		r.b = append(r.b, data...)
+		return r, nil
+	}
+
+	ctx, done := c.begin(ctx, fid.fsys, fid.path, "read")
+	defer done()
+	buf := make([]byte, count)
+	n, err := interruptible(ctx, fid.file, buf, func(b []byte) (int, error) {
+		return fs.ReadAt(fid.file, b, int64(f.offset))
+	})
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	r.put32(uint32(n))
+	r.b = append(r.b, buf[:n]...)
+	return r, nil
+}
+
+// readDir returns whole stat entries starting at offset. Reading at zero
+// lists the directory again. Other offsets usually continue where the
+// last read ended, but any offset at the start of an entry is served,
+// listing again if it isn't one in the current listing.
+func (c *conn9p) readDir(ctx context.Context, fid *fid9p, offset uint64, count uint32) ([]byte, error) {
+	if offset == 0 || fid.dirents == nil {
+		if err := c.listDir(ctx, fid); err != nil {
+			return nil, err
+		}
+	}
+	if offset != fid.diroff && !seekDir(fid, offset) {
+		// the offset may be from an earlier listing, so list again
+		if err := c.listDir(ctx, fid); err != nil {
+			return nil, err
+		}
+		if !seekDir(fid, offset) {
+			return nil, errors.New("bad offset in directory read")
+		}
+	}
+
+	var data []byte
+	for fid.dirpos < len(fid.dirents) && len(data)+len(fid.dirents[fid.dirpos]) <= int(count) {
+		data = append(data, fid.dirents[fid.dirpos]...)
+		fid.dirpos++
+	}
+	fid.diroff += uint64(len(data))
+	return data, nil
+}
+
+// seekDir moves the directory read of fid to offset, reporting whether
+// it is the start of an entry or the end of the listing.
+func seekDir(fid *fid9p, offset uint64) bool {
+	fid.dirpos, fid.diroff = 0, 0
+	for fid.dirpos < len(fid.dirents) && fid.diroff < offset {
+		fid.diroff += uint64(len(fid.dirents[fid.dirpos]))
+		fid.dirpos++
+	}
+	return fid.diroff == offset
+}
+
+// listDir takes a snapshot of the entries of the directory of fid.
+func (c *conn9p) listDir(ctx context.Context, fid *fid9p) error {
+	rctx, done := c.begin(ctx, fid.fsys, fid.path, "readdir")
+	entries, err := fs.ReadDirContext(rctx, fid.fsys, fid.path)
+	done()
+	if err != nil {
+		return err
+	}
+	fid.dirents = [][]byte{}
+	for _, e := range entries {
+		name := path.Join(fid.path, e.Name())
+		fi, err := c.statPath(ctx, fid.fsys, name)
+		if err != nil {
+			if fi, err = e.Info(); err != nil {
+				continue
+			}
+		}
+		fid.dirents = append(fid.dirents, c.dirStat(ctx, fid.fsys, name, fi))
+	}
+	fid.dirpos, fid.diroff = 0, 0
+	return nil
+}
+
+func (c *conn9p) write(ctx context.Context, f *fcall) (*msgBuf, error) {
+	if a := c.lookupAuth(f.fid); a != nil {
+		if err := a.write(f.data); err != nil {
+			return nil, err
+		}
+		r := newReply(msgRwrite, f.tag)
+		r.put32(uint32(len(f.data)))
+		return r, nil
+	}
+	fid, err := c.lookup(f.fid)
+	if err != nil {
+		return nil, err
+	}
+	fid.mu.Lock()
+	defer fid.mu.Unlock()
+	if !fid.opened || fid.file == nil || mode3(fid.mode) == oRead {
+		return nil, linux.EBADF
+	}
+	ctx, done := c.begin(ctx, fid.fsys, fid.path, "write")
+	defer done()
+	n, err := interruptible(ctx, fid.file, f.data, func(b []byte) (int, error) {
+		return fs.WriteAt(fid.file, b, int64(f.offset))
+	})
+	if err != nil {
+		return nil, err
+	}
+	r := newReply(msgRwrite, f.tag)
+	r.put32(uint32(n))
+	return r, nil
+}
+
+func (c *conn9p) clunk(ctx context.Context, f *fcall) (*msgBuf, error) {
+	fid, err := c.unbind(f.fid)
+	if err != nil {
+		return nil, err
+	}
+	fid.mu.Lock()
+	defer fid.mu.Unlock()
+	if fid.file != nil {
+		fid.file.Close()
+	}
+	if fid.rclose {
+		ctx, done := c.begin(ctx, fid.fsys, fid.path, "remove")
+		rfsys, rname := resolve(fs.WithNoFollow(ctx), fid.fsys, fid.path)
+		fs.Remove(rfsys, rname)
+		done()
+	}
+	return newReply(msgRclunk, f.tag), nil
+}
+
+func (c *conn9p) remove(ctx context.Context, f *fcall) (*msgBuf, error) {
+	// the fid is clunked even if the remove fails
+	fid, err := c.unbind(f.fid)
+	if err != nil {
+		return nil, err
+	}
+	fid.mu.Lock()
+	defer fid.mu.Unlock()
+	if fid.file != nil {
+		fid.file.Close()
+	}
+	if fid.auth != nil {
+		return nil, linux.EBADF
+	}
+	ctx, done := c.begin(ctx, fid.fsys, fid.path, "remove")
+	defer done()
+	rfsys, rname := resolve(fs.WithNoFollow(ctx), fid.fsys, fid.path)
+	if err := fs.Remove(rfsys, rname); err != nil {
+		return nil, err
+	}
+	return newReply(msgRremove, f.tag), nil
+}
+
+func (c *conn9p) stat(ctx context.Context, f *fcall) (*msgBuf, error) {
+	fid, err := c.lookup(f.fid)
+	if err != nil {
+		return nil, err
+	}
+	fid.mu.Lock()
+	name := fid.path
+	fid.mu.Unlock()
+	fi, err := c.statPath(ctx, fid.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	stat := c.dirStat(ctx, fid.fsys, name, fi)
+	r := newReply(msgRstat, f.tag)
+	r.put16(uint16(len(stat)))
+	r.b = append(r.b, stat...)
+	return r, nil
+}
+
+func (c *conn9p) wstat(ctx context.Context, f *fcall) (*msgBuf, error) {
+	fid, err := c.lookup(f.fid)
+	if err != nil {
+		return nil, err
+	}
+	d, err := parseDir(f.stat, c.dotu)
+	if err != nil {
+		return nil, err
+	}
+	fid.mu.Lock()
+	defer fid.mu.Unlock()
+
+	ctx, done := c.begin(ctx, fid.fsys, fid.path, "wstat")
+	defer done()
+	fi, err := fs.StatContext(ctx, fid.fsys, fid.path)
+	if err != nil {
+		return nil, err
+	}
+	fsys, name := resolve(ctx, fid.fsys, fid.path)
+	// all-ones fields and empty strings are left unchanged
+	if d.mode != noFid {
+		if (d.mode&dmDir != 0) != fi.IsDir() {
+			return nil, errors.New("cannot change directory bit")
+		}
+		if err := fs.Chmod(fsys, name, fs.FileMode(d.mode&0777)); err != nil {
+			return nil, err
+		}
+	}
+	if d.length != ^uint64(0) {
+		if fi.IsDir() {
+			return nil, errors.New("cannot set length of a directory")
+		}
+		if err := fs.Truncate(fsys, name, int64(d.length)); err != nil {
+			return nil, err
+		}
+	}
+	if d.mtime != noFid || d.atime != noFid {
+		mtime, atime := fi.ModTime(), fi.ModTime()
+		if d.mtime != noFid {
+			mtime = time.Unix(int64(d.mtime), 0)
+		}
+		if d.atime != noFid {
+			atime = time.Unix(int64(d.atime), 0)
+		}
+		if err := fs.Chtimes(fsys, name, atime, mtime); err != nil {
+			return nil, err
+		}
+	}
+	if d.nuid != noFid || d.ngid != noFid {
+		uid, gid := -1, -1
+		if d.nuid != noFid {
+			uid = int(d.nuid)
+		}
+		if d.ngid != noFid {
+			gid = int(d.ngid)
+		}
+		if err := fs.Chown(fsys, name, uid, gid); err != nil {
+			return nil, err
+		}
+	}
+	if d.name != "" && d.name != path.Base(fid.path) {
+		if strings.Contains(d.name, "/") || fid.path == "." {
+			return nil, fs.ErrInvalid
+		}
+		newpath := path.Join(path.Dir(fid.path), d.name)
+		if err := fs.Rename(fid.fsys, fid.path, newpath); err != nil {
+			return nil, err
+		}
+		fid.path = newpath
+	}
+	return newReply(msgRwstat, f.tag), nil
+}
@@ -0,0 +1,344 @@
+package p9kit
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"9fans.net/go/plan9"
+	"9fans.net/go/plan9/client"
+	"tractor.dev/wanix/fs"
+	"tractor.dev/wanix/fs/fskit"
+)
+
+func mount9p(t *testing.T, backend fs.FS) *client.Fsys {
+	t.Helper()
+	a, b := net.Pipe()
+	go NewServer(backend).Handle(a, a)
+
+	conn, err := client.NewConn(b)
+	if err != nil {
+		t.Fatalf("NewConn: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fsys, err := conn.Attach(nil, "glenda", "")
+	if err != nil {
+		t.Fatalf("Attach: %v", err)
+	}
+	return fsys
+}
+
+func TestServer9P2000(t *testing.T) {
+	backend := fskit.MemFS{
+		"hello":    fskit.RawNode([]byte("hello world"), fs.FileMode(0644)),
+		"sub/file": fskit.RawNode([]byte("nested")),
+	}
+	fsys := mount9p(t, backend)
+
+	root, err := fsys.Open("/", plan9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs, err := root.Dirreadall()
+	root.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, d := range dirs {
+		names = append(names, d.Name)
+	}
+	if !slices.Equal(names, []string{"hello", "sub"}) {
+		t.Fatalf("unexpected root entries: %v", names)
+	}
+
+	d, err := fsys.Stat("/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Mode&plan9.DMDIR == 0 || d.Qid.Type&plan9.QTDIR == 0 {
+		t.Fatalf("expected sub to be a directory: %v", d)
+	}
+
+	f, err := fsys.Open("/hello", plan9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello world" {
+		t.Fatalf("unexpected contents: %q", b)
+	}
+
+	f, err = fsys.Create("/sub/new", plan9.OWRITE, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("created")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if b, _ := fs.ReadFile(backend, "sub/new"); string(b) != "created" {
+		t.Fatalf("unexpected created contents: %q", b)
+	}
+
+	if _, err := fsys.Create("/sub/dir", plan9.OREAD, plan9.DMDIR|0755); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := fs.Stat(backend, "sub/dir"); err != nil || !fi.IsDir() {
+		t.Fatalf("expected sub/dir to be created: %v", err)
+	}
+
+	f, err = fsys.Open("/hello", plan9.OWRITE|plan9.OTRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("bye"))
+	f.Close()
+	if b, _ := fs.ReadFile(backend, "hello"); string(b) != "bye" {
+		t.Fatalf("unexpected contents after truncate: %q", b)
+	}
+
+	var dir plan9.Dir
+	dir.Null()
+	dir.Name = "renamed"
+	dir.Mode = 0600
+	if err := fsys.Wstat("/hello", &dir); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := fs.Stat(backend, "renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected mode after wstat: %v", fi.Mode())
+	}
+
+	if err := fsys.Remove("/renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Stat("/renamed"); err == nil {
+		t.Fatal("expected removed file to be gone")
+	}
+	if _, err := fsys.Open("/missing", plan9.OREAD); err == nil {
+		t.Fatal("expected error opening missing file")
+	}
+}
+
+// rpc9p sends a raw T-message built by fn and returns the reply body.
+func rpc9p(t *testing.T, conn net.Conn, typ uint8, fn func(m *msgBuf)) (uint8, *msgBuf) {
+	t.Helper()
+	m := newReply(typ, 1)
+	fn(m)
+	if _, err := conn.Write(m.bytes()); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := readMsg(conn, defaultMsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &msgBuf{b: msg[4:]}
+	rtyp := r.get8()
+	r.get16()
+	return rtyp, r
+}
+
+func TestServer9P2000u(t *testing.T) {
+	backend := fskit.MemFS{
+		"target": fskit.RawNode([]byte("data")),
+	}
+	if err := fs.Symlink(backend, "target", "link"); err != nil {
+		t.Fatal(err)
+	}
+	a, b := net.Pipe()
+	defer b.Close()
+	go NewServer(backend).Handle(a, a)
+
+	typ, r := rpc9p(t, b, msgTversion, func(m *msgBuf) {
+		m.put32(8192)
+		m.putStr("9P2000.u")
+	})
+	if typ != msgRversion {
+		t.Fatalf("unexpected reply type %d", typ)
+	}
+	if r.get32(); r.getStr() != "9P2000.u" {
+		t.Fatal("expected server to negotiate 9P2000.u")
+	}
+
+	typ, _ = rpc9p(t, b, msgTattach, func(m *msgBuf) {
+		m.put32(0)
+		m.put32(noFid)
+		m.putStr("glenda")
+		m.putStr("")
+		m.put32(1000)
+	})
+	if typ != msgRattach {
+		t.Fatalf("unexpected reply type %d", typ)
+	}
+
+	typ, r = rpc9p(t, b, msgTwalk, func(m *msgBuf) {
+		m.put32(0)
+		m.put32(1)
+		m.put16(1)
+		m.putStr("link")
+	})
+	if typ != msgRwalk || r.get16() != 1 || r.get8() != qtSymlink {
+		t.Fatal("expected walk to link to return a symlink qid")
+	}
+
+	typ, r = rpc9p(t, b, msgTstat, func(m *msgBuf) {
+		m.put32(1)
+	})
+	if typ != msgRstat {
+		t.Fatalf("unexpected reply type %d", typ)
+	}
+	r.get16()
+	d, err := parseDir(r.b, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.mode&dmSymlink == 0 || d.ext != "target" || d.name != "link" {
+		t.Fatalf("unexpected symlink stat: %+v", d)
+	}
+
+	typ, r = rpc9p(t, b, msgTwalk, func(m *msgBuf) {
+		m.put32(0)
+		m.put32(2)
+		m.put16(1)
+		m.putStr("missing")
+	})
+	if typ != msgRerror {
+		t.Fatalf("expected error walking to missing file, got %d", typ)
+	}
+	if r.getStr(); r.get32() != 2 {
+		t.Fatal("expected ENOENT errno in 9P2000.u error")
+	}
+}
+
+func TestServerDialectL(t *testing.T) {
+	a, b := net.Pipe()
+	go NewServer(fskit.MapFS{"foo": fskit.RawNode([]byte("bar"))}).Handle(a, a)
+
+	fsys, err := ClientFS(b, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := fs.ReadFile(fsys, "foo"); err != nil || string(b) != "bar" {
+		t.Fatalf("unexpected read over 9P2000.L: %q %v", b, err)
+	}
+}
+
+// attach9p negotiates 9P2000 on conn and attaches fid 0 to the root.
+func attach9p(t *testing.T, conn net.Conn) {
+	t.Helper()
+	if typ, _ := rpc9p(t, conn, msgTversion, func(m *msgBuf) {
+		m.put32(8192)
+		m.putStr("9P2000")
+	}); typ != msgRversion {
+		t.Fatalf("unexpected reply type %d", typ)
+	}
+	if typ, _ := rpc9p(t, conn, msgTattach, func(m *msgBuf) {
+		m.put32(0)
+		m.put32(noFid)
+		m.putStr("glenda")
+		m.putStr("")
+	}); typ != msgRattach {
+		t.Fatalf("unexpected reply type %d", typ)
+	}
+}
+
+func TestServerReaddirOffsets(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	go NewServer(fskit.MemFS{
+		"a": fskit.RawNode([]byte("a")),
+		"b": fskit.RawNode([]byte("b")),
+		"c": fskit.RawNode([]byte("c")),
+	}).Handle(a, a)
+	attach9p(t, b)
+
+	if typ, _ := rpc9p(t, b, msgTopen, func(m *msgBuf) {
+		m.put32(0)
+		m.put8(0)
+	}); typ != msgRopen {
+		t.Fatalf("unexpected reply type %d", typ)
+	}
+	readAt := func(offset uint64) (uint8, []byte) {
+		typ, r := rpc9p(t, b, msgTread, func(m *msgBuf) {
+			m.put32(0)
+			m.put64(offset)
+			m.put32(4096)
+		})
+		if typ != msgRread {
+			return typ, nil
+		}
+		return typ, r.b[4:]
+	}
+
+	_, all := readAt(0)
+	first := uint64(binary.LittleEndian.Uint16(all)) + 2
+	_, rest := readAt(first)
+	if !bytes.Equal(rest, all[first:]) {
+		t.Fatal("unexpected entries reading at the second entry")
+	}
+	// seeking back to an earlier entry is served from the listing
+	if _, again := readAt(first); !bytes.Equal(again, rest) {
+		t.Fatal("unexpected entries reading at an earlier offset")
+	}
+	if _, end := readAt(uint64(len(all))); len(end) != 0 {
+		t.Fatalf("expected no entries at the end, got %d bytes", len(end))
+	}
+	if typ, _ := readAt(first + 1); typ != msgRerror {
+		t.Fatalf("expected error reading inside an entry, got %d", typ)
+	}
+}
+
+// slowStatFS delays stats so requests after them arrive first.
+type slowStatFS struct {
+	fskit.MemFS
+}
+
+func (fsys slowStatFS) StatContext(ctx context.Context, name string) (fs.FileInfo, error) {
+	time.Sleep(10 * time.Millisecond)
+	return fs.StatContext(ctx, fsys.MemFS, name)
+}
+
+func TestServerFidOrder(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	go NewServer(slowStatFS{fskit.MemFS{
+		"file": fskit.RawNode([]byte("data")),
+	}}).Handle(a, a)
+	attach9p(t, b)
+
+	// the clunk of the new fid is sent before the walk making it is done
+	walk := newReply(msgTwalk, 1)
+	walk.put32(0)
+	walk.put32(1)
+	walk.put16(1)
+	walk.putStr("file")
+	clunk := newReply(msgTclunk, 2)
+	clunk.put32(1)
+	go func() {
+		b.Write(walk.bytes())
+		b.Write(clunk.bytes())
+	}()
+
+	for range 2 {
+		msg, err := readMsg(b, defaultMsize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ := msg[4]; typ == msgRerror {
+			t.Fatalf("unexpected error reply to tag %d", binary.LittleEndian.Uint16(msg[5:]))
+		}
+	}
+}
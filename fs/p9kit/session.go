@@ -0,0 +1,232 @@
+package p9kit
+
+import (
+	"context"
+	"encoding/binary"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hugelgupf/p9/linux"
+	"tractor.dev/wanix/fs"
+)
+
+// session is shared by the files of one tree attached over a connection.
+// Operations run under its context, which carries the identity of the
+// task owning the tree and is cancelled when the connection closes.
+// Operations still in flight can also be cancelled by path for Tflush.
+type session struct {
+	ctx context.Context
+	mu  sync.Mutex
+	ops map[*inflight]struct{}
+}
+
+type inflight struct {
+	path   string
+	cancel context.CancelFunc
+}
+
+func newSession(ctx context.Context) *session {
+	return &session{ctx: ctx, ops: make(map[*inflight]struct{})}
+}
+
+// begin starts an operation on name, returning its context and a func
+// to call when it is done.
+func (s *session) begin(name string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	op := &inflight{path: name, cancel: cancel}
+	s.mu.Lock()
+	s.ops[op] = struct{}{}
+	s.mu.Unlock()
+	return ctx, func() {
+		s.mu.Lock()
+		delete(s.ops, op)
+		s.mu.Unlock()
+		cancel()
+	}
+}
+
+// flush cancels the operations in flight on name.
+func (s *session) flush(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for op := range s.ops {
+		if op.path == name {
+			op.cancel()
+		}
+	}
+}
+
+// withCancelOf returns a copy of ctx that is also cancelled with other,
+// so requests keep the values of the tree they act on.
+func withCancelOf(ctx, other context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(other, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// resolve resolves name in fsys under ctx, for helpers that would
+// otherwise resolve it without one. On failure the helper is left to
+// report the error itself.
+func resolve(ctx context.Context, fsys fs.FS, name string) (fs.FS, string) {
+	rfsys, rname, err := fs.Resolve(fsys, ctx, name)
+	if err != nil {
+		return fsys, name
+	}
+	return rfsys, rname
+}
+
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// interruptible runs fn on a buffer the size of p, returning EINTR if
+// ctx is cancelled first. Files with deadlines, like task fds, are woken
+// by setting one. Others are left to finish in the background on a buffer
+// of their own.
+func interruptible(ctx context.Context, f fs.File, p []byte, fn func([]byte) (int, error)) (int, error) {
+	if ctx.Done() == nil {
+		return fn(p)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, linux.EINTR
+	}
+
+	if d, ok := f.(deadliner); ok {
+		var (
+			mu       sync.Mutex
+			finished bool
+		)
+		stop := context.AfterFunc(ctx, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if !finished {
+				d.SetDeadline(time.Now())
+			}
+		})
+		n, err := fn(p)
+		mu.Lock()
+		finished = true
+		mu.Unlock()
+		if !stop() {
+			d.SetDeadline(time.Time{})
+			if err != nil {
+				return n, linux.EINTR
+			}
+		}
+		return n, err
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+	buf := make([]byte, len(p))
+	copy(buf, p)
+	ch := make(chan result, 1)
+	go func() {
+		n, err := fn(buf)
+		ch <- result{n, err}
+	}()
+	select {
+	case r := <-ch:
+		copy(p, buf[:r.n])
+		return r.n, r.err
+	case <-ctx.Done():
+		return 0, linux.EINTR
+	}
+}
+
+// fidPath is the file a 9P2000.L fid refers to.
+type fidPath struct {
+	tree int
+	path string
+}
+
+// requests follows the fids and tags of a 9P2000.L connection closely
+// enough to tell which file a Tflush is aimed at. Paths are updated as
+// requests are seen rather than when they succeed, and renames aren't
+// followed, so a flush may miss an operation but won't hit another file.
+type requests struct {
+	mu   sync.Mutex
+	tags map[uint16]uint32
+	fids map[uint32]fidPath
+}
+
+func newRequests() *requests {
+	return &requests{
+		tags: make(map[uint16]uint32),
+		fids: make(map[uint32]fidPath),
+	}
+}
+
+// request notes a T-message about to be served. Attaches must already
+// be rewritten to name their tree by index.
+func (r *requests) request(msg []byte) {
+	m := &msgBuf{b: msg[4:]}
+	typ, tag := m.get8(), m.get16()
+	if typ == msgTversion || typ == msgTflush || typ == msgTauth {
+		return
+	}
+	fid := m.get32()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tags[tag] = fid
+	switch typ {
+	case msgTattach:
+		m.get32()  // afid
+		m.getStr() // uname
+		if tree, err := strconv.Atoi(m.getStr()); err == nil {
+			r.fids[fid] = fidPath{tree: tree, path: "."}
+		}
+	case msgTwalk:
+		newfid := m.get32()
+		fp, ok := r.fids[fid]
+		if !ok {
+			return
+		}
+		names := make([]string, int(m.get16()))
+		for i := range names {
+			names[i] = m.getStr()
+		}
+		if !m.short {
+			r.fids[newfid] = fidPath{tree: fp.tree, path: path.Join(append([]string{fp.path}, names...)...)}
+		}
+	case msgTlcreate:
+		fp, ok := r.fids[fid]
+		name := m.getStr()
+		if ok && !m.short {
+			r.fids[fid] = fidPath{tree: fp.tree, path: path.Join(fp.path, name)}
+		}
+	case msgTclunk, msgTremove:
+		delete(r.fids, fid)
+	}
+}
+
+// reply notes an R-message, after which its tag is free again.
+func (r *requests) reply(msg []byte) {
+	if len(msg) < 7 {
+		return
+	}
+	tag := binary.LittleEndian.Uint16(msg[5:])
+	r.mu.Lock()
+	delete(r.tags, tag)
+	r.mu.Unlock()
+}
+
+// flushed returns the file the request with tag is acting on.
+func (r *requests) flushed(tag uint16) (fidPath, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fid, ok := r.tags[tag]
+	if !ok {
+		return fidPath{}, false
+	}
+	fp, ok := r.fids[fid]
+	return fp, ok
+}
@@ -0,0 +1,242 @@
+package p9kit
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hugelgupf/p9/linux"
+	"tractor.dev/wanix/fs"
+	"tractor.dev/wanix/fs/fskit"
+)
+
+// pipeFile is a file that blocks reading until its peer writes, like a
+// task fd.
+type pipeFile struct {
+	net.Conn
+}
+
+func (pipeFile) Stat() (fs.FileInfo, error) { return fskit.Entry("pipe", 0644), nil }
+
+func (f pipeFile) ReadAt(p []byte, off int64) (int, error) { return f.Read(p) }
+
+// Close leaves the pipe open, since every open shares it.
+func (pipeFile) Close() error { return nil }
+
+// stuckFile blocks reading until released and has no deadlines.
+type stuckFile struct {
+	release chan struct{}
+}
+
+func (stuckFile) Stat() (fs.FileInfo, error) { return fskit.Entry("stuck", 0644), nil }
+
+func (f stuckFile) Read(p []byte) (int, error) {
+	<-f.release
+	return 0, io.EOF
+}
+
+func (f stuckFile) ReadAt(p []byte, off int64) (int, error) { return f.Read(p) }
+
+func (stuckFile) Close() error { return nil }
+
+type taskKey struct{}
+
+// ctxFS serves files from open under a context of its own, as a task
+// namespace does.
+type ctxFS struct {
+	fskit.OpenFunc
+	ctx context.Context
+}
+
+func (f ctxFS) Context() context.Context { return f.ctx }
+
+func blockingFS(t *testing.T, opened chan<- context.Context) ctxFS {
+	t.Helper()
+	pipe, peer := net.Pipe()
+	t.Cleanup(func() { peer.Close() })
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	return ctxFS{
+		ctx: context.WithValue(context.Background(), taskKey{}, "task1"),
+		OpenFunc: func(ctx context.Context, name string) (fs.File, error) {
+			switch name {
+			case ".":
+				return fskit.DirFile(fskit.Entry(".", fs.ModeDir|0555),
+					fskit.Entry("pipe", 0644), fskit.Entry("stuck", 0644)), nil
+			case "pipe":
+				if opened != nil && fs.Op(ctx) == "open" {
+					opened <- ctx
+				}
+				return pipeFile{pipe}, nil
+			case "stuck":
+				return stuckFile{release}, nil
+			}
+			return nil, fs.ErrNotExist
+		},
+	}
+}
+
+// send9p writes a raw T-message with tag built by fn.
+func send9p(t *testing.T, conn net.Conn, typ uint8, tag uint16, fn func(m *msgBuf)) {
+	t.Helper()
+	m := newReply(typ, tag)
+	fn(m)
+	if _, err := conn.Write(m.bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recv9p reads a raw R-message, returning its type, tag and body.
+func recv9p(t *testing.T, conn net.Conn) (uint8, uint16, *msgBuf) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := readMsg(conn, defaultMsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &msgBuf{b: msg[4:]}
+	return r.get8(), r.get16(), r
+}
+
+// openBlocking attaches and opens name for reading as fid 1.
+func openBlocking(t *testing.T, conn net.Conn, version, name string) {
+	t.Helper()
+	dotL := version == "9P2000.L"
+	steps := []struct {
+		typ uint8
+		fn  func(m *msgBuf)
+	}{
+		{msgTversion, func(m *msgBuf) {
+			m.put32(8192)
+			m.putStr(version)
+		}},
+		{msgTattach, func(m *msgBuf) {
+			m.put32(0)
+			m.put32(noFid)
+			m.putStr("glenda")
+			m.putStr("")
+			if dotL {
+				m.put32(0)
+			}
+		}},
+		{msgTwalk, func(m *msgBuf) {
+			m.put32(0)
+			m.put32(1)
+			m.put16(1)
+			m.putStr(name)
+		}},
+	}
+	if dotL {
+		steps = append(steps, struct {
+			typ uint8
+			fn  func(m *msgBuf)
+		}{12, func(m *msgBuf) { // Tlopen
+			m.put32(1)
+			m.put32(0)
+		}})
+	} else {
+		steps = append(steps, struct {
+			typ uint8
+			fn  func(m *msgBuf)
+		}{msgTopen, func(m *msgBuf) {
+			m.put32(1)
+			m.put8(oRead)
+		}})
+	}
+	for _, step := range steps {
+		send9p(t, conn, step.typ, 1, step.fn)
+		if typ, _, _ := recv9p(t, conn); typ != step.typ+1 {
+			t.Fatalf("unexpected reply type %d to %d", typ, step.typ)
+		}
+	}
+}
+
+func TestServerFlush(t *testing.T) {
+	for _, tt := range []struct {
+		version, name string
+		errType       uint8
+	}{
+		{"9P2000.L", "pipe", msgRlerror},
+		{"9P2000.L", "stuck", msgRlerror},
+		{"9P2000", "pipe", msgRerror},
+		{"9P2000", "stuck", msgRerror},
+	} {
+		t.Run(tt.version+"/"+tt.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer b.Close()
+			go NewServer(blockingFS(t, nil)).Handle(a, a)
+			openBlocking(t, b, tt.version, tt.name)
+
+			send9p(t, b, msgTread, 5, func(m *msgBuf) {
+				m.put32(1)
+				m.put64(0)
+				m.put32(64)
+			})
+			send9p(t, b, msgTflush, 6, func(m *msgBuf) {
+				m.put16(5)
+			})
+
+			// the flushed read is answered before the flush
+			typ, tag, r := recv9p(t, b)
+			if typ != tt.errType || tag != 5 {
+				t.Fatalf("expected interrupted read, got type %d tag %d", typ, tag)
+			}
+			if typ == msgRlerror {
+				if errno := linux.Errno(r.get32()); errno != linux.EINTR {
+					t.Fatalf("expected EINTR, got %v", errno)
+				}
+			}
+			if typ, tag, _ := recv9p(t, b); typ != msgRflush || tag != 6 {
+				t.Fatalf("expected Rflush, got type %d tag %d", typ, tag)
+			}
+		})
+	}
+}
+
+func TestServerHangup(t *testing.T) {
+	a, b := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		NewServer(blockingFS(t, nil)).Handle(a, a)
+		close(done)
+	}()
+	openBlocking(t, b, "9P2000.L", "pipe")
+	send9p(t, b, msgTread, 5, func(m *msgBuf) {
+		m.put32(1)
+		m.put64(0)
+		m.put32(64)
+	})
+	b.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked read kept the server from finishing")
+	}
+}
+
+func TestServerContext(t *testing.T) {
+	opened := make(chan context.Context, 1)
+	a, b := net.Pipe()
+	defer b.Close()
+	go NewServer(blockingFS(t, opened)).Handle(a, a)
+	fsys, err := ClientFS(b, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fsys.Open("pipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ctx := <-opened
+	if ctx.Value(taskKey{}) != "task1" {
+		t.Fatal("expected open to carry the tree's context")
+	}
+	if origin, name, ok := fs.Origin(ctx); !ok || name != "pipe" || origin == nil {
+		t.Fatalf("expected open to carry its origin, got %q %v", name, ok)
+	}
+}
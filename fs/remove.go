@@ -13,12 +13,12 @@ type RemoveFS interface {
 // Remove removes the named file or empty directory if supported.
 func Remove(fsys FS, name string) error {
 	if r, ok := fsys.(RemoveFS); ok {
-		return r.Remove(name)
+		return changed(r.Remove(name), fsys, name)
 	}
 
 	rfsys, rname, err := ResolveTo[RemoveFS](fsys, ContextFor(fsys), name)
 	if err == nil {
-		return rfsys.Remove(rname)
+		return resolvedChanged(rfsys.Remove(rname), fsys, name, rfsys, rname)
 	}
 	return opErr(fsys, name, "remove", err)
 }
@@ -31,12 +31,12 @@ type RemoveAllFS interface {
 // RemoveAll removes path name and any children it contains if supported.
 func RemoveAll(fsys FS, name string) error {
 	if r, ok := fsys.(RemoveAllFS); ok {
-		return r.RemoveAll(name)
+		return changed(r.RemoveAll(name), fsys, name)
 	}
 
 	rfsys, rname, err := ResolveTo[RemoveAllFS](fsys, ContextFor(fsys), name)
 	if err == nil {
-		return rfsys.RemoveAll(rname)
+		return resolvedChanged(rfsys.RemoveAll(rname), fsys, name, rfsys, rname)
 	}
 	if !errors.Is(err, ErrNotSupported) {
 		return opErr(fsys, name, "removeall", err)
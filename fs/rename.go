@@ -8,7 +8,7 @@ type RenameFS interface {
 // Rename renames (moves) oldname to newname if supported.
 func Rename(fsys FS, oldname, newname string) error {
 	if r, ok := fsys.(RenameFS); ok {
-		return r.Rename(oldname, newname)
+		return renamed(r.Rename(oldname, newname), fsys, oldname, newname)
 	}
 
 	if exists, err := Exists(fsys, oldname); err != nil || !exists {
@@ -26,7 +26,8 @@ func Rename(fsys FS, oldname, newname string) error {
 	}
 
 	if Equal(oldfsys, newfsys) {
-		return oldfsys.Rename(oldrname, newrname)
+		err := oldfsys.Rename(oldrname, newrname)
+		return renamed(renamed(err, oldfsys, oldrname, newrname), fsys, oldname, newname)
 	}
 
 	// TODO:
@@ -34,3 +35,9 @@ func Rename(fsys FS, oldname, newname string) error {
 
 	return opErr(fsys, newname, "rename", ErrNotSupported)
 }
+
+// renamed reports changes to both names of a rename in fsys if err is nil,
+// returning err.
+func renamed(err error, fsys FS, oldname, newname string) error {
+	return changed(changed(err, fsys, oldname), fsys, newname)
+}
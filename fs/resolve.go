@@ -97,3 +97,19 @@ func Resolve(fsys FS, ctx context.Context, name string) (rfsys FS, rname string,
 	rname = path.Base(name)
 	return
 }
+
+// BindFS is implemented by filesystems with other filesystems bound at
+// names within them, like a namespace. A name at or below a binding has
+// to be resolved from the BindFS, not relative to its resolved parent.
+type BindFS interface {
+	FS
+	Bound(name string) bool
+}
+
+// Bound reports whether anything is bound at or below name in fsys.
+func Bound(fsys FS, name string) bool {
+	if bfs, ok := fsys.(BindFS); ok {
+		return bfs.Bound(name)
+	}
+	return false
+}
@@ -148,3 +148,17 @@ func (f *SubdirFS) Sub(dir string) (FS, error) {
 	}
 	return &SubdirFS{f.Fsys, full}, nil
 }
+
+// Context returns the context of the parent filesystem, so a subtree of a
+// task namespace is still resolved as that task.
+func (f *SubdirFS) Context() context.Context {
+	return ContextFor(f.Fsys)
+}
+
+func (f *SubdirFS) Bound(name string) bool {
+	full, err := f.fullName("bound", name)
+	if err != nil {
+		return false
+	}
+	return Bound(f.Fsys, full)
+}
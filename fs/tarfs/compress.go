@@ -0,0 +1,63 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+var (
+	magicGzip  = []byte{0x1f, 0x8b}
+	magicZstd  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicXz    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	magicBzip2 = []byte("BZh")
+)
+
+// Decompress returns a reader of the uncompressed contents of r, detecting
+// gzip, zstd, xz and bzip2 by their magic bytes. Anything else is returned
+// as is. A reader that is also an io.Closer should be closed when done to
+// release its decoder.
+func Decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(magicXz))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(head, magicGzip):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(head, magicZstd):
+		// decoding concurrently would start goroutines that run
+		// until the decoder is closed
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case bytes.HasPrefix(head, magicXz):
+		return xz.NewReader(br)
+	case bytes.HasPrefix(head, magicBzip2):
+		return bzip2.NewReader(br), nil
+	default:
+		return br, nil
+	}
+}
+
+// Read loads a tar archive from r, which may be compressed.
+func Read(r io.Reader) (*FS, error) {
+	dr, err := Decompress(r)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := dr.(io.Closer); ok {
+		// the archive is loaded into memory, so the decoder is done after
+		defer c.Close()
+	}
+	return load(tar.NewReader(dr))
+}
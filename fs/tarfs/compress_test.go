@@ -0,0 +1,115 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+func testTarball(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+	tw.Write([]byte("hello"))
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRead(t *testing.T) {
+	raw := testTarball(t)
+	compress := map[string]func(w io.Writer) (io.WriteCloser, error){
+		"none": func(w io.Writer) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+		"gzip": func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		"zstd": func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+		"xz": func(w io.Writer) (io.WriteCloser, error) {
+			return xz.NewWriter(w)
+		},
+	}
+	for name, fn := range compress {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := fn(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(raw)
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			fsys, err := Read(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := fs.ReadFile(fsys, "dir/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != "hello" {
+				t.Fatalf("unexpected contents: %q", b)
+			}
+		})
+	}
+}
+
+// testTarballBzip2 is testTarball compressed with bzip2, which the
+// standard library can only decompress.
+var testTarballBzip2 = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x5f, 0x67,
+	0xb9, 0x9b, 0x00, 0x00, 0x5a, 0x5b, 0x90, 0xc9, 0x80, 0x40, 0x00, 0xff,
+	0x84, 0x00, 0x44, 0x67, 0x64, 0x9e, 0x00, 0x04, 0x00, 0x00, 0x08, 0x20,
+	0x00, 0x72, 0x12, 0xa9, 0xa6, 0x46, 0x81, 0xa6, 0x81, 0xa0, 0xd3, 0xd2,
+	0x7a, 0x82, 0x44, 0xa1, 0x8a, 0x1b, 0x53, 0x43, 0xca, 0x01, 0x93, 0x49,
+	0x17, 0x9e, 0x78, 0x64, 0x7b, 0xdd, 0x13, 0x04, 0xb1, 0xaf, 0xd2, 0x46,
+	0x94, 0x80, 0xce, 0x19, 0x22, 0x62, 0xa3, 0x02, 0x01, 0x32, 0x64, 0x15,
+	0xd2, 0x04, 0xb1, 0x18, 0x25, 0x6b, 0xe0, 0x5c, 0x62, 0x3b, 0x64, 0x58,
+	0xe6, 0xf8, 0x56, 0xd7, 0x93, 0xa0, 0xe2, 0x05, 0xb0, 0xf7, 0xd9, 0x3a,
+	0x6a, 0x21, 0x4f, 0x5e, 0x50, 0x68, 0xa2, 0x8a, 0x64, 0x07, 0xe2, 0xee,
+	0x48, 0xa7, 0x0a, 0x12, 0x0b, 0xec, 0xf7, 0x33, 0x60,
+}
+
+func TestReadBzip2(t *testing.T) {
+	dr, err := Decompress(bytes.NewReader(testTarballBzip2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(dr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, testTarball(t)) {
+		t.Fatal("bzip2 contents differ from the test tarball")
+	}
+	fsys, err := Read(bytes.NewReader(testTarballBzip2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := fs.ReadFile(fsys, "dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Fatalf("unexpected contents: %q", b)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
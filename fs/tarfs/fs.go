@@ -4,6 +4,8 @@ package tarfs
 import (
 	"archive/tar"
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
@@ -27,7 +29,16 @@ func splitpath(name string) (dir, file string) {
 	return
 }
 
+// Load reads the archive from t. It returns nil if the archive is invalid.
 func Load(t *tar.Reader) *FS {
+	fsys, err := load(t)
+	if err != nil {
+		return nil
+	}
+	return fsys
+}
+
+func load(t *tar.Reader) (*FS, error) {
 	fsys := &FS{files: make(map[string]map[string]*File)}
 	for {
 		hdr, err := t.Next()
@@ -35,7 +46,7 @@ func Load(t *tar.Reader) *FS {
 			break
 		}
 		if err != nil {
-			return nil
+			return nil, err
 		}
 
 		d, f := splitpath(hdr.Name)
@@ -46,11 +57,11 @@ func Load(t *tar.Reader) *FS {
 		var buf bytes.Buffer
 		size, err := buf.ReadFrom(t)
 		if err != nil {
-			panic("tarfs: reading from tar:" + err.Error())
+			return nil, fmt.Errorf("tarfs: reading from tar: %w", err)
 		}
 
 		if size != hdr.Size {
-			panic("tarfs: size mismatch")
+			return nil, errors.New("tarfs: size mismatch")
 		}
 
 		file := &File{
@@ -65,6 +76,10 @@ func Load(t *tar.Reader) *FS {
 	if fsys.files[Separator] == nil {
 		fsys.files[Separator] = make(map[string]*File)
 	}
+	// Add parent directories missing from the archive
+	for dir := range fsys.files {
+		fsys.addImplicitDir(dir)
+	}
 	// Add a pseudoroot
 	fsys.files[Separator][""] = &File{
 		h: &tar.Header{
@@ -76,16 +91,53 @@ func Load(t *tar.Reader) *FS {
 		fs:   fsys,
 	}
 
-	return fsys
+	return fsys, nil
 }
 
-func (fsys *FS) Open(name string) (fs.File, error) {
-	d, f := splitpath(name)
+func (fsys *FS) addImplicitDir(dir string) {
+	if dir == Separator {
+		return
+	}
+	d, f := splitpath(dir)
 	if _, ok := fsys.files[d]; !ok {
-		return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		fsys.files[d] = make(map[string]*File)
 	}
+	if _, ok := fsys.files[d][f]; ok {
+		return
+	}
+	fsys.files[d][f] = &File{
+		h: &tar.Header{
+			Name:     dir,
+			Typeflag: tar.TypeDir,
+			Mode:     0755,
+		},
+		data: bytes.NewReader(nil),
+		fs:   fsys,
+	}
+	fsys.addImplicitDir(d)
+}
 
+func (fsys *FS) lookup(name string) (*File, bool) {
+	d, f := splitpath(name)
+	if _, ok := fsys.files[d]; !ok {
+		return nil, false
+	}
 	file, ok := fsys.files[d][f]
+	if ok && file.h.Typeflag == tar.TypeLink {
+		// hard links share the data of their target
+		target, ok := fsys.lookup(file.h.Linkname)
+		if !ok {
+			return nil, false
+		}
+		h := *target.h
+		h.Name = file.h.Name
+		return &File{h: &h, data: target.data, fs: fsys}, true
+	}
+	return file, ok
+}
+
+func (fsys *FS) Open(name string) (fs.File, error) {
+	file, ok := fsys.lookup(name)
 	if !ok {
 		return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
 	}
@@ -97,16 +149,29 @@ func (fsys *FS) Open(name string) (fs.File, error) {
 	return &nf, nil
 }
 
+// Cacheable reports that files can be cached, since the archive is
+// read-only.
+func (fsys *FS) Cacheable(name string) bool {
+	return true
+}
+
 func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
-	d, f := splitpath(name)
-	if _, ok := fsys.files[d]; !ok {
+	file, ok := fsys.lookup(name)
+	if !ok {
 		return nil, &os.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
 	}
 
-	file, ok := fsys.files[d][f]
+	return file.h.FileInfo(), nil
+}
+
+func (fsys *FS) Readlink(name string) (string, error) {
+	file, ok := fsys.lookup(name)
 	if !ok {
-		return nil, &os.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+		return "", &os.PathError{Op: "readlink", Path: name, Err: fs.ErrNotExist}
+	}
+	if file.h.Typeflag != tar.TypeSymlink {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
 	}
 
-	return file.h.FileInfo(), nil
+	return file.h.Linkname, nil
 }
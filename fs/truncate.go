@@ -11,12 +11,12 @@ type TruncateFS interface {
 
 func Truncate(fsys FS, name string, size int64) error {
 	if t, ok := fsys.(TruncateFS); ok {
-		return t.Truncate(name, size)
+		return changed(t.Truncate(name, size), fsys, name)
 	}
 
 	rfsys, rname, err := ResolveTo[TruncateFS](fsys, ContextFor(fsys), name)
 	if err == nil {
-		return rfsys.Truncate(rname, size)
+		return resolvedChanged(rfsys.Truncate(rname, size), fsys, name, rfsys, rname)
 	}
 	if !errors.Is(err, ErrNotSupported) {
 		return opErr(fsys, name, "truncate", err)
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"reflect"
+	"strings"
 )
 
 func IsDir(fsys FS, path string) (bool, error) {
@@ -62,6 +64,15 @@ func DirExists(fsys FS, path string) (bool, error) {
 	return false, err
 }
 
+// NSPath converts an absolute or relative namespace path to an fs path.
+func NSPath(name string) string {
+	name = strings.TrimPrefix(path.Clean(name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
 func WriteFile(fsys FS, filename string, data []byte, perm FileMode) error {
 	f, err := Create(fsys, filename)
 	if errors.Is(err, ErrNotSupported) {
@@ -85,7 +96,7 @@ func WriteFile(fsys FS, filename string, data []byte, perm FileMode) error {
 		err = err1
 	}
 	// TODO: use perm?
-	return err
+	return changed(err, fsys, filename)
 }
 
 func Equal(a, b FS) bool {
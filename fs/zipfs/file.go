@@ -0,0 +1,135 @@
+package zipfs
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+type File struct {
+	*entry
+	fs *FS
+
+	mu     sync.Mutex
+	data   io.ReaderAt
+	offset int64
+	dirpos int
+	closed bool
+}
+
+func (f *File) Stat() (fs.FileInfo, error) { return f.entry, nil }
+
+// reader returns random access to the uncompressed contents. Stored
+// entries are read in place, others are inflated on first use.
+func (f *File) reader() (io.ReaderAt, error) {
+	if f.closed {
+		return nil, fs.ErrClosed
+	}
+	if f.IsDir() {
+		return nil, &os.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if f.data != nil {
+		return f.data, nil
+	}
+	if f.zf.Method == zip.Store {
+		if raw, err := f.zf.OpenRaw(); err == nil {
+			if ra, ok := raw.(io.ReaderAt); ok {
+				f.data = ra
+				return f.data, nil
+			}
+		}
+	}
+	rc, err := f.zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	f.data = bytes.NewReader(b)
+	return f.data, nil
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r, err := f.reader()
+	if err != nil {
+		return 0, err
+	}
+	n, err := r.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r, err := f.reader()
+	if err != nil {
+		return 0, err
+	}
+	return r.ReadAt(p, off)
+}
+
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.Size()
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *File) ReadDir(count int) ([]fs.DirEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, fs.ErrClosed
+	}
+	if !f.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: f.name, Err: fs.ErrInvalid}
+	}
+	names := f.fs.dirs[f.name][f.dirpos:]
+	if count > 0 && len(names) > count {
+		names = names[:count]
+	}
+	if count > 0 && len(names) == 0 {
+		return nil, io.EOF
+	}
+	var entries []fs.DirEntry
+	for _, name := range names {
+		entries = append(entries, f.fs.files[name])
+	}
+	f.dirpos += len(names)
+	return entries, nil
+}
+
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	f.data = nil
+	return nil
+}
@@ -0,0 +1,183 @@
+// zipfs implements a read-only filesystem over a zip archive
+package zipfs
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+type FS struct {
+	files map[string]*entry
+	dirs  map[string][]string
+}
+
+type entry struct {
+	name string
+	zf   *zip.File // nil for implicit directories
+	mode fs.FileMode
+}
+
+func (e *entry) Name() string      { return path.Base(e.name) }
+func (e *entry) Mode() fs.FileMode { return e.mode }
+func (e *entry) IsDir() bool       { return e.mode.IsDir() }
+func (e *entry) Sys() any          { return e.zf }
+func (e *entry) Type() fs.FileMode { return e.mode.Type() }
+
+func (e *entry) Info() (fs.FileInfo, error) { return e, nil }
+
+func (e *entry) Size() int64 {
+	if e.zf == nil || e.IsDir() {
+		return 0
+	}
+	return int64(e.zf.UncompressedSize64)
+}
+
+func (e *entry) ModTime() time.Time {
+	if e.zf == nil {
+		return time.Time{}
+	}
+	return e.zf.Modified
+}
+
+// New reads the zip archive from r, which is size bytes long.
+func New(r io.ReaderAt, size int64) (*FS, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return Load(zr)
+}
+
+// Load indexes the entries of zr. Parent directories missing
+// from the archive are added implicitly. As with zip tools, a
+// name in the archive more than once is the last entry of it.
+func Load(zr *zip.Reader) (*FS, error) {
+	fsys := &FS{
+		files: map[string]*entry{
+			".": {name: ".", mode: fs.ModeDir | 0555},
+		},
+		dirs: map[string][]string{},
+	}
+	for _, zf := range zr.File {
+		name := path.Clean(strings.TrimPrefix(zf.Name, "/"))
+		if name == "." || name == ".." || strings.HasPrefix(name, "../") {
+			continue
+		}
+		mode := zf.Mode()
+		if strings.HasSuffix(zf.Name, "/") {
+			mode |= fs.ModeDir
+		}
+		if err := fsys.add(&entry{name: name, zf: zf, mode: mode}); err != nil {
+			return nil, err
+		}
+	}
+	for dir := range fsys.dirs {
+		sort.Strings(fsys.dirs[dir])
+	}
+	return fsys, nil
+}
+
+func (fsys *FS) add(e *entry) error {
+	if existing, ok := fsys.files[e.name]; ok {
+		if existing.IsDir() != e.IsDir() {
+			return &os.PathError{Op: "load", Path: e.name, Err: fmt.Errorf("both a file and a directory in the archive")}
+		}
+		if e.zf != nil {
+			// a later entry replaces an earlier or implicit one
+			existing.zf = e.zf
+			existing.mode = e.mode
+		}
+		return nil
+	}
+	dir := path.Dir(e.name)
+	if parent, ok := fsys.files[dir]; !ok {
+		if err := fsys.add(&entry{name: dir, mode: fs.ModeDir | 0555}); err != nil {
+			return err
+		}
+	} else if !parent.IsDir() {
+		return &os.PathError{Op: "load", Path: e.name, Err: fmt.Errorf("parent %s is a file in the archive", dir)}
+	}
+	fsys.files[e.name] = e
+	fsys.dirs[dir] = append(fsys.dirs[dir], e.name)
+	return nil
+}
+
+func (fsys *FS) lookup(op, name string) (*entry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &os.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	e, ok := fsys.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return e, nil
+}
+
+func (fsys *FS) Open(name string) (fs.File, error) {
+	e, err := fsys.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return &File{entry: e, fs: fsys}, nil
+}
+
+// Cacheable reports that files can be cached, since the archive is
+// read-only.
+func (fsys *FS) Cacheable(name string) bool {
+	return true
+}
+
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	return fsys.StatContext(context.Background(), name)
+}
+
+func (fsys *FS) StatContext(ctx context.Context, name string) (fs.FileInfo, error) {
+	return fsys.lookup("stat", name)
+}
+
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fsys.ReadDirContext(context.Background(), name)
+}
+
+func (fsys *FS) ReadDirContext(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	e, err := fsys.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	var entries []fs.DirEntry
+	for _, child := range fsys.dirs[name] {
+		entries = append(entries, fsys.files[child])
+	}
+	return entries, nil
+}
+
+func (fsys *FS) Readlink(name string) (string, error) {
+	e, err := fsys.lookup("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	if e.mode&fs.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	rc, err := e.zf.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
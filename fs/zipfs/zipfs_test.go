@@ -0,0 +1,138 @@
+package zipfs
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+type testFile struct {
+	name   string
+	data   string
+	method uint16
+}
+
+func zipOf(t *testing.T, files ...testFile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: f.method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, f.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testArchive(t *testing.T) *FS {
+	t.Helper()
+	b := zipOf(t,
+		testFile{"a/b/deflated.txt", "hello deflated world", zip.Deflate},
+		testFile{"a/stored.txt", "hello stored world", zip.Store},
+		testFile{"empty/", "", zip.Store},
+		testFile{"top.txt", "top", zip.Deflate},
+	)
+	fsys, err := New(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+func TestFS(t *testing.T) {
+	fsys := testArchive(t)
+	if err := fstest.TestFS(fsys, "a/b/deflated.txt", "a/stored.txt", "empty", "top.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadAt(t *testing.T) {
+	fsys := testArchive(t)
+	for name, want := range map[string]string{
+		"a/b/deflated.txt": "deflated",
+		"a/stored.txt":     "stored",
+	} {
+		f, err := fsys.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(want))
+		if _, err := f.(io.ReaderAt).ReadAt(buf, 6); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != want {
+			t.Fatalf("%s: got %q, want %q", name, buf, want)
+		}
+		f.Close()
+	}
+}
+
+func TestImplicitDirs(t *testing.T) {
+	fsys := testArchive(t)
+	fi, err := fsys.StatContext(context.Background(), "a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.IsDir() {
+		t.Fatal("expected a/b to be a directory")
+	}
+	entries, err := fsys.ReadDirContext(context.Background(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if len(names) != 3 || names[0] != "a" || names[1] != "empty" || names[2] != "top.txt" {
+		t.Fatalf("unexpected entries: %v", names)
+	}
+}
+
+func TestDuplicateNames(t *testing.T) {
+	b := zipOf(t,
+		testFile{"dup.txt", "first", zip.Store},
+		testFile{"dir/", "", zip.Store},
+		testFile{"dup.txt", "last", zip.Store},
+	)
+	fsys, err := New(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := fs.ReadFile(fsys, "dup.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "last" {
+		t.Fatalf("got %q, want the last entry", data)
+	}
+	entries, err := fsys.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected dir and dup.txt once each, got %v", entries)
+	}
+}
+
+func TestConflictingNames(t *testing.T) {
+	for _, files := range [][]testFile{
+		{{"a", "file", zip.Store}, {"a/b", "file under a file", zip.Store}},
+		{{"a/b", "file", zip.Store}, {"a", "file over a directory", zip.Store}},
+		{{"a", "file", zip.Store}, {"a/", "", zip.Store}},
+	} {
+		b := zipOf(t, files...)
+		if _, err := New(bytes.NewReader(b), int64(len(b))); err == nil {
+			t.Fatalf("expected an error loading %v", files)
+		}
+	}
+}
@@ -5,12 +5,15 @@ go 1.23.1
 replace github.com/hugelgupf/p9 => github.com/progrium/p9 v0.0.0-20250227010111-4025760ecd04
 
 require (
+	9fans.net/go v0.0.7
 	github.com/gorilla/websocket v1.5.3
 	github.com/hanwen/go-fuse/v2 v2.7.2
 	github.com/hugelgupf/p9 v0.3.1-0.20240118043522-6f4f11e5296e
+	github.com/klauspost/compress v1.17.11
 	github.com/magefile/mage v1.15.0
 	github.com/progrium/go-netstack v0.0.0-20240720002214-37b2b8227b91
 	github.com/u-root/uio v0.0.0-20240224005618-d2acac8f3701
+	github.com/ulikunitz/xz v0.5.12
 	golang.org/x/net v0.39.0
 	golang.org/x/term v0.31.0
 	tractor.dev/toolkit-go v0.0.0-20250103001615-9a6753936c19
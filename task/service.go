@@ -3,7 +3,9 @@ package task
 import (
 	"context"
 	"log"
+	"maps"
 	"strconv"
+	"sync"
 
 	"tractor.dev/wanix/fs"
 	"tractor.dev/wanix/fs/fskit"
@@ -12,7 +14,9 @@ import (
 )
 
 type Service struct {
-	types     map[string]func(*Resource) error
+	types map[string]func(*Resource) error
+
+	mu        sync.Mutex // guards resources and nextID
 	resources map[string]fs.FS
 	nextID    int
 }
@@ -34,13 +38,30 @@ func (d *Service) Register(kind string, starter func(*Resource) error) {
 	d.types[kind] = starter
 }
 
+// Get returns the task with the given ID.
+func (d *Service) Get(id string) (*Resource, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r, ok := d.resources[id].(*Resource)
+	return r, ok
+}
+
+// Free removes the task with the given ID.
+func (d *Service) Free(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.resources, id)
+}
+
 func (d *Service) Alloc(kind string, parent *Resource) (*Resource, error) {
 	starter, ok := d.types[kind]
 	if !ok {
 		return nil, fs.ErrNotExist
 	}
+	d.mu.Lock()
 	d.nextID++
-	rid := strconv.Itoa(d.nextID)
+	id := d.nextID
+	d.mu.Unlock()
 
 	a0, b0 := internal.BufferedConnPipe(false)
 	a1, b1 := internal.BufferedConnPipe(false)
@@ -48,7 +69,7 @@ func (d *Service) Alloc(kind string, parent *Resource) (*Resource, error) {
 
 	p := &Resource{
 		starter: starter,
-		id:      d.nextID,
+		id:      id,
 		typ:     kind,
 		fds: map[string]fs.FS{
 			"0": newFdFile(a0, "0"),
@@ -68,7 +89,9 @@ func (d *Service) Alloc(kind string, parent *Resource) (*Resource, error) {
 	} else {
 		p.ns = vfs.New(ctx)
 	}
-	d.resources[rid] = p
+	d.mu.Lock()
+	d.resources[strconv.Itoa(id)] = p
+	d.mu.Unlock()
 	return p, nil
 }
 
@@ -100,7 +123,10 @@ func (d *Service) ResolveFS(ctx context.Context, name string) (fs.FS, string, er
 	if ok {
 		m["self"] = internal.FieldFile(t.ID(), nil)
 	}
-	return fs.Resolve(fskit.UnionFS{m, fskit.MapFS(d.resources)}, ctx, name)
+	d.mu.Lock()
+	resources := fskit.MapFS(maps.Clone(d.resources))
+	d.mu.Unlock()
+	return fs.Resolve(fskit.UnionFS{m, resources}, ctx, name)
 }
 
 func (d *Service) Stat(name string) (fs.FileInfo, error) {
@@ -0,0 +1,53 @@
+package task
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"tractor.dev/wanix/fs"
+)
+
+func TestServiceConcurrentAlloc(t *testing.T) {
+	d := New()
+	root, err := d.Alloc("ns", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			p, err := d.Alloc("ns", root)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			d.Free(p.ID())
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := fs.ReadDirContext(context.Background(), d, "."); err != nil {
+				t.Error(err)
+			}
+			d.Get(root.ID())
+		}()
+	}
+	wg.Wait()
+
+	entries, err := fs.ReadDir(d, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Name() != "new" {
+			names = append(names, e.Name())
+		}
+	}
+	if len(names) != 1 || names[0] != root.ID() {
+		t.Fatalf("expected only the root task after freeing, got %v", names)
+	}
+}
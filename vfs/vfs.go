@@ -4,9 +4,11 @@ import (
 	"context"
 	"errors"
 	"log"
+	"maps"
 	"path"
 	"slices"
 	"strings"
+	"sync"
 
 	"tractor.dev/wanix/fs"
 	"tractor.dev/wanix/fs/fskit"
@@ -21,9 +23,12 @@ const (
 )
 
 // NS represents a namespace with Plan9-style file and directory bindings.
-// Todo: figure out how to make this thread safe. Tricky because ResolveFS
-// can call back into the namespace.
+// It's safe for concurrent use. As resolving a binding can call back into
+// the namespace, lookups work on a copy of the bindings taken under the
+// lock rather than holding it, and binding slices are never changed in
+// place.
 type NS struct {
+	mu       sync.RWMutex
 	bindings map[string][]bindTarget
 	ctx      context.Context
 }
@@ -54,24 +59,29 @@ func New(ctx context.Context) *NS {
 }
 
 func (ns *NS) Clone(ctx context.Context) *NS {
-	b := make(map[string][]bindTarget)
-	for k, v := range ns.bindings {
-		b[k] = slices.Clone(v)
-	}
 	return &NS{
-		bindings: b,
+		bindings: ns.snapshot(),
 		ctx:      ctx,
 	}
 }
 
+// snapshot returns a copy of the bindings to look names up in.
+func (ns *NS) snapshot() map[string][]bindTarget {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	return maps.Clone(ns.bindings)
+}
+
 func (ns *NS) Context() context.Context {
 	return ns.ctx
 }
 
 func (ns *NS) ResolveFS(ctx context.Context, name string) (fs.FS, string, error) {
+	bindings := ns.snapshot()
+
 	// todo: if there is a direct binding by this name, it might also
 	// exist as a subpath of another binding. so this is not correct.
-	if refs, ok := ns.bindings[name]; ok {
+	if refs, ok := bindings[name]; ok {
 		if len(refs) == 1 {
 			// if there is a single binding, return it
 			return refs[0].fs, refs[0].path, nil
@@ -91,11 +101,11 @@ func (ns *NS) ResolveFS(ctx context.Context, name string) (fs.FS, string, error)
 
 	// now check subpaths of bindings
 	var bindPaths []string
-	for p := range ns.bindings {
+	for p := range bindings {
 		bindPaths = append(bindPaths, p)
 	}
 	for _, bindPath := range fskit.MatchPaths(bindPaths, name) {
-		refs := ns.bindings[bindPath]
+		refs := bindings[bindPath]
 		relativeName := strings.Trim(strings.TrimPrefix(name, bindPath), "/")
 		var toStat []bindTarget
 
@@ -151,6 +161,18 @@ func (ns *NS) ResolveFS(ctx context.Context, name string) (fs.FS, string, error)
 	return ns, name, nil
 }
 
+// Bound reports whether anything is bound at or below name.
+func (ns *NS) Bound(name string) bool {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	for p := range ns.bindings {
+		if name == "." || p == name || strings.HasPrefix(p, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
 func (ns *NS) Unbind(src fs.FS, srcPath, dstPath string) error {
 	if !fs.ValidPath(srcPath) {
 		return &fs.PathError{Op: "unbind", Path: srcPath, Err: fs.ErrNotExist}
@@ -165,13 +187,16 @@ func (ns *NS) Unbind(src fs.FS, srcPath, dstPath string) error {
 		return err
 	}
 
-	ns.bindings[dstPath] = slices.DeleteFunc(ns.bindings[dstPath], func(ref bindTarget) bool {
+	ns.mu.Lock()
+	ns.bindings[dstPath] = slices.DeleteFunc(slices.Clone(ns.bindings[dstPath]), func(ref bindTarget) bool {
 		return fs.Equal(ref.fs, rfsys) && ref.path == rname
 	})
 	if len(ns.bindings[dstPath]) == 0 {
 		delete(ns.bindings, dstPath)
 	}
+	ns.mu.Unlock()
 
+	fs.Changed(ns, dstPath)
 	return nil
 }
 
@@ -202,16 +227,20 @@ func (ns *NS) Bind(src fs.FS, srcPath, dstPath, mode string) error {
 	file.Close()
 
 	ref := bindTarget{fs: rfsys, path: rname, fi: fi}
+	ns.mu.Lock()
 	switch mode {
 	case "", "after":
 		ns.bindings[dstPath] = append([]bindTarget{ref}, ns.bindings[dstPath]...)
 	case "before":
-		ns.bindings[dstPath] = append(ns.bindings[dstPath], ref)
+		ns.bindings[dstPath] = append(slices.Clip(ns.bindings[dstPath]), ref)
 	case "replace":
 		ns.bindings[dstPath] = []bindTarget{ref}
 	default:
+		ns.mu.Unlock()
 		return &fs.PathError{Op: "bind", Path: mode, Err: fs.ErrInvalid}
 	}
+	ns.mu.Unlock()
+	fs.Changed(ns, dstPath)
 	return nil
 }
 
@@ -238,7 +267,7 @@ func (ns *NS) StatContext(ctx context.Context, name string) (fs.FileInfo, error)
 	// Check direct bindings since they don't get resolved by the resolver.
 	// todo: again, if there is a direct binding by this name, it might also
 	// exist as a subpath of another binding. so this is not correct.
-	if refs, exists := ns.bindings[name]; exists {
+	if refs, exists := ns.snapshot()[name]; exists {
 		for _, ref := range refs {
 			fi, err := ref.fileInfo(ctx, path.Base(name))
 			if err != nil {
@@ -283,12 +312,14 @@ func (ns *NS) OpenContext(ctx context.Context, name string) (fs.File, error) {
 
 	ctx = fs.WithOrigin(ctx, ns, name, "open")
 
+	bindings := ns.snapshot()
+
 	var dir *fskit.Node
 	var dirEntries []fs.DirEntry
 	var foundDir bool
 
 	// Check direct bindings
-	if refs, exists := ns.bindings[name]; exists {
+	if refs, exists := bindings[name]; exists {
 		for _, ref := range refs {
 			if ref.fi.IsDir() {
 				// directory binding, add entries
@@ -321,11 +352,11 @@ func (ns *NS) OpenContext(ctx context.Context, name string) (fs.File, error) {
 
 	// Check subpaths of bindings
 	var bindPaths []string
-	for p := range ns.bindings {
+	for p := range bindings {
 		bindPaths = append(bindPaths, p)
 	}
 	for _, bindPath := range fskit.MatchPaths(bindPaths, name) {
-		for _, ref := range ns.bindings[bindPath] {
+		for _, ref := range bindings[bindPath] {
 			relativePath := path.Join(ref.path, strings.Trim(strings.TrimPrefix(name, bindPath), "/"))
 			fi, err := fs.StatContext(ctx, ref.fs, relativePath)
 			if err != nil {
@@ -361,7 +392,7 @@ func (ns *NS) OpenContext(ctx context.Context, name string) (fs.File, error) {
 	// Synthesized parent directories
 	var need = make(map[string]bool)
 	if name == "." {
-		for fname, refs := range ns.bindings {
+		for fname, refs := range bindings {
 			i := strings.Index(fname, "/")
 			if i < 0 {
 				if fname != "." {
@@ -377,7 +408,7 @@ func (ns *NS) OpenContext(ctx context.Context, name string) (fs.File, error) {
 		}
 	} else {
 		prefix := name + "/"
-		for fname, refs := range ns.bindings {
+		for fname, refs := range bindings {
 			if strings.HasPrefix(fname, prefix) {
 				felem := fname[len(prefix):]
 				i := strings.Index(felem, "/")
@@ -2,6 +2,7 @@ package assets
 
 import (
 	"embed"
+	"io/fs"
 
 	v86 "tractor.dev/wanix/external/v86"
 )
@@ -9,30 +10,30 @@ import (
 //go:embed *
 var Dir embed.FS
 
-func WanixBundle() (out []byte) {
-	libv86, err := v86.Dir.ReadFile("libv86.js")
+func WanixBundle() []byte {
+	out, err := BundleFrom(Dir, v86.Dir)
 	if err != nil {
 		panic(err)
 	}
-	out = append(out, libv86...)
+	return out
+}
 
-	wasmExec, err := Dir.ReadFile("wasm_exec.js")
+// BundleFrom builds wanix.bundle.js from the assets in fsys and the v86
+// files in v86fs, which can be directories on disk instead of the
+// embedded ones.
+func BundleFrom(fsys, v86fs fs.FS) (out []byte, err error) {
+	libv86, err := fs.ReadFile(v86fs, "libv86.js")
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	out = append(out, wasmExec...)
-
-	wio, err := Dir.ReadFile("wio.js")
-	if err != nil {
-		panic(err)
-	}
-	out = append(out, wio...)
+	out = append(out, libv86...)
 
-	prebundleJS, err := Dir.ReadFile("wanix.prebundle.js")
-	if err != nil {
-		panic(err)
+	for _, name := range []string{"wasm_exec.js", "wio.js", "wanix.prebundle.js"} {
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b...)
 	}
-	out = append(out, prebundleJS...)
-
-	return
+	return out, nil
 }
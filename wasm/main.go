@@ -12,6 +12,7 @@ import (
 	"tractor.dev/wanix"
 	"tractor.dev/wanix/fs"
 	"tractor.dev/wanix/fs/fskit"
+	"tractor.dev/wanix/fs/p9kit"
 	"tractor.dev/wanix/fs/tarfs"
 	"tractor.dev/wanix/internal"
 	"tractor.dev/wanix/web"
@@ -62,7 +63,22 @@ func main() {
 	// }
 	// root.Namespace().Bind(arw, ".", "#alpine", "")
 
-	go virtio9p.Serve(root.Namespace(), inst, false)
+	// the guest mounts the namespace by default, or one of these with
+	// the aname option, like a fresh scratch tree with aname=tmp
+	srv := p9kit.NewServer(root.Namespace())
+	for aname, name := range map[string]string{
+		"cap":   "cap",
+		"task":  "task",
+		"shell": "#shell",
+	} {
+		sub, err := fs.Sub(root.Namespace(), name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.Publish(aname, sub)
+	}
+	srv.Publish("tmp", fskit.MemFS{})
+	go virtio9p.Serve(srv, inst)
 	api.PortResponder(inst.Get("sys"), root)
 }
 
@@ -31,26 +31,40 @@ func (s Stat) Info() fs.FileInfo {
 	return fskit.Entry(path.Base(s.Name), s.Mode, s.Size, s.Mtime)
 }
 
-var statCache sync.Map
+// metadata holds the modes and times that the File System Access API has no
+// place for. It is persisted to the hidden #stat file at the root.
+var metadata sync.Map
 
-// todo: clean all this up!
-func statStore(fsys FS, name string, stat Stat) {
-	statCache.Store(name, stat)
-	go func() {
+var (
+	persistMu    sync.Mutex
+	persistTimer *time.Timer
+)
+
+// storeMetadata updates the metadata for name and schedules it to be
+// persisted, coalescing bursts of changes into a single write.
+func storeMetadata(fsys FS, name string, stat Stat) {
+	metadata.Store(name, stat)
+
+	persistMu.Lock()
+	defer persistMu.Unlock()
+	if persistTimer != nil {
+		persistTimer.Stop()
+	}
+	persistTimer = time.AfterFunc(persistDelay, func() {
 		var stats []Stat
-		statCache.Range(func(key, value any) bool {
+		metadata.Range(func(key, value any) bool {
 			stats = append(stats, value.(Stat))
 			return true
 		})
 		b, err := json.Marshal(stats)
 		if err != nil {
-			log.Println("fsa: statstore: marshal:", err)
+			log.Println("fsa: metadata: marshal:", err)
 			return
 		}
 		if err := fs.WriteFile(fsys, "#stat", b, 0755); err != nil {
-			log.Println("fsa: statstore: write:", err)
+			log.Println("fsa: metadata: write:", err)
 		}
-	}()
+	})
 }
 
 func (fsys FS) walkDir(path string) (js.Value, error) {
@@ -80,13 +94,13 @@ func (fsys FS) Symlink(oldname, newname string) error {
 		return err
 	}
 
-	v, ok := statCache.Load(newname)
+	v, ok := metadata.Load(newname)
 	if ok {
 		stat := v.(Stat)
 		stat.Mode = fs.FileMode(0777) | fs.ModeSymlink
-		statStore(fsys, newname, stat)
+		storeMetadata(fsys, newname, stat)
 	} else {
-		statStore(fsys, newname, Stat{Name: newname, Mode: fs.FileMode(0777) | fs.ModeSymlink})
+		storeMetadata(fsys, newname, Stat{Name: newname, Mode: fs.FileMode(0777) | fs.ModeSymlink})
 	}
 
 	return nil
@@ -97,15 +111,15 @@ func (fsys FS) Chtimes(name string, atime time.Time, mtime time.Time) error {
 		return &fs.PathError{Op: "chtimes", Path: name, Err: fs.ErrInvalid}
 	}
 
-	v, ok := statCache.Load(name)
+	v, ok := metadata.Load(name)
 	if ok {
 		stat := v.(Stat)
 		// stat.atime = atime
 		stat.Mtime = mtime
-		statStore(fsys, name, stat)
+		storeMetadata(fsys, name, stat)
 		return nil
 	}
-	statStore(fsys, name, Stat{Name: name, Atime: atime, Mtime: mtime})
+	storeMetadata(fsys, name, Stat{Name: name, Atime: atime, Mtime: mtime})
 
 	return nil
 }
@@ -115,15 +129,15 @@ func (fsys FS) Chmod(name string, mode fs.FileMode) error {
 		return &fs.PathError{Op: "chmod", Path: name, Err: fs.ErrInvalid}
 	}
 
-	v, ok := statCache.Load(name)
+	v, ok := metadata.Load(name)
 	if ok {
 		stat := v.(Stat)
 		// Keep the file type bits and update only the permission bits
 		stat.Mode = (stat.Mode & fs.ModeType) | (mode & fs.ModePerm)
-		statStore(fsys, name, stat)
+		storeMetadata(fsys, name, stat)
 		return nil
 	}
-	statStore(fsys, name, Stat{Name: name, Mode: mode & fs.ModePerm})
+	storeMetadata(fsys, name, Stat{Name: name, Mode: mode & fs.ModePerm})
 	return nil
 }
 
@@ -160,7 +174,7 @@ func (fsys FS) OpenContext(ctx context.Context, name string) (fs.File, error) {
 
 	file, err := jsutil.AwaitErr(dirHandle.Call("getFileHandle", path.Base(name), map[string]any{"create": false}))
 	if err == nil {
-		v, ok := statCache.Load(name)
+		v, ok := metadata.Load(name)
 		if ok && fs.FollowSymlinks(ctx) && fs.IsSymlink(v.(Stat).Mode) {
 			if origin, fullname, ok := fs.Origin(ctx); ok {
 				target, err := fs.Readlink(fsys, name)
@@ -280,6 +294,6 @@ func (fsys FS) Remove(name string) error {
 	if err != nil {
 		return err
 	}
-	statCache.Delete(name)
+	metadata.Delete(name)
 	return nil
 }
@@ -37,14 +37,14 @@ func OPFS() (fs.FS, error) {
 			log.Println("fsa: opfs: read #stat:", err)
 			return
 		}
-		statCache.Clear()
+		metadata.Clear()
 		var stats []Stat
 		if err := json.Unmarshal(b, &stats); err != nil {
 			log.Println("fsa: opfs: unmarshal #stat:", err)
 			return
 		}
 		for _, s := range stats {
-			statCache.Store(s.Name, s)
+			metadata.Store(s.Name, s)
 		}
 	}()
 	return fsys, nil
@@ -57,7 +57,7 @@ func DirHandleFile(fsys FS, name string, v js.Value) fs.File {
 		var size int64
 		name := e.Get("name").String()
 
-		v, cached := statCache.Load(name)
+		v, cached := metadata.Load(name)
 		if cached {
 			mode = v.(Stat).Mode
 		}
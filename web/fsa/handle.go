@@ -15,9 +15,17 @@ import (
 var (
 	DefaultFileMode = fs.FileMode(0744)
 	DefaultDirMode  = fs.FileMode(0755)
-	CacheDuration   = time.Millisecond * 100
+
+	// CacheDuration was how long file stats were cached.
+	//
+	// Deprecated: stats are no longer cached here and this has no
+	// effect. Wrap the filesystem in an fskit.CacheFS and set its TTLs
+	// instead.
+	CacheDuration = time.Millisecond * 100
 )
 
+const persistDelay = 100 * time.Millisecond
+
 type FileHandle struct {
 	name   string
 	append bool
@@ -114,18 +122,14 @@ func (h *FileHandle) Size() int64 {
 }
 
 func (h *FileHandle) Stat() (fs.FileInfo, error) {
-	v, cached := statCache.Load(h.name)
-	if cached && v.(Stat).Name != "" && time.Since(v.(Stat).Atime) < CacheDuration {
-		fi := v.(Stat).Info()
-		return fi, nil
-	}
 	if err := h.tryGetFile(); err != nil {
 		return nil, err
 	}
+	v, ok := metadata.Load(h.name)
 	isDir := h.Value.Get("kind").String() == "directory"
 	modTime := h.file.Get("lastModified").Int()
 	var mode fs.FileMode
-	if cached {
+	if ok {
 		mode = v.(Stat).Mode
 	}
 	if isDir {
@@ -143,9 +147,7 @@ func (h *FileHandle) Stat() (fs.FileInfo, error) {
 		Size:  uint64(h.Size()),
 		Mode:  mode,
 		Mtime: time.UnixMilli(int64(modTime)),
-		Atime: time.Now(),
 	}
-	statCache.Store(h.name, s) // todo: replace with statStore
 	return s.Info(), nil
 }
 
@@ -3,77 +3,63 @@
 package virtio9p
 
 import (
-	"io"
-	"io/fs"
 	"log"
+	"sync"
 	"syscall/js"
 
-	"github.com/hugelgupf/p9/p9"
-	"github.com/u-root/uio/ulog"
 	"tractor.dev/wanix/fs/p9kit"
 )
 
-func Serve(fsys fs.FS, inst js.Value, debug bool) {
-	inR, inW := io.Pipe()
-	outR, outW := io.Pipe()
+// Serve serves srv to the v86 guest over its virtio 9P device. The guest
+// picks a tree published on srv with the aname mount option.
+func Serve(srv *p9kit.Server, inst js.Value) {
+	var (
+		mu         sync.Mutex
+		virtioSend js.Value
+	)
 
-	var virtioSend js.Value
-
-	inst.Set("virtioHandle", js.FuncOf(func(this js.Value, args []js.Value) any {
-		virtioSend = args[1]
-		go func() {
-			buf := make([]byte, args[0].Get("byteLength").Int())
-			js.CopyBytesToGo(buf, args[0])
-			_, err := inW.Write(buf)
-			if err != nil {
-				log.Println(err)
-			}
-			// if debug {
-			// 	log.Printf("virtio >>%s %v\n", p9kit.MessageTypes[int(buf[4])], buf)
-			// }
-		}()
+	conn := p9kit.NewMsgConn(func(msg []byte) error {
+		mu.Lock()
+		send := virtioSend
+		mu.Unlock()
+		if send.IsUndefined() {
+			log.Println("virtioSend is undefined")
+			return nil
+		}
+		jsBuf := js.Global().Get("Uint8Array").New(len(msg))
+		js.CopyBytesToJS(jsBuf, msg)
+		// if debug {
+		// 	log.Printf("virtio <<%s %v\n", p9kit.MessageTypes[int(msg[4])], msg)
+		// }
+		send.Invoke(jsBuf)
 		return nil
-	}))
+	}, nil)
 
+	// requests are handed off in order so the callback never blocks the
+	// event loop. the virtqueue bounds how many can be outstanding.
+	in := make(chan []byte, 128)
 	go func() {
-		for {
-			// Read message length (4 bytes)
-			sizeBuf := make([]byte, 4)
-			_, err := io.ReadFull(outR, sizeBuf)
-			if err != nil {
-				log.Println("9p->virtio:", err)
-				break
-			}
-			messageSize := int(sizeBuf[3])<<24 | int(sizeBuf[2])<<16 | int(sizeBuf[1])<<8 | int(sizeBuf[0])
-			payloadSize := messageSize - 4
-
-			messageBuf := make([]byte, payloadSize)
-			_, err = io.ReadFull(outR, messageBuf)
-			if err != nil {
-				log.Println("9p-virtio:", err)
-				break
-			}
-
-			buf := append(sizeBuf, messageBuf...)
-
-			jsBuf := js.Global().Get("Uint8Array").New(len(buf))
-			js.CopyBytesToJS(jsBuf, buf)
-			if virtioSend.IsUndefined() {
-				log.Println("virtioSend is undefined")
-				return
+		for buf := range in {
+			if err := conn.Deliver(buf); err != nil {
+				log.Println("virtio->9p:", err)
 			}
-			// if debug {
-			// 	log.Printf("virtio <<%s %v\n", p9kit.MessageTypes[int(buf[4])], buf)
-			// }
-			virtioSend.Invoke(jsBuf)
 		}
 	}()
-	var o []p9.ServerOpt
-	if debug {
-		o = append(o, p9.WithServerLogger(ulog.Log))
-	}
-	srv := p9.NewServer(p9kit.Attacher(fsys), o...)
-	if err := srv.Handle(inR, outW); err != nil {
+
+	inst.Set("virtioHandle", js.FuncOf(func(this js.Value, args []js.Value) any {
+		mu.Lock()
+		virtioSend = args[1]
+		mu.Unlock()
+		buf := make([]byte, args[0].Get("byteLength").Int())
+		js.CopyBytesToGo(buf, args[0])
+		// if debug {
+		// 	log.Printf("virtio >>%s %v\n", p9kit.MessageTypes[int(buf[4])], buf)
+		// }
+		in <- buf
+		return nil
+	}))
+
+	if err := srv.Handle(conn, conn); err != nil {
 		log.Fatal(err)
 	}
 }
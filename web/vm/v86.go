@@ -15,7 +15,7 @@ func makeVM(id string) js.Value {
 		"vga_memory_size":  8 * 1024 * 1024,
 		"net_device": map[string]any{
 			"type":      "ne2k",
-			"relay_url": "ws://localhost:8777",
+			"relay_url": relayURL(),
 		},
 		"bios": map[string]any{
 			"url": "./v86/seabios.bin",
@@ -36,3 +36,24 @@ func makeVM(id string) js.Value {
 	vm.Set("ready", readyPromise)
 	return vm
 }
+
+// relayURL is where the VM network is: the network option of the page,
+// resolved against the page so it can be a path like ./.net, or else
+// port 8777 of the page's host, where wanix serve listens by default.
+func relayURL() string {
+	location := js.Global().Get("location")
+	network := "//" + location.Get("hostname").String() + ":8777"
+	if wanix := js.Global().Get("wanix"); wanix.Type() == js.TypeObject {
+		if v := wanix.Get("config").Get("network"); v.Type() == js.TypeString {
+			network = v.String()
+		}
+	}
+	u := js.Global().Get("URL").New(network, location.Get("href"))
+	switch u.Get("protocol").String() {
+	case "http:":
+		u.Set("protocol", "ws:")
+	case "https:":
+		u.Set("protocol", "wss:")
+	}
+	return u.Call("toString").String()
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"strings"
 	"syscall/js"
+	"time"
 
 	"tractor.dev/wanix"
 	"tractor.dev/wanix/cap"
@@ -23,25 +24,26 @@ import (
 
 func New(k *wanix.K, ctx js.Value) fskit.MapFS {
 	workerfs := worker.New(k.Root)
-	opfs, _ := fsa.OPFS()
 	webfs := fskit.MapFS{
 		"dom":    dom.New(k),
 		"vm":     vm.New(),
 		"worker": workerfs,
-		"opfs":   opfs,
+	}
+	if opfs, err := fsa.OPFS(); err == nil {
+		webfs["opfs"] = fskit.NewCacheFS(opfs, time.Second, time.Second, 0)
 	}
 	if !ctx.Get("sw").IsUndefined() {
 		webfs["sw"] = sw.Activate(ctx.Get("sw"), k)
 	}
 
 	k.Cap.Register("pickerfs", func(_ *cap.Resource) (cap.Mounter, error) {
-		return func(_ []string) (fs.FS, error) {
+		return func(_ context.Context, _ []string) (fs.FS, error) {
 			return fsa.ShowDirectoryPicker(), nil
 		}, nil
 	})
 
 	k.Cap.Register("ws", func(r *cap.Resource) (cap.Mounter, error) {
-		return func(args []string) (fs.FS, error) {
+		return func(_ context.Context, args []string) (fs.FS, error) {
 			if len(args) == 0 {
 				return nil, fmt.Errorf("ws: no url provided")
 			}